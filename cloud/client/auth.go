@@ -0,0 +1,22 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// BearerToken authenticates requests with the token of a Session from Login
+func BearerToken(token string) RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+}
+
+// APIKeyAuth authenticates requests with an API key
+func APIKeyAuth(key string) RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("X-API-Key", key)
+		return nil
+	}
+}
@@ -0,0 +1,8 @@
+// Package client is a Go client for the Smart Farm cloud server API,
+// generated from cloud/cloud-server/openapi.yaml. Regenerate it after
+// changing the spec (TestClientIsGenerated fails until then):
+//
+//	go generate ./...
+package client
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.4.1 -config oapi-codegen.yaml ../cloud-server/openapi.yaml
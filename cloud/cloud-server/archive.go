@@ -0,0 +1,753 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// ARCHIVE
+// ============================================================================
+
+// Redis keeps the last 1000 readings per sensor. The archiver keeps
+// everything the cloud stores (readings, gate events and decisions) in files
+// partitioned per farm, kind, UTC day and sensor type:
+//
+//	<dir>/<farm>/readings/2026-10-18/soil-moisture-sensors.csv
+//	<dir>/<farm>/readings/2026-10-18/soil-moisture-sensors.parquet
+//	<dir>/<farm>/gate-events/2026-10-18/gates.csv
+//	<dir>/<farm>/decisions/2026-10-18/decisions.csv
+//	<dir>/manifest.json
+//
+// Stored records are appended to the CSV file of their day every
+// archiveFlushInterval. Once a day is over (plus archiveSealAfter for late
+// data) its CSV files are also written as Parquet. Late data reopens the day
+// and its Parquet file is written again. Days older than the retention are
+// deleted. The manifest lists every partition with its rows, time span and
+// files.
+//
+//	CLOUD_ARCHIVE_DIR             Archive directory, archiving is off if unset
+//	CLOUD_ARCHIVE_RETENTION_DAYS  Days kept (default 365)
+
+// Archive kinds
+const (
+	archiveReadings   = "readings"
+	archiveGateEvents = "gate-events"
+	archiveDecisions  = "decisions"
+)
+
+const (
+	archiveFlushInterval = 10 * time.Second
+	archiveSealAfter     = time.Hour // Wait for late data after midnight UTC
+	archiveManifestFile  = "manifest.json"
+)
+
+// Columns of each kind, the first is always the unix timestamp
+var archiveColumns = map[string][]archiveColumn{
+	archiveReadings: {
+		{Name: "timestamp", Kind: columnTime},
+		{Name: "farm_id", Kind: columnString},
+		{Name: "sensor_id", Kind: columnInt},
+		{Name: "type", Kind: columnString},
+		{Name: "value", Kind: columnFloat, Optional: true},
+		{Name: "unit", Kind: columnString},
+		{Name: "raw_value", Kind: columnFloat, Optional: true},
+		{Name: "temperature", Kind: columnFloat, Optional: true},
+		{Name: "calibrated", Kind: columnBool, Optional: true},
+		{Name: "lat", Kind: columnFloat},
+		{Name: "lon", Kind: columnFloat},
+	},
+	archiveGateEvents: {
+		{Name: "timestamp", Kind: columnTime},
+		{Name: "farm_id", Kind: columnString},
+		{Name: "gate_id", Kind: columnInt},
+		{Name: "event", Kind: columnString},
+		{Name: "status", Kind: columnString},
+		{Name: "command", Kind: columnString},
+		{Name: "action", Kind: columnString},
+		{Name: "reason", Kind: columnString},
+		{Name: "source", Kind: columnString},
+		{Name: "key_id", Kind: columnString},
+	},
+	archiveDecisions: {
+		{Name: "timestamp", Kind: columnTime},
+		{Name: "farm_id", Kind: columnString},
+		{Name: "gate_id", Kind: columnInt},
+		{Name: "action", Kind: columnString},
+		{Name: "reason", Kind: columnString},
+		{Name: "source", Kind: columnString},
+		{Name: "payload", Kind: columnString}, // The full decision event as JSON
+	},
+}
+
+// Sensor types become file names, anything else is replaced
+var unsafePartitionChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// ArchiveConfig locates the archive
+type ArchiveConfig struct {
+	Dir           string
+	RetentionDays int
+}
+
+// ArchivePartition is one day of one kind (and sensor type) of a farm
+type ArchivePartition struct {
+	Farm         string `json:"farm_id"`
+	Kind         string `json:"kind"`
+	Date         string `json:"date"`
+	Partition    string `json:"partition"`
+	Rows         int    `json:"rows"`
+	From         int64  `json:"from"` // Earliest timestamp
+	To           int64  `json:"to"`   // Latest timestamp
+	CSV          string `json:"csv"`  // Relative to the archive directory
+	CSVBytes     int64  `json:"csv_bytes"`
+	Parquet      string `json:"parquet,omitempty"`
+	ParquetBytes int64  `json:"parquet_bytes,omitempty"`
+	ParquetRows  int    `json:"parquet_rows,omitempty"` // Rows the Parquet file holds
+}
+
+// sealed reports whether the Parquet file holds every row
+func (p *ArchivePartition) sealed() bool {
+	return p.Parquet != "" && p.ParquetRows == p.Rows
+}
+
+// ArchiveManifest is manifest.json
+type ArchiveManifest struct {
+	Updated       int64               `json:"updated"`
+	RetentionDays int                 `json:"retention_days"`
+	Partitions    []*ArchivePartition `json:"partitions"`
+}
+
+// archiveRecord is one row waiting to be written
+type archiveRecord struct {
+	farm      string
+	kind      string
+	partition string
+	timestamp int64
+	row       []string
+}
+
+// Archiver buffers stored records and writes them to the archive. A nil
+// Archiver (archiving off) ignores records.
+type Archiver struct {
+	dir       string
+	retention int
+
+	pendingMutex sync.Mutex
+	pending      []archiveRecord
+
+	mutex      sync.Mutex // Guards partitions and the files
+	partitions map[string]*ArchivePartition
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newArchiver loads the manifest and starts the background writer, nil if
+// archiving is off
+func newArchiver(config ArchiveConfig) (*Archiver, error) {
+	if config.Dir == "" {
+		log.Println("⚠️ CLOUD_ARCHIVE_DIR not set, readings older than the store keeps are not archived")
+		return nil, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	a := &Archiver{
+		dir:        config.Dir,
+		retention:  config.RetentionDays,
+		partitions: make(map[string]*ArchivePartition),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	data, err := os.ReadFile(filepath.Join(a.dir, archiveManifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var manifest ArchiveManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("%s: %w", archiveManifestFile, err)
+		}
+		for _, partition := range manifest.Partitions {
+			a.partitions[partition.key()] = partition
+		}
+	} else if err := a.rebuildManifest(); err != nil {
+		return nil, fmt.Errorf("rebuild %s: %w", archiveManifestFile, err)
+	}
+
+	go a.run()
+	log.Printf("✅ Archiving to %s (%d partitions, %d days retention)", a.dir, len(a.partitions), a.retention)
+	return a, nil
+}
+
+func (p *ArchivePartition) key() string {
+	return p.Farm + "/" + p.Kind + "/" + p.Date + "/" + p.Partition
+}
+
+// run flushes, seals and applies the retention until close
+func (a *Archiver) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(archiveFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+			a.expire(time.Now())
+			a.seal(time.Now())
+		case <-a.stop:
+			a.flush()
+			return
+		}
+	}
+}
+
+// close writes what is buffered and stops the background writer
+func (a *Archiver) close() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+}
+
+// add buffers a record for the next flush
+func (a *Archiver) add(record archiveRecord) {
+	if a == nil {
+		return
+	}
+	a.pendingMutex.Lock()
+	a.pending = append(a.pending, record)
+	a.pendingMutex.Unlock()
+}
+
+// addReadings archives stored sensor readings
+func (a *Archiver) addReadings(farm string, readings []SensorMessage) {
+	if a == nil {
+		return
+	}
+	for _, reading := range readings {
+		fields, _ := latestReadingFields(farm, reading)
+		calibrated := ""
+		if fields["calibrated"] != "" {
+			calibrated = strconv.FormatBool(fields["calibrated"] == "1")
+		}
+		partition := unsafePartitionChars.ReplaceAllString(reading.Type, "_")
+		if partition == "" {
+			partition = "unknown"
+		}
+		a.add(archiveRecord{
+			farm:      farm,
+			kind:      archiveReadings,
+			partition: partition,
+			timestamp: reading.Timestamp,
+			row: []string{
+				fields["timestamp"], farm, fields["sensor_id"], reading.Type, fields["value"], reading.Unit,
+				fields["raw_value"], fields["temperature"], calibrated, fields["lat"], fields["lon"],
+			},
+		})
+	}
+}
+
+// addGateEvent archives a stored gate event
+func (a *Archiver) addGateEvent(farm string, event GateEvent) {
+	a.add(archiveRecord{
+		farm:      farm,
+		kind:      archiveGateEvents,
+		partition: "gates",
+		timestamp: event.Timestamp,
+		row: []string{
+			strconv.FormatInt(event.Timestamp, 10), farm, strconv.Itoa(event.GateID), event.Type,
+			event.Status, event.Command, event.Action, event.Reason, event.Source, event.KeyID,
+		},
+	})
+}
+
+// addDecision archives a stored edge decision
+func (a *Archiver) addDecision(farm string, decision DecisionMessage, payload []byte) {
+	a.add(archiveRecord{
+		farm:      farm,
+		kind:      archiveDecisions,
+		partition: "decisions",
+		timestamp: decision.Timestamp,
+		row: []string{
+			strconv.FormatInt(decision.Timestamp, 10), farm, strconv.Itoa(decision.GateID),
+			decision.Action, decision.Reason, decision.Source, string(payload),
+		},
+	})
+}
+
+// flush appends the buffered records to their CSV files
+func (a *Archiver) flush() {
+	if a == nil {
+		return
+	}
+	a.pendingMutex.Lock()
+	records := a.pending
+	a.pending = nil
+	a.pendingMutex.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	groups := make(map[string][]archiveRecord)
+	var order []string
+	for _, record := range records {
+		date := time.Unix(record.timestamp, 0).UTC().Format("2006-01-02")
+		key := record.farm + "/" + record.kind + "/" + date + "/" + record.partition
+		if _, seen := groups[key]; !seen {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, key := range order {
+		if err := a.appendPartition(key, groups[key]); err != nil {
+			log.Printf("❌ Failed to archive %d records to %s: %v", len(groups[key]), key, err)
+		}
+	}
+	if err := a.saveManifest(); err != nil {
+		log.Printf("❌ Failed to write the archive manifest: %v", err)
+	}
+}
+
+// appendPartition writes records of one partition, creating it if needed
+func (a *Archiver) appendPartition(key string, records []archiveRecord) error {
+	partition := a.partitions[key]
+	if partition == nil {
+		first := records[0]
+		date := time.Unix(first.timestamp, 0).UTC().Format("2006-01-02")
+		partition = &ArchivePartition{
+			Farm:      first.farm,
+			Kind:      first.kind,
+			Date:      date,
+			Partition: first.partition,
+			From:      first.timestamp,
+			To:        first.timestamp,
+			CSV:       filepath.Join(first.farm, first.kind, date, first.partition+".csv"),
+		}
+		if err := a.recoverPartition(partition); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(a.dir, partition.CSV)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if partition.Rows == 0 {
+		header := []string{}
+		for _, column := range archiveColumns[partition.Kind] {
+			header = append(header, column.Name)
+		}
+		w.Write(header)
+	}
+	for _, record := range records {
+		w.Write(record.row)
+		partition.From = min(partition.From, record.timestamp)
+		partition.To = max(partition.To, record.timestamp)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	partition.Rows += len(records)
+	partition.CSVBytes = info.Size()
+	a.partitions[key] = partition
+	return nil
+}
+
+// recoverPartition counts the rows of a CSV file the manifest does not
+// list, left by a lost or deleted manifest
+func (a *Archiver) recoverPartition(partition *ArchivePartition) error {
+	info, err := os.Stat(filepath.Join(a.dir, partition.CSV))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	partition.CSVBytes = info.Size()
+	err = a.readRows(partition, allTime, func(row []string) error {
+		timestamp, _ := strconv.ParseInt(row[0], 10, 64)
+		partition.From = min(partition.From, timestamp)
+		partition.To = max(partition.To, timestamp)
+		partition.Rows++
+		return nil
+	})
+	if err == io.EOF { // Header only
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("🔁 Recovered %s from disk (%d rows)", partition.CSV, partition.Rows)
+	return nil
+}
+
+// rebuildManifest lists the CSV files of an archive without a manifest.
+// Their Parquet files are written again when the days are sealed.
+func (a *Archiver) rebuildManifest() error {
+	paths, err := filepath.Glob(filepath.Join(a.dir, "*", "*", "*", "*.csv"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	for _, path := range paths {
+		relative, _ := filepath.Rel(a.dir, path)
+		parts := strings.Split(filepath.ToSlash(relative), "/")
+		if _, ok := archiveColumns[parts[1]]; !ok {
+			continue
+		}
+		partition := &ArchivePartition{
+			Farm:      parts[0],
+			Kind:      parts[1],
+			Date:      parts[2],
+			Partition: strings.TrimSuffix(parts[3], ".csv"),
+			From:      math.MaxInt64,
+			To:        math.MinInt64,
+			CSV:       relative,
+		}
+		if err := a.recoverPartition(partition); err != nil {
+			return fmt.Errorf("%s: %w", relative, err)
+		}
+		a.partitions[partition.key()] = partition
+	}
+	return a.saveManifest()
+}
+
+// saveManifest replaces manifest.json, the caller holds a.mutex
+func (a *Archiver) saveManifest() error {
+	manifest := ArchiveManifest{
+		Updated:       time.Now().Unix(),
+		RetentionDays: a.retention,
+		Partitions:    a.sortedPartitions(func(*ArchivePartition) bool { return true }),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(a.dir, archiveManifestFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// sortedPartitions returns copies of the matching partitions by farm, kind,
+// date and partition. The caller holds a.mutex.
+func (a *Archiver) sortedPartitions(match func(*ArchivePartition) bool) []*ArchivePartition {
+	partitions := []*ArchivePartition{}
+	for _, partition := range a.partitions {
+		if match(partition) {
+			copied := *partition
+			partitions = append(partitions, &copied)
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].key() < partitions[j].key() })
+	return partitions
+}
+
+// seal writes the Parquet files of finished days that do not hold every row
+func (a *Archiver) seal(now time.Time) {
+	a.mutex.Lock()
+	unsealed := a.sortedPartitions(func(p *ArchivePartition) bool {
+		end, err := time.Parse("2006-01-02", p.Date)
+		return err == nil && now.Sub(end.AddDate(0, 0, 1)) >= archiveSealAfter && !p.sealed()
+	})
+	a.mutex.Unlock()
+
+	for _, partition := range unsealed {
+		parquetPath := filepath.Join(partition.Farm, partition.Kind, partition.Date, partition.Partition+".parquet")
+		size, err := a.writeParquetFile(partition, filepath.Join(a.dir, parquetPath))
+		if err != nil {
+			log.Printf("❌ Failed to write %s: %v", parquetPath, err)
+			continue
+		}
+
+		a.mutex.Lock()
+		if current := a.partitions[partition.key()]; current != nil {
+			current.Parquet, current.ParquetBytes, current.ParquetRows = parquetPath, size, partition.Rows
+		}
+		err = a.saveManifest()
+		a.mutex.Unlock()
+		if err != nil {
+			log.Printf("❌ Failed to write the archive manifest: %v", err)
+		}
+		log.Printf("📦 Archived %s (%d rows, %d bytes)", parquetPath, partition.Rows, size)
+	}
+}
+
+// writeParquetFile converts the rows a partition had when it was copied
+func (a *Archiver) writeParquetFile(partition *ArchivePartition, path string) (int64, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path + ".tmp")
+
+	if err := a.writeParquet(partition, file, allTime); err != nil {
+		file.Close()
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(path+".tmp", path)
+}
+
+// writeParquet writes the rows of a partition in a time range as Parquet
+func (a *Archiver) writeParquet(partition *ArchivePartition, w io.Writer, span timeRange) error {
+	columns := archiveColumns[partition.Kind]
+	writer, err := newParquetWriter(w, columns)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	err = a.readRows(partition, span, func(row []string) error {
+		rows = append(rows, row)
+		if len(rows) == parquetRowGroupRows {
+			err := writer.writeRows(rows)
+			rows = rows[:0]
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.writeRows(rows); err != nil {
+		return err
+	}
+	return writer.close()
+}
+
+// readRows reads the rows of a partition in a time range. Only the bytes
+// written when the partition was copied are read, so a flush running at the
+// same time is not seen half-written.
+func (a *Archiver) readRows(partition *ArchivePartition, span timeRange, fn func([]string) error) error {
+	file, err := os.Open(filepath.Join(a.dir, partition.CSV))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := csv.NewReader(bufio.NewReader(io.LimitReader(file, partition.CSVBytes)))
+	r.FieldsPerRecord = len(archiveColumns[partition.Kind])
+	r.ReuseRecord = false
+	if _, err := r.Read(); err != nil { // Header
+		return err
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		timestamp, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil || !span.contains(timestamp) {
+			continue
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// expire deletes the days older than the retention
+func (a *Archiver) expire(now time.Time) {
+	cutoff := now.UTC().AddDate(0, 0, -a.retention).Format("2006-01-02")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	removed := 0
+	for key, partition := range a.partitions {
+		if partition.Date >= cutoff {
+			continue
+		}
+		for _, path := range []string{partition.CSV, partition.Parquet} {
+			if path == "" {
+				continue
+			}
+			if err := os.Remove(filepath.Join(a.dir, path)); err != nil && !os.IsNotExist(err) {
+				log.Printf("❌ Failed to delete %s: %v", path, err)
+			}
+		}
+		os.Remove(filepath.Join(a.dir, filepath.Dir(partition.CSV))) // The day, once empty
+		delete(a.partitions, key)
+		removed++
+	}
+	if removed == 0 {
+		return
+	}
+	log.Printf("🗑️ Deleted %d archive partitions older than %s", removed, cutoff)
+	if err := a.saveManifest(); err != nil {
+		log.Printf("❌ Failed to write the archive manifest: %v", err)
+	}
+}
+
+// ============================================================================
+// ARCHIVE HTTP HANDLERS
+// ============================================================================
+
+// archiveQuery is a download request
+type archiveQuery struct {
+	Kind       string
+	SensorType string
+	Range      timeRange
+	Format     string
+}
+
+// parseArchiveQuery reads ?kind=&type=&from=&to=&format=
+func parseArchiveQuery(c *fiber.Ctx) (archiveQuery, error) {
+	q := archiveQuery{
+		Kind:       c.Query("kind", archiveReadings),
+		SensorType: c.Query("type"),
+		Format:     c.Query("format", "csv"),
+	}
+	if _, ok := archiveColumns[q.Kind]; !ok {
+		return q, fmt.Errorf("kind must be %s, %s or %s", archiveReadings, archiveGateEvents, archiveDecisions)
+	}
+	if q.Format != "csv" && q.Format != "parquet" {
+		return q, fmt.Errorf("format must be csv or parquet")
+	}
+	var err error
+	q.Range, err = parseTimeRange(c)
+	return q, err
+}
+
+// matching lists a farm's partitions a download covers
+func (a *Archiver) matching(farm string, q archiveQuery) []*ArchivePartition {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.sortedPartitions(func(p *ArchivePartition) bool {
+		return p.Farm == farm && p.Kind == q.Kind &&
+			(q.SensorType == "" || p.Partition == unsafePartitionChars.ReplaceAllString(q.SensorType, "_")) &&
+			p.To >= q.Range.From && p.From <= q.Range.To
+	})
+}
+
+// GET /api/farms/:farm/archive (the farm's part of the manifest)
+func (h *APIHandlers) getArchiveManifest(c *fiber.Ctx) error {
+	if h.archive == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Archiving is not enabled"})
+	}
+	farm := farmOf(c)
+	h.archive.mutex.Lock()
+	partitions := h.archive.sortedPartitions(func(p *ArchivePartition) bool { return p.Farm == farm })
+	h.archive.mutex.Unlock()
+
+	return c.JSON(fiber.Map{
+		"farm_id":        farm,
+		"retention_days": h.archive.retention,
+		"partitions":     partitions,
+		"count":          len(partitions),
+	})
+}
+
+// GET /api/farms/:farm/archive/download?kind=readings&type=&from=&to=&format=csv
+//
+// csv streams one file with the rows in the range. parquet returns a zip
+// with one Parquet file per day and partition, holding the rows in the
+// range; days that are not sealed yet are converted on the fly.
+func (h *APIHandlers) downloadArchive(c *fiber.Ctx) error {
+	if h.archive == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Archiving is not enabled"})
+	}
+	q, err := parseArchiveQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	farm := farmOf(c)
+	h.archive.flush() // Include what is still buffered
+	partitions := h.archive.matching(farm, q)
+	if len(partitions) == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "No archived data in this range"})
+	}
+
+	archive := h.archive
+	name := fmt.Sprintf("%s-%s", farm, q.Kind)
+	if q.Format == "parquet" {
+		c.Set(fiber.HeaderContentType, "application/zip")
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			zw := zip.NewWriter(w)
+			for _, partition := range partitions {
+				entry, err := zw.CreateHeader(&zip.FileHeader{
+					Name:     filepath.ToSlash(filepath.Join(partition.Date, partition.Partition+".parquet")),
+					Method:   zip.Store, // Pages are compressed already
+					Modified: time.Now(),
+				})
+				if err == nil {
+					err = archive.writeParquet(partition, entry, q.Range)
+				}
+				if err != nil {
+					log.Printf("❌ Archive download %s/%s: %v", partition.Date, partition.Partition, err)
+					return
+				}
+			}
+			if err := zw.Close(); err != nil {
+				log.Printf("❌ Archive download: %v", err)
+			}
+		})
+		return nil
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		cw := csv.NewWriter(w)
+		header := []string{}
+		for _, column := range archiveColumns[q.Kind] {
+			header = append(header, column.Name)
+		}
+		cw.Write(header)
+		for _, partition := range partitions {
+			if err := archive.readRows(partition, q.Range, cw.Write); err != nil {
+				log.Printf("❌ Archive download %s/%s: %v", partition.Date, partition.Partition, err)
+				break
+			}
+		}
+		cw.Flush()
+	})
+	return nil
+}
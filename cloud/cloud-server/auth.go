@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ============================================================================
+// AUTHENTICATION & ROLES
+// ============================================================================
+
+// Roles, from least to most privileged. A route requiring a role accepts
+// that role and every role above it.
+const (
+	roleViewer   = "viewer"   // Read-only access to data
+	roleOperator = "operator" // Viewer + device registry, calibrations and dead-letter replay
+	roleAdmin    = "admin"    // Operator + user and key management, audit and ingestion status
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+const (
+	tokenTTL    = 12 * time.Hour
+	tokenCookie = "cropmind_token"
+	apiKeyBytes = 24
+)
+
+// Identity is the authenticated caller, stored in c.Locals("identity")
+type Identity struct {
+	Username string   `json:"username"`
+	Role     string   `json:"role"`
+	Method   string   `json:"method"`          // "jwt" or "api_key"
+	Farms    []string `json:"farms,omitempty"` // Farms the caller may access, empty for all
+}
+
+// canAccessFarm reports whether the caller may see a farm's data.
+// Admins and users without a farm list can access every farm.
+func (i *Identity) canAccessFarm(farm string) bool {
+	if i.Role == roleAdmin || len(i.Farms) == 0 {
+		return true
+	}
+	for _, allowed := range i.Farms {
+		if allowed == farm {
+			return true
+		}
+	}
+	return false
+}
+
+// User is stored in Redis at user:<username>
+type User struct {
+	Username     string   `json:"username"`
+	Role         string   `json:"role"`
+	Farms        []string `json:"farms"` // Empty for all farms
+	PasswordHash string   `json:"-"`
+	CreatedAt    int64    `json:"created_at"`
+}
+
+// APIKey is stored in Redis at apikey:<sha256 of key>
+type APIKey struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type tokenClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// lowerRole returns the less privileged of two roles
+func lowerRole(a, b string) string {
+	if roleRank[a] <= roleRank[b] {
+		return a
+	}
+	return b
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalf("❌ Failed to read random bytes: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// ============================================================================
+// USER STORE (REDIS)
+// ============================================================================
+
+// Create or replace a user
+func (r *RedisClient) storeUser(ctx context.Context, user User) error {
+	key := "user:" + user.Username
+	data := map[string]interface{}{
+		"username":      user.Username,
+		"role":          user.Role,
+		"farms":         strings.Join(user.Farms, ","),
+		"password_hash": user.PasswordHash,
+		"created_at":    user.CreatedAt,
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.SAdd(ctx, "users", user.Username)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Get a user, nil if it does not exist
+func (r *RedisClient) getUser(ctx context.Context, username string) (*User, error) {
+	data, err := r.client.HGetAll(ctx, "user:"+username).Result()
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	user := &User{
+		Username:     data["username"],
+		Role:         data["role"],
+		Farms:        []string{},
+		PasswordHash: data["password_hash"],
+	}
+	if data["farms"] != "" {
+		user.Farms = strings.Split(data["farms"], ",")
+	}
+	fmt.Sscan(data["created_at"], &user.CreatedAt)
+	return user, nil
+}
+
+// Get all usernames
+func (r *RedisClient) getAllUsers(ctx context.Context) ([]string, error) {
+	return r.client.SMembers(ctx, "users").Result()
+}
+
+// Delete a user and its API keys
+func (r *RedisClient) deleteUser(ctx context.Context, username string) error {
+	keys, err := r.client.SMembers(ctx, "user:"+username+":apikeys").Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	for _, hash := range keys {
+		pipe.Del(ctx, "apikey:"+hash)
+	}
+	pipe.Del(ctx, "user:"+username, "user:"+username+":apikeys")
+	pipe.SRem(ctx, "users", username)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Store an API key under the hash of its secret
+func (r *RedisClient) storeAPIKey(ctx context.Context, hash string, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.Set(ctx, "apikey:"+hash, data, 0)
+	pipe.SAdd(ctx, "user:"+key.Username+":apikeys", hash)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Look up an API key by the hash of its secret, nil if unknown
+func (r *RedisClient) getAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	data, err := r.client.Get(ctx, "apikey:"+hash).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// List a user's API keys (metadata only)
+func (r *RedisClient) getUserAPIKeys(ctx context.Context, username string) (map[string]APIKey, error) {
+	hashes, err := r.client.SMembers(ctx, "user:"+username+":apikeys").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]APIKey, len(hashes))
+	for _, hash := range hashes {
+		if key, err := r.getAPIKey(ctx, hash); err == nil && key != nil {
+			keys[hash] = *key
+		}
+	}
+	return keys, nil
+}
+
+// Revoke an API key by id
+func (r *RedisClient) deleteAPIKey(ctx context.Context, username, id string) (bool, error) {
+	keys, err := r.getUserAPIKeys(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	for hash, key := range keys {
+		if key.ID != id {
+			continue
+		}
+		pipe := r.client.Pipeline()
+		pipe.Del(ctx, "apikey:"+hash)
+		pipe.SRem(ctx, "user:"+username+":apikeys", hash)
+		_, err := pipe.Exec(ctx)
+		return true, err
+	}
+	return false, nil
+}
+
+// Record a user action (keep last 100000)
+func (r *RedisClient) storeUserAudit(ctx context.Context, entry map[string]interface{}, timestamp int64) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.ZAdd(ctx, "audit:users", &redis.Z{Score: float64(timestamp), Member: data})
+	pipe.ZRemRangeByRank(ctx, "audit:users", 0, -maxAuditEvents-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Query user actions in a time range, newest first
+func (r *RedisClient) queryUserAudit(ctx context.Context, span timeRange, offset, count int64) ([]string, error) {
+	return r.queryAuditSet(ctx, "audit:users", span, offset, count)
+}
+
+// bootstrapAdmin creates the admin user on first start when a password is
+// configured, so there is always a way in.
+func bootstrapAdmin(ctx context.Context, store Store, password string) {
+	users, err := store.getAllUsers(ctx)
+	if err != nil {
+		log.Printf("⚠️ Could not check users: %v", err)
+		return
+	}
+	if len(users) > 0 {
+		return
+	}
+	if password == "" {
+		log.Println("⚠️ No users exist. Set CLOUD_ADMIN_PASSWORD to create the admin user.")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("❌ Failed to hash admin password: %v", err)
+		return
+	}
+	if err := store.storeUser(ctx, User{
+		Username:     "admin",
+		Role:         roleAdmin,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now().Unix(),
+	}); err != nil {
+		log.Printf("❌ Failed to create admin user: %v", err)
+		return
+	}
+	log.Println("✅ Created admin user")
+}
+
+// ============================================================================
+// AUTH MIDDLEWARE
+// ============================================================================
+
+type Auth struct {
+	store  Store
+	secret []byte
+}
+
+func newAuth(store Store, secret string) *Auth {
+	if secret == "" {
+		log.Println("⚠️ CLOUD_JWT_SECRET not set, using a random secret (sessions end on restart)")
+		secret = randomHex(32)
+	}
+	return &Auth{store: store, secret: []byte(secret)}
+}
+
+func (a *Auth) issueToken(user *User) (string, time.Time, error) {
+	expires := time.Now().Add(tokenTTL)
+	claims := tokenClaims{
+		Role: user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.Username,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	return token, expires, err
+}
+
+func (a *Auth) parseToken(ctx context.Context, raw string) (*Identity, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-check the user so deleted users and role changes take effect
+	user, err := a.store.getUser(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errInvalidCredentials
+	}
+	return &Identity{Username: user.Username, Role: user.Role, Method: "jwt", Farms: user.Farms}, nil
+}
+
+// identify resolves the caller from X-API-Key, a Bearer token or the
+// dashboard session cookie. It returns nil for anonymous requests.
+func (a *Auth) identify(c *fiber.Ctx) (*Identity, error) {
+	if key := c.Get("X-API-Key"); key != "" {
+		apiKey, err := a.store.getAPIKey(c.UserContext(), hashAPIKey(key))
+		if err != nil {
+			return nil, err
+		}
+		if apiKey == nil {
+			return nil, errInvalidCredentials
+		}
+		// Keys follow their user's farm list and never exceed the user's role
+		user, err := a.store.getUser(c.UserContext(), apiKey.Username)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, errInvalidCredentials
+		}
+		role := lowerRole(apiKey.Role, user.Role)
+		return &Identity{Username: apiKey.Username, Role: role, Method: "api_key", Farms: user.Farms}, nil
+	}
+
+	if header := c.Get(fiber.HeaderAuthorization); strings.HasPrefix(header, "Bearer ") {
+		return a.parseToken(c.UserContext(), strings.TrimPrefix(header, "Bearer "))
+	}
+
+	// An expired or stale dashboard cookie just means "not logged in"
+	if raw := c.Cookies(tokenCookie); raw != "" {
+		if identity, err := a.parseToken(c.UserContext(), raw); err == nil {
+			return identity, nil
+		}
+		c.ClearCookie(tokenCookie)
+	}
+	return nil, nil
+}
+
+// authenticate stores the caller identity in c.Locals("identity").
+// It rejects invalid credentials but lets anonymous requests through, so
+// requireRole decides per route.
+func (a *Auth) authenticate(c *fiber.Ctx) error {
+	identity, err := a.identify(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+	}
+	if identity != nil {
+		c.Locals("identity", identity)
+	}
+	return c.Next()
+}
+
+// requireRole only lets callers with at least the given role through
+func requireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identity := currentIdentity(c)
+		if identity == nil {
+			return c.Status(401).JSON(fiber.Map{"error": "Authentication required"})
+		}
+		if roleRank[identity.Role] < roleRank[role] {
+			return c.Status(403).JSON(fiber.Map{"error": "Requires role " + role})
+		}
+		return c.Next()
+	}
+}
+
+// requireDashboardLogin redirects anonymous browsers to the login page
+func requireDashboardLogin(c *fiber.Ctx) error {
+	path := c.Path()
+	if path == "/login.html" || strings.HasPrefix(path, "/api") {
+		return c.Next()
+	}
+	if currentIdentity(c) == nil {
+		return c.Redirect("/login.html")
+	}
+	return c.Next()
+}
+
+func currentIdentity(c *fiber.Ctx) *Identity {
+	identity, _ := c.Locals("identity").(*Identity)
+	return identity
+}
+
+// auditUserActions records every state-changing request with the user
+// that made it
+func (a *Auth) auditUserActions(c *fiber.Ctx) error {
+	err := c.Next()
+	if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || c.Method() == fiber.MethodOptions {
+		return err
+	}
+
+	username := "anonymous"
+	if identity := currentIdentity(c); identity != nil {
+		username = identity.Username
+	}
+	if name, ok := c.Locals("login_user").(string); ok {
+		username = name // Login attempts are attributed to the attempted user
+	}
+
+	now := time.Now().Unix()
+	a.recordAudit(c.UserContext(), map[string]interface{}{
+		"timestamp": now,
+		"user":      username,
+		"method":    c.Method(),
+		"path":      c.Path(),
+		"status":    c.Response().StatusCode(),
+		"ip":        c.IP(),
+	}, now)
+	return err
+}
+
+func (a *Auth) recordAudit(ctx context.Context, entry map[string]interface{}, timestamp int64) {
+	if err := a.store.storeUserAudit(ctx, entry, timestamp); err != nil {
+		log.Printf("❌ Failed to store user audit entry: %v", err)
+	}
+}
+
+// ============================================================================
+// AUTH HTTP HANDLERS
+// ============================================================================
+
+// POST /api/auth/login {"username": "...", "password": "..."}
+func (a *Auth) login(c *fiber.Ctx) error {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	c.Locals("login_user", req.Username)
+
+	user, err := a.store.getUser(c.UserContext(), req.Username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if user == nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid username or password"})
+	}
+
+	token, expires, err := a.issueToken(user)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Expires:  expires,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+		Secure:   c.Protocol() == "https",
+	})
+	return c.JSON(fiber.Map{
+		"token":      token,
+		"expires_at": expires.Unix(),
+		"username":   user.Username,
+		"role":       user.Role,
+	})
+}
+
+// POST /api/auth/logout
+func (a *Auth) logout(c *fiber.Ctx) error {
+	c.ClearCookie(tokenCookie)
+	return c.JSON(fiber.Map{"status": "logged out"})
+}
+
+// GET /api/auth/me
+func (a *Auth) me(c *fiber.Ctx) error {
+	return c.JSON(currentIdentity(c))
+}
+
+// GET /api/users
+func (a *Auth) listUsers(c *fiber.Ctx) error {
+	names, err := a.store.getAllUsers(c.UserContext())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	users := []User{}
+	for _, name := range names {
+		if user, err := a.store.getUser(c.UserContext(), name); err == nil && user != nil {
+			users = append(users, *user)
+		}
+	}
+	return c.JSON(fiber.Map{"users": users, "count": len(users)})
+}
+
+// POST /api/users {"username": "...", "password": "...", "role": "viewer", "farms": ["north"]}
+// Creates a user. Leave farms empty to give access to every farm.
+func (a *Auth) createUser(c *fiber.Ctx) error {
+	var req struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Role     string   `json:"role"`
+		Farms    []string `json:"farms"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Username == "" || strings.ContainsAny(req.Username, ": ") {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid username"})
+	}
+	if err := validateAccess(req.Role, req.Farms); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	existing, err := a.store.getUser(c.UserContext(), req.Username)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if existing != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "User already exists"})
+	}
+	if req.Farms == nil {
+		req.Farms = []string{}
+	}
+	user := User{
+		Username:     req.Username,
+		Role:         req.Role,
+		Farms:        req.Farms,
+		PasswordHash: hash,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if err := a.store.storeUser(c.UserContext(), user); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(user)
+}
+
+// PUT /api/users/:name {"role": "operator", "farms": ["north"]}
+// Changes a user's role and farms, the password stays. Keys above a lowered
+// role are lowered with it.
+func (a *Auth) updateUser(c *fiber.Ctx) error {
+	var req struct {
+		Role  string   `json:"role"`
+		Farms []string `json:"farms"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := validateAccess(req.Role, req.Farms); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	user, err := a.store.getUser(c.UserContext(), c.Params("name"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	if req.Farms == nil {
+		req.Farms = []string{}
+	}
+	demoted := roleRank[req.Role] < roleRank[user.Role]
+	user.Role, user.Farms = req.Role, req.Farms
+	if err := a.store.storeUser(c.UserContext(), *user); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if demoted {
+		if err := a.capAPIKeys(c.UserContext(), *user); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	return c.JSON(user)
+}
+
+// PUT /api/users/:name/password {"password": "..."}
+func (a *Auth) setPassword(c *fiber.Ctx) error {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	user, err := a.store.getUser(c.UserContext(), c.Params("name"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	user.PasswordHash = hash
+	if err := a.store.storeUser(c.UserContext(), *user); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(204)
+}
+
+// validateAccess checks a role and the farms it is limited to
+func validateAccess(role string, farms []string) error {
+	if !validRole(role) {
+		return errors.New("role must be viewer, operator or admin")
+	}
+	for _, farm := range farms {
+		if err := validateFarmID(farm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPassword checks the length of a new password and hashes it
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// capAPIKeys lowers the role of a demoted user's keys to the user's role
+func (a *Auth) capAPIKeys(ctx context.Context, user User) error {
+	keys, err := a.store.getUserAPIKeys(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	for hash, key := range keys {
+		if roleRank[key.Role] <= roleRank[user.Role] {
+			continue
+		}
+		key.Role = user.Role
+		if err := a.store.storeAPIKey(ctx, hash, key); err != nil {
+			return err
+		}
+		log.Printf("🔁 API key %s of %s lowered to %s", key.ID, user.Username, user.Role)
+	}
+	return nil
+}
+
+// DELETE /api/users/:name
+func (a *Auth) removeUser(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if identity := currentIdentity(c); identity != nil && identity.Username == name {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot delete yourself"})
+	}
+	if err := a.store.deleteUser(c.UserContext(), name); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(204)
+}
+
+// GET /api/users/:name/api-keys
+func (a *Auth) listAPIKeys(c *fiber.Ctx) error {
+	keys, err := a.store.getUserAPIKeys(c.UserContext(), c.Params("name"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	list := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, key)
+	}
+	return c.JSON(fiber.Map{"api_keys": list, "count": len(list)})
+}
+
+// POST /api/users/:name/api-keys {"name": "grafana", "role": "viewer"}
+// The key is returned once and only its hash is stored. The role cannot
+// exceed the user's own role.
+func (a *Auth) createAPIKey(c *fiber.Ctx) error {
+	user, err := a.store.getUser(c.UserContext(), c.Params("name"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if user == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Role == "" {
+		req.Role = user.Role
+	}
+	if !validRole(req.Role) || roleRank[req.Role] > roleRank[user.Role] {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role for this user"})
+	}
+
+	secret := "cm_" + randomHex(apiKeyBytes)
+	key := APIKey{
+		ID:        randomHex(6),
+		Name:      req.Name,
+		Username:  user.Username,
+		Role:      req.Role,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := a.store.storeAPIKey(c.UserContext(), hashAPIKey(secret), key); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"api_key": secret, "key": key})
+}
+
+// DELETE /api/users/:name/api-keys/:id
+func (a *Auth) revokeAPIKey(c *fiber.Ctx) error {
+	found, err := a.store.deleteAPIKey(c.UserContext(), c.Params("name"), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "API key not found"})
+	}
+	return c.SendStatus(204)
+}
+
+// GET /api/audit?from=&to=&limit=100&offset=0
+func (a *Auth) listAudit(c *fiber.Ctx) error {
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	items, err := a.store.queryUserAudit(c.UserContext(), q.Range, int64(q.Offset), int64(q.Limit+1))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	hasMore := len(items) > q.Limit
+	if hasMore {
+		items = items[:q.Limit]
+	}
+	return c.JSON(fiber.Map{
+		"entries":  rawJSON(items),
+		"count":    len(items),
+		"limit":    q.Limit,
+		"offset":   q.Offset,
+		"has_more": hasMore,
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogin(t *testing.T) {
+	server.user(t, "auth-login", roleViewer)
+	if _, err := server.login("auth-login", "wrong-password"); err == nil {
+		t.Error("logged in with a wrong password")
+	}
+	if _, err := server.login("auth-nobody", testPassword); err == nil {
+		t.Error("logged in as an unknown user")
+	}
+
+	// The session cookie authenticates the dashboard
+	resp := server.doAs(t, "", "POST", "/api/auth/login", map[string]string{
+		"username": "auth-login", "password": testPassword,
+	})
+	expect(t, resp, 200)
+	cookie := resp.header.Get("Set-Cookie")
+	req := httptest.NewRequest("GET", "/api/auth/me", nil)
+	req.Header.Set("Cookie", cookie)
+	me, err := server.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if me.StatusCode != 200 {
+		t.Errorf("cookie session got %d", me.StatusCode)
+	}
+
+	expect(t, server.doAs(t, "not-a-token", "GET", "/api/auth/me", nil), 401)
+	expect(t, server.doAs(t, "", "GET", "/api/farms", nil), 401)
+}
+
+func TestRoles(t *testing.T) {
+	viewer := server.user(t, "auth-viewer", roleViewer)
+	operator := server.user(t, "auth-operator", roleOperator)
+
+	var identity Identity
+	server.doAs(t, viewer, "GET", "/api/auth/me", nil).json(t, &identity)
+	if identity.Username != "auth-viewer" || identity.Role != roleViewer {
+		t.Errorf("identity is %+v", identity)
+	}
+
+	expect(t, server.doAs(t, viewer, "GET", "/api/farms/default/stats", nil), 200)
+	for _, token := range []string{viewer, operator} {
+		expect(t, server.doAs(t, token, "GET", "/api/users", nil), 403)
+		expect(t, server.doAs(t, token, "GET", "/api/ingest/status", nil), 403)
+	}
+
+	// Operators keep the registry, calibrations and dead letters
+	device := map[string]interface{}{"sensor_id": 61001, "type": moistureLayer}
+	expect(t, server.doAs(t, viewer, "POST", "/api/farms/default/devices", device), 403)
+	expect(t, server.doAs(t, operator, "POST", "/api/farms/default/devices", device), 201)
+	device["status"] = "maintenance"
+	expect(t, server.doAs(t, viewer, "PUT", "/api/farms/default/devices/61001", device), 403)
+	expect(t, server.doAs(t, operator, "PUT", "/api/farms/default/devices/61001", device), 200)
+	calibrations := map[string]interface{}{"calibrations": map[string]interface{}{
+		"61001": map[string]interface{}{"method": calibrationLinear, "coefficients": []float64{0, 0.025}},
+	}}
+	expect(t, server.doAs(t, viewer, "POST", "/api/farms/default/devices/calibrations", calibrations), 403)
+	expect(t, server.doAs(t, operator, "POST", "/api/farms/default/devices/calibrations", calibrations), 200)
+	expect(t, server.doAs(t, viewer, "POST", "/api/ingest/dead-letters/replay", nil), 403)
+	expect(t, server.doAs(t, operator, "GET", "/api/ingest/dead-letters", nil), 200)
+	expect(t, server.doAs(t, viewer, "DELETE", "/api/farms/default/devices/61001", nil), 403)
+	expect(t, server.doAs(t, operator, "DELETE", "/api/farms/default/devices/61001", nil), 204)
+}
+
+func TestUpdateUser(t *testing.T) {
+	server.user(t, "auth-updated", roleViewer)
+	expect(t, server.do(t, "POST", "/api/users", map[string]interface{}{
+		"username": "auth-updated", "password": testPassword, "role": roleAdmin,
+	}), 409)
+
+	// A role change needs no password and keeps it
+	var user User
+	server.do(t, "PUT", "/api/users/auth-updated", map[string]interface{}{
+		"role": roleOperator, "farms": []string{"auth-north"},
+	}).json(t, &user)
+	if user.Role != roleOperator || len(user.Farms) != 1 {
+		t.Errorf("updated user is %+v", user)
+	}
+	token, err := server.login("auth-updated", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity Identity
+	server.doAs(t, token, "GET", "/api/auth/me", nil).json(t, &identity)
+	if identity.Role != roleOperator {
+		t.Errorf("session of the updated user has role %s", identity.Role)
+	}
+
+	// A password change keeps the role
+	expect(t, server.do(t, "PUT", "/api/users/auth-updated/password", map[string]string{"password": "short"}), 400)
+	expect(t, server.do(t, "PUT", "/api/users/auth-updated/password", map[string]string{"password": "another-password"}), 204)
+	if _, err := server.login("auth-updated", testPassword); err == nil {
+		t.Error("logged in with the old password")
+	}
+	token, err = server.login("auth-updated", "another-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.doAs(t, token, "GET", "/api/auth/me", nil).json(t, &identity)
+	if identity.Role != roleOperator {
+		t.Errorf("password change left role %s", identity.Role)
+	}
+
+	expect(t, server.do(t, "PUT", "/api/users/auth-nobody", map[string]interface{}{"role": roleViewer}), 404)
+	expect(t, server.do(t, "PUT", "/api/users/auth-nobody/password", map[string]string{"password": "another-password"}), 404)
+	expect(t, server.do(t, "PUT", "/api/users/auth-updated", map[string]interface{}{"role": "root"}), 400)
+}
+
+func TestFarmScope(t *testing.T) {
+	token := server.user(t, "auth-scoped", roleViewer, "auth-north")
+	server.publish("farm/auth-north/gates/1/status", GateStatusMessage{GateID: 1, Status: "open", IsOpen: true, Timestamp: 1})
+	server.publish("farm/auth-south/gates/1/status", GateStatusMessage{GateID: 1, Status: "open", IsOpen: true, Timestamp: 1})
+
+	expect(t, server.doAs(t, token, "GET", "/api/farms/auth-north/gates", nil), 200)
+	expect(t, server.doAs(t, token, "GET", "/api/farms/auth-south/gates", nil), 403)
+	expect(t, server.doAs(t, token, "GET", "/api/gates", nil), 403) // The default farm
+
+	var farms struct {
+		Farms []struct {
+			ID string `json:"farm_id"`
+		} `json:"farms"`
+	}
+	server.doAs(t, token, "GET", "/api/farms", nil).json(t, &farms)
+	if len(farms.Farms) != 1 || farms.Farms[0].ID != "auth-north" {
+		t.Errorf("scoped user sees farms %+v", farms.Farms)
+	}
+}
+
+func TestDeadLettersByFarm(t *testing.T) {
+	north := server.user(t, "auth-letters-north", roleOperator, "auth-letters-north")
+	for _, topic := range []string{
+		"farm/auth-letters-north/sensors/" + moistureLayer + "/1",
+		"farm/auth-letters-south/sensors/" + moistureLayer + "/1",
+		"not-a-farm-topic",
+	} {
+		item := readingItem("", 1, 30, time.Now().Unix())
+		item.Topic = topic
+		server.mqtt.queue.deadLetter(item, reasonStoreFailed, errors.New("store down"))
+	}
+	topics := func(token string) map[string]bool {
+		var body struct {
+			DeadLetters []DeadLetter `json:"dead_letters"`
+		}
+		server.doAs(t, token, "GET", "/api/ingest/dead-letters?limit=1000", nil).json(t, &body)
+		seen := map[string]bool{}
+		for _, letter := range body.DeadLetters {
+			seen[letter.Topic] = true
+		}
+		return seen
+	}
+
+	// An operator of one farm sees and replays its letters only
+	if seen := topics(north); !seen["farm/auth-letters-north/sensors/"+moistureLayer+"/1"] || len(seen) != 1 {
+		t.Errorf("operator of auth-letters-north sees %v", seen)
+	}
+	expect(t, server.doAs(t, north, "POST", "/api/ingest/dead-letters/replay", nil), 200)
+	seen := topics(server.token)
+	if seen["farm/auth-letters-north/sensors/"+moistureLayer+"/1"] ||
+		!seen["farm/auth-letters-south/sensors/"+moistureLayer+"/1"] || !seen["not-a-farm-topic"] {
+		t.Errorf("after the operator's replay the letters are %v", seen)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	server.user(t, "auth-keys", roleOperator, "auth-keys-farm")
+	var created struct {
+		APIKey string `json:"api_key"`
+		Key    APIKey `json:"key"`
+	}
+	resp := server.do(t, "POST", "/api/users/auth-keys/api-keys", map[string]interface{}{"name": "ci", "role": roleOperator})
+	expect(t, resp, 201)
+	resp.json(t, &created)
+
+	var identity Identity
+	server.doAs(t, created.APIKey, "GET", "/api/auth/me", nil).json(t, &identity)
+	if identity.Username != "auth-keys" || identity.Role != roleOperator || identity.Method != "api_key" {
+		t.Errorf("key identity is %+v", identity)
+	}
+	// Keys follow their user's farms
+	expect(t, server.doAs(t, created.APIKey, "GET", "/api/farms/default/stats", nil), 403)
+
+	// Demoting the user caps the key
+	expect(t, server.do(t, "PUT", "/api/users/auth-keys", map[string]interface{}{
+		"role": roleViewer, "farms": []string{"auth-keys-farm"},
+	}), 200)
+	server.doAs(t, created.APIKey, "GET", "/api/auth/me", nil).json(t, &identity)
+	if identity.Role != roleViewer {
+		t.Errorf("key of a demoted user has role %s", identity.Role)
+	}
+
+	// A key can not be created above its user's role
+	expect(t, server.do(t, "POST", "/api/users/auth-keys/api-keys", map[string]interface{}{"role": roleAdmin}), 400)
+
+	expect(t, server.do(t, "DELETE", "/api/users/auth-keys/api-keys/"+created.Key.ID, nil), 204)
+	expect(t, server.doAs(t, created.APIKey, "GET", "/api/auth/me", nil), 401)
+}
+
+func TestDeletedUserLosesAccess(t *testing.T) {
+	server.user(t, "auth-deleted", roleViewer)
+	var created struct {
+		APIKey string `json:"api_key"`
+	}
+	server.do(t, "POST", "/api/users/auth-deleted/api-keys", map[string]interface{}{"name": "old"}).json(t, &created)
+	expect(t, server.do(t, "DELETE", "/api/users/auth-deleted", nil), 204)
+
+	expect(t, server.doAs(t, created.APIKey, "GET", "/api/auth/me", nil), 401)
+	if _, err := server.login("auth-deleted", testPassword); err == nil {
+		t.Error("deleted user logged in")
+	}
+}
+
+func TestAuditRecordsChanges(t *testing.T) {
+	server.user(t, "auth-audited", roleViewer)
+	var audit struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	server.do(t, "GET", "/api/audit?limit=5", nil).json(t, &audit)
+	for _, entry := range audit.Entries {
+		if entry["path"] == "/api/users" && entry["user"] == "admin" {
+			return
+		}
+	}
+	t.Errorf("creating a user is not in the audit log: %v", audit.Entries)
+}
+
+func TestMetricsAccess(t *testing.T) {
+	viewer := server.user(t, "auth-metrics", roleViewer)
+	expect(t, server.doAs(t, "", "GET", "/metrics", nil), 401)
+	expect(t, server.doAs(t, viewer, "GET", "/metrics", nil), 403)
+	expect(t, server.do(t, "GET", "/metrics", nil), 200)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// BATCHED READINGS
+// ============================================================================
+
+// Gateways and the simulator can send many readings in one message instead
+// of one message per sensor:
+//
+//	farm/<farm>/sensors/<type>/batch      readings of one sensor type
+//	farm/<farm>/sensors/batch/<gateway>   everything a gateway collected
+//
+// The payload is {"farm_id", "gateway", "readings": [<sensor message>, ...]}.
+// A batch is checked as a whole, so a bad reading rejects the whole batch,
+// and its readings go through the ingestion pipeline together: one SQL
+// transaction, one Redis MULTI/EXEC or one memory store lock. Only the SQL
+// stores roll back a failed batch. Redis keeps other clients from seeing
+// half of it but still applies the commands that did not fail, and the
+// retry then stores the batch again. That is harmless: the latest hashes
+// are overwritten, and a sensor's history is a sorted set that holds a
+// reading stored twice once.
+
+// batchSegment marks batch topics
+const batchSegment = "batch"
+
+// maxBatchReadings bounds the work one message can cause
+const maxBatchReadings = 10000
+
+// SensorBatch is the payload of a batch topic
+type SensorBatch struct {
+	FarmID   string          `json:"farm_id"`
+	Gateway  string          `json:"gateway,omitempty"`
+	Readings []SensorMessage `json:"readings"`
+}
+
+// isBatchTopic reports whether a topic below the farm carries a batch
+func isBatchTopic(rest string) bool {
+	parts := strings.Split(rest, "/")
+	return len(parts) == 3 && (parts[1] == batchSegment || parts[2] == batchSegment)
+}
+
+// validate checks a batch from sensors/<type>/batch or sensors/batch/<gateway>
+// and fills in what the topic implies
+func (b *SensorBatch) validate(farm, rest string) error {
+	parts := strings.Split(rest, "/")
+	topicType, gateway := parts[1], ""
+	if topicType == batchSegment {
+		topicType, gateway = "", parts[2]
+	}
+
+	if len(b.Readings) == 0 {
+		return fmt.Errorf("batch has no readings")
+	}
+	if len(b.Readings) > maxBatchReadings {
+		return fmt.Errorf("batch has %d readings, at most %d are allowed", len(b.Readings), maxBatchReadings)
+	}
+	if gateway != "" {
+		if b.Gateway != "" && b.Gateway != gateway {
+			return fmt.Errorf("payload names gateway %q", b.Gateway)
+		}
+		b.Gateway = gateway
+	}
+
+	for i := range b.Readings {
+		reading := &b.Readings[i]
+		if reading.SensorID <= 0 {
+			return fmt.Errorf("reading %d has no sensor_id", i)
+		}
+		if reading.FarmID != "" && reading.FarmID != farm {
+			return fmt.Errorf("reading %d (sensor %d) names farm %q", i, reading.SensorID, reading.FarmID)
+		}
+		reading.FarmID = farm
+
+		if reading.Type == "" {
+			reading.Type = topicType
+		}
+		if reading.Type == "" {
+			return fmt.Errorf("reading %d (sensor %d) has no type", i, reading.SensorID)
+		}
+		if topicType != "" && reading.Type != topicType {
+			return fmt.Errorf("reading %d (sensor %d) is %s, not %s", i, reading.SensorID, reading.Type, topicType)
+		}
+	}
+	return nil
+}
+
+// parseSensorBatch decodes and checks a batch message
+func (h *MQTTHandler) parseSensorBatch(farm, topic, rest string, payload []byte) (SensorBatch, error) {
+	sensorPayloadBytes.WithLabelValues("json").Add(float64(len(payload)))
+
+	var batch SensorBatch
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		mqttParseFailures.WithLabelValues("sensor_batch").Inc()
+		return batch, unparseable(fmt.Errorf("sensor batch: %w", err))
+	}
+	if !sameFarm(farm, batch.FarmID, topic) {
+		return batch, errFarmMismatch
+	}
+	if err := batch.validate(farm, rest); err != nil {
+		mqttParseFailures.WithLabelValues("sensor_batch").Inc()
+		return batch, rejected(err)
+	}
+	return batch, nil
+}
+
+// source names where a batch came from, for the log
+func (b *SensorBatch) source() string {
+	if b.Gateway != "" {
+		return b.Gateway
+	}
+	return b.Readings[0].Type
+}
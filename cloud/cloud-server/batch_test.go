@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The ingest benchmarks store one reading of each of benchSensors soil
+// moisture sensors, once as a single batch message and once as one message
+// per sensor:
+//
+//	go test -run '^$' -bench Ingest
+
+const benchSensors = maxBatchReadings
+
+// benchReadings returns one reading per sensor
+func benchReadings(farm string) []SensorMessage {
+	now := time.Now().Unix()
+	readings := make([]SensorMessage, benchSensors)
+	for i := range readings {
+		readings[i] = SensorMessage{
+			SensorID: i + 1, FarmID: farm, Type: moistureLayer, Lat: 32.7637, Lon: 52.6365,
+			Value: float64(20 + i%60), Unit: "%", Timestamp: now,
+		}
+	}
+	return readings
+}
+
+// BenchmarkIngestBatched runs a batch of every sensor through the
+// ingestion pipeline into the memory store
+func BenchmarkIngestBatched(b *testing.B) {
+	farm := "bench-batched"
+	payload, err := json.Marshal(SensorBatch{FarmID: farm, Readings: benchReadings(farm)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	topic := fmt.Sprintf("farm/%s/sensors/%s/batch", farm, moistureLayer)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		server.mqtt.queue.process([]ingestItem{{Topic: topic, Payload: payload, Received: time.Now()}})
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchSensors), "ns/reading")
+}
+
+// BenchmarkIngestUnbatched runs one message per sensor through the
+// ingestion pipeline into the memory store, as many together as a worker
+// takes from the queue
+func BenchmarkIngestUnbatched(b *testing.B) {
+	farm := "bench-unbatched"
+	items := make([]ingestItem, 0, benchSensors)
+	for _, reading := range benchReadings(farm) {
+		payload, err := json.Marshal(reading)
+		if err != nil {
+			b.Fatal(err)
+		}
+		topic := fmt.Sprintf("farm/%s/sensors/%s/%d", farm, reading.Type, reading.SensorID)
+		items = append(items, ingestItem{Topic: topic, Payload: payload, Received: time.Now()})
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for start := 0; start < len(items); start += maxPipelineMessages {
+			end := start + maxPipelineMessages
+			if end > len(items) {
+				end = len(items)
+			}
+			server.mqtt.queue.process(items[start:end])
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchSensors), "ns/reading")
+}
+
+// benchRedis returns a Redis store on an in-process server
+func benchRedis(b *testing.B) *RedisClient {
+	mr := miniredis.RunT(b)
+	r := newRedisClient(mr.Addr())
+	b.Cleanup(func() { r.close() })
+	return r
+}
+
+// BenchmarkIngestRedisBatched stores every sensor's reading in one
+// MULTI/EXEC round trip
+func BenchmarkIngestRedisBatched(b *testing.B) {
+	ctx := context.Background()
+	r := benchRedis(b)
+	readings := benchReadings(defaultFarm)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := r.storeSensorReadings(ctx, defaultFarm, readings); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchSensors), "ns/reading")
+}
+
+// BenchmarkIngestRedisUnbatched stores every sensor's reading in its own
+// round trip
+func BenchmarkIngestRedisUnbatched(b *testing.B) {
+	ctx := context.Background()
+	r := benchRedis(b)
+	readings := benchReadings(defaultFarm)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range readings {
+			if err := r.storeSensorReadings(ctx, defaultFarm, readings[i:i+1]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchSensors), "ns/reading")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// SENSOR CALIBRATION
+// ============================================================================
+
+// Probes in raw mode publish "raw_value" (e.g. ADC counts of a capacitive
+// moisture probe) and optionally the probe "temperature" instead of a final
+// "value". The calibration stored with the device in the registry turns the
+// raw reading into engineering units before it is stored; both values are
+// kept. Raw readings of devices without a calibration are stored raw only.
+// The curves themselves are in calibrationcurve.go.
+
+// calibrateReadings calibrates raw readings with one registry lookup and
+// returns how many had no calibration
+func (h *MQTTHandler) calibrateReadings(ctx context.Context, farm string, readings []SensorMessage) (int, error) {
+	var ids []int
+	for _, reading := range readings {
+		if reading.RawValue != nil {
+			ids = append(ids, reading.SensorID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	devices, err := h.store.getDevices(ctx, farm, ids)
+	if err != nil {
+		return 0, err
+	}
+	uncalibrated := 0
+	for i := range readings {
+		if readings[i].RawValue != nil && !applyCalibration(devices[readings[i].SensorID], &readings[i]) {
+			uncalibrated++
+		}
+	}
+	return uncalibrated, nil
+}
+
+// applyCalibration calibrates a raw reading with a registry entry, which
+// may be nil. It reports false when there is no calibration.
+func applyCalibration(device *Device, msg *SensorMessage) bool {
+	if device == nil || device.Calibration == nil {
+		return false
+	}
+	msg.Value = device.Calibration.apply(*msg.RawValue, msg.Temperature)
+	msg.Calibrated = true
+	return true
+}
+
+// ============================================================================
+// CALIBRATION HTTP HANDLERS
+// ============================================================================
+
+// GET /api/farms/:farm/devices/calibrations (for EDGE_CALIBRATION_FILE)
+func (h *APIHandlers) exportCalibrations(c *fiber.Ctx) error {
+	farm := farmOf(c)
+	devices, err := h.store.getAllDevices(c.UserContext(), farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	set := CalibrationSet{FarmID: farm, Calibrations: map[string]*Calibration{}}
+	for i := range devices {
+		if devices[i].Calibration != nil {
+			set.Calibrations[strconv.Itoa(devices[i].SensorID)] = devices[i].Calibration
+		}
+	}
+	return c.JSON(set)
+}
+
+// POST /api/farms/:farm/devices/calibrations
+//
+// Sets the calibration of registered devices, other registry fields are
+// left alone. A null calibration removes it. Unregistered sensor IDs are
+// reported and skipped; one invalid calibration rejects the whole set.
+func (h *APIHandlers) importCalibrations(c *fiber.Ctx) error {
+	var set CalibrationSet
+	if err := json.Unmarshal(c.Body(), &set); err != nil || set.Calibrations == nil {
+		return c.Status(400).JSON(fiber.Map{"error": `Body must be {"calibrations": {"<sensor_id>": {...}}}`})
+	}
+
+	farm := farmOf(c)
+	calibrations := make(map[int]*Calibration, len(set.Calibrations))
+	ids := make([]int, 0, len(set.Calibrations))
+	for key, calibration := range set.Calibrations {
+		id, err := strconv.Atoi(key)
+		if err != nil || id <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Invalid sensor ID %q", key)})
+		}
+		if calibration != nil {
+			if err := calibration.validate(); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Sensor %d: %v", id, err)})
+			}
+		}
+		calibrations[id] = calibration
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	updated, unknown := []int{}, []int{}
+	for _, id := range ids {
+		device, err := h.store.getDevice(c.UserContext(), farm, id)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if device == nil {
+			unknown = append(unknown, id)
+			continue
+		}
+		device.Calibration = calibrations[id]
+		device.UpdatedAt = time.Now().Unix()
+		if err := h.store.storeDevice(c.UserContext(), farm, *device); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		updated = append(updated, id)
+	}
+
+	log.Printf("✅ Calibrated %d devices of farm %s", len(updated), farm)
+	return c.JSON(fiber.Map{
+		"updated": updated,
+		"unknown": unknown,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestCalibrationCurveCopiesAreIdentical(t *testing.T) {
+	canonical, err := os.ReadFile("../../edge/calibrationcurve.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile("calibrationcurve.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, canonical) {
+		t.Error("calibrationcurve.go differs from edge/calibrationcurve.go, copy it over")
+	}
+}
+
+// The edge tests load edge/testdata/calibrations.json as its
+// EDGE_CALIBRATION_FILE, this keeps it what the cloud exports
+func TestExportCalibrationsForEdge(t *testing.T) {
+	farm := "north"
+	for _, device := range []map[string]interface{}{
+		{"sensor_id": 9001, "type": moistureLayer, "calibration": map[string]interface{}{
+			"method": "linear", "coefficients": []float64{177.8, -0.0556}, "temp_coefficient": -4, "reference_temp": 20}},
+		{"sensor_id": 9002, "type": moistureLayer, "calibration": map[string]interface{}{
+			"table": [][2]float64{{1400, 100}, {2300, 40}, {3200, 0}}}},
+		{"sensor_id": 9003, "type": moistureLayer}, // Reports calibrated values
+	} {
+		expect(t, server.do(t, "POST", "/api/farms/"+farm+"/devices", device), 201)
+	}
+
+	resp := server.do(t, "GET", "/api/farms/"+farm+"/devices/calibrations", nil)
+	expect(t, resp, 200)
+	fixture, err := os.ReadFile("../../edge/testdata/calibrations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.body, bytes.TrimSpace(fixture)) {
+		t.Errorf("export is\n%s\nedge/testdata/calibrations.json is\n%s", resp.body, fixture)
+	}
+}
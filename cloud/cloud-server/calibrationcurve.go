@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ============================================================================
+// CALIBRATION CURVES
+// ============================================================================
+
+// This file is the same in the edge and the cloud server.
+// edge/calibrationcurve.go is the canonical copy: change it there and copy it
+// to cloud/cloud-server/ (TestCalibrationCurveCopiesAreIdentical in the cloud
+// server checks they match).
+
+// Calibration methods
+const (
+	calibrationLinear     = "linear"     // value = c0 + c1*raw
+	calibrationPolynomial = "polynomial" // value = c0 + c1*raw + c2*raw² + ...
+	calibrationTable      = "table"      // Piecewise linear through [raw, value] points
+)
+
+// Temperature the calibration curve was measured at, unless set per sensor
+const defaultReferenceTemp = 25.0
+
+// Calibration is the per-sensor curve from raw readings to engineering
+// units, with optional linear temperature compensation of the raw reading:
+// raw' = raw - temp_coefficient * (temperature - reference_temp)
+type Calibration struct {
+	Method          string       `json:"method,omitempty"`
+	Coefficients    []float64    `json:"coefficients,omitempty"`
+	Table           [][2]float64 `json:"table,omitempty"`            // [raw, value], raw ascending
+	TempCoefficient float64      `json:"temp_coefficient,omitempty"` // Raw units per °C
+	ReferenceTemp   *float64     `json:"reference_temp,omitempty"`   // °C, default 25
+}
+
+// CalibrationSet is the exchange format for calibrations, keyed by sensor
+// ID. The cloud exports it and the simulator writes it for its probes; the
+// edge reads it from EDGE_CALIBRATION_FILE.
+type CalibrationSet struct {
+	FarmID       string                  `json:"farm_id,omitempty"`
+	Calibrations map[string]*Calibration `json:"calibrations"`
+}
+
+// validate checks a calibration and fills in the method. Entries stored
+// before methods existed only have coefficients and are polynomials.
+func (c *Calibration) validate() error {
+	if c.Method == "" {
+		c.Method = calibrationPolynomial
+		if len(c.Table) > 0 {
+			c.Method = calibrationTable
+		}
+	}
+
+	values := append([]float64{c.TempCoefficient}, c.Coefficients...)
+	for _, point := range c.Table {
+		values = append(values, point[0], point[1])
+	}
+	if c.ReferenceTemp != nil {
+		values = append(values, *c.ReferenceTemp)
+	}
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("calibration values must be finite")
+		}
+	}
+
+	switch c.Method {
+	case calibrationLinear:
+		if len(c.Coefficients) != 2 {
+			return fmt.Errorf("linear calibration needs 2 coefficients (offset, slope)")
+		}
+	case calibrationPolynomial:
+		if len(c.Coefficients) == 0 {
+			return fmt.Errorf("calibration needs at least one coefficient")
+		}
+	case calibrationTable:
+		if len(c.Table) < 2 {
+			return fmt.Errorf("table calibration needs at least 2 points")
+		}
+		for i := 1; i < len(c.Table); i++ {
+			if c.Table[i][0] <= c.Table[i-1][0] {
+				return fmt.Errorf("table calibration raw values must be strictly ascending")
+			}
+		}
+	default:
+		return fmt.Errorf("calibration method must be linear, polynomial or table")
+	}
+	return nil
+}
+
+// apply converts a raw reading. The temperature is only used when the
+// calibration has a temperature coefficient and the probe reported one.
+func (c *Calibration) apply(raw float64, temperature *float64) float64 {
+	if c.TempCoefficient != 0 && temperature != nil {
+		reference := defaultReferenceTemp
+		if c.ReferenceTemp != nil {
+			reference = *c.ReferenceTemp
+		}
+		raw -= c.TempCoefficient * (*temperature - reference)
+	}
+
+	if c.Method == calibrationTable {
+		return interpolateTable(c.Table, raw)
+	}
+
+	// Horner's scheme, linear is a first-degree polynomial
+	value := 0.0
+	for i := len(c.Coefficients) - 1; i >= 0; i-- {
+		value = value*raw + c.Coefficients[i]
+	}
+	return value
+}
+
+// interpolateTable interpolates linearly between the table points and
+// clamps to the first and last value outside the table
+func interpolateTable(table [][2]float64, raw float64) float64 {
+	if raw <= table[0][0] {
+		return table[0][1]
+	}
+	last := len(table) - 1
+	if raw >= table[last][0] {
+		return table[last][1]
+	}
+	i := sort.Search(len(table), func(i int) bool { return table[i][0] >= raw })
+	lo, hi := table[i-1], table[i]
+	return lo[1] + (raw-lo[0])*(hi[1]-lo[1])/(hi[0]-lo[0])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ============================================================================
+// COMPACT PAYLOADS (CBOR)
+// ============================================================================
+
+// Low-bandwidth sensors (LoRa, cellular) publish CBOR on
+// farm/<farm>/sensors/<type>/<id>/cbor. MQTT 3.1.1 has no content-type
+// property, so the topic suffix tells the encodings apart. The payload only
+// carries what changes, keyed by small integers:
+//
+//	1: value        float
+//	2: timestamp    unix seconds
+//	3: raw_value    float (raw mode)
+//	4: temperature  float (raw mode)
+//
+// Floats may come in any CBOR width (half, single or double precision) and
+// are decoded as float64.
+//
+// Farm, type and sensor ID come from the topic, location from the device
+// registry and the unit from the sensor type. Compact readings of devices
+// that are not in the registry are rejected (and dead-lettered, so they can
+// be replayed once the device is registered).
+
+// compactSuffix is the topic suffix that marks a CBOR payload
+const compactSuffix = "cbor"
+
+// CompactReading is the CBOR payload of one reading
+type CompactReading struct {
+	Value       *float64 `cbor:"1,keyasint,omitempty"`
+	Timestamp   int64    `cbor:"2,keyasint"`
+	RawValue    *float64 `cbor:"3,keyasint,omitempty"`
+	Temperature *float64 `cbor:"4,keyasint,omitempty"`
+}
+
+// Units of the sensor types, static per type so compact payloads omit them.
+// This is the only copy outside the simulator (getUnit, which publishes them
+// in JSON payloads): the edge does not store units.
+var sensorUnits = map[string]string{
+	"soil-moisture-sensors":    "%",
+	"soil-temperature-sensors": "°C",
+	"water-flow-sensors":       "L/min",
+	"water-level-sensor":       "%",
+	"weather-sensor":           "°C",
+}
+
+// isCompactTopic reports whether a sensor topic carries a CBOR payload
+func isCompactTopic(rest string) bool {
+	return strings.HasSuffix(rest, "/"+compactSuffix)
+}
+
+// decodeCompact turns a CBOR reading from sensors/<type>/<id>/cbor (the
+// topic below the farm) into the message a JSON payload gives, completed
+// from the registry entry of the device
+func (h *MQTTHandler) decodeCompact(ctx context.Context, farm, rest string, payload []byte) (SensorMessage, error) {
+	parts := strings.Split(rest, "/")
+	if len(parts) != 4 {
+		return SensorMessage{}, unparseable(fmt.Errorf("unexpected topic %s", rest))
+	}
+	sensorType := parts[1]
+	sensorID, err := strconv.Atoi(parts[2])
+	if err != nil || sensorID <= 0 {
+		return SensorMessage{}, unparseable(fmt.Errorf("invalid sensor id in topic %s", rest))
+	}
+
+	var reading CompactReading
+	if err := cbor.Unmarshal(payload, &reading); err != nil {
+		return SensorMessage{}, unparseable(err)
+	}
+	if reading.Value == nil && reading.RawValue == nil {
+		return SensorMessage{}, rejected(fmt.Errorf("sensor %d sent neither value nor raw_value", sensorID))
+	}
+	// CBOR, unlike JSON, can carry NaN and infinities
+	for _, value := range []*float64{reading.Value, reading.RawValue, reading.Temperature} {
+		if value != nil && !finite(*value) {
+			return SensorMessage{}, rejected(fmt.Errorf("sensor %d sent a value that is not finite", sensorID))
+		}
+	}
+
+	device, err := h.store.getDevice(ctx, farm, sensorID)
+	if err != nil {
+		return SensorMessage{}, err
+	}
+	if device == nil {
+		return SensorMessage{}, rejected(fmt.Errorf("sensor %d is not in the device registry", sensorID))
+	}
+	if device.Type != sensorType {
+		return SensorMessage{}, rejected(fmt.Errorf("sensor %d is registered as %s, not %s", sensorID, device.Type, sensorType))
+	}
+
+	msg := SensorMessage{
+		FarmID:      farm,
+		SensorID:    sensorID,
+		Type:        sensorType,
+		Lat:         device.Lat,
+		Lon:         device.Lon,
+		RawValue:    reading.RawValue,
+		Temperature: reading.Temperature,
+		Unit:        sensorUnits[sensorType],
+		Timestamp:   reading.Timestamp,
+	}
+	if reading.Value != nil {
+		msg.Value = *reading.Value
+	}
+	return msg, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCompactReadings(t *testing.T) {
+	farm := "compact"
+	expect(t, server.do(t, "POST", "/api/farms/"+farm+"/devices", map[string]interface{}{
+		"sensor_id": 1, "type": moistureLayer, "lat": 32.7637, "lon": 52.6365,
+	}), 201)
+
+	// Double precision values arrive unchanged, shorter widths are widened
+	for _, value := range []interface{}{45.123456789, float32(45.25), 42} {
+		payload, err := cbor.Marshal(map[int]interface{}{1: value, 2: time.Now().Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.mqtt.queue.process([]ingestItem{{
+			Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/1/cbor", Payload: payload, Received: time.Now(),
+		}})
+
+		var latest map[string]string
+		server.do(t, "GET", "/api/farms/"+farm+"/sensors/1/latest", nil).json(t, &latest)
+		want := map[interface{}]string{45.123456789: "45.123456789", float32(45.25): "45.25", 42: "42"}[value]
+		if latest["value"] != want || latest["unit"] != "%" || latest["lat"] != "32.7637" {
+			t.Errorf("compact reading %v stored as %v", value, latest)
+		}
+	}
+
+	// Values JSON cannot hold are rejected before they reach the store
+	for _, reading := range []map[int]interface{}{
+		{1: math.NaN()}, {1: math.Inf(1)}, {3: math.Inf(-1)}, {3: 2400.0, 4: math.NaN()},
+	} {
+		reading[2] = time.Now().Unix()
+		payload, _ := cbor.Marshal(reading)
+		server.mqtt.queue.process([]ingestItem{{
+			Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/1/cbor", Payload: payload, Received: time.Now(),
+		}})
+	}
+	var latest map[string]string
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors/1/latest", nil).json(t, &latest)
+	if latest["value"] != "42" || latest["raw_value"] != "" {
+		t.Errorf("latest reading after non-finite values is %v", latest)
+	}
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/sensors", nil), 200)
+	letters, _, _ := server.mqtt.queue.deadLetters.list(reasonRejected, 1000, allLetters)
+	rejected := 0
+	for _, letter := range letters {
+		if letter.Topic == "farm/"+farm+"/sensors/"+moistureLayer+"/1/cbor" {
+			rejected++
+		}
+	}
+	if rejected != 4 {
+		t.Errorf("%d non-finite readings dead-lettered as rejected, want 4", rejected)
+	}
+
+	// Unregistered devices are rejected
+	payload, _ := cbor.Marshal(CompactReading{Value: new(float64), Timestamp: time.Now().Unix()})
+	server.mqtt.queue.process([]ingestItem{{
+		Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/2/cbor", Payload: payload, Received: time.Now(),
+	}})
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/sensors/2/latest", nil), 404)
+}
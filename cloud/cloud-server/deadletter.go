@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// DEAD LETTERS
+// ============================================================================
+
+// Messages the ingestion pipeline could not store are appended to a JSON
+// lines file rather than to Redis, so they are kept while Redis is down.
+// Operators can list them and replay them through the queue once the cause
+// is fixed (Redis back, device registered); messages that fail again are
+// dead-lettered again. A replay removes the letters from the file only once
+// the workers have stored them or dead-lettered them again, so a crash or
+// a shutdown mid-replay can replay them twice but not lose them. Replays
+// run one at a time. Replayed messages keep their receive time and are not
+// counted again in the message rate.
+
+// Longest line read back from the dead-letter file (large batches)
+const maxDeadLetterLine = 64 << 20
+
+// DeadLetter is one message that could not be stored
+type DeadLetter struct {
+	Topic         string `json:"topic"`
+	Payload       string `json:"payload,omitempty"`        // Text payloads (JSON)
+	PayloadBase64 string `json:"payload_base64,omitempty"` // Binary payloads (CBOR)
+	Reason        string `json:"reason"`
+	Error         string `json:"error"`
+	Received      int64  `json:"received"`
+	Failed        int64  `json:"failed"`
+}
+
+func newDeadLetter(item ingestItem, reason string, err error) DeadLetter {
+	letter := DeadLetter{
+		Topic:    item.Topic,
+		Reason:   reason,
+		Error:    err.Error(),
+		Received: item.Received.Unix(),
+		Failed:   time.Now().Unix(),
+	}
+	if utf8.Valid(item.Payload) {
+		letter.Payload = string(item.Payload)
+	} else {
+		letter.PayloadBase64 = base64.StdEncoding.EncodeToString(item.Payload)
+	}
+	return letter
+}
+
+// item turns a dead letter back into a queue item
+func (d DeadLetter) item() (ingestItem, error) {
+	item := ingestItem{Topic: d.Topic, Received: time.Unix(d.Received, 0), Replayed: time.Now()}
+	item.Payload = []byte(d.Payload)
+	if d.PayloadBase64 != "" {
+		var err error
+		if item.Payload, err = base64.StdEncoding.DecodeString(d.PayloadBase64); err != nil {
+			item.Payload = nil
+			return item, err
+		}
+	}
+	return item, nil
+}
+
+// DeadLetterStore appends to and reads the dead-letter file
+type DeadLetterStore struct {
+	path      string
+	mutex     sync.Mutex
+	total     int        // Letters in the file
+	replaying sync.Mutex // Held from a replay's snapshot to its discard
+}
+
+func newDeadLetterStore(path string) *DeadLetterStore {
+	s := &DeadLetterStore{path: path}
+	letters, _, err := s.read()
+	if err != nil {
+		log.Printf("⚠️ Cannot read dead-letter file %s: %v", path, err)
+	}
+	s.total = len(letters)
+	return s
+}
+
+// add appends a dead letter
+func (s *DeadLetterStore) add(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	s.total++
+	return file.Close()
+}
+
+// read returns all dead letters, oldest first, and the size of the file
+// they were read from. Lines that do not parse are skipped.
+func (s *DeadLetterStore) read() ([]DeadLetter, int64, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return []DeadLetter{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	letters := []DeadLetter{}
+	var size int64
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			break // Partly written, left for the next read
+		}
+		size += int64(len(line))
+		var letter DeadLetter
+		if len(line) <= maxDeadLetterLine && json.Unmarshal(line, &letter) == nil {
+			letters = append(letters, letter)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return letters, size, nil
+}
+
+// list returns the newest dead letters first, optionally of one reason,
+// and how many there are in total. Only letters visible reports true for
+// are listed.
+func (s *DeadLetterStore) list(reason string, limit int, visible func(DeadLetter) bool) ([]DeadLetter, int, error) {
+	s.mutex.Lock()
+	letters, _, err := s.read()
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	matching := []DeadLetter{}
+	for i := len(letters) - 1; i >= 0; i-- {
+		if (reason == "" || letters[i].Reason == reason) && visible(letters[i]) {
+			matching = append(matching, letters[i])
+		}
+	}
+	total := len(matching)
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return matching, total, nil
+}
+
+// count returns how many dead letters there are
+func (s *DeadLetterStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.total
+}
+
+// snapshot returns all dead letters and the size of the file holding them,
+// to pass to discard once they are taken care of
+func (s *DeadLetterStore) snapshot() ([]DeadLetter, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read()
+}
+
+// discard replaces the first size bytes of the file, which hold the
+// letters of a snapshot, with the letters of it to keep, and keeps the
+// letters added since. removed is how many letters are gone.
+func (s *DeadLetterStore) discard(size int64, kept []DeadLetter, removed int) error {
+	if size == 0 {
+		return nil // Empty snapshot, the file may not exist
+	}
+	var head []byte
+	for _, letter := range kept {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		head = append(append(head, line...), '\n')
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < size {
+		return fmt.Errorf("dead-letter file %s shrank during replay", s.path)
+	}
+	if int64(len(data)) == size && len(head) == 0 {
+		err = os.Remove(s.path)
+	} else {
+		temp := s.path + ".tmp"
+		if err = os.WriteFile(temp, append(head, data[size:]...), 0600); err == nil {
+			err = os.Rename(temp, s.path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.total = max(0, s.total-removed)
+	return nil
+}
+
+// letterVisibility reports which dead letters the caller may see: those of
+// farms it can access. Letters whose topic names no farm are only visible
+// to callers with access to every farm.
+func letterVisibility(c *fiber.Ctx) func(DeadLetter) bool {
+	identity := currentIdentity(c)
+	return func(letter DeadLetter) bool {
+		if identity == nil {
+			return true
+		}
+		farm, _, _ := parseFarmTopic(letter.Topic)
+		return identity.canAccessFarm(farm)
+	}
+}
+
+// ============================================================================
+// INGESTION HTTP HANDLERS
+// ============================================================================
+
+// GET /api/ingest/status
+func (q *IngestQueue) status(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"workers":        len(q.shards),
+		"queue_depth":    q.depth(),
+		"queue_capacity": q.capacity,
+		"dead_letters":   q.deadLetters.count(),
+	})
+}
+
+// GET /api/ingest/dead-letters?reason=&limit=100
+func (q *IngestQueue) listDeadLetters(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 1000 {
+		return c.Status(400).JSON(fiber.Map{"error": "limit must be between 1 and 1000"})
+	}
+	letters, total, err := q.deadLetters.list(c.Query("reason"), limit, letterVisibility(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"dead_letters": letters,
+		"count":        len(letters),
+		"total":        total,
+	})
+}
+
+// POST /api/ingest/dead-letters/replay
+//
+// Puts every dead letter of the farms the caller can access back on the
+// queue, waiting for room, and once the workers have stored them or
+// dead-lettered them again removes them from the file; the letters of
+// other farms stay. If they are not all queued and processed within the
+// request deadline nothing is removed, and the letters already stored will
+// be replayed twice. A replay waits for the one running, which would
+// otherwise queue the same letters.
+func (q *IngestQueue) replayDeadLetters(c *fiber.Ctx) error {
+	q.deadLetters.replaying.Lock()
+	defer q.deadLetters.replaying.Unlock()
+
+	letters, size, err := q.deadLetters.snapshot()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	visible := letterVisibility(c)
+	var processing sync.WaitGroup
+	replayed := 0
+	var kept []DeadLetter   // Letters of farms the caller cannot access
+	var broken []ingestItem // Payloads that do not decode, dead-lettered again after the discard
+	var brokenErrs []error
+	for _, letter := range letters {
+		if !visible(letter) {
+			kept = append(kept, letter)
+			continue
+		}
+		item, err := letter.item()
+		if err != nil {
+			broken = append(broken, item)
+			brokenErrs = append(brokenErrs, err)
+			continue
+		}
+		item.done = &processing
+		processing.Add(1)
+		if err := q.enqueueWait(c.UserContext(), item); err != nil {
+			processing.Done()
+			log.Printf("❌ Replay stopped after %d of %d dead letters: %v", replayed, len(letters), err)
+			return c.Status(503).JSON(fiber.Map{"error": "Replay stopped: " + err.Error(), "replayed": replayed})
+		}
+		replayed++
+	}
+
+	processed := make(chan struct{})
+	go func() {
+		processing.Wait()
+		close(processed)
+	}()
+	select {
+	case <-processed:
+	case <-c.UserContext().Done():
+		err := c.UserContext().Err()
+		log.Printf("❌ Replay of %d dead letters not stored in time: %v", replayed, err)
+		return c.Status(503).JSON(fiber.Map{"error": "Replay not stored in time: " + err.Error(), "replayed": replayed})
+	}
+
+	if err := q.deadLetters.discard(size, kept, len(letters)-len(kept)); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error(), "replayed": replayed})
+	}
+	for i, item := range broken {
+		q.deadLetter(item, reasonUnparseable, fmt.Errorf("dead letter payload: %w", brokenErrs[i]))
+	}
+
+	log.Printf("🔁 Replayed %d dead-lettered messages", replayed)
+	return c.JSON(fiber.Map{"replayed": replayed})
+}
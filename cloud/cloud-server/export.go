@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// DATA EXPORT
+// ============================================================================
+
+// Exports of latest readings, sensor history and gate history for
+// spreadsheets and GIS tools, with typed values instead of the stored
+// strings. Rows are streamed as they are read, history in pages of
+// exportPageSize per sensor or gate.
+//
+//	csv      One header row, empty cells for missing values
+//	ndjson   One JSON object per line
+//	geojson  A FeatureCollection of Points (null geometry if the location is
+//	         unknown), every other column is a property
+//
+// The status is sent before the rows are read, so an export that fails
+// midway cannot change it. It ends with a marker instead: a last CSV row
+// with the error as its only cell, a last NDJSON line {"error": "..."}, and
+// a GeoJSON FeatureCollection left unterminated. Complete CSV rows always
+// have every column and complete GeoJSON always parses.
+
+// Export formats
+const (
+	exportCSV     = "csv"
+	exportNDJSON  = "ndjson"
+	exportGeoJSON = "geojson"
+)
+
+// History entries read per store query
+const exportPageSize = 1000
+
+var exportContentTypes = map[string]string{
+	exportCSV:     "text/csv",
+	exportNDJSON:  "application/x-ndjson",
+	exportGeoJSON: "application/geo+json",
+}
+
+// Columns of each export; lon and lat are the GeoJSON geometry
+var (
+	latestExportColumns = []string{
+		"farm_id", "sensor_id", "type", "zone", "gate_id", "timestamp", "time",
+		"value", "unit", "raw_value", "temperature", "calibrated", "lon", "lat",
+	}
+	historyExportColumns = []string{
+		"farm_id", "sensor_id", "type", "zone", "gate_id", "timestamp", "time",
+		"value", "unit", "raw_value", "lon", "lat",
+	}
+	gateExportColumns = []string{
+		"farm_id", "gate_id", "timestamp", "time", "event", "status", "command",
+		"action", "reason", "source", "key_id", "lon", "lat",
+	}
+)
+
+// exportQuery holds the format and filters of an export
+type exportQuery struct {
+	Format     string
+	Range      timeRange
+	SensorType string
+	Zone       string
+	SensorIDs  map[int]bool // Empty means all
+	GateIDs    map[int]bool
+}
+
+// parseExportQuery reads ?format=&from=&to=&type=&zone=&sensor=&gate=.
+// sensor and gate take comma-separated IDs.
+func parseExportQuery(c *fiber.Ctx) (exportQuery, error) {
+	q := exportQuery{
+		Format:     c.Query("format", exportCSV),
+		SensorType: c.Query("type"),
+		Zone:       c.Query("zone"),
+	}
+	if _, ok := exportContentTypes[q.Format]; !ok {
+		return q, fmt.Errorf("format must be %s, %s or %s", exportCSV, exportNDJSON, exportGeoJSON)
+	}
+
+	var err error
+	if q.Range, err = parseTimeRange(c); err != nil {
+		return q, err
+	}
+	if q.SensorIDs, err = parseIDList(c.Query("sensor")); err != nil {
+		return q, fmt.Errorf("invalid sensor: %w", err)
+	}
+	if q.GateIDs, err = parseIDList(c.Query("gate")); err != nil {
+		return q, fmt.Errorf("invalid gate: %w", err)
+	}
+	return q, nil
+}
+
+// parseIDList reads comma-separated IDs
+func parseIDList(value string) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	if value == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ID", part)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// ============================================================================
+// EXPORT WRITER
+// ============================================================================
+
+// exportWriter writes rows of typed values (nil, string, int, int64,
+// float64 or bool) in one of the export formats
+type exportWriter struct {
+	format  string
+	w       *bufio.Writer
+	csv     *csv.Writer
+	columns []string
+	lon     int // Column indexes of the location
+	lat     int
+	rows    int
+}
+
+// newExportWriter writes the CSV header or the FeatureCollection opening
+func newExportWriter(format, name string, w *bufio.Writer, columns []string) (*exportWriter, error) {
+	e := &exportWriter{format: format, w: w, columns: columns, lon: -1, lat: -1}
+	for i, column := range columns {
+		switch column {
+		case "lon":
+			e.lon = i
+		case "lat":
+			e.lat = i
+		}
+	}
+
+	switch format {
+	case exportCSV:
+		e.csv = csv.NewWriter(w)
+		return e, e.csv.Write(columns)
+	case exportGeoJSON:
+		encodedName, _ := json.Marshal(name)
+		_, err := fmt.Fprintf(w, `{"type":"FeatureCollection","name":%s,"features":[`, encodedName)
+		return e, err
+	}
+	return e, nil
+}
+
+func (e *exportWriter) write(values []interface{}) error {
+	e.rows++
+	switch e.format {
+	case exportCSV:
+		cells := make([]string, len(values))
+		for i, value := range values {
+			cells[i] = exportCell(value)
+		}
+		return e.csv.Write(cells)
+	case exportNDJSON:
+		if err := e.writeObject(values, false); err != nil {
+			return err
+		}
+		return e.w.WriteByte('\n')
+	}
+
+	if e.rows > 1 {
+		e.w.WriteByte(',')
+	}
+	e.w.WriteString(`{"type":"Feature","properties":`)
+	if err := e.writeObject(values, true); err != nil {
+		return err
+	}
+	lon, lonOK := values[e.lon].(float64)
+	lat, latOK := values[e.lat].(float64)
+	var err error
+	if lonOK && latOK {
+		_, err = fmt.Fprintf(e.w, `,"geometry":{"type":"Point","coordinates":[%s,%s]}}`, formatFloat(lon), formatFloat(lat))
+	} else {
+		_, err = e.w.WriteString(`,"geometry":null}`)
+	}
+	return err // bufio.Writer keeps the first error, so this is any of the row's
+}
+
+// writeObject writes a row as a JSON object with the columns in order,
+// without the location for GeoJSON properties
+func (e *exportWriter) writeObject(values []interface{}, skipLocation bool) error {
+	e.w.WriteByte('{')
+	first := true
+	for i, value := range values {
+		if skipLocation && (i == e.lon || i == e.lat) {
+			continue
+		}
+		if !first {
+			e.w.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(e.columns[i])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", e.columns[i], err)
+		}
+		e.w.Write(key)
+		e.w.WriteByte(':')
+		e.w.Write(data)
+	}
+	return e.w.WriteByte('}')
+}
+
+// close ends a complete export
+func (e *exportWriter) close() error {
+	switch e.format {
+	case exportCSV:
+		e.csv.Flush()
+		return e.csv.Error()
+	case exportGeoJSON:
+		_, err := e.w.WriteString("]}")
+		return err
+	}
+	return nil
+}
+
+// abort ends an export that failed midway with the error marker of its
+// format, see the top of the file
+func (e *exportWriter) abort(err error) {
+	switch e.format {
+	case exportCSV:
+		e.csv.Write([]string{"export failed: " + err.Error()})
+		e.csv.Flush()
+	case exportNDJSON:
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		e.w.Write(data)
+		e.w.WriteByte('\n')
+	}
+}
+
+// exportCell formats a value for CSV
+func exportCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return formatFloat(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// stringOrNil leaves empty fields out of JSON
+func stringOrNil(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// exportTime formats a unix timestamp for spreadsheets
+func exportTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// streamExport sends a streamed export, rows is called once the response
+// has started so errors can only be logged and marked in the body. The
+// handler has returned by then, so rows gets a context of its own.
+func streamExport(c *fiber.Ctx, q exportQuery, name string, columns []string, rows func(context.Context, *exportWriter) error) error {
+	c.Set(fiber.HeaderContentType, exportContentTypes[q.Format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, name, q.Format))
+	ctx, cancel := streamContext(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		e, err := newExportWriter(q.Format, name, w, columns)
+		if err == nil {
+			err = rows(ctx, e)
+		}
+		if err == nil {
+			err = e.close()
+		} else {
+			e.abort(err)
+		}
+		if err != nil {
+			log.Printf("❌ Export %s stopped after %d rows: %v", name, e.rows, err)
+		}
+	})
+	return nil
+}
+
+// ============================================================================
+// EXPORTED SENSORS
+// ============================================================================
+
+// exportSensor is a sensor selected for an export
+type exportSensor struct {
+	ID       int
+	Type     string
+	Zone     string
+	GateID   int
+	Lon, Lat interface{} // nil if unknown
+	Latest   map[string]string
+}
+
+// exportSensors selects the reporting and registered sensors matching the
+// sensor, type and zone filters, by sensor ID. Only registered sensors have
+// a zone.
+func (h *APIHandlers) exportSensors(ctx context.Context, farm string, q exportQuery) ([]exportSensor, error) {
+	sensorIDs, err := h.store.getAllSensors(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := h.devicesByID(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := h.layout.layers(farm)
+	if err != nil {
+		return nil, err
+	}
+	centroids := gateCentroids(layers)
+
+	seen := make(map[int]bool)
+	ids := []int{}
+	for _, raw := range sensorIDs {
+		if id, err := strconv.Atoi(raw); err == nil && !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	for id := range devices {
+		if !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	sort.Ints(ids)
+
+	if len(q.SensorIDs) > 0 {
+		selected := ids[:0]
+		for _, id := range ids {
+			if q.SensorIDs[id] {
+				selected = append(selected, id)
+			}
+		}
+		ids = selected
+	}
+	latest, err := h.store.getLatestReadings(ctx, farm, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := []exportSensor{}
+	for _, id := range ids {
+		sensor := exportSensor{ID: id, Latest: latest[id]}
+		if device, ok := devices[id]; ok {
+			sensor.Type = device.Type
+			sensor.Zone, sensor.GateID, _ = deviceZone(device, centroids)
+			sensor.Lon, sensor.Lat = device.Lon, device.Lat
+		} else {
+			sensor.Type = sensor.Latest["type"]
+			sensor.Lon, sensor.Lat = parseFloatOrNil(sensor.Latest["lon"]), parseFloatOrNil(sensor.Latest["lat"])
+			if sensor.Lon == 0.0 && sensor.Lat == 0.0 {
+				sensor.Lon, sensor.Lat = nil, nil // No usable location
+			}
+		}
+		if q.SensorType != "" && sensor.Type != q.SensorType {
+			continue
+		}
+		if q.Zone != "" && sensor.Zone != q.Zone {
+			continue
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors, nil
+}
+
+// zoneOrNil and gateOrNil leave unknown zones empty
+func (s exportSensor) zoneOrNil() interface{} {
+	if s.Zone == "" {
+		return nil
+	}
+	return s.Zone
+}
+
+func (s exportSensor) gateOrNil() interface{} {
+	if s.GateID == 0 {
+		return nil
+	}
+	return s.GateID
+}
+
+// ============================================================================
+// EXPORT HTTP HANDLERS
+// ============================================================================
+
+// GET /api/farms/:farm/export/latest?format=csv|ndjson|geojson&type=&zone=&sensor=&from=&to=
+//
+// The latest reading of every matching sensor; from and to select by the
+// reading's timestamp.
+func (h *APIHandlers) exportLatest(c *fiber.Ctx) error {
+	q, err := parseExportQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	farm := farmOf(c)
+	sensors, err := h.exportSensors(c.UserContext(), farm, q)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return streamExport(c, q, farm+"-latest", latestExportColumns, func(_ context.Context, e *exportWriter) error {
+		for _, sensor := range sensors {
+			latest := sensor.Latest
+			timestamp, err := strconv.ParseInt(latest["timestamp"], 10, 64)
+			if err != nil || !q.Range.contains(timestamp) {
+				continue // Never reported, or outside the range
+			}
+			var calibrated interface{}
+			if latest["calibrated"] != "" {
+				calibrated = latest["calibrated"] == "1"
+			}
+			err = e.write([]interface{}{
+				farm, sensor.ID, sensor.Type, sensor.zoneOrNil(), sensor.gateOrNil(), timestamp, exportTime(timestamp),
+				parseFloatOrNil(latest["value"]), latest["unit"], parseFloatOrNil(latest["raw_value"]),
+				parseFloatOrNil(latest["temperature"]), calibrated, sensor.Lon, sensor.Lat,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GET /api/farms/:farm/export/history?format=csv|ndjson|geojson&type=&zone=&sensor=&from=&to=
+//
+// The stored history of every matching sensor, sensor by sensor and newest
+// first. Redis and the memory store keep the last 1000 readings per sensor.
+func (h *APIHandlers) exportHistory(c *fiber.Ctx) error {
+	q, err := parseExportQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	farm := farmOf(c)
+	sensors, err := h.exportSensors(c.UserContext(), farm, q)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	store := h.store
+	return streamExport(c, q, farm+"-history", historyExportColumns, func(ctx context.Context, e *exportWriter) error {
+		for _, sensor := range sensors {
+			unit := sensor.Latest["unit"]
+			for offset := int64(0); ; offset += exportPageSize {
+				entries, err := store.querySensorHistory(ctx, farm, sensor.ID, q.Range, offset, exportPageSize)
+				if err != nil {
+					return fmt.Errorf("sensor %d: %w", sensor.ID, err)
+				}
+				for _, raw := range entries {
+					var entry historyEntry
+					if json.Unmarshal([]byte(raw), &entry) != nil {
+						continue
+					}
+					var value, rawValue interface{}
+					if entry.Value != nil {
+						value = *entry.Value
+					}
+					if entry.RawValue != nil {
+						rawValue = *entry.RawValue
+					}
+					err := e.write([]interface{}{
+						farm, sensor.ID, sensor.Type, sensor.zoneOrNil(), sensor.gateOrNil(), entry.Timestamp,
+						exportTime(entry.Timestamp), value, unit, rawValue, sensor.Lon, sensor.Lat,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				if len(entries) < exportPageSize {
+					break
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GET /api/farms/:farm/export/gates?format=csv|ndjson|geojson&gate=&zone=&from=&to=
+//
+// The audit trail of every matching gate, gate by gate and newest first.
+// zone selects the gates irrigating that zone; locations are the gate
+// centroids of the layout.
+func (h *APIHandlers) exportGateHistory(c *fiber.Ctx) error {
+	q, err := parseExportQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	farm := farmOf(c)
+	gateIDs, err := h.store.getAllGates(c.UserContext(), farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	layers, err := h.layout.layers(farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	centroids := gateCentroids(layers)
+
+	var zoneGates map[int]bool
+	if q.Zone != "" {
+		devices, err := h.devicesByID(c.UserContext(), farm)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		zoneGates = make(map[int]bool)
+		for _, device := range devices {
+			if name, gateID, _ := deviceZone(device, centroids); name == q.Zone && gateID != 0 {
+				zoneGates[gateID] = true
+			}
+		}
+	}
+
+	ids := []int{}
+	for _, raw := range gateIDs {
+		id, err := strconv.Atoi(raw)
+		if err != nil || (len(q.GateIDs) > 0 && !q.GateIDs[id]) || (zoneGates != nil && !zoneGates[id]) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	store := h.store
+	return streamExport(c, q, farm+"-gates", gateExportColumns, func(ctx context.Context, e *exportWriter) error {
+		for _, gateID := range ids {
+			var lon, lat interface{}
+			if position, ok := centroids[gateID]; ok {
+				lon, lat = position[0], position[1]
+			}
+			for offset := int64(0); ; offset += exportPageSize {
+				items, err := store.queryGateHistory(ctx, farm, gateID, q.Range, offset, exportPageSize)
+				if err != nil {
+					return fmt.Errorf("gate %d: %w", gateID, err)
+				}
+				for _, raw := range items {
+					var event GateEvent
+					if json.Unmarshal([]byte(raw), &event) != nil {
+						continue
+					}
+					err := e.write([]interface{}{
+						farm, gateID, event.Timestamp, exportTime(event.Timestamp), event.Type,
+						stringOrNil(event.Status), stringOrNil(event.Command), stringOrNil(event.Action),
+						stringOrNil(event.Reason), stringOrNil(event.Source), stringOrNil(event.KeyID), lon, lat,
+					})
+					if err != nil {
+						return err
+					}
+				}
+				if len(items) < exportPageSize {
+					break
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// exportFeatureCollection is a GeoJSON export
+type exportFeatureCollection struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Features []struct {
+		Type       string                 `json:"type"`
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   *struct {
+			Type        string    `json:"type"`
+			Coordinates []float64 `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+// parseExportCSV returns the rows of a CSV export by column name
+func parseExportCSV(t *testing.T, body []byte, columns []string) []map[string]string {
+	t.Helper()
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v\n%.500s", err, body)
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(columns, ",") {
+		t.Fatalf("CSV header is %v, want %v", records, columns)
+	}
+	rows := []map[string]string{}
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, column := range columns {
+			row[column] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// parseExportNDJSON returns the objects of an NDJSON export
+func parseExportNDJSON(t *testing.T, body []byte, columns []string) []map[string]interface{} {
+	t.Helper()
+	rows := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("parse NDJSON line %q: %v", line, err)
+		}
+		if len(row) != len(columns) {
+			t.Fatalf("NDJSON row %v, want the columns %v", row, columns)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// parseExportGeoJSON returns the FeatureCollection of a GeoJSON export
+func parseExportGeoJSON(t *testing.T, body []byte, columns []string) exportFeatureCollection {
+	t.Helper()
+	var collection exportFeatureCollection
+	if err := json.Unmarshal(body, &collection); err != nil {
+		t.Fatalf("parse GeoJSON: %v\n%.500s", err, body)
+	}
+	if collection.Type != "FeatureCollection" {
+		t.Fatalf("GeoJSON type is %q", collection.Type)
+	}
+	for _, feature := range collection.Features {
+		if feature.Type != "Feature" || len(feature.Properties) != len(columns)-2 {
+			t.Fatalf("GeoJSON feature %+v, want the columns %v but lon and lat", feature, columns)
+		}
+		if feature.Geometry != nil && (feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) != 2) {
+			t.Fatalf("GeoJSON geometry is %+v", feature.Geometry)
+		}
+	}
+	return collection
+}
+
+func TestExportFormats(t *testing.T) {
+	sensorID, gateID := server.moisture[0], server.gates[0]
+	var latest map[string]string
+	server.do(t, "GET", fmt.Sprintf("/api/farms/default/sensors/%d/latest", sensorID), nil).json(t, &latest)
+
+	tests := []struct {
+		name    string
+		path    string
+		columns []string
+		rows    int // 0: at least one
+		key     string
+	}{
+		{"latest", "/api/farms/default/export/latest?", latestExportColumns, 0, "sensor_id"},
+		{"latest of a sensor", fmt.Sprintf("/api/farms/default/export/latest?sensor=%d&", sensorID), latestExportColumns, 1, "sensor_id"},
+		{"history of a sensor", fmt.Sprintf("/api/farms/default/export/history?sensor=%d&", sensorID), historyExportColumns, 4, "sensor_id"},
+		{"gates", fmt.Sprintf("/api/farms/default/export/gates?gate=%d&", gateID), gateExportColumns, 0, "gate_id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := server.do(t, "GET", test.path+"format=csv", nil)
+			expect(t, resp, 200)
+			csvRows := parseExportCSV(t, resp.body, test.columns)
+			resp = server.do(t, "GET", test.path+"format=ndjson", nil)
+			expect(t, resp, 200)
+			ndjsonRows := parseExportNDJSON(t, resp.body, test.columns)
+			resp = server.do(t, "GET", test.path+"format=geojson", nil)
+			expect(t, resp, 200)
+			features := parseExportGeoJSON(t, resp.body, test.columns).Features
+
+			if len(csvRows) == 0 || (test.rows > 0 && len(csvRows) != test.rows) {
+				t.Fatalf("%d CSV rows, want %d", len(csvRows), test.rows)
+			}
+			if len(ndjsonRows) != len(csvRows) || len(features) != len(csvRows) {
+				t.Fatalf("%d CSV rows, %d NDJSON rows and %d GeoJSON features", len(csvRows), len(ndjsonRows), len(features))
+			}
+
+			// The formats agree row by row, typed in JSON
+			for i, row := range csvRows {
+				for _, column := range test.columns {
+					var value interface{} = ndjsonRows[i][column]
+					if column != "lon" && column != "lat" && features[i].Properties[column] != value {
+						t.Errorf("row %d %s is %v in NDJSON and %v in GeoJSON", i, column, value, features[i].Properties[column])
+					}
+					if cell := exportCell(value); cell != row[column] {
+						t.Errorf("row %d %s is %q in CSV and %v in NDJSON", i, column, row[column], value)
+					}
+				}
+				if _, ok := ndjsonRows[i][test.key].(float64); !ok {
+					t.Errorf("row %d %s is %v, want a number", i, test.key, ndjsonRows[i][test.key])
+				}
+				lon, lat := ndjsonRows[i]["lon"], ndjsonRows[i]["lat"]
+				if geometry := features[i].Geometry; (geometry == nil) != (lon == nil || lat == nil) ||
+					(geometry != nil && (geometry.Coordinates[0] != lon || geometry.Coordinates[1] != lat)) {
+					t.Errorf("row %d geometry is %+v for lon %v, lat %v", i, geometry, lon, lat)
+				}
+			}
+
+			if test.name == "latest of a sensor" && (csvRows[0]["value"] != latest["value"] || csvRows[0]["timestamp"] != latest["timestamp"]) {
+				t.Errorf("latest reading exported as %v, is %v", csvRows[0], latest)
+			}
+		})
+	}
+}
+
+// failingHistoryStore fails the history queries of one sensor
+type failingHistoryStore struct {
+	Store
+	sensorID int
+}
+
+func (s failingHistoryStore) querySensorHistory(ctx context.Context, farm string, sensorID int, span timeRange, offset, count int64) ([]string, error) {
+	if sensorID == s.sensorID {
+		return nil, errors.New("store went away")
+	}
+	return s.Store.querySensorHistory(ctx, farm, sensorID, span, offset, count)
+}
+
+func TestExportFailsMidway(t *testing.T) {
+	first, failing := server.moisture[0], server.moisture[1]
+	if failing < first {
+		first, failing = failing, first
+	}
+	handlers := newAPIHandlers(failingHistoryStore{server.store, failing}, newLayoutStore("../../edge/sensors"), nil, nil)
+	app := fiber.New()
+	app.Get("/api/farms/:farm/export/history", func(c *fiber.Ctx) error {
+		c.Locals("farm", c.Params("farm"))
+		return handlers.exportHistory(c)
+	})
+	export := func(format string) []byte {
+		t.Helper()
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/farms/default/export/history?sensor=%d,%d&format=%s", first, failing, format), nil)
+		resp, err := app.Test(req, int(time.Minute/time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		return body
+	}
+
+	// The rows read before the error are sent, then the marker
+	body := export(exportCSV)
+	reader := csv.NewReader(bytes.NewReader(body))
+	rows := 0
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if !errors.Is(err, csv.ErrFieldCount) {
+				t.Errorf("parsing the failed CSV export: %v, want %v", err, csv.ErrFieldCount)
+			}
+			break
+		}
+		if rows > 0 && record[1] != strconv.Itoa(first) {
+			t.Errorf("failed CSV export has a row of sensor %s", record[1])
+		}
+		rows++
+	}
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if last := lines[len(lines)-1]; rows != 5 || last != "export failed: sensor "+strconv.Itoa(failing)+": store went away" {
+		t.Errorf("failed CSV export has %d records and ends with %q, want the header, 4 rows and the error", rows, last)
+	}
+
+	lines = strings.Split(strings.TrimSuffix(string(export(exportNDJSON)), "\n"), "\n")
+	var marker map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &marker); err != nil || len(lines) != 5 ||
+		!strings.Contains(fmt.Sprint(marker["error"]), "store went away") {
+		t.Errorf("failed NDJSON export has %d lines and ends with %q", len(lines), lines[len(lines)-1])
+	}
+
+	body = export(exportGeoJSON)
+	var collection exportFeatureCollection
+	if err := json.Unmarshal(body, &collection); err == nil {
+		t.Errorf("failed GeoJSON export parses: %.300s", body)
+	}
+	if !bytes.HasPrefix(body, []byte(`{"type":"FeatureCollection"`)) || bytes.Count(body, []byte(`"type":"Feature",`)) != 4 {
+		t.Errorf("failed GeoJSON export is %.500s", body)
+	}
+}
+
+// brokenConn fails every write, like a client that went away
+type brokenConn struct{}
+
+func (brokenConn) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestExportStopsOnWriteErrors(t *testing.T) {
+	row := []interface{}{"default", 1, moistureLayer, nil, nil, int64(1760000000), exportTime(1760000000), 41.5, "%", nil, 52.6, 32.7}
+	for _, format := range []string{exportCSV, exportNDJSON, exportGeoJSON} {
+		t.Run(format, func(t *testing.T) {
+			e, err := newExportWriter(format, "broken", bufio.NewWriterSize(brokenConn{}, 64), historyExportColumns)
+			for rows := 0; err == nil && rows < 100; rows++ {
+				err = e.write(row)
+			}
+			if err == nil {
+				t.Error("100 rows written to a closed connection without an error")
+			}
+
+			// Values JSON cannot hold are errors too, not empty fields
+			if format == exportCSV {
+				return
+			}
+			var out bytes.Buffer
+			e, _ = newExportWriter(format, "nan", bufio.NewWriter(&out), historyExportColumns)
+			nan := append([]interface{}{}, row...)
+			nan[7] = math.NaN()
+			if err := e.write(nan); err == nil {
+				t.Error("wrote a NaN value")
+			}
+		})
+	}
+}
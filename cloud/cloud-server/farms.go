@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// ============================================================================
+// FARMS (TENANTS)
+// ============================================================================
+
+// Every farm has its own namespace, so sensor and gate IDs only need to be
+// unique within a farm:
+//
+//	MQTT   farm/<farm>/sensors/<type>/<id>, farm/<farm>/gates/<id>/status, ...
+//	Redis  farm:<farm>:sensor:<id>:latest, farm:<farm>:sensors, ...
+//	API    /api/farms/<farm>/sensors, ...
+//
+// Messages on the old un-namespaced topics (farm/sensors/..., gates/+/status)
+// and the old /api/sensors style routes belong to the default farm.
+const defaultFarm = "default"
+
+var farmIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Second topic level of the old un-namespaced topics, not usable as farm IDs
+var legacyTopicKinds = map[string]bool{"sensors": true, "gates": true, "commands": true, "edge": true}
+
+// validateFarmID checks that a farm ID is a single topic level and can not
+// be mistaken for the old un-namespaced topics
+func validateFarmID(farm string) error {
+	if !farmIDPattern.MatchString(farm) {
+		return fmt.Errorf("invalid farm id %q, use 1-32 characters a-z, 0-9 and -", farm)
+	}
+	if legacyTopicKinds[farm] {
+		return fmt.Errorf("farm id %q is reserved", farm)
+	}
+	return nil
+}
+
+// farmKey builds a Redis key in a farm's namespace: farm:<farm>:<suffix>
+func farmKey(farm, format string, args ...interface{}) string {
+	return "farm:" + farm + ":" + fmt.Sprintf(format, args...)
+}
+
+// parseFarmTopic splits a topic into its farm and the farm-relative rest,
+// e.g. farm/north/sensors/soil-moisture-sensors/9001 →
+// ("north", "sensors/soil-moisture-sensors/9001")
+func parseFarmTopic(topic string) (string, string, bool) {
+	parts := strings.SplitN(topic, "/", 3)
+	if len(parts) == 3 && parts[0] == "gates" {
+		return defaultFarm, topic, true // Old edge gate status topic
+	}
+	if len(parts) < 3 || parts[0] != "farm" {
+		return "", "", false
+	}
+	if legacyTopicKinds[parts[1]] {
+		return defaultFarm, strings.TrimPrefix(topic, "farm/"), true
+	}
+	if validateFarmID(parts[1]) != nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// ============================================================================
+// FARM STORE (REDIS)
+// ============================================================================
+
+// Get all farms that have reported data
+func (r *RedisClient) getAllFarms(ctx context.Context) ([]string, error) {
+	return r.client.SMembers(ctx, "farms").Result()
+}
+
+// migrateLegacyKeys moves data stored before farms existed into the default
+// farm's namespace. Keys that already exist there are left alone.
+func (r *RedisClient) migrateLegacyKeys(ctx context.Context) error {
+	keys := []string{"sensors", "gates", "irrigation:queue", "decisions"}
+	for _, pattern := range []string{"sensor:*", "gate:*"} {
+		iter := r.client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	moved := 0
+	for _, key := range keys {
+		ok, err := r.client.RenameNX(ctx, key, farmKey(defaultFarm, "%s", key)).Result()
+		if err != nil {
+			if strings.Contains(err.Error(), "no such key") {
+				continue
+			}
+			return err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	if moved > 0 {
+		r.client.SAdd(ctx, "farms", defaultFarm)
+		log.Printf("✅ Moved %d keys into farm %q", moved, defaultFarm)
+	}
+	return nil
+}
+
+// ============================================================================
+// FARM SCOPE MIDDLEWARE
+// ============================================================================
+
+// farmScope selects the farm from the :farm route parameter and checks that
+// the caller may access it. Fiber reuses the parameter's memory for the next
+// request, so the farm is copied before stores and caches keep it.
+func farmScope(c *fiber.Ctx) error {
+	return scopeToFarm(c, utils.CopyString(c.Params("farm")))
+}
+
+// defaultFarmScope serves the old /api/sensors style routes from the
+// default farm
+func defaultFarmScope(c *fiber.Ctx) error {
+	return scopeToFarm(c, defaultFarm)
+}
+
+func scopeToFarm(c *fiber.Ctx, farm string) error {
+	if err := validateFarmID(farm); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if identity := currentIdentity(c); identity != nil && !identity.canAccessFarm(farm) {
+		return c.Status(403).JSON(fiber.Map{"error": "No access to farm " + farm})
+	}
+	c.Locals("farm", farm)
+	return c.Next()
+}
+
+// farmOf returns the farm selected by farmScope
+func farmOf(c *fiber.Ctx) string {
+	farm, _ := c.Locals("farm").(string)
+	return farm
+}
+
+// ============================================================================
+// FARM HTTP HANDLERS
+// ============================================================================
+
+// GET /api/farms (farms the caller can access, with sensor and gate counts)
+func (h *APIHandlers) listFarms(c *fiber.Ctx) error {
+	farmIDs, err := h.store.getAllFarms(c.UserContext())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	sort.Strings(farmIDs)
+
+	identity := currentIdentity(c)
+	farms := []fiber.Map{}
+	for _, farm := range farmIDs {
+		if identity != nil && !identity.canAccessFarm(farm) {
+			continue
+		}
+		sensorIDs, _ := h.store.getAllSensors(c.UserContext(), farm)
+		gateIDs, _ := h.store.getAllGates(c.UserContext(), farm)
+		farms = append(farms, fiber.Map{
+			"farm_id":       farm,
+			"total_sensors": len(sensorIDs),
+			"total_gates":   len(gateIDs),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"farms": farms,
+		"count": len(farms),
+	})
+}
+
+// registerFarmRoutes mounts the farm-scoped API on router. scope picks the
+// farm, either from the route or the default farm for the old routes.
+func registerFarmRoutes(router fiber.Router, scope fiber.Handler, h *APIHandlers) {
+	viewer := requireRole(roleViewer)
+	operator := requireRole(roleOperator)
+
+	router.Get("/sensors", viewer, scope, h.listSensors)
+	router.Get("/sensors/:id/latest", viewer, scope, h.getLatestReading)
+	router.Get("/sensors/:id/history", viewer, scope, h.getSensorHistory)
+
+	router.Get("/devices", viewer, scope, h.listDevices)
+	router.Get("/devices/export", viewer, scope, h.exportDevices)
+	router.Post("/devices/import", operator, scope, h.importDevices)
+	router.Get("/devices/calibrations", viewer, scope, h.exportCalibrations)
+	router.Post("/devices/calibrations", operator, scope, h.importCalibrations)
+	router.Post("/devices", operator, scope, h.createDevice)
+	router.Get("/devices/:id", viewer, scope, h.getDevice)
+	router.Put("/devices/:id", operator, scope, h.updateDevice)
+	router.Delete("/devices/:id", operator, scope, h.deleteDevice)
+
+	router.Get("/gates", viewer, scope, h.listGates)
+	router.Get("/gates/:id/status", viewer, scope, h.getGateStatus)
+	router.Get("/gates/:id/history", viewer, scope, h.getGateHistory)
+	router.Get("/gates/:id/duty-cycle", viewer, scope, h.getGateDutyCycle)
+
+	router.Get("/geo/layers", viewer, scope, h.listLayers)
+	router.Get("/geo/layers/:name", viewer, scope, h.getLayer)
+	router.Get("/geo/zones", viewer, scope, h.getZones)
+	router.Get("/geo/heatmap", viewer, scope, h.getHeatmap)
+	router.Get("/geo/surface", viewer, scope, h.getSurface)
+	router.Get("/geo/contours", viewer, scope, h.getContours)
+
+	router.Get("/decisions", viewer, scope, h.listDecisions)
+
+	router.Get("/irrigation/queue", viewer, scope, h.getIrrigationQueue)
+
+	router.Get("/stats", viewer, scope, h.getStats)
+
+	router.Get("/export/latest", viewer, scope, h.exportLatest)
+	router.Get("/export/history", viewer, scope, h.exportHistory)
+	router.Get("/export/gates", viewer, scope, h.exportGateHistory)
+
+	router.Get("/archive", viewer, scope, h.getArchiveManifest)
+	router.Get("/archive/download", viewer, scope, h.downloadArchive)
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// GEO API (FARM LAYOUT + LIVE STATE)
+// ============================================================================
+
+// The GeoJSON layout of the default farm lives in CLOUD_LAYERS_DIR, other
+// farms keep theirs in CLOUD_LAYERS_DIR/<farm>. Layers are served back with
+// the live state of every feature merged into its properties, so QGIS or
+// the dashboard can draw the field as it is right now.
+
+// Layers whose features are gates, numbered by "gate_id" or id % 1000
+// (3001 → gate 1)
+var gateLayers = map[string]bool{"water-gates": true, "water-gate-sensors": true}
+
+// Layer holding the soil moisture sensors used for zones and the heat map
+const moistureLayer = "soil-moisture-sensors"
+
+// LayoutStore caches the GeoJSON layout of each farm
+type LayoutStore struct {
+	dir   string
+	mu    sync.Mutex
+	farms map[string]map[string]FeatureCollection
+}
+
+func newLayoutStore(dir string) *LayoutStore {
+	return &LayoutStore{dir: dir, farms: make(map[string]map[string]FeatureCollection)}
+}
+
+// layers returns a farm's layers, loading them on first use. A farm
+// without a layout directory has no layers.
+func (l *LayoutStore) layers(farm string) (map[string]FeatureCollection, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if layers, ok := l.farms[farm]; ok {
+		return layers, nil
+	}
+
+	dir := l.dir
+	if farm != defaultFarm {
+		dir = filepath.Join(l.dir, farm)
+	}
+	layers := map[string]FeatureCollection{}
+	if _, err := os.Stat(dir); err == nil {
+		loaded, err := loadLayers(dir)
+		if err != nil {
+			return nil, err
+		}
+		layers = loaded
+	}
+
+	l.farms[farm] = layers
+	return layers, nil
+}
+
+// gateNumber returns the edge gate number of a gate feature
+func gateNumber(feature Feature) (int, bool) {
+	if gateID, ok := feature.Properties["gate_id"].(float64); ok && gateID > 0 {
+		return int(gateID), true
+	}
+	id, ok := featureID(feature)
+	if !ok || id%1000 == 0 {
+		return 0, false
+	}
+	return id % 1000, true
+}
+
+// ============================================================================
+// LAYER ENRICHMENT
+// ============================================================================
+
+// enrichLayer returns a copy of a layer with the latest reading, registry
+// status and reporting state of each device, and the state of each gate
+func (h *APIHandlers) enrichLayer(ctx context.Context, farm, name string, layer FeatureCollection) (FeatureCollection, error) {
+	isGateLayer := gateLayers[name]
+
+	var sensorIDs, gateIDs []int
+	for _, feature := range layer.Features {
+		if id, ok := featureID(feature); ok {
+			sensorIDs = append(sensorIDs, id)
+		}
+		if gateID, ok := gateNumber(feature); ok && isGateLayer {
+			gateIDs = append(gateIDs, gateID)
+		}
+	}
+
+	readings, err := h.store.getLatestReadings(ctx, farm, sensorIDs)
+	if err != nil {
+		return FeatureCollection{}, err
+	}
+	gates, err := h.store.getGateStatuses(ctx, farm, gateIDs)
+	if err != nil {
+		return FeatureCollection{}, err
+	}
+	devices, err := h.devicesByID(ctx, farm)
+	if err != nil {
+		return FeatureCollection{}, err
+	}
+
+	now := time.Now()
+	enriched := layer
+	enriched.Features = make([]Feature, 0, len(layer.Features))
+	for _, feature := range layer.Features {
+		properties := make(map[string]interface{}, len(feature.Properties)+8)
+		for key, value := range feature.Properties {
+			properties[key] = value
+		}
+
+		if id, ok := featureID(feature); ok && isPointGeometry(feature.Geometry) {
+			latest := readings[id]
+			device, registered := devices[id]
+			properties["state"] = sensorState(latest, registered, now)
+			if registered {
+				properties["status"] = device.Status
+			}
+			if latest != nil {
+				properties["value"] = parseFloatOrNil(latest["value"])
+				properties["unit"] = latest["unit"]
+				properties["timestamp"] = parseIntOrNil(latest["timestamp"])
+			}
+		}
+
+		if gateID, ok := gateNumber(feature); ok && isGateLayer {
+			properties["gate_id"] = gateID
+			properties["gate_status"] = "unknown"
+			if gate := gates[gateID]; gate != nil {
+				properties["gate_status"] = gate["status"]
+				properties["gate_updated"] = parseIntOrNil(gate["timestamp"])
+			}
+		}
+
+		feature.Properties = properties
+		enriched.Features = append(enriched.Features, feature)
+	}
+	return enriched, nil
+}
+
+// devicesByID returns a farm's registry keyed by sensor ID
+func (h *APIHandlers) devicesByID(ctx context.Context, farm string) (map[int]Device, error) {
+	devices, err := h.store.getAllDevices(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]Device, len(devices))
+	for _, device := range devices {
+		byID[device.SensorID] = device
+	}
+	return byID, nil
+}
+
+func parseFloatOrNil(value string) interface{} {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return nil
+}
+
+func parseIntOrNil(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	return nil
+}
+
+// ============================================================================
+// MOISTURE SAMPLES
+// ============================================================================
+
+// moistureSample is one fresh soil moisture reading at a known location
+type moistureSample struct {
+	SensorID int
+	Lon      float64
+	Lat      float64
+	Value    float64
+}
+
+// moistureSamples collects the fresh soil moisture readings of a farm. The
+// location comes from the registry, or from the reading for unregistered
+// sensors. Retired devices and readings older than deviceSilentAfter are
+// left out.
+func (h *APIHandlers) moistureSamples(ctx context.Context, farm string, devices map[int]Device) ([]moistureSample, error) {
+	sensorIDs, err := h.store.getAllSensors(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(sensorIDs)+len(devices))
+	seen := make(map[int]bool)
+	for _, raw := range sensorIDs {
+		if id, err := strconv.Atoi(raw); err == nil && !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	for id, device := range devices {
+		if device.Type == moistureLayer && !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+
+	readings, err := h.store.getLatestReadings(ctx, farm, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	samples := []moistureSample{}
+	for id, latest := range readings {
+		if latest["type"] != moistureLayer {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(latest["timestamp"], 10, 64)
+		if err != nil || now.Sub(time.Unix(timestamp, 0)) > deviceSilentAfter {
+			continue
+		}
+		value, err := strconv.ParseFloat(latest["value"], 64)
+		if err != nil {
+			continue
+		}
+
+		sample := moistureSample{SensorID: id, Value: value}
+		if device, ok := devices[id]; ok {
+			if device.Status == deviceRetired {
+				continue
+			}
+			sample.Lon, sample.Lat = device.Lon, device.Lat
+		} else {
+			sample.Lon, _ = strconv.ParseFloat(latest["lon"], 64)
+			sample.Lat, _ = strconv.ParseFloat(latest["lat"], 64)
+			if sample.Lon == 0 && sample.Lat == 0 {
+				continue // No usable location
+			}
+		}
+		samples = append(samples, sample)
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].SensorID < samples[j].SensorID })
+	return samples, nil
+}
+
+// ============================================================================
+// ZONES
+// ============================================================================
+
+// zone groups the soil moisture sensors irrigated by one gate
+type zone struct {
+	Name       string
+	GateID     int
+	Assignment string // registry or nearest_gate
+	Points     [][]float64
+	Sensors    []int
+	Values     []float64
+}
+
+// buildZones assigns every soil moisture sensor to a zone: the registry
+// zone or gate if set, otherwise the nearest gate of the layout
+func buildZones(devices map[int]Device, gateCentroids map[int][]float64, samples []moistureSample) []*zone {
+	values := make(map[int]float64, len(samples))
+	for _, sample := range samples {
+		values[sample.SensorID] = sample.Value
+	}
+
+	zones := make(map[string]*zone)
+	ids := make([]int, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		device := devices[id]
+		if device.Type != moistureLayer || device.Status == deviceRetired {
+			continue
+		}
+
+		name, gateID, assignment := deviceZone(device, gateCentroids)
+		if name == "" {
+			continue // No gate on the layout
+		}
+
+		z, ok := zones[name]
+		if !ok {
+			z = &zone{Name: name, GateID: gateID, Assignment: assignment}
+			zones[name] = z
+		}
+		if z.GateID == 0 {
+			z.GateID = gateID
+		}
+		z.Points = append(z.Points, []float64{device.Lon, device.Lat})
+		z.Sensors = append(z.Sensors, id)
+		if value, ok := values[id]; ok {
+			z.Values = append(z.Values, value)
+		}
+	}
+
+	result := make([]*zone, 0, len(zones))
+	for _, z := range zones {
+		result = append(result, z)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// deviceZone returns the zone and gate of a device: the registry zone or
+// gate if set, otherwise the nearest gate of the layout. The name is empty
+// if there is neither.
+func deviceZone(device Device, gateCentroids map[int][]float64) (string, int, string) {
+	name, gateID, assignment := device.Zone, device.GateID, "registry"
+	if name == "" && gateID == 0 {
+		gateID = nearestGate(gateCentroids, device.Lon, device.Lat)
+		assignment = "nearest_gate"
+	}
+	if name == "" && gateID != 0 {
+		name = fmt.Sprintf("gate-%d", gateID)
+	}
+	return name, gateID, assignment
+}
+
+// gateCentroids returns the centroid of each gate of the layout
+func gateCentroids(layers map[string]FeatureCollection) map[int][]float64 {
+	centroids := make(map[int][]float64)
+	for name, layer := range layers {
+		if name != "water-gates" {
+			continue
+		}
+		for _, feature := range layer.Features {
+			gateID, ok := gateNumber(feature)
+			if !ok {
+				continue
+			}
+			if lon, lat, err := centroid(feature.Geometry); err == nil {
+				centroids[gateID] = []float64{lon, lat}
+			}
+		}
+	}
+	return centroids
+}
+
+// nearestGate returns the gate closest to a location, 0 if there is none
+func nearestGate(centroids map[int][]float64, lon, lat float64) int {
+	best, bestDistance := 0, math.Inf(1)
+	for gateID, position := range centroids {
+		distance := distanceMeters(lon, lat, position[0], position[1])
+		if distance < bestDistance || (distance == bestDistance && gateID < best) {
+			best, bestDistance = gateID, distance
+		}
+	}
+	return best
+}
+
+// zonePolygon returns the convex hull of a zone's sensors as a closed ring.
+// Zones with fewer than three distinct sensors get a small box around them.
+func zonePolygon(points [][]float64) [][]float64 {
+	hull := convexHull(points)
+	if len(hull) < 3 {
+		minLon, minLat, maxLon, maxLat := bounds(points)
+		pad := 1.0 / metersPerDegreeLat // ~1 m
+		minLon, minLat, maxLon, maxLat = minLon-pad, minLat-pad, maxLon+pad, maxLat+pad
+		hull = [][]float64{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}}
+	}
+	return append(hull, hull[0])
+}
+
+// convexHull returns the counter-clockwise hull of [lon, lat] points
+// (Andrew's monotone chain)
+func convexHull(points [][]float64) [][]float64 {
+	sorted := make([][]float64, len(points))
+	copy(sorted, points)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i][0] != sorted[j][0] {
+			return sorted[i][0] < sorted[j][0]
+		}
+		return sorted[i][1] < sorted[j][1]
+	})
+	if len(sorted) < 3 {
+		return sorted
+	}
+
+	cross := func(o, a, b []float64) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+	hull := make([][]float64, 0, 2*len(sorted))
+	for _, p := range sorted {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(sorted) - 2; i >= 0; i-- {
+		p := sorted[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// ============================================================================
+// GEO HTTP HANDLERS
+// ============================================================================
+
+// GET /api/farms/:farm/geo/layers (layer names with feature counts)
+func (h *APIHandlers) listLayers(c *fiber.Ctx) error {
+	layers, err := h.layout.layers(farmOf(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	names := make([]string, 0, len(layers))
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := []fiber.Map{}
+	for _, name := range names {
+		geometries := map[string]bool{}
+		for _, feature := range layers[name].Features {
+			geometries[feature.Geometry.Type] = true
+		}
+		types := make([]string, 0, len(geometries))
+		for geometry := range geometries {
+			types = append(types, geometry)
+		}
+		sort.Strings(types)
+
+		result = append(result, fiber.Map{
+			"name":       name,
+			"features":   len(layers[name].Features),
+			"geometries": types,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"farm_id": farmOf(c),
+		"layers":  result,
+		"count":   len(result),
+	})
+}
+
+// GET /api/farms/:farm/geo/layers/:name (GeoJSON with live state)
+func (h *APIHandlers) getLayer(c *fiber.Ctx) error {
+	farm := farmOf(c)
+	layers, err := h.layout.layers(farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	name := c.Params("name")
+	layer, ok := layers[name]
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "Layer not found"})
+	}
+
+	enriched, err := h.enrichLayer(c.UserContext(), farm, name, layer)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/geo+json")
+	return c.JSON(enriched)
+}
+
+// GET /api/farms/:farm/geo/zones?method=idw|kriging (zone polygons with
+// aggregate moisture and the estimate from the moisture surface)
+func (h *APIHandlers) getZones(c *fiber.Ctx) error {
+	options, err := parseSurfaceOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	farm := farmOf(c)
+	layers, err := h.layout.layers(farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	devices, err := h.devicesByID(c.UserContext(), farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	samples, err := h.moistureSamples(c.UserContext(), farm, devices)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	zones := buildZones(devices, gateCentroids(layers), samples)
+
+	// Without a surface (no fresh readings) zones only carry sensor statistics
+	var estimates map[string]fiber.Map
+	if grid, err := buildSurface(samples, options); err == nil {
+		estimates = zoneEstimates(grid, zones)
+	}
+
+	var gateIDs []int
+	for _, z := range zones {
+		if z.GateID > 0 {
+			gateIDs = append(gateIDs, z.GateID)
+		}
+	}
+	gates, err := h.store.getGateStatuses(c.UserContext(), farm, gateIDs)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	features := make([]fiber.Map, 0, len(zones))
+	for _, z := range zones {
+		properties := fiber.Map{
+			"zone":       z.Name,
+			"assignment": z.Assignment,
+			"sensors":    z.Sensors,
+			"reporting":  len(z.Values),
+		}
+		if z.GateID > 0 {
+			properties["gate_id"] = z.GateID
+			properties["gate_status"] = "unknown"
+			if gate := gates[z.GateID]; gate != nil {
+				properties["gate_status"] = gate["status"]
+			}
+		}
+		if len(z.Values) > 0 {
+			sum, low, high := 0.0, math.Inf(1), math.Inf(-1)
+			for _, value := range z.Values {
+				sum += value
+				low, high = math.Min(low, value), math.Max(high, value)
+			}
+			properties["mean_moisture"] = round2(sum / float64(len(z.Values)))
+			properties["min_moisture"] = round2(low)
+			properties["max_moisture"] = round2(high)
+		}
+		for key, value := range estimates[z.Name] {
+			properties[key] = value
+		}
+
+		features = append(features, fiber.Map{
+			"type":       "Feature",
+			"properties": properties,
+			"geometry": fiber.Map{
+				"type":        "Polygon",
+				"coordinates": [][][]float64{zonePolygon(z.Points)},
+			},
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/geo+json")
+	return c.JSON(fiber.Map{
+		"type":     "FeatureCollection",
+		"name":     farm + "-zones",
+		"features": features,
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// HEALTH, READINESS AND STARTUP
+// ============================================================================
+
+// The server starts serving HTTP right away and connects to the store and
+// the MQTT broker in the background, retrying with backoff, so it comes up
+// whatever starts first. /readyz answers 503 until both are connected and
+// whenever one of them is lost or ingestion lags; /healthz only fails when
+// ingestion is stalled, which a restart may fix.
+
+const (
+	pingTimeout     = 2 * time.Second  // Store ping of the probes
+	maxConnectDelay = 30 * time.Second // Longest wait between connection attempts
+	maxReadyLag     = 30 * time.Second // Ingest lag above which the server is not ready
+	maxHealthyLag   = 5 * time.Minute  // Ingest lag at which ingestion counts as stalled
+)
+
+// Health reports the state of the server's dependencies
+type Health struct {
+	store   Store
+	backend string
+	mqtt    *MQTTHandler
+	started time.Time
+	ready   atomic.Bool // Startup finished
+}
+
+func newHealth(store Store, backend string, mqttHandler *MQTTHandler) *Health {
+	return &Health{store: store, backend: backend, mqtt: mqttHandler, started: time.Now()}
+}
+
+// Wait after the first failed connection attempt, doubled after each one
+var firstConnectDelay = time.Second
+
+// retryWithBackoff calls connect until it succeeds, waiting 1s, 2s, 4s, ...
+// up to maxConnectDelay between attempts. It gives up when ctx is done.
+func retryWithBackoff(ctx context.Context, what string, connect func() error) error {
+	delay := firstConnectDelay
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("⚠️ %s unavailable (attempt %d): %v, retrying in %v", what, attempt, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, maxConnectDelay)
+	}
+}
+
+// startup prepares the store, seeds the registry, admin user and statistics,
+// then connects to the broker. Messages are only taken once the store works.
+// A shutdown (ctx done) stops it wherever it is.
+func startup(ctx context.Context, health *Health, config *Config, stats *Stats) {
+	err := retryWithBackoff(ctx, config.Store.Backend+" store", func() error {
+		if err := health.store.ping(ctx); err != nil {
+			return err
+		}
+		return health.store.prepare(ctx)
+	})
+	if err != nil {
+		return
+	}
+	log.Printf("✅ Connected to the %s store", config.Store.Backend)
+
+	seedRegistry(ctx, health.store, config.LayersDir)
+	bootstrapAdmin(ctx, health.store, config.AdminPassword)
+	stats.seed(ctx)
+
+	if err := retryWithBackoff(ctx, "MQTT broker "+config.MQTT.BrokerURL, health.mqtt.connect); err != nil {
+		return
+	}
+	health.ready.Store(true)
+	log.Println("✅ Ready")
+}
+
+// checks probes every dependency. ready tells whether to route traffic to
+// the server, healthy whether it is worth keeping alive.
+func (h *Health) checks(ctx context.Context) (checks fiber.Map, ready, healthy bool) {
+	ready, healthy = h.ready.Load(), true
+
+	store := fiber.Map{"backend": h.backend, "status": "up"}
+	start := time.Now()
+	if err := h.store.ping(ctx); err != nil {
+		store["status"], store["error"] = "down", err.Error()
+		ready = false
+	}
+	store["latency_ms"] = float64(time.Since(start).Microseconds()) / 1000
+
+	broker := fiber.Map{"broker": h.mqtt.broker, "status": "connected"}
+	if !h.mqtt.client.IsConnectionOpen() {
+		broker["status"] = "disconnected"
+		ready = false
+	}
+	if last := h.mqtt.lastMessage.Load(); last != 0 {
+		broker["last_message"] = time.Unix(0, last).Unix()
+		broker["last_message_age_seconds"] = time.Since(time.Unix(0, last)).Round(time.Millisecond).Seconds()
+	}
+
+	lag := h.mqtt.queue.lag()
+	ingest := fiber.Map{
+		"status":         "ok",
+		"lag_seconds":    lag.Round(time.Millisecond).Seconds(),
+		"queue_depth":    h.mqtt.queue.depth(),
+		"queue_capacity": h.mqtt.queue.capacity,
+	}
+	if lag > maxReadyLag {
+		ingest["status"] = "lagging"
+		ready = false
+	}
+	if lag > maxHealthyLag {
+		ingest["status"] = "stalled"
+		healthy = false
+	}
+
+	return fiber.Map{"store": store, "mqtt": broker, "ingest": ingest}, ready, healthy
+}
+
+// GET /healthz (liveness: 503 only when ingestion is stalled)
+func (h *Health) healthz(c *fiber.Ctx) error {
+	checks, ready, healthy := h.checks(c.UserContext())
+	status, code := "ok", 200
+	if !ready {
+		status = "degraded"
+	}
+	if !healthy {
+		status, code = "stalled", 503
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status":         status,
+		"started":        h.ready.Load(),
+		"uptime_seconds": int64(time.Since(h.started).Seconds()),
+		"checks":         checks,
+	})
+}
+
+// GET /readyz (readiness: 503 until started and while a dependency is down)
+func (h *Health) readyz(c *fiber.Ctx) error {
+	checks, ready, _ := h.checks(c.UserContext())
+	status, code := "ready", 200
+	if !ready {
+		status, code = "not_ready", 503
+	}
+	return c.Status(code).JSON(fiber.Map{
+		"status":  status,
+		"started": h.ready.Load(),
+		"checks":  checks,
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofiber/fiber/v2"
+)
+
+// pingStore is a store whose ping fails while err is set
+type pingStore struct {
+	Store
+	err error
+}
+
+func (s *pingStore) ping(ctx context.Context) error {
+	return s.err
+}
+
+// connectionState is an MQTT client that only reports its connection
+type connectionState struct {
+	mqtt.Client
+	open bool
+}
+
+func (c *connectionState) IsConnectionOpen() bool {
+	return c.open
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	saved := firstConnectDelay
+	firstConnectDelay = time.Millisecond
+	t.Cleanup(func() { firstConnectDelay = saved })
+
+	attempts := 0
+	err := retryWithBackoff(context.Background(), "test", func() error {
+		if attempts++; attempts < 4 {
+			return errors.New("refused")
+		}
+		return nil
+	})
+	if err != nil || attempts != 4 {
+		t.Errorf("retry returned %v after %d attempts, want success on the 4th", err, attempts)
+	}
+
+	// A shutdown ends the retries, even while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = retryWithBackoff(ctx, "test", func() error {
+		if attempts++; attempts == 3 {
+			cancel()
+		}
+		return errors.New("refused")
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 3 {
+		t.Errorf("cancelled retry returned %v after %d attempts", err, attempts)
+	}
+
+	firstConnectDelay = time.Hour
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := retryWithBackoff(ctx, "test", func() error { return errors.New("refused") }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("retry waiting past the deadline returned %v", err)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name      string
+		started   bool
+		storeErr  error
+		connected bool
+		lag       time.Duration
+		ready     int // /readyz status
+		healthy   int // /healthz status
+		ingest    string
+	}{
+		{"ready", true, nil, true, 0, 200, 200, "ok"},
+		{"starting", false, nil, true, 0, 503, 200, "ok"},
+		{"store down", true, errors.New("connection refused"), true, 0, 503, 200, "ok"},
+		{"broker disconnected", true, nil, false, 0, 503, 200, "ok"},
+		{"short lag", true, nil, true, maxReadyLag / 2, 200, 200, "ok"},
+		{"lagging", true, nil, true, maxReadyLag + time.Second, 503, 200, "lagging"},
+		{"stalled", true, nil, true, maxHealthyLag + time.Second, 503, 503, "stalled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &pingStore{Store: newMemoryStore(), err: test.storeErr}
+			handler := newTestHandler(t, store, 1, 10)
+			t.Cleanup(func() { closeQueue(t, handler.queue) })
+			handler.client = &connectionState{open: test.connected}
+			if test.lag > 0 {
+				handler.queue.storing[0].Store(time.Now().Add(-test.lag).UnixNano())
+			}
+			health := newHealth(store, storeMemory, handler)
+			health.ready.Store(test.started)
+
+			app := fiber.New()
+			app.Get("/healthz", health.healthz)
+			app.Get("/readyz", health.readyz)
+			probe := func(path string) (int, map[string]map[string]interface{}) {
+				resp, err := app.Test(httptest.NewRequest("GET", path, nil), -1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var body struct {
+					Checks map[string]map[string]interface{} `json:"checks"`
+				}
+				defer resp.Body.Close()
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				return resp.StatusCode, body.Checks
+			}
+
+			status, checks := probe("/readyz")
+			if status != test.ready {
+				t.Errorf("/readyz is %d, want %d (checks %v)", status, test.ready, checks)
+			}
+			if status, _ := probe("/healthz"); status != test.healthy {
+				t.Errorf("/healthz is %d, want %d", status, test.healthy)
+			}
+			if want := map[bool]string{true: "down", false: "up"}[test.storeErr != nil]; checks["store"]["status"] != want {
+				t.Errorf("store check is %v, want %s", checks["store"], want)
+			}
+			if want := map[bool]string{true: "connected", false: "disconnected"}[test.connected]; checks["mqtt"]["status"] != want {
+				t.Errorf("mqtt check is %v, want %s", checks["mqtt"], want)
+			}
+			if checks["ingest"]["status"] != test.ingest {
+				t.Errorf("ingest check is %v, want %s", checks["ingest"], test.ingest)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// AUDIT TRAIL
+// ============================================================================
+
+// Gate commands, state changes and edge decisions are kept in sorted sets
+// scored by unix timestamp, so they can be queried by time range. Keys are
+// in the farm namespace (farm:<farm>:...):
+//
+//	decisions          every edge decision event
+//	gate:<id>:history  commands, state changes and open/close decisions
+//	gate:<id>:states   state changes only (used for duty cycle)
+const maxAuditEvents = 100000
+
+// GateEvent is one entry in a gate's history
+type GateEvent struct {
+	Type      string `json:"type"` // "command", "state" or "decision"
+	GateID    int    `json:"gate_id"`
+	Timestamp int64  `json:"timestamp"`
+	Command   string `json:"command,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Source    string `json:"source,omitempty"`
+	KeyID     string `json:"key_id,omitempty"` // Signing key of a command
+}
+
+// GateCommandMessage is a command sent to a gate actuator
+type GateCommandMessage struct {
+	FarmID    string `json:"farm_id"`
+	GateID    int    `json:"gate_id"`
+	Command   string `json:"command"`
+	Action    string `json:"action"` // Used by older test tools instead of command
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	Timestamp int64  `json:"timestamp"`
+	KeyID     string `json:"key_id"`
+}
+
+// DutyCycleDay summarizes how long a gate was open on one day
+type DutyCycleDay struct {
+	Date             string  `json:"date"`
+	Openings         int     `json:"openings"`
+	OpenSeconds      float64 `json:"open_seconds"`
+	DutyCycle        float64 `json:"duty_cycle"`
+	MeanOpenDuration float64 `json:"mean_open_duration_seconds"`
+}
+
+// Store an event in a gate's history
+func (r *RedisClient) storeGateEvent(ctx context.Context, farm string, event GateEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	historyKey := farmKey(farm, "gate:%d:history", event.GateID)
+	pipe := r.client.Pipeline()
+	pipe.ZAdd(ctx, historyKey, &redis.Z{Score: float64(event.Timestamp), Member: data})
+	pipe.ZRemRangeByRank(ctx, historyKey, 0, -maxAuditEvents-1)
+	if event.Type == "state" {
+		statesKey := farmKey(farm, "gate:%d:states", event.GateID)
+		pipe.ZAdd(ctx, statesKey, &redis.Z{Score: float64(event.Timestamp), Member: data})
+		pipe.ZRemRangeByRank(ctx, statesKey, 0, -maxAuditEvents-1)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Query a time-ordered audit set, newest first
+func (r *RedisClient) queryAuditSet(ctx context.Context, key string, span timeRange, offset, count int64) ([]string, error) {
+	return r.client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:    scoreBound(span.From),
+		Max:    scoreBound(span.To),
+		Offset: offset,
+		Count:  count,
+	}).Result()
+}
+
+// scoreBound writes a range end as a sorted set score, unbounded as -inf/+inf
+func scoreBound(timestamp int64) string {
+	switch timestamp {
+	case allTime.From:
+		return "-inf"
+	case allTime.To:
+		return "+inf"
+	}
+	return strconv.FormatInt(timestamp, 10)
+}
+
+// Query a gate's history in a time range, newest first
+func (r *RedisClient) queryGateHistory(ctx context.Context, farm string, gateID int, span timeRange, offset, count int64) ([]string, error) {
+	return r.queryAuditSet(ctx, farmKey(farm, "gate:%d:history", gateID), span, offset, count)
+}
+
+// Get a gate's state changes in a time range (oldest first), plus the last
+// state change before the range
+func (r *RedisClient) getGateStates(ctx context.Context, farm string, gateID int, from, to int64) (*GateEvent, []GateEvent, error) {
+	key := farmKey(farm, "gate:%d:states", gateID)
+
+	before, err := r.client.ZRevRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   "(" + strconv.FormatInt(from, 10),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var initial *GateEvent
+	if len(before) > 0 {
+		var event GateEvent
+		if json.Unmarshal([]byte(before[0]), &event) == nil {
+			initial = &event
+		}
+	}
+
+	raw, err := r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from, 10),
+		Max: strconv.FormatInt(to, 10),
+	}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	states := make([]GateEvent, 0, len(raw))
+	for _, item := range raw {
+		var event GateEvent
+		if json.Unmarshal([]byte(item), &event) == nil {
+			states = append(states, event)
+		}
+	}
+	return initial, states, nil
+}
+
+// computeDutyCycle walks state changes and splits open time into days.
+// Openings are counted on the day the gate opened, and each open period
+// counts towards the mean duration of that day once it has closed.
+func computeDutyCycle(initialOpen bool, states []GateEvent, from, to time.Time) []DutyCycleDay {
+	days := []DutyCycleDay{}
+	closedPeriods := map[string]int{}
+	closedSeconds := map[string]float64{}
+
+	dayStart := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for day := dayStart; day.Before(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, DutyCycleDay{Date: day.Format("2006-01-02")})
+	}
+	index := map[string]int{}
+	for i, day := range days {
+		index[day.Date] = i
+	}
+
+	// addOpenTime spreads an open period over the days it covers
+	addOpenTime := func(start, end time.Time) {
+		for start.Before(end) {
+			next := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+			if next.After(end) {
+				next = end
+			}
+			if i, ok := index[start.Format("2006-01-02")]; ok {
+				days[i].OpenSeconds += next.Sub(start).Seconds()
+			}
+			start = next
+		}
+	}
+
+	isOpen := initialOpen
+	openedAt := from
+	for _, state := range states {
+		at := time.Unix(state.Timestamp, 0).In(from.Location())
+		nowOpen := state.Status == "open"
+
+		if nowOpen && !isOpen {
+			openedAt = at
+			if i, ok := index[at.Format("2006-01-02")]; ok {
+				days[i].Openings++
+			}
+		} else if !nowOpen && isOpen {
+			addOpenTime(openedAt, at)
+			key := openedAt.Format("2006-01-02")
+			closedPeriods[key]++
+			closedSeconds[key] += at.Sub(openedAt).Seconds()
+		}
+		isOpen = nowOpen
+	}
+	if isOpen {
+		addOpenTime(openedAt, to)
+	}
+
+	for i := range days {
+		start, _ := time.ParseInLocation("2006-01-02", days[i].Date, from.Location())
+		end := start.AddDate(0, 0, 1)
+		if end.After(to) {
+			end = to
+		}
+		if length := end.Sub(start).Seconds(); length > 0 {
+			days[i].DutyCycle = days[i].OpenSeconds / length
+		}
+		if n := closedPeriods[days[i].Date]; n > 0 {
+			days[i].MeanOpenDuration = closedSeconds[days[i].Date] / float64(n)
+		}
+	}
+	return days
+}
+
+// ============================================================================
+// AUDIT TRAIL HTTP HANDLERS
+// ============================================================================
+
+// auditQuery holds the common time-range and pagination parameters
+type auditQuery struct {
+	Range  timeRange
+	Limit  int
+	Offset int
+}
+
+// parseAuditQuery reads ?from=&to= (unix seconds) and ?limit=&offset=
+func parseAuditQuery(c *fiber.Ctx) (auditQuery, error) {
+	q := auditQuery{Limit: 100}
+
+	var err error
+	if q.Range, err = parseTimeRange(c); err != nil {
+		return q, err
+	}
+
+	q.Limit = c.QueryInt("limit", 100)
+	if q.Limit <= 0 || q.Limit > 1000 {
+		return q, fmt.Errorf("limit must be between 1 and 1000")
+	}
+	q.Offset = c.QueryInt("offset", 0)
+	if q.Offset < 0 {
+		return q, fmt.Errorf("offset must not be negative")
+	}
+	return q, nil
+}
+
+// parseTimeRange reads ?from=&to= (unix seconds), all time if not given
+func parseTimeRange(c *fiber.Ctx) (timeRange, error) {
+	span := allTime
+	if from := c.Query("from"); from != "" {
+		timestamp, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return span, fmt.Errorf("invalid from: %s", from)
+		}
+		span.From = timestamp
+	}
+	if to := c.Query("to"); to != "" {
+		timestamp, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return span, fmt.Errorf("invalid to: %s", to)
+		}
+		span.To = timestamp
+	}
+	return span, nil
+}
+
+// rawJSON decodes stored JSON members for the response
+func rawJSON(items []string) []json.RawMessage {
+	out := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		out = append(out, json.RawMessage(item))
+	}
+	return out
+}
+
+// GET /api/farms/:farm/gates/:id/history?from=&to=&limit=100&offset=0
+func (h *APIHandlers) getGateHistory(c *fiber.Ctx) error {
+	gateID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid gate id"})
+	}
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	items, err := h.store.queryGateHistory(c.UserContext(), farmOf(c), gateID, q.Range, int64(q.Offset), int64(q.Limit+1))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	hasMore := len(items) > q.Limit
+	if hasMore {
+		items = items[:q.Limit]
+	}
+	return c.JSON(fiber.Map{
+		"gate_id":  gateID,
+		"events":   rawJSON(items),
+		"count":    len(items),
+		"limit":    q.Limit,
+		"offset":   q.Offset,
+		"has_more": hasMore,
+	})
+}
+
+// GET /api/farms/:farm/decisions?from=&to=&gate=&action=&limit=100&offset=0
+//
+// gate and action filters are applied while paging through the time range,
+// so offset counts matching decisions.
+func (h *APIHandlers) listDecisions(c *fiber.Ctx) error {
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	gateFilter := c.QueryInt("gate", 0)
+	actionFilter := c.Query("action")
+	farm := farmOf(c)
+
+	const pageSize = 500
+	matches := []json.RawMessage{}
+	skipped := 0
+	for scanned := int64(0); len(matches) <= q.Limit; scanned += pageSize {
+		page, err := h.store.queryDecisions(c.UserContext(), farm, q.Range, scanned, pageSize)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		for _, item := range page {
+			if gateFilter != 0 || actionFilter != "" {
+				var decision DecisionMessage
+				if json.Unmarshal([]byte(item), &decision) != nil {
+					continue
+				}
+				if gateFilter != 0 && decision.GateID != gateFilter {
+					continue
+				}
+				if actionFilter != "" && decision.Action != actionFilter {
+					continue
+				}
+			}
+			if skipped < q.Offset {
+				skipped++
+				continue
+			}
+			matches = append(matches, json.RawMessage(item))
+			if len(matches) > q.Limit {
+				break
+			}
+		}
+
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	hasMore := len(matches) > q.Limit
+	if hasMore {
+		matches = matches[:q.Limit]
+	}
+	return c.JSON(fiber.Map{
+		"decisions": matches,
+		"count":     len(matches),
+		"limit":     q.Limit,
+		"offset":    q.Offset,
+		"has_more":  hasMore,
+	})
+}
+
+// GET /api/farms/:farm/gates/:id/duty-cycle?days=7
+func (h *APIHandlers) getGateDutyCycle(c *fiber.Ctx) error {
+	gateID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid gate id"})
+	}
+	days := c.QueryInt("days", 7)
+	if days <= 0 || days > 366 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be between 1 and 366"})
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from := today.AddDate(0, 0, -(days - 1))
+
+	initial, states, err := h.store.getGateStates(c.UserContext(), farmOf(c), gateID, from.Unix(), now.Unix())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	initialOpen := initial != nil && initial.Status == "open"
+
+	return c.JSON(fiber.Map{
+		"gate_id": gateID,
+		"days":    computeDutyCycle(initialOpen, states, from, now),
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// publishGateCycle opens gate 1 of farm at opened and closes it closed
+// seconds later on an edge command
+func publishGateCycle(farm string, opened, closed int64) {
+	server.publish("farm/"+farm+"/gates/1/status", GateStatusMessage{GateID: 1, Status: "open", IsOpen: true, Timestamp: opened})
+	server.publish("farm/"+farm+"/edge/decisions", DecisionMessage{
+		GateID: 1, Action: "close", Reason: "moisture above 70%", Source: "edge", Timestamp: closed,
+	})
+	server.publish("farm/"+farm+"/commands/water-gate-sensors/1", GateCommandMessage{
+		GateID: 1, Command: "close", Reason: "moisture above 70%", Source: "edge", Timestamp: closed,
+	})
+	server.publish("farm/"+farm+"/gates/1/status", GateStatusMessage{GateID: 1, Status: "closed", IsOpen: false, Timestamp: closed + 1})
+}
+
+func TestGateStatus(t *testing.T) {
+	farm := "gates-status"
+	now := time.Now().Unix()
+	publishGateCycle(farm, now-600, now-300)
+	server.publish("farm/"+farm+"/gates/2/status", GateStatusMessage{GateID: 2, Status: "open", IsOpen: true, Timestamp: now})
+
+	var gates struct {
+		Gates []map[string]string `json:"gates"`
+		Count int                 `json:"count"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates", nil).json(t, &gates)
+	if gates.Count != 2 {
+		t.Fatalf("listed %d gates, want 2", gates.Count)
+	}
+
+	var status map[string]string
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/status", nil).json(t, &status)
+	if status["status"] != "closed" || status["is_open"] != "0" || status["timestamp"] != fmt.Sprint(now-299) {
+		t.Errorf("gate 1 status is %v", status)
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/2/status", nil).json(t, &status)
+	if status["status"] != "open" || status["is_open"] != "1" {
+		t.Errorf("gate 2 status is %v", status)
+	}
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/gates/3/status", nil), 404)
+}
+
+func TestGateHistory(t *testing.T) {
+	farm := "gates-history"
+	now := time.Now().Unix()
+	publishGateCycle(farm, now-600, now-300)
+
+	var history struct {
+		Events  []GateEvent `json:"events"`
+		Count   int         `json:"count"`
+		HasMore bool        `json:"has_more"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/history", nil).json(t, &history)
+	var kinds []string
+	for _, event := range history.Events {
+		kinds = append(kinds, event.Type)
+	}
+	if fmt.Sprint(kinds) != "[state command decision state]" {
+		t.Errorf("events newest first are %v, want [state command decision state]", kinds)
+	}
+	if event := history.Events[1]; event.Command != "close" || event.Source != "edge" {
+		t.Errorf("command event is %+v", event)
+	}
+
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/history?limit=1&offset=1", nil).json(t, &history)
+	if history.Count != 1 || !history.HasMore || history.Events[0].Type != "command" {
+		t.Errorf("second page is %+v", history)
+	}
+
+	server.do(t, "GET", fmt.Sprintf("/api/farms/%s/gates/1/history?from=%d&to=%d", farm, now-700, now-500), nil).json(t, &history)
+	if history.Count != 1 || history.Events[0].Status != "open" {
+		t.Errorf("range before the close has %+v", history.Events)
+	}
+}
+
+func TestGateDutyCycle(t *testing.T) {
+	farm := "gates-duty"
+	// Today from 00:10 for 301 seconds, yesterday's state is unknown
+	today := time.Now().Truncate(time.Minute)
+	midnight := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+	opened := midnight.Add(10 * time.Minute).Unix()
+	if opened+301 > time.Now().Unix() {
+		t.Skip("too close to midnight")
+	}
+	publishGateCycle(farm, opened, opened+300)
+
+	var cycle struct {
+		Days []DutyCycleDay `json:"days"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/duty-cycle?days=2", nil).json(t, &cycle)
+	if len(cycle.Days) != 2 {
+		t.Fatalf("got %d days, want 2", len(cycle.Days))
+	}
+	if day := cycle.Days[0]; day.Openings != 0 || day.OpenSeconds != 0 {
+		t.Errorf("yesterday is %+v, want closed", day)
+	}
+	if day := cycle.Days[1]; day.Openings != 1 || day.OpenSeconds != 301 || day.MeanOpenDuration != 301 {
+		t.Errorf("today is %+v, want one opening of 301 s", day)
+	}
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/gates/1/duty-cycle?days=0", nil), 400)
+}
+
+func TestDecisionFilters(t *testing.T) {
+	farm := "decisions"
+	now := time.Now().Unix()
+	for i, decision := range []DecisionMessage{
+		{GateID: 1, Action: "open", Reason: "dry", Source: "edge"},
+		{GateID: 2, Action: "open", Reason: "dry", Source: "edge"},
+		{GateID: 1, Action: "close", Reason: "wet", Source: "edge"},
+		{GateID: 0, Action: "none", Reason: "no change", Source: "edge"},
+	} {
+		decision.Timestamp = now - 100 + int64(i)
+		server.publish("farm/"+farm+"/edge/decisions", decision)
+	}
+
+	var decisions struct {
+		Decisions []DecisionMessage `json:"decisions"`
+		Count     int               `json:"count"`
+		HasMore   bool              `json:"has_more"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/decisions", nil).json(t, &decisions)
+	if decisions.Count != 4 || decisions.Decisions[0].Action != "none" {
+		t.Errorf("decisions are %+v, want 4 newest first", decisions.Decisions)
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/decisions?gate=1", nil).json(t, &decisions)
+	if decisions.Count != 2 {
+		t.Errorf("gate 1 has %d decisions, want 2", decisions.Count)
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/decisions?action=open&limit=1", nil).json(t, &decisions)
+	if decisions.Count != 1 || !decisions.HasMore || decisions.Decisions[0].GateID != 2 {
+		t.Errorf("first open decision is %+v", decisions)
+	}
+
+	// Only decisions that act on a gate reach its history
+	var history struct {
+		Count int `json:"count"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/history", nil).json(t, &history)
+	if history.Count != 2 {
+		t.Errorf("gate 1 history has %d events, want 2", history.Count)
+	}
+}
+
+func TestGateHistorySkipsWaitingDecisions(t *testing.T) {
+	farm := "gates-history-waiting"
+	now := time.Now().Unix()
+	for i, action := range []string{"queue", "cooldown", "dequeue", "open"} {
+		server.publish("farm/"+farm+"/edge/decisions", DecisionMessage{
+			GateID: 1, Action: action, Reason: "test", Source: "scheduler", Timestamp: now - 100 + int64(i),
+		})
+	}
+
+	var history struct {
+		Events []GateEvent `json:"events"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/gates/1/history", nil).json(t, &history)
+	if len(history.Events) != 1 || history.Events[0].Action != "open" {
+		t.Errorf("gate history is %+v, want only the open decision", history.Events)
+	}
+
+	var decisions struct {
+		Count int `json:"count"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/decisions", nil).json(t, &decisions)
+	if decisions.Count != 4 {
+		t.Errorf("decision log has %d events, want all 4", decisions.Count)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ============================================================================
+// INGESTION PIPELINE
+// ============================================================================
+
+// MQTT messages are not stored on the MQTT client goroutine. The message
+// handler puts them on a bounded queue, sharded by topic so the readings of
+// one sensor stay in order, and a pool of workers stores them. A worker
+// takes everything waiting on its shard and stores the sensor readings of
+// each farm in one Redis round trip. Store errors are retried with backoff.
+// Messages that cannot be parsed, are rejected, keep failing or find the
+// queue full go to the dead-letter file and can be replayed.
+//
+//	CLOUD_INGEST_WORKERS    Workers (default 4)
+//	CLOUD_INGEST_QUEUE      Queued messages across all workers (default 10000)
+//	CLOUD_DEADLETTER_FILE   Dead-letter file (default deadletter.jsonl)
+
+// Dead-letter reasons
+const (
+	reasonUnparseable = "unparseable"  // Payload cannot be decoded
+	reasonRejected    = "rejected"     // Decoded but not acceptable, e.g. an unregistered compact sensor
+	reasonStoreFailed = "store_failed" // Redis kept failing
+	reasonQueueFull   = "queue_full"   // No room in the queue
+	reasonShutdown    = "shutdown"     // Arrived after the queue was closed or not stored before the shutdown deadline
+)
+
+const (
+	maxPipelineMessages = 256              // Messages a worker stores together
+	storeTimeout        = 10 * time.Second // Deadline of one store attempt
+)
+
+// Waits before retrying a failed store
+var retryDelays = []time.Duration{200 * time.Millisecond, time.Second, 5 * time.Second}
+
+// errFarmMismatch drops a message that names another farm than its topic
+var errFarmMismatch = errors.New("payload farm does not match topic")
+
+// ingestError marks a message that retrying will not fix
+type ingestError struct {
+	reason string
+	err    error
+}
+
+func (e *ingestError) Error() string { return e.err.Error() }
+func (e *ingestError) Unwrap() error { return e.err }
+
+func unparseable(err error) error { return &ingestError{reasonUnparseable, err} }
+func rejected(err error) error    { return &ingestError{reasonRejected, err} }
+
+// IngestConfig sizes the pipeline
+type IngestConfig struct {
+	Workers        int
+	QueueSize      int
+	DeadLetterFile string
+}
+
+// ingestItem is one queued MQTT message
+type ingestItem struct {
+	Topic    string
+	Payload  []byte
+	Received time.Time       // Arrival from the broker, kept through dead-lettering
+	Replayed time.Time       // When a dead letter was put back on the queue, zero otherwise
+	done     *sync.WaitGroup // Replays wait on it until the item is stored or dead-lettered again
+}
+
+// processed tells a replay waiting for the item that it is taken care of
+func (i ingestItem) processed() {
+	if i.done != nil {
+		i.done.Done()
+	}
+}
+
+// queued is when the item last entered the queue, for the lag and latency
+func (i ingestItem) queued() time.Time {
+	if !i.Replayed.IsZero() {
+		return i.Replayed
+	}
+	return i.Received
+}
+
+// sensorMessage is a parsed message from a sensors/ topic
+type sensorMessage struct {
+	item     ingestItem
+	batch    *SensorBatch // nil for a single reading
+	readings []SensorMessage
+}
+
+// IngestQueue is the bounded queue and its workers
+type IngestQueue struct {
+	handler     *MQTTHandler
+	shards      []chan ingestItem
+	capacity    int
+	deadLetters *DeadLetterStore
+	mutex       sync.RWMutex // Held for writing while closing
+	closed      bool
+	workers     sync.WaitGroup
+	storing     []atomic.Int64  // Per worker, receive time (Unix ns) of the oldest message it is storing
+	ctx         context.Context // Cancelled when draining runs past the shutdown deadline
+	cancel      context.CancelFunc
+}
+
+func newIngestQueue(handler *MQTTHandler, config IngestConfig) *IngestQueue {
+	q := &IngestQueue{
+		handler:     handler,
+		deadLetters: newDeadLetterStore(config.DeadLetterFile),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	perShard := max(1, config.QueueSize/config.Workers)
+	q.storing = make([]atomic.Int64, config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		shard := make(chan ingestItem, perShard)
+		q.shards = append(q.shards, shard)
+		q.capacity += perShard
+		q.workers.Add(1)
+		go q.work(shard, &q.storing[i])
+	}
+	log.Printf("✅ Ingestion queue: %d workers, %d messages", config.Workers, q.capacity)
+	return q
+}
+
+// registerMetrics exports the queue depth and capacity, once per process
+func (q *IngestQueue) registerMetrics() {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cloud_ingest_queue_depth",
+			Help: "MQTT messages waiting in the ingestion queue.",
+		}, func() float64 { return float64(q.depth()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "cloud_ingest_queue_capacity",
+			Help: "Size of the ingestion queue.",
+		}, func() float64 { return float64(q.capacity) }),
+	)
+}
+
+// depth counts the queued messages
+func (q *IngestQueue) depth() int {
+	depth := 0
+	for _, shard := range q.shards {
+		depth += len(shard)
+	}
+	return depth
+}
+
+// lag is the age of the oldest message a worker is storing, 0 when all
+// workers are idle. Queued messages are newer than those of their worker.
+func (q *IngestQueue) lag() time.Duration {
+	var lag time.Duration
+	for i := range q.storing {
+		if received := q.storing[i].Load(); received != 0 {
+			lag = max(lag, time.Since(time.Unix(0, received)))
+		}
+	}
+	return lag
+}
+
+// shardOf keeps every topic on one worker
+func (q *IngestQueue) shardOf(topic string) chan ingestItem {
+	hash := fnv.New32a()
+	hash.Write([]byte(topic))
+	return q.shards[hash.Sum32()%uint32(len(q.shards))]
+}
+
+// enqueue queues a message without waiting. It runs on the MQTT client
+// goroutine, so when the shard is full (the store is slow or down) the
+// message is dead-lettered at once rather than holding up the client.
+func (q *IngestQueue) enqueue(item ingestItem) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.closed {
+		q.deadLetter(item, reasonShutdown, errors.New("ingestion queue is closed"))
+		return
+	}
+
+	select {
+	case q.shardOf(item.Topic) <- item:
+	default:
+		q.deadLetter(item, reasonQueueFull, errors.New("no room in the ingestion queue"))
+	}
+}
+
+// enqueueWait queues a message, waiting for room until ctx is done. Only
+// for callers that may block, such as a dead-letter replay.
+func (q *IngestQueue) enqueueWait(ctx context.Context, item ingestItem) error {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.closed {
+		return errors.New("ingestion queue is closed")
+	}
+
+	select {
+	case q.shardOf(item.Topic) <- item:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops taking messages and waits until the workers have stored
+// everything that was queued. Once ctx is done the store calls in flight
+// are cancelled and what is left goes to the dead-letter file.
+func (q *IngestQueue) close(ctx context.Context) {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("⚠️ Ingestion not drained in time, dead-lettering %d queued messages", q.depth())
+		q.cancel()
+		<-drained
+	}
+	q.cancel()
+}
+
+// work stores the messages of one shard until it is closed and empty
+func (q *IngestQueue) work(shard chan ingestItem, storing *atomic.Int64) {
+	defer q.workers.Done()
+	for item := range shard {
+		items := []ingestItem{item}
+	drain:
+		for len(items) < maxPipelineMessages {
+			select {
+			case next, ok := <-shard:
+				if !ok {
+					break drain
+				}
+				items = append(items, next)
+			default:
+				break drain
+			}
+		}
+		storing.Store(items[0].queued().UnixNano())
+		q.process(items)
+		storing.Store(0)
+	}
+}
+
+// process handles messages taken from a shard. Gate, command and edge
+// messages are stored one by one, sensor readings per farm in one pipeline.
+// When it returns every item is stored, dropped or dead-lettered.
+func (q *IngestQueue) process(items []ingestItem) {
+	defer func() {
+		for _, item := range items {
+			item.processed()
+		}
+	}()
+	farms := make(map[string][]sensorMessage)
+	var order []string
+
+	for _, item := range items {
+		farm, rest, ok := parseFarmTopic(item.Topic)
+		if !ok {
+			log.Printf("⚠️ Ignoring message on unknown topic %s", item.Topic)
+			continue
+		}
+		if item.Replayed.IsZero() {
+			q.handler.stats.countMessage(farm, item.Received) // Counted on arrival only
+		}
+
+		if !strings.HasPrefix(rest, "sensors/") {
+			if err := q.retry(func(ctx context.Context) error {
+				return q.handler.handleMessage(ctx, farm, item.Topic, rest, item.Payload)
+			}); err != nil {
+				q.fail(item, err)
+			}
+			continue
+		}
+
+		var msg sensorMessage
+		err := q.retry(func(ctx context.Context) error {
+			var err error
+			msg, err = q.handler.parseSensors(ctx, farm, rest, item)
+			return err
+		})
+		if errors.Is(err, errFarmMismatch) {
+			continue
+		}
+		if err != nil {
+			q.fail(item, err)
+			continue
+		}
+		if _, seen := farms[farm]; !seen {
+			order = append(order, farm)
+		}
+		farms[farm] = append(farms[farm], msg)
+	}
+
+	for _, farm := range order {
+		q.storeReadings(farm, farms[farm])
+	}
+}
+
+// parseSensors decodes a single reading or a batch from a sensors/ topic
+func (h *MQTTHandler) parseSensors(ctx context.Context, farm, rest string, item ingestItem) (sensorMessage, error) {
+	msg := sensorMessage{item: item}
+	if isBatchTopic(rest) {
+		batch, err := h.parseSensorBatch(farm, item.Topic, rest, item.Payload)
+		if err != nil {
+			return msg, err
+		}
+		msg.batch, msg.readings = &batch, batch.Readings
+		return msg, nil
+	}
+
+	reading, err := h.parseSensorReading(ctx, farm, item.Topic, rest, item.Payload)
+	if err != nil {
+		return msg, err
+	}
+	msg.readings = []SensorMessage{reading}
+	return msg, nil
+}
+
+// storeReadings calibrates and stores the readings of one farm's messages
+// in one round trip, then logs them message by message
+func (q *IngestQueue) storeReadings(farm string, msgs []sensorMessage) {
+	var readings []SensorMessage
+	for _, msg := range msgs {
+		readings = append(readings, msg.readings...)
+	}
+
+	// Raw mode probes need the calibration from the registry
+	uncalibrated := 0
+	err := q.retry(func(ctx context.Context) error {
+		var err error
+		if uncalibrated, err = q.handler.calibrateReadings(ctx, farm, readings); err != nil {
+			return err
+		}
+		return q.handler.store.storeSensorReadings(ctx, farm, readings)
+	})
+	if err != nil {
+		for _, msg := range msgs {
+			q.fail(msg.item, err)
+		}
+		return
+	}
+	q.handler.archive.addReadings(farm, readings)
+	q.handler.stats.addReadings(farm, readings)
+	ingestPipelineReadings.Observe(float64(len(readings)))
+	if uncalibrated > 0 {
+		uncalibratedReadings.WithLabelValues(farm).Add(float64(uncalibrated))
+	}
+
+	offset := 0
+	for _, msg := range msgs {
+		stored := readings[offset : offset+len(msg.readings)]
+		offset += len(msg.readings)
+		for _, reading := range stored {
+			if reading.hasValue() {
+				sensorMetrics.observe(farm, reading.SensorID, reading.Type, reading.Value)
+			}
+		}
+
+		if msg.batch != nil {
+			observeIngest("batch", len(stored), msg.item.queued())
+			logStoredBatch(farm, msg, stored)
+			continue
+		}
+		observeIngest("single", 1, msg.item.queued())
+		reading := stored[0]
+		if !reading.hasValue() {
+			log.Printf("⚠️ Stored raw only: [%s] Sensor %d (%s) = %.2f, no calibration in the registry",
+				farm, reading.SensorID, reading.Type, *reading.RawValue)
+			continue
+		}
+		log.Printf("✅ Stored: [%s] Sensor %d (%s) = %.2f %s",
+			farm, reading.SensorID, reading.Type, reading.Value, reading.Unit)
+	}
+}
+
+// logStoredBatch logs one line per batch instead of one per reading
+func logStoredBatch(farm string, msg sensorMessage, stored []SensorMessage) {
+	rawOnly := 0
+	for _, reading := range stored {
+		if !reading.hasValue() {
+			rawOnly++
+		}
+	}
+	latency := time.Since(msg.item.queued()).Round(time.Microsecond)
+	if rawOnly > 0 {
+		log.Printf("✅ Stored batch: [%s] %d readings from %s in %v (%d raw only, no calibration in the registry)",
+			farm, len(stored), msg.batch.source(), latency, rawOnly)
+		return
+	}
+	log.Printf("✅ Stored batch: [%s] %d readings from %s in %v", farm, len(stored), msg.batch.source(), latency)
+}
+
+// retry runs fn until it succeeds or fails for good, each attempt with a
+// deadline of storeTimeout. Only store errors are retried; a message that
+// cannot be parsed will not parse next time either.
+func (q *IngestQueue) retry(fn func(ctx context.Context) error) error {
+	err := q.attempt(fn)
+	for _, delay := range retryDelays {
+		var ingestErr *ingestError
+		if err == nil || errors.As(err, &ingestErr) || errors.Is(err, errFarmMismatch) || q.ctx.Err() != nil {
+			return err
+		}
+		ingestRetries.Inc()
+		select {
+		case <-time.After(delay):
+		case <-q.ctx.Done():
+			return err
+		}
+		err = q.attempt(fn)
+	}
+	return err
+}
+
+// attempt runs fn once with the deadline of one store attempt
+func (q *IngestQueue) attempt(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(q.ctx, storeTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// fail dead-letters a message with the reason its error carries
+func (q *IngestQueue) fail(item ingestItem, err error) {
+	reason := reasonStoreFailed
+	var ingestErr *ingestError
+	if errors.As(err, &ingestErr) {
+		reason = ingestErr.reason
+	} else if q.ctx.Err() != nil {
+		reason = reasonShutdown
+	}
+	q.deadLetter(item, reason, err)
+}
+
+// deadLetter keeps a message that could not be stored
+func (q *IngestQueue) deadLetter(item ingestItem, reason string, err error) {
+	ingestDeadLetters.WithLabelValues(reason).Inc()
+	log.Printf("❌ Dead-lettered message on %s (%s): %v", item.Topic, reason, err)
+	if err := q.deadLetters.add(newDeadLetter(item, reason, err)); err != nil {
+		log.Printf("❌ Failed to write dead letter, message on %s is lost: %v", item.Topic, err)
+	}
+}
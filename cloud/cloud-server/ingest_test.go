@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// gatedStore is a store whose sensor writes can be held back or failed
+type gatedStore struct {
+	Store
+	mu     sync.Mutex
+	fail   error         // Returned by storeSensorReadings while set
+	gate   chan struct{} // storeSensorReadings waits for it to close while set
+	stored int           // Readings stored
+}
+
+func (s *gatedStore) storeSensorReadings(ctx context.Context, farm string, msgs []SensorMessage) error {
+	s.mu.Lock()
+	fail, gate := s.fail, s.gate
+	s.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail != nil {
+		return fail
+	}
+	if err := s.Store.storeSensorReadings(ctx, farm, msgs); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.stored += len(msgs)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *gatedStore) set(fail error, gate chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail, s.gate = fail, gate
+}
+
+func (s *gatedStore) storedReadings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stored
+}
+
+// newTestHandler builds an MQTT handler and ingestion pipeline of its own
+// on store, with its dead letters in a temporary file. It never connects.
+func newTestHandler(t *testing.T, store Store, workers, size int) *MQTTHandler {
+	t.Helper()
+	stats := newStats(store, newLayoutStore("../../edge/sensors"))
+	t.Cleanup(stats.close)
+	return newMQTTHandler(MQTTConfig{BrokerURL: "tcp://localhost:1", ClientID: "cloud-test-queue", FarmID: defaultFarm},
+		store, nil, stats, IngestConfig{
+			Workers: workers, QueueSize: size, DeadLetterFile: filepath.Join(t.TempDir(), "deadletter.jsonl"),
+		})
+}
+
+// newTestQueue builds an ingestion pipeline of its own on store
+func newTestQueue(t *testing.T, store Store, workers, size int) *IngestQueue {
+	t.Helper()
+	return newTestHandler(t, store, workers, size).queue
+}
+
+// withQuickRetries shortens the store retries for one test
+func withQuickRetries(t *testing.T) {
+	saved := retryDelays
+	retryDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { retryDelays = saved })
+}
+
+// allLetters lists every dead letter
+func allLetters(DeadLetter) bool { return true }
+
+// readingItem is a JSON soil moisture reading as it arrives from the broker
+func readingItem(farm string, sensorID int, value float64, timestamp int64) ingestItem {
+	payload, _ := json.Marshal(SensorMessage{
+		SensorID: sensorID, Type: moistureLayer, Lat: 32.7637, Lon: 52.6365, Value: value, Unit: "%", Timestamp: timestamp,
+	})
+	return ingestItem{
+		Topic:    fmt.Sprintf("farm/%s/sensors/%s/%d", farm, moistureLayer, sensorID),
+		Payload:  payload,
+		Received: time.Now(),
+	}
+}
+
+// closeQueue drains a queue
+func closeQueue(t *testing.T, q *IngestQueue) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q.close(ctx)
+}
+
+func TestIngestQueue(t *testing.T) {
+	farm := "ingest-order"
+	store := &gatedStore{Store: newMemoryStore()}
+	q := newTestQueue(t, store, 2, 1000)
+
+	now := time.Now().Unix()
+	for i := 0; i < 50; i++ {
+		q.enqueue(readingItem(farm, 1, float64(i), now-50+int64(i)))
+		q.enqueue(readingItem(farm, 2, float64(100-i), now-50+int64(i)))
+	}
+	batch, _ := json.Marshal(SensorBatch{FarmID: farm, Readings: []SensorMessage{
+		{SensorID: 3, Type: moistureLayer, Value: 30, Unit: "%", Timestamp: now},
+		{SensorID: 4, Type: moistureLayer, Value: 40, Unit: "%", Timestamp: now},
+	}})
+	q.enqueue(ingestItem{Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/batch", Payload: batch, Received: time.Now()})
+	closeQueue(t, q)
+
+	if stored := store.storedReadings(); stored != 102 {
+		t.Errorf("stored %d readings, want 102", stored)
+	}
+	ctx := context.Background()
+	for sensorID, want := range map[int]string{1: "49", 2: "51", 3: "30", 4: "40"} {
+		latest, err := store.getLatestReading(ctx, farm, sensorID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest["value"] != want {
+			t.Errorf("sensor %d latest value is %s, want %s", sensorID, latest["value"], want)
+		}
+	}
+	if q.depth() != 0 || q.deadLetters.count() != 0 {
+		t.Errorf("after draining: depth %d, %d dead letters", q.depth(), q.deadLetters.count())
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	farm := "ingest-full"
+	store := &gatedStore{Store: newMemoryStore()}
+	gate := make(chan struct{})
+	store.set(nil, gate)
+	q := newTestQueue(t, store, 1, 2)
+
+	// The worker takes the first reading and waits on the store
+	q.enqueue(readingItem(farm, 1, 1, 1))
+	for deadline := time.Now().Add(5 * time.Second); q.lag() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the worker did not take the reading")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i <= 6; i++ {
+		q.enqueue(readingItem(farm, 1, float64(i), int64(i)))
+	}
+
+	letters, total, err := q.deadLetters.list(reasonQueueFull, 10, allLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(letters) != 3 {
+		t.Errorf("%d readings dead-lettered as queue full, want 3", total)
+	}
+
+	close(gate)
+	closeQueue(t, q)
+	if stored := store.storedReadings(); stored != 3 {
+		t.Errorf("stored %d readings, want 3", stored)
+	}
+}
+
+func TestDeadLetterReasons(t *testing.T) {
+	withQuickRetries(t)
+	farm := "ingest-dead"
+	store := &gatedStore{Store: newMemoryStore()}
+	store.set(errors.New("store down"), nil)
+	q := newTestQueue(t, store, 1, 10)
+
+	received := time.Now().Add(-time.Minute).Truncate(time.Second)
+	item := readingItem(farm, 1, 1, 1)
+	item.Received = received
+	q.enqueue(item)
+	q.enqueue(ingestItem{Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/2", Payload: []byte("{"), Received: time.Now()})
+	q.enqueue(ingestItem{Topic: "farm/" + farm + "/sensors/" + moistureLayer + "/3/cbor", Payload: []byte{0xa1, 0x02, 0x01}, Received: time.Now()})
+	closeQueue(t, q)
+	q.enqueue(readingItem(farm, 4, 1, 1))
+
+	letters, _, err := q.deadLetters.list("", 10, allLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]DeadLetter{}
+	for _, letter := range letters {
+		reasons[letter.Reason] = letter
+	}
+	for _, reason := range []string{reasonStoreFailed, reasonUnparseable, reasonRejected, reasonShutdown} {
+		if _, ok := reasons[reason]; !ok {
+			t.Errorf("no %s dead letter in %+v", reason, letters)
+		}
+	}
+	if letter := reasons[reasonStoreFailed]; letter.Received != received.Unix() || letter.Error != "store down" {
+		t.Errorf("store failure kept as %+v", letter)
+	}
+
+	// The binary payload survives the file
+	replayed, err := reasons[reasonRejected].item()
+	if err != nil || string(replayed.Payload) != string([]byte{0xa1, 0x02, 0x01}) {
+		t.Errorf("CBOR dead letter decodes to %x, %v", replayed.Payload, err)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	withQuickRetries(t)
+	farm := "ingest-replay"
+	store := &gatedStore{Store: newMemoryStore()}
+	store.set(errors.New("store down"), nil)
+	q := newTestQueue(t, store, 1, 4) // A replay waits for room
+	app := fiber.New()
+	app.Post("/replay", q.replayDeadLetters)
+	replay := func() int {
+		resp, err := app.Test(httptest.NewRequest("POST", "/replay", nil), -1)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitForLetters := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); q.deadLetters.count() < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d dead letters, want %d", q.deadLetters.count(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	received := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 20; i++ {
+		item := readingItem(farm, 1+i%5, float64(i), int64(i))
+		item.Received = received
+		q.deadLetter(item, reasonStoreFailed, errors.New("store down"))
+	}
+
+	// Failing again, the letters come back with their receive time
+	if status := replay(); status != 200 {
+		t.Fatalf("replay got %d", status)
+	}
+	waitForLetters(20)
+	letters, total, _ := q.deadLetters.list("", 100, allLetters)
+	if total != 20 {
+		t.Fatalf("%d dead letters after a failed replay, want 20", total)
+	}
+	for _, letter := range letters {
+		if letter.Received != received.Unix() {
+			t.Fatalf("replayed letter received at %d, want %d", letter.Received, received.Unix())
+		}
+	}
+
+	// Concurrent replays store every letter once. The store holds the
+	// first replay until the others have started.
+	gate := make(chan struct{})
+	store.set(nil, gate)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := replay(); status != 200 {
+				t.Errorf("replay got %d", status)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	closeQueue(t, q)
+
+	if stored := store.storedReadings(); stored != 20 {
+		t.Errorf("stored %d readings, want each of the 20 once", stored)
+	}
+	if count := q.deadLetters.count(); count != 0 {
+		t.Errorf("%d dead letters left", count)
+	}
+	if letters, _, _ := q.deadLetters.snapshot(); len(letters) != 0 {
+		t.Errorf("dead-letter file still holds %d letters", len(letters))
+	}
+}
+
+func TestReplayKeepsLettersUntilProcessed(t *testing.T) {
+	withQuickRetries(t)
+	farm := "ingest-replay-wait"
+	store := &gatedStore{Store: newMemoryStore()}
+	q := newTestQueue(t, store, 1, 100)
+	app := fiber.New()
+	app.Post("/replay", q.replayDeadLetters)
+	replay := func() <-chan int {
+		status := make(chan int, 1)
+		go func() {
+			resp, err := app.Test(httptest.NewRequest("POST", "/replay", nil), -1)
+			if err != nil {
+				t.Error(err)
+				status <- 0
+				return
+			}
+			resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		return status
+	}
+	for i := 0; i < 5; i++ {
+		q.deadLetter(readingItem(farm, 1+i, float64(i), int64(i)), reasonStoreFailed, errors.New("store down"))
+	}
+
+	// Queued but not stored, the letters stay in the file
+	gate := make(chan struct{})
+	store.set(nil, gate)
+	status := replay()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case got := <-status:
+		t.Fatalf("replay returned %d before the letters were stored", got)
+	default:
+	}
+	if letters, _, _ := q.deadLetters.snapshot(); len(letters) != 5 {
+		t.Fatalf("dead-letter file holds %d letters while they are being stored, want 5", len(letters))
+	}
+	close(gate)
+	if got := <-status; got != 200 || store.storedReadings() != 5 || q.deadLetters.count() != 0 {
+		t.Fatalf("replay got %d, stored %d readings, %d dead letters left", got, store.storedReadings(), q.deadLetters.count())
+	}
+
+	// A shutdown mid-replay dead-letters them again rather than losing them
+	for i := 0; i < 5; i++ {
+		q.deadLetter(readingItem(farm, 1+i, float64(i), int64(10+i)), reasonStoreFailed, errors.New("store down"))
+	}
+	store.set(nil, make(chan struct{}))
+	status = replay()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	q.close(ctx)
+	if got := <-status; got != 200 {
+		t.Errorf("replay cut by the shutdown got %d", got)
+	}
+	letters, total, _ := q.deadLetters.list(reasonShutdown, 10, allLetters)
+	if total != 5 || q.deadLetters.count() != 5 {
+		t.Errorf("%d letters dead-lettered by the shutdown (%+v), %d in the file, want the 5 replayed", total, letters, q.deadLetters.count())
+	}
+}
+
+func TestReplayEmptyDeadLetters(t *testing.T) {
+	q := newTestQueue(t, newMemoryStore(), 1, 10)
+	app := fiber.New()
+	app.Post("/replay", q.replayDeadLetters)
+	resp, err := app.Test(httptest.NewRequest("POST", "/replay", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]int
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != 200 || body["replayed"] != 0 {
+		t.Errorf("replay without dead letters got %d %v", resp.StatusCode, body)
+	}
+	closeQueue(t, q)
+}
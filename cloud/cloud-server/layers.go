@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ============================================================================
+// GEOJSON FARM LAYOUT
+// ============================================================================
+
+// The farm layout is drawn in QGIS and exported as one GeoJSON
+// FeatureCollection per layer (edge/sensors/<layer>.geojson). Sensors are
+// Points or MultiPoints, gates are MultiLineStrings, and every feature has a
+// numeric "id" property.
+
+// FeatureCollection is one GeoJSON layer
+type FeatureCollection struct {
+	Type     string          `json:"type"`
+	Name     string          `json:"name"`
+	CRS      json.RawMessage `json:"crs,omitempty"`
+	Features []Feature       `json:"features"`
+}
+
+// Feature is a GeoJSON feature with free-form properties
+type Feature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   Geometry               `json:"geometry"`
+}
+
+// Geometry keeps the raw coordinates so every geometry type round-trips
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// loadLayers reads every single-layer *.geojson file in dir, keyed by layer
+// name. Combined files holding a list of layers (main.geojson) are skipped,
+// their layers also exist as separate files.
+func loadLayers(dir string) (map[string]FeatureCollection, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.geojson"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no .geojson files in %s", dir)
+	}
+
+	layers := make(map[string]FeatureCollection)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			continue // Combined file
+		}
+
+		var layer FeatureCollection
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if layer.Type != "FeatureCollection" {
+			return nil, fmt.Errorf("%s: expected a FeatureCollection, got %q", path, layer.Type)
+		}
+		if layer.Name == "" {
+			layer.Name = strings.TrimSuffix(filepath.Base(path), ".geojson")
+		}
+		layers[layer.Name] = layer
+	}
+	return layers, nil
+}
+
+// featureID returns the numeric "id" property of a feature
+func featureID(feature Feature) (int, bool) {
+	id, ok := feature.Properties["id"].(float64)
+	if !ok || id != float64(int(id)) {
+		return 0, false
+	}
+	return int(id), true
+}
+
+// allPositions flattens every [lon, lat] position of a geometry
+func allPositions(geometry Geometry) ([][]float64, error) {
+	var err error
+	var positions [][]float64
+
+	switch geometry.Type {
+	case "Point":
+		var position []float64
+		err = json.Unmarshal(geometry.Coordinates, &position)
+		positions = [][]float64{position}
+	case "MultiPoint", "LineString":
+		err = json.Unmarshal(geometry.Coordinates, &positions)
+	case "MultiLineString", "Polygon":
+		var lines [][][]float64
+		err = json.Unmarshal(geometry.Coordinates, &lines)
+		for _, line := range lines {
+			positions = append(positions, line...)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry %q", geometry.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	for _, position := range positions {
+		if len(position) < 2 {
+			return nil, fmt.Errorf("incomplete %s position", geometry.Type)
+		}
+	}
+	if len(positions) == 0 {
+		return nil, fmt.Errorf("empty %s coordinates", geometry.Type)
+	}
+	return positions, nil
+}
+
+// firstPosition returns the first [lon, lat] position of a geometry
+func firstPosition(geometry Geometry) (float64, float64, error) {
+	positions, err := allPositions(geometry)
+	if err != nil {
+		return 0, 0, err
+	}
+	return positions[0][0], positions[0][1], nil
+}
+
+// centroid returns the mean [lon, lat] of a geometry's positions
+func centroid(geometry Geometry) (float64, float64, error) {
+	positions, err := allPositions(geometry)
+	if err != nil {
+		return 0, 0, err
+	}
+	var lon, lat float64
+	for _, position := range positions {
+		lon += position[0]
+		lat += position[1]
+	}
+	n := float64(len(positions))
+	return lon / n, lat / n, nil
+}
+
+// isPointGeometry reports whether a geometry marks a device location
+func isPointGeometry(geometry Geometry) bool {
+	return geometry.Type == "Point" || geometry.Type == "MultiPoint"
+}
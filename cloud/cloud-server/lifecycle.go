@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// LIFECYCLE
+// ============================================================================
+
+// Every store call runs under a context with a deadline: the store calls of
+// an HTTP request get requestTimeout (a streamed export streamTimeout), an
+// ingest store attempt storeTimeout and background jobs their own.
+//
+// On SIGINT or SIGTERM the server stops in order within
+// CLOUD_SHUTDOWN_TIMEOUT seconds (default 30):
+//
+//  1. Stop accepting HTTP connections. Requests in flight get up to half
+//     the timeout, then their contexts are cancelled.
+//  2. Unsubscribe from MQTT and disconnect.
+//  3. Store the messages still queued. Those left at the deadline go to the
+//     dead-letter file.
+//  4. Flush the archive, stop the statistics and close the store.
+//
+// A second signal exits at once.
+
+const (
+	requestTimeout = 30 * time.Second // Deadline of the store calls of a request
+	streamTimeout  = 10 * time.Minute // Deadline of a streamed export
+)
+
+// requestContext gives every request a context that ends after
+// requestTimeout or when the server stops serving
+func requestContext(serving context.Context) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(serving, requestTimeout)
+		defer cancel()
+		c.Locals("serving", serving)
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
+// streamContext is the context of a streamed response, which is written
+// after its handler has returned and the request context has ended
+func streamContext(c *fiber.Ctx) (context.Context, context.CancelFunc) {
+	serving, ok := c.Locals("serving").(context.Context)
+	if !ok {
+		serving = context.Background()
+	}
+	return context.WithTimeout(serving, streamTimeout)
+}
+
+// Lifecycle holds what the shutdown sequence stops
+type Lifecycle struct {
+	app         *fiber.App
+	stopServing context.CancelFunc // Cancels the contexts of requests and streams
+	started     <-chan struct{}    // Closed once startup has returned
+	mqtt        *MQTTHandler
+	archive     *Archiver
+	stats       *Stats
+	store       Store
+}
+
+// shutdown runs the shutdown sequence within timeout
+func (l *Lifecycle) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	log.Printf("👋 Shutting down within %v...", timeout)
+
+	requests, cancelRequests := context.WithTimeout(ctx, timeout/2)
+	if err := l.app.ShutdownWithContext(requests); err != nil {
+		log.Printf("⚠️ HTTP requests cancelled: %v", err)
+	}
+	cancelRequests()
+	l.stopServing()
+	log.Println("✅ HTTP server stopped")
+
+	// Startup gives up once the signal arrived, but may be mid-connect
+	select {
+	case <-l.started:
+	case <-ctx.Done():
+	}
+	l.mqtt.disconnect(ctx)
+
+	log.Printf("📦 Storing %d queued messages...", l.mqtt.queue.depth())
+	l.mqtt.queue.close(ctx)
+	log.Println("✅ Ingestion queue drained")
+
+	l.archive.close()
+	l.stats.close()
+	if err := l.store.close(); err != nil {
+		log.Printf("⚠️ Closing the store: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofiber/fiber/v2"
+)
+
+// shutdownSteps records the shutdown sequence
+type shutdownSteps struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (s *shutdownSteps) add(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, step)
+}
+
+func (s *shutdownSteps) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.steps...)
+}
+
+// subscribedClient is a connected MQTT client whose unsubscribe runs a
+// callback, like a message delivered before the broker got the request
+type subscribedClient struct {
+	mqtt.Client
+	steps         *shutdownSteps
+	onUnsubscribe func()
+}
+
+func (c *subscribedClient) IsConnectionOpen() bool { return true }
+
+func (c *subscribedClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.onUnsubscribe()
+	c.steps.add("unsubscribe")
+	return &mqtt.DummyToken{}
+}
+
+func (c *subscribedClient) Disconnect(quiesce uint) { c.steps.add("disconnect") }
+
+// closingStore records when it is closed and how many readings it had
+// stored by then
+type closingStore struct {
+	*gatedStore
+	steps        *shutdownSteps
+	storedAtExit int
+}
+
+func (s *closingStore) close() error {
+	s.storedAtExit = s.storedReadings()
+	s.steps.add("close store")
+	return s.gatedStore.close()
+}
+
+func TestShutdownDrainsQueue(t *testing.T) {
+	farm := "shutdown-drain"
+	steps := &shutdownSteps{}
+	gate := make(chan struct{})
+	store := &closingStore{gatedStore: &gatedStore{Store: newMemoryStore()}, steps: steps}
+	store.set(nil, gate) // Nothing is stored until the broker is left
+	handler := newTestHandler(t, store, 2, 100)
+
+	now := time.Now().Unix()
+	queued := 20
+	for i := 0; i < queued; i++ {
+		handler.queue.enqueue(readingItem(farm, 1+i%4, float64(i), now-60+int64(i)))
+	}
+	handler.topics = []string{"farm/+/sensors/#"}
+	handler.client = &subscribedClient{Client: handler.client, steps: steps, onUnsubscribe: func() {
+		if stored := store.storedReadings(); stored != 0 {
+			t.Errorf("%d readings stored before leaving the broker", stored)
+		}
+		handler.queue.enqueue(readingItem(farm, 5, 50, now))
+		close(gate)
+	}}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Hooks().OnShutdown(func() error {
+		steps.add("stop HTTP")
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(listener)
+
+	serving, stopServing := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	close(started)
+	lifecycle := &Lifecycle{
+		app: app, stopServing: stopServing, started: started,
+		mqtt: handler, stats: handler.stats, store: store,
+	}
+	lifecycle.shutdown(10 * time.Second)
+
+	want := []string{"stop HTTP", "unsubscribe", "disconnect", "close store"}
+	if got := steps.list(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Errorf("shutdown steps are %v, want %v", got, want)
+	}
+	if serving.Err() == nil {
+		t.Error("request contexts are still serving")
+	}
+	if store.storedAtExit != queued+1 || handler.queue.depth() != 0 {
+		t.Errorf("%d of %d readings stored when the store closed, %d still queued", store.storedAtExit, queued+1, handler.queue.depth())
+	}
+	history, err := store.Store.querySensorHistory(context.Background(), farm, 5, allTime, 0, 10)
+	if err != nil || len(history) != 1 {
+		t.Errorf("reading delivered while unsubscribing: %v, %v", history, err)
+	}
+}
@@ -5,15 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // ============================================================================
@@ -21,25 +27,78 @@ import (
 // ============================================================================
 
 type Config struct {
-	RedisAddr  string
-	MQTTBroker string
-	HTTPPort   string
+	Store         StoreConfig
+	MQTT          MQTTConfig
+	HTTPPort      string
+	JWTSecret     string // CLOUD_JWT_SECRET, random per run if empty
+	AdminPassword string // CLOUD_ADMIN_PASSWORD, creates "admin" when no users exist
+	CORSOrigins   string // CLOUD_CORS_ORIGINS, comma-separated allow-list
+	LayersDir     string // CLOUD_LAYERS_DIR, GeoJSON farm layout (other farms in <dir>/<farm>)
+	Ingest        IngestConfig
+	Archive       ArchiveConfig
+	Validate      string        // CLOUD_OPENAPI_VALIDATE, off, requests or all
+	Shutdown      time.Duration // CLOUD_SHUTDOWN_TIMEOUT, seconds to stop in (default 30)
 }
 
 func loadConfig() *Config {
-	return &Config{
-		RedisAddr:  "localhost:6379",
-		MQTTBroker: "tcp://localhost:1883",
-		HTTPPort:   ":8080",
+	config := &Config{
+		Store: StoreConfig{
+			Backend:   getEnv("CLOUD_STORE", storeRedis),
+			RedisAddr: getEnv("CLOUD_REDIS_ADDR", "localhost:6379"),
+			DSN:       os.Getenv("CLOUD_STORE_DSN"),
+		},
+		MQTT:          loadMQTTConfig("cloud-server"),
+		HTTPPort:      ":8080",
+		JWTSecret:     os.Getenv("CLOUD_JWT_SECRET"),
+		AdminPassword: os.Getenv("CLOUD_ADMIN_PASSWORD"),
+		CORSOrigins:   getEnv("CLOUD_CORS_ORIGINS", "http://localhost:8080"),
+		LayersDir:     getEnv("CLOUD_LAYERS_DIR", "../../edge/sensors"),
+		Ingest: IngestConfig{
+			Workers:        getEnvInt("CLOUD_INGEST_WORKERS", 4),
+			QueueSize:      getEnvInt("CLOUD_INGEST_QUEUE", 10000),
+			DeadLetterFile: getEnv("CLOUD_DEADLETTER_FILE", "deadletter.jsonl"),
+		},
+		Archive: ArchiveConfig{
+			Dir:           os.Getenv("CLOUD_ARCHIVE_DIR"),
+			RetentionDays: getEnvInt("CLOUD_ARCHIVE_RETENTION_DAYS", 365),
+		},
+		Validate: getEnv("CLOUD_OPENAPI_VALIDATE", validateRequests),
+		Shutdown: time.Duration(getEnvInt("CLOUD_SHUTDOWN_TIMEOUT", 30)) * time.Second,
 	}
+
+	// Sessions are sent cross-origin, which browsers (and Fiber) refuse for "*"
+	for _, origin := range strings.Split(config.CORSOrigins, ",") {
+		if strings.TrimSpace(origin) == "*" {
+			log.Fatalf("❌ CLOUD_CORS_ORIGINS cannot be \"*\" with credentials, list the dashboard origins")
+		}
+	}
+	return config
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt reads a positive number, or exits on a bad value
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		log.Fatalf("❌ %s must be a positive number, got %q", key, value)
+	}
+	return number
 }
 
 // ============================================================================
 // REDIS CLIENT
 // ============================================================================
 
-var ctx = context.Background()
-
 type RedisClient struct {
 	client *redis.Client
 }
@@ -49,91 +108,240 @@ func newRedisClient(addr string) *RedisClient {
 		Addr: addr,
 		DB:   0,
 	})
-
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Fatalf("❌ Failed to connect to Redis: %v", err)
-	}
-
-	log.Println("✅ Connected to Redis")
+	rdb.AddHook(redisMetricsHook{})
 	return &RedisClient{client: rdb}
 }
 
-// Store latest sensor reading with full metadata
-func (r *RedisClient) storeSensorReading(sensorID int, sensorType string, value float64, unit string, lat, lon float64, timestamp int64) error {
-	key := fmt.Sprintf("sensor:%d:latest", sensorID)
-	data := map[string]interface{}{
-		"sensor_id": sensorID,
-		"type":      sensorType,
-		"value":     value,
-		"unit":      unit,
-		"lat":       lat,
-		"lon":       lon,
-		"timestamp": timestamp,
+func (r *RedisClient) ping(ctx context.Context) error {
+	timeout, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := r.client.Ping(timeout).Err(); err != nil {
+		return fmt.Errorf("connect to Redis at %s: %w", r.client.Options().Addr, err)
 	}
+	return nil
+}
 
-	// Add to sensors set for easy listing
-	r.client.SAdd(ctx, "sensors", sensorID)
+func (r *RedisClient) close() error {
+	return r.client.Close()
+}
 
-	return r.client.HSet(ctx, key, data).Err()
+// prepare moves data stored before farms existed into the default farm and
+// sensor histories kept as lists into sorted sets
+func (r *RedisClient) prepare(ctx context.Context) error {
+	if err := r.migrateLegacyKeys(ctx); err != nil {
+		return fmt.Errorf("move existing data into farm %q: %w", defaultFarm, err)
+	}
+	if err := r.migrateSensorHistoryLists(ctx); err != nil {
+		return fmt.Errorf("convert sensor histories: %w", err)
+	}
+	return nil
 }
 
-// Store reading in history (keep last 1000)
-func (r *RedisClient) storeSensorHistory(sensorID int, value float64, timestamp int64) error {
-	key := fmt.Sprintf("sensor:%d:history", sensorID)
-	data := fmt.Sprintf(`{"value":%.2f,"timestamp":%d}`, value, timestamp)
+// Store the latest readings with full metadata and their history in one
+// MULTI/EXEC round trip. Redis has no rollback: if a command fails inside
+// EXEC (e.g. a key holding another type) the others are still applied, and
+// Exec returns the first error so the ingestion pipeline retries them all.
+func (r *RedisClient) storeSensorReadings(ctx context.Context, farm string, msgs []SensorMessage) error {
+	ids := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.SensorID
+	}
 
-	pipe := r.client.Pipeline()
-	pipe.LPush(ctx, key, data)
-	pipe.LTrim(ctx, key, 0, 999)
+	pipe := r.client.TxPipeline()
+	// Add to sensors and farms sets for easy listing
+	pipe.SAdd(ctx, farmKey(farm, "sensors"), ids...)
+	pipe.SAdd(ctx, "farms", farm)
+	for _, msg := range msgs {
+		queueSensorReading(ctx, pipe, farm, msg)
+		if err := queueSensorHistory(ctx, pipe, farm, msg); err != nil {
+			return err
+		}
+	}
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
+// queueSensorReading queues the latest reading hash
+func queueSensorReading(ctx context.Context, pipe redis.Pipeliner, farm string, msg SensorMessage) {
+	key := farmKey(farm, "sensor:%d:latest", msg.SensorID)
+	fields, stale := latestReadingFields(farm, msg)
+	if len(stale) > 0 {
+		pipe.HDel(ctx, key, stale...)
+	}
+	pipe.HSet(ctx, key, fields)
+}
+
+// queueSensorHistory queues the reading for the history (keep last 1000).
+// The history is a sorted set by timestamp like a gate's, so storing the
+// same reading again, as a retried batch does, leaves a single entry.
+func queueSensorHistory(ctx context.Context, pipe redis.Pipeliner, farm string, msg SensorMessage) error {
+	entry, err := sensorHistoryEntry(msg)
+	if err != nil {
+		return err
+	}
+	key := farmKey(farm, "sensor:%d:history", msg.SensorID)
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(msg.Timestamp), Member: entry})
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxSensorHistory-1)
+	return nil
+}
+
 // Get latest reading
-func (r *RedisClient) getLatestReading(sensorID int) (map[string]string, error) {
-	key := fmt.Sprintf("sensor:%d:latest", sensorID)
+func (r *RedisClient) getLatestReading(ctx context.Context, farm string, sensorID int) (map[string]string, error) {
+	key := farmKey(farm, "sensor:%d:latest", sensorID)
 	return r.client.HGetAll(ctx, key).Result()
 }
 
+// Get the latest readings of many sensors in one round trip
+func (r *RedisClient) getLatestReadings(ctx context.Context, farm string, sensorIDs []int) (map[int]map[string]string, error) {
+	pipe := r.client.Pipeline()
+	cmds := make(map[int]*redis.StringStringMapCmd, len(sensorIDs))
+	for _, id := range sensorIDs {
+		cmds[id] = pipe.HGetAll(ctx, farmKey(farm, "sensor:%d:latest", id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	readings := make(map[int]map[string]string, len(cmds))
+	for id, cmd := range cmds {
+		if data := cmd.Val(); len(data) > 0 {
+			readings[id] = data
+		}
+	}
+	return readings, nil
+}
+
 // Get history (last N readings)
-func (r *RedisClient) getSensorHistory(sensorID int, count int) ([]string, error) {
-	key := fmt.Sprintf("sensor:%d:history", sensorID)
-	return r.client.LRange(ctx, key, 0, int64(count-1)).Result()
+func (r *RedisClient) getSensorHistory(ctx context.Context, farm string, sensorID int, count int) ([]string, error) {
+	key := farmKey(farm, "sensor:%d:history", sensorID)
+	return r.client.ZRevRange(ctx, key, 0, int64(count-1)).Result()
 }
 
-// Get all sensor IDs
-func (r *RedisClient) getAllSensors() ([]string, error) {
-	return r.client.SMembers(ctx, "sensors").Result()
+// Get history entries in a time range (newest first)
+func (r *RedisClient) querySensorHistory(ctx context.Context, farm string, sensorID int, span timeRange, offset, count int64) ([]string, error) {
+	return r.queryAuditSet(ctx, farmKey(farm, "sensor:%d:history", sensorID), span, offset, count)
 }
 
-// Store gate status
-func (r *RedisClient) storeGateStatus(gateID int, isOpen bool, timestamp int64) error {
-	key := fmt.Sprintf("gate:%d:latest", gateID)
-	status := "closed"
-	if isOpen {
-		status = "open"
+// migrateSensorHistoryLists converts the sensor histories stored as lists,
+// newest first, into sorted sets by timestamp
+func (r *RedisClient) migrateSensorHistoryLists(ctx context.Context) error {
+	keys := []string{}
+	iter := r.client.Scan(ctx, 0, farmKey("*", "sensor:*:history"), 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	converted := 0
+	for _, key := range keys {
+		kind, err := r.client.Type(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if kind != "list" {
+			continue
+		}
+		entries, err := r.client.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		members := make([]*redis.Z, 0, len(entries))
+		for _, entry := range entries {
+			var decoded historyEntry
+			if json.Unmarshal([]byte(entry), &decoded) == nil {
+				members = append(members, &redis.Z{Score: float64(decoded.Timestamp), Member: entry})
+			}
+		}
+		pipe := r.client.TxPipeline()
+		pipe.Del(ctx, key)
+		if len(members) > 0 {
+			pipe.ZAdd(ctx, key, members...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		converted++
 	}
-	data := map[string]interface{}{
-		"gate_id":   gateID,
-		"status":    status,
-		"is_open":   isOpen,
-		"timestamp": timestamp,
+
+	if converted > 0 {
+		log.Printf("✅ Converted %d sensor histories into sorted sets", converted)
 	}
+	return nil
+}
 
-	r.client.SAdd(ctx, "gates", gateID)
-	return r.client.HSet(ctx, key, data).Err()
+// Get all sensor IDs of a farm
+func (r *RedisClient) getAllSensors(ctx context.Context, farm string) ([]string, error) {
+	return r.client.SMembers(ctx, farmKey(farm, "sensors")).Result()
+}
+
+// Store gate status
+func (r *RedisClient) storeGateStatus(ctx context.Context, farm string, gateID int, isOpen bool, timestamp int64) error {
+	key := farmKey(farm, "gate:%d:latest", gateID)
+	r.client.SAdd(ctx, farmKey(farm, "gates"), gateID)
+	r.client.SAdd(ctx, "farms", farm)
+	return r.client.HSet(ctx, key, gateStatusFields(farm, gateID, isOpen, timestamp)).Err()
 }
 
 // Get gate status
-func (r *RedisClient) getGateStatus(gateID int) (map[string]string, error) {
-	key := fmt.Sprintf("gate:%d:latest", gateID)
+func (r *RedisClient) getGateStatus(ctx context.Context, farm string, gateID int) (map[string]string, error) {
+	key := farmKey(farm, "gate:%d:latest", gateID)
 	return r.client.HGetAll(ctx, key).Result()
 }
 
-// Get all gate IDs
-func (r *RedisClient) getAllGates() ([]string, error) {
-	return r.client.SMembers(ctx, "gates").Result()
+// Get the status of many gates in one round trip
+func (r *RedisClient) getGateStatuses(ctx context.Context, farm string, gateIDs []int) (map[int]map[string]string, error) {
+	pipe := r.client.Pipeline()
+	cmds := make(map[int]*redis.StringStringMapCmd, len(gateIDs))
+	for _, id := range gateIDs {
+		cmds[id] = pipe.HGetAll(ctx, farmKey(farm, "gate:%d:latest", id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	statuses := make(map[int]map[string]string, len(cmds))
+	for id, cmd := range cmds {
+		if data := cmd.Val(); len(data) > 0 {
+			statuses[id] = data
+		}
+	}
+	return statuses, nil
+}
+
+// Get all gate IDs of a farm
+func (r *RedisClient) getAllGates(ctx context.Context, farm string) ([]string, error) {
+	return r.client.SMembers(ctx, farmKey(farm, "gates")).Result()
+}
+
+// Store the latest irrigation queue snapshot published by the edge
+func (r *RedisClient) storeIrrigationQueue(ctx context.Context, farm string, snapshot []byte) error {
+	return r.client.Set(ctx, farmKey(farm, "irrigation:queue"), snapshot, 0).Err()
+}
+
+// Get the latest irrigation queue snapshot, nil if none was reported
+func (r *RedisClient) getIrrigationQueue(ctx context.Context, farm string) ([]byte, error) {
+	snapshot, err := r.client.Get(ctx, farmKey(farm, "irrigation:queue")).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return snapshot, err
+}
+
+// Store an edge decision event, scored by timestamp (keep last 100000)
+func (r *RedisClient) storeDecision(ctx context.Context, farm string, event []byte, timestamp int64) error {
+	key := farmKey(farm, "decisions")
+	pipe := r.client.Pipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(timestamp), Member: event})
+	pipe.ZRemRangeByRank(ctx, key, 0, -maxAuditEvents-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Query decisions in a time range, newest first
+func (r *RedisClient) queryDecisions(ctx context.Context, farm string, span timeRange, offset, count int64) ([]string, error) {
+	return r.queryAuditSet(ctx, farmKey(farm, "decisions"), span, offset, count)
 }
 
 // ============================================================================
@@ -141,139 +349,290 @@ func (r *RedisClient) getAllGates() ([]string, error) {
 // ============================================================================
 
 type MQTTHandler struct {
-	client mqtt.Client
-	redis  *RedisClient
+	client      mqtt.Client
+	broker      string
+	topics      []string // Subscribed on every connect
+	store       Store
+	archive     *Archiver
+	stats       *Stats
+	queue       *IngestQueue
+	lastMessage atomic.Int64 // Unix nanoseconds
 }
 
 type SensorMessage struct {
-	SensorID  int     `json:"sensor_id"`
-	Type      string  `json:"type"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Value     float64 `json:"value"`
-	Unit      string  `json:"unit"`
-	Timestamp int64   `json:"timestamp"`
+	FarmID      string   `json:"farm_id"`
+	SensorID    int      `json:"sensor_id"`
+	Type        string   `json:"type"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	Value       float64  `json:"value"`
+	RawValue    *float64 `json:"raw_value,omitempty"`   // Uncalibrated reading (raw mode)
+	Temperature *float64 `json:"temperature,omitempty"` // Probe temperature in °C (raw mode)
+	Unit        string   `json:"unit"`
+	Timestamp   int64    `json:"timestamp"`
+
+	Calibrated bool `json:"-"` // Value was computed from RawValue
+}
+
+// hasValue reports whether Value holds an engineering value
+func (m SensorMessage) hasValue() bool {
+	return m.RawValue == nil || m.Calibrated
+}
+
+type DecisionMessage struct {
+	FarmID    string `json:"farm_id"`
+	Timestamp int64  `json:"timestamp"`
+	GateID    int    `json:"gate_id"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
 }
 
 type GateStatusMessage struct {
+	FarmID    string `json:"farm_id"`
 	GateID    int    `json:"gate_id"`
 	Status    string `json:"status"`
 	IsOpen    bool   `json:"is_open"`
 	Timestamp int64  `json:"timestamp"`
 }
 
-func newMQTTHandler(brokerURL string, redisClient *RedisClient) *MQTTHandler {
+func newMQTTHandler(config MQTTConfig, store Store, archive *Archiver, stats *Stats, ingest IngestConfig) *MQTTHandler {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(brokerURL)
-	opts.SetClientID("cloud-server-" + strconv.FormatInt(time.Now().Unix(), 10))
+	if err := config.apply(opts); err != nil {
+		log.Fatalf("❌ Invalid MQTT configuration: %v", err)
+	}
 	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxConnectDelay)
 	opts.SetKeepAlive(60 * time.Second)
 	opts.SetPingTimeout(10 * time.Second)
 
-	handler := &MQTTHandler{redis: redisClient}
+	handler := &MQTTHandler{broker: config.BrokerURL, store: store, archive: archive, stats: stats}
+	handler.queue = newIngestQueue(handler, ingest)
 	opts.SetDefaultPublishHandler(handler.messageHandler)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Printf("✅ Connected to MQTT Broker %s as %s", config.BrokerURL, config.ClientID)
+		for _, topic := range handler.topics {
+			token := client.Subscribe(topic, 1, nil)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("❌ Failed to subscribe to %s: %v", topic, token.Error())
+				continue
+			}
+			log.Printf("📡 Subscribed to: %s", topic)
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf("⚠️ Lost the MQTT connection: %v, reconnecting...", err)
+	})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("❌ Failed to connect to MQTT: %v", token.Error())
-	}
-
-	handler.client = client
-	log.Println("✅ Connected to MQTT Broker")
-
+	handler.client = mqtt.NewClient(opts)
 	return handler
 }
 
+// subscribe adds a topic to subscribe to once connected
 func (h *MQTTHandler) subscribe(topic string) {
-	token := h.client.Subscribe(topic, 1, nil)
+	h.topics = append(h.topics, topic)
+}
+
+// connect makes one connection attempt. Once connected, the client
+// reconnects and subscribes again by itself.
+func (h *MQTTHandler) connect() error {
+	token := h.client.Connect()
 	token.Wait()
-	log.Printf("📡 Subscribed to: %s", topic)
+	return token.Error()
 }
 
+// disconnect unsubscribes, so the broker stops sending, and disconnects.
+// Messages already received are still queued.
+func (h *MQTTHandler) disconnect(ctx context.Context) {
+	if !h.client.IsConnectionOpen() {
+		h.client.Disconnect(0) // Stops reconnecting
+		return
+	}
+	token := h.client.Unsubscribe(h.topics...)
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			log.Printf("⚠️ Failed to unsubscribe: %v", token.Error())
+		}
+	case <-ctx.Done():
+	}
+	h.client.Disconnect(250)
+	log.Println("✅ Disconnected from MQTT")
+}
+
+// messageHandler runs on the MQTT client goroutine, so it only queues the
+// message; the ingestion workers parse and store it
 func (h *MQTTHandler) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	topic := msg.Topic()
-
-	// Handle sensor data from farm/sensors/*/sensorID
-	if strings.HasPrefix(topic, "farm/sensors/") {
-		var sensorMsg SensorMessage
-		if err := json.Unmarshal(msg.Payload(), &sensorMsg); err != nil {
-			log.Printf("❌ Failed to parse sensor message: %v", err)
-			return
-		}
-
-		// Store in Redis with full metadata
-		err := h.redis.storeSensorReading(
-			sensorMsg.SensorID,
-			sensorMsg.Type,
-			sensorMsg.Value,
-			sensorMsg.Unit,
-			sensorMsg.Lat,
-			sensorMsg.Lon,
-			sensorMsg.Timestamp,
-		)
-		if err != nil {
-			log.Printf("❌ Failed to store sensor reading: %v", err)
-			return
+	mqttMessagesReceived.WithLabelValues(topicLabel(msg.Topic())).Inc()
+	h.lastMessage.Store(time.Now().UnixNano())
+	h.queue.enqueue(ingestItem{Topic: msg.Topic(), Payload: msg.Payload(), Received: time.Now()})
+}
+
+// handleMessage stores a gate, command or edge message. Sensor readings go
+// through the ingestion pipeline instead.
+func (h *MQTTHandler) handleMessage(ctx context.Context, farm, topic, rest string, payload []byte) error {
+	// Handle gate status
+	if strings.HasPrefix(rest, "gates/") {
+		var gateMsg GateStatusMessage
+		if err := json.Unmarshal(payload, &gateMsg); err != nil {
+			mqttParseFailures.WithLabelValues("gate_status").Inc()
+			return unparseable(fmt.Errorf("gate message: %w", err))
+		}
+		if !sameFarm(farm, gateMsg.FarmID, topic) {
+			return nil
 		}
 
-		// Store in history
-		h.redis.storeSensorHistory(sensorMsg.SensorID, sensorMsg.Value, sensorMsg.Timestamp)
+		if err := h.store.storeGateStatus(ctx, farm, gateMsg.GateID, gateMsg.IsOpen, gateMsg.Timestamp); err != nil {
+			return fmt.Errorf("store gate status: %w", err)
+		}
+		event := GateEvent{
+			Type:      "state",
+			GateID:    gateMsg.GateID,
+			Timestamp: gateMsg.Timestamp,
+			Status:    gateMsg.Status,
+		}
+		if err := h.store.storeGateEvent(ctx, farm, event); err != nil {
+			return fmt.Errorf("store gate state change: %w", err)
+		}
+		h.archive.addGateEvent(farm, event)
+		h.stats.setGate(farm, gateMsg.GateID, gateMsg.IsOpen)
+		log.Printf("✅ Stored: [%s] Gate %d = %s", farm, gateMsg.GateID, gateMsg.Status)
+	}
+
+	// Handle gate commands (from the edge or manual tools)
+	if strings.HasPrefix(rest, "commands/water-gate-sensors/") {
+		var cmdMsg GateCommandMessage
+		if err := json.Unmarshal(payload, &cmdMsg); err != nil {
+			mqttParseFailures.WithLabelValues("gate_command").Inc()
+			return unparseable(fmt.Errorf("gate command: %w", err))
+		}
+		if !sameFarm(farm, cmdMsg.FarmID, topic) {
+			return nil
+		}
 
-		log.Printf("✅ Stored: Sensor %d (%s) = %.2f %s",
-			sensorMsg.SensorID, sensorMsg.Type, sensorMsg.Value, sensorMsg.Unit)
+		command := cmdMsg.Command
+		if command == "" {
+			command = cmdMsg.Action
+		}
+		event := GateEvent{
+			Type:      "command",
+			GateID:    cmdMsg.GateID,
+			Timestamp: cmdMsg.Timestamp,
+			Command:   command,
+			Reason:    cmdMsg.Reason,
+			Source:    cmdMsg.Source,
+			KeyID:     cmdMsg.KeyID,
+		}
+		if err := h.store.storeGateEvent(ctx, farm, event); err != nil {
+			return fmt.Errorf("store gate command: %w", err)
+		}
+		h.archive.addGateEvent(farm, event)
+		log.Printf("✅ Stored: [%s] Gate %d command %s", farm, cmdMsg.GateID, command)
 	}
 
-	// Handle gate status
-	if strings.HasPrefix(topic, "farm/gates/") || strings.HasPrefix(topic, "gates/") {
-		var gateMsg GateStatusMessage
-		if err := json.Unmarshal(msg.Payload(), &gateMsg); err != nil {
-			log.Printf("❌ Failed to parse gate message: %v", err)
-			return
+	// Handle irrigation queue snapshots from the edge scheduler
+	if rest == "edge/irrigation-queue" {
+		if !json.Valid(payload) {
+			mqttParseFailures.WithLabelValues("irrigation_queue").Inc()
+			return unparseable(fmt.Errorf("irrigation queue message is not JSON"))
 		}
 
-		h.redis.storeGateStatus(gateMsg.GateID, gateMsg.IsOpen, gateMsg.Timestamp)
-		log.Printf("✅ Stored: Gate %d = %s", gateMsg.GateID, gateMsg.Status)
+		if err := h.store.storeIrrigationQueue(ctx, farm, payload); err != nil {
+			return fmt.Errorf("store irrigation queue: %w", err)
+		}
+		log.Printf("✅ Stored: [%s] Irrigation queue snapshot", farm)
 	}
-}
 
-// ============================================================================
-// HTTP HANDLERS
-// ============================================================================
+	// Handle decision audit events from the edge
+	if rest == "edge/decisions" {
+		var decision DecisionMessage
+		if err := json.Unmarshal(payload, &decision); err != nil {
+			mqttParseFailures.WithLabelValues("decision").Inc()
+			return unparseable(fmt.Errorf("decision message: %w", err))
+		}
+		if !sameFarm(farm, decision.FarmID, topic) {
+			return nil
+		}
 
-type APIHandlers struct {
-	redis *RedisClient
+		if err := h.store.storeDecision(ctx, farm, payload, decision.Timestamp); err != nil {
+			return fmt.Errorf("store decision: %w", err)
+		}
+		// Queue and cooldown decisions repeat while a zone waits, the gate
+		// history keeps only the ones that moved the gate
+		if (decision.Action == "open" || decision.Action == "close") && decision.GateID != 0 {
+			event := GateEvent{
+				Type:      "decision",
+				GateID:    decision.GateID,
+				Timestamp: decision.Timestamp,
+				Action:    decision.Action,
+				Reason:    decision.Reason,
+				Source:    decision.Source,
+			}
+			if err := h.store.storeGateEvent(ctx, farm, event); err != nil {
+				return fmt.Errorf("store decision gate event: %w", err)
+			}
+			h.archive.addGateEvent(farm, event)
+			log.Printf("✅ Stored: [%s] Decision gate %d → %s (%s)", farm, decision.GateID, decision.Action, decision.Reason)
+		}
+		h.archive.addDecision(farm, decision, payload)
+	}
+	return nil
 }
 
-func newAPIHandlers(redisClient *RedisClient) *APIHandlers {
-	return &APIHandlers{redis: redisClient}
+// parseSensorReading decodes one reading, JSON or compact
+func (h *MQTTHandler) parseSensorReading(ctx context.Context, farm, topic, rest string, payload []byte) (SensorMessage, error) {
+	var sensorMsg SensorMessage
+	if isCompactTopic(rest) {
+		sensorPayloadBytes.WithLabelValues(compactSuffix).Add(float64(len(payload)))
+		var err error
+		if sensorMsg, err = h.decodeCompact(ctx, farm, rest, payload); err != nil {
+			mqttParseFailures.WithLabelValues("sensor_cbor").Inc()
+			return sensorMsg, err
+		}
+	} else {
+		sensorPayloadBytes.WithLabelValues("json").Add(float64(len(payload)))
+		if err := json.Unmarshal(payload, &sensorMsg); err != nil {
+			mqttParseFailures.WithLabelValues("sensor").Inc()
+			return sensorMsg, unparseable(fmt.Errorf("sensor message: %w", err))
+		}
+	}
+	if !sameFarm(farm, sensorMsg.FarmID, topic) {
+		return sensorMsg, errFarmMismatch
+	}
+	return sensorMsg, nil
 }
 
-// GET /api/sensors (list all sensors with their latest data)
-func (h *APIHandlers) listSensors(c *fiber.Ctx) error {
-	sensorIDs, err := h.redis.getAllSensors()
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+// sameFarm rejects payloads that name a different farm than their topic.
+// The topic wins because the broker ACL is enforced on it.
+func sameFarm(topicFarm, payloadFarm, topic string) bool {
+	if payloadFarm == "" || payloadFarm == topicFarm {
+		return true
 	}
+	log.Printf("❌ Farm mismatch on %s: payload says %q", topic, payloadFarm)
+	mqttParseFailures.WithLabelValues("farm_mismatch").Inc()
+	return false
+}
 
-	sensors := []map[string]string{}
-	for _, idStr := range sensorIDs {
-		id, _ := strconv.Atoi(idStr)
-		data, err := h.redis.getLatestReading(id)
-		if err == nil && len(data) > 0 {
-			sensors = append(sensors, data)
-		}
-	}
+// ============================================================================
+// HTTP HANDLERS
+// ============================================================================
 
-	return c.JSON(fiber.Map{
-		"sensors": sensors,
-		"count":   len(sensors),
-	})
+type APIHandlers struct {
+	store   Store
+	layout  *LayoutStore
+	archive *Archiver // nil if archiving is off
+	stats   *Stats
+}
+
+func newAPIHandlers(store Store, layout *LayoutStore, archive *Archiver, stats *Stats) *APIHandlers {
+	return &APIHandlers{store: store, layout: layout, archive: archive, stats: stats}
 }
 
-// GET /api/sensors/:id/latest
+// GET /api/farms/:farm/sensors/:id/latest
 func (h *APIHandlers) getLatestReading(c *fiber.Ctx) error {
 	sensorID, _ := strconv.Atoi(c.Params("id"))
-	data, err := h.redis.getLatestReading(sensorID)
+	data, err := h.store.getLatestReading(c.UserContext(), farmOf(c), sensorID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -283,21 +642,22 @@ func (h *APIHandlers) getLatestReading(c *fiber.Ctx) error {
 	return c.JSON(data)
 }
 
-// GET /api/sensors/:id/history?limit=100
+// GET /api/farms/:farm/sensors/:id/history?limit=100
 func (h *APIHandlers) getSensorHistory(c *fiber.Ctx) error {
 	sensorID, _ := strconv.Atoi(c.Params("id"))
 	limit, _ := strconv.Atoi(c.Query("limit", "100"))
 
-	history, err := h.redis.getSensorHistory(sensorID, limit)
+	history, err := h.store.getSensorHistory(c.UserContext(), farmOf(c), sensorID, limit)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	return c.JSON(fiber.Map{"history": history, "count": len(history)})
 }
 
-// GET /api/gates (list all gates with their status)
+// GET /api/farms/:farm/gates (list all gates with their status)
 func (h *APIHandlers) listGates(c *fiber.Ctx) error {
-	gateIDs, err := h.redis.getAllGates()
+	farm := farmOf(c)
+	gateIDs, err := h.store.getAllGates(c.UserContext(), farm)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -305,7 +665,7 @@ func (h *APIHandlers) listGates(c *fiber.Ctx) error {
 	gates := []map[string]string{}
 	for _, idStr := range gateIDs {
 		id, _ := strconv.Atoi(idStr)
-		status, err := h.redis.getGateStatus(id)
+		status, err := h.store.getGateStatus(c.UserContext(), farm, id)
 		if err == nil && len(status) > 0 {
 			gates = append(gates, status)
 		}
@@ -317,10 +677,10 @@ func (h *APIHandlers) listGates(c *fiber.Ctx) error {
 	})
 }
 
-// GET /api/gates/:id/status
+// GET /api/farms/:farm/gates/:id/status
 func (h *APIHandlers) getGateStatus(c *fiber.Ctx) error {
 	gateID, _ := strconv.Atoi(c.Params("id"))
-	status, err := h.redis.getGateStatus(gateID)
+	status, err := h.store.getGateStatus(c.UserContext(), farmOf(c), gateID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -330,18 +690,18 @@ func (h *APIHandlers) getGateStatus(c *fiber.Ctx) error {
 	return c.JSON(status)
 }
 
-// GET /api/stats (system statistics)
-func (h *APIHandlers) getStats(c *fiber.Ctx) error {
-	sensorIDs, _ := h.redis.getAllSensors()
-	gateIDs, _ := h.redis.getAllGates()
-
-	stats := fiber.Map{
-		"total_sensors": len(sensorIDs),
-		"total_gates":   len(gateIDs),
-		"status":        "online",
-		"timestamp":     time.Now().Unix(),
+// GET /api/farms/:farm/irrigation/queue (edge scheduler queue and supply usage)
+func (h *APIHandlers) getIrrigationQueue(c *fiber.Ctx) error {
+	snapshot, err := h.store.getIrrigationQueue(c.UserContext(), farmOf(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if snapshot == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "No queue reported yet"})
 	}
-	return c.JSON(stats)
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(snapshot)
 }
 
 // ============================================================================
@@ -352,35 +712,138 @@ func main() {
 	log.Println("🚀 Starting Smart Farm Cloud Server...")
 
 	config := loadConfig()
-	redisClient := newRedisClient(config.RedisAddr)
-	mqttHandler := newMQTTHandler(config.MQTTBroker, redisClient)
+	openAPI, err := loadOpenAPI(config.Validate)
+	if err != nil {
+		log.Fatalf("❌ Failed to load the OpenAPI spec: %v", err)
+	}
+	store, err := openStore(config.Store)
+	if err != nil {
+		log.Fatalf("❌ Failed to open the %s store: %v", config.Store.Backend, err)
+	}
+	archive, err := newArchiver(config.Archive)
+	if err != nil {
+		log.Fatalf("❌ Failed to open the archive: %v", err)
+	}
+	layout := newLayoutStore(config.LayersDir)
+	stats := newStats(store, layout)
+	mqttHandler := newMQTTHandler(config.MQTT, store, archive, stats, config.Ingest)
+	mqttHandler.queue.registerMetrics()
+
+	// Subscribe to every farm's topics (farm/<farm>/...)
+	mqttHandler.subscribe("farm/+/sensors/#") // All sensor data
+	mqttHandler.subscribe("farm/+/gates/#")   // All gate status
+	mqttHandler.subscribe("farm/+/edge/irrigation-queue")
+	mqttHandler.subscribe("farm/+/edge/decisions")
+	mqttHandler.subscribe("farm/+/commands/water-gate-sensors/+")
+
+	// Old un-namespaced topics, stored under the default farm
+	mqttHandler.subscribe("farm/sensors/#")
+	mqttHandler.subscribe("farm/gates/#")
+	mqttHandler.subscribe("gates/+/status")
+	mqttHandler.subscribe("farm/edge/irrigation-queue")
+	mqttHandler.subscribe("farm/edge/decisions")
+	mqttHandler.subscribe("farm/commands/water-gate-sensors/+")
+
+	auth := newAuth(store, config.JWTSecret)
+	health := newHealth(store, config.Store.Backend, mqttHandler)
+	handlers := newAPIHandlers(store, layout, archive, stats)
+
+	// Requests and streamed exports are cancelled once the server stops serving
+	serving, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+
+	app := newApp(config, serving, openAPI, auth, health, handlers, mqttHandler.queue)
+	if err := openAPI.checkRoutes(app); err != nil {
+		log.Fatalf("❌ The API does not match openapi.yaml: %v", err)
+	}
 
-	// Subscribe to correct topics from simulator
-	mqttHandler.subscribe("farm/sensors/#") // All sensor data
-	mqttHandler.subscribe("farm/gates/#")   // All gate status
-	mqttHandler.subscribe("gates/+/status") // Edge processor gate updates
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
+	// Connect to the store and broker while already answering /healthz and /readyz
+	started := make(chan struct{})
+	go func() {
+		startup(signals, health, config, stats)
+		close(started)
+	}()
+
+	go func() {
+		log.Printf("🌐 Server listening on http://localhost%s", config.HTTPPort)
+		if err := app.Listen(config.HTTPPort); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-signals.Done()
+	stopSignals() // A second signal exits at once
+	lifecycle := &Lifecycle{
+		app:         app,
+		stopServing: stopServing,
+		started:     started,
+		mqtt:        mqttHandler,
+		archive:     archive,
+		stats:       stats,
+		store:       store,
+	}
+	lifecycle.shutdown(config.Shutdown)
+	log.Println("👋 Bye")
+}
+
+// newApp registers the middleware, dashboard and routes
+func newApp(config *Config, serving context.Context, openAPI *OpenAPI, auth *Auth, health *Health,
+	handlers *APIHandlers, queue *IngestQueue) *fiber.App {
 	app := fiber.New(fiber.Config{
 		AppName: "Smart Farm Cloud Server v1.0",
 	})
 
 	app.Use(logger.New())
-	app.Use(cors.New())
-
+	app.Use(requestContext(serving))
+	app.Use(cors.New(cors.Config{
+		AllowOrigins:     config.CORSOrigins,
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-API-Key",
+		AllowCredentials: true,
+	}))
+	app.Use(metricsMiddleware)
+	app.Use(auth.authenticate)
+	app.Use(auth.auditUserActions)
+
+	// Metrics carry every farm's readings, so only admins (or an admin API
+	// key in the scrape config) see them
+	app.Get("/metrics", requireRole(roleAdmin), adaptor.HTTPHandler(promhttp.Handler()))
+	app.Get("/healthz", health.healthz)
+	app.Get("/readyz", health.readyz)
+
+	app.Use(requireDashboardLogin)
 	app.Static("/", "./static")
 
-
-	handlers := newAPIHandlers(redisClient)
 	api := app.Group("/api")
-
-	api.Get("/sensors", handlers.listSensors)
-	api.Get("/sensors/:id/latest", handlers.getLatestReading)
-	api.Get("/sensors/:id/history", handlers.getSensorHistory)
-
-	api.Get("/gates", handlers.listGates)
-	api.Get("/gates/:id/status", handlers.getGateStatus)
-
-	api.Get("/stats", handlers.getStats)
+	api.Use(openAPI.validate)
+	api.Get("/openapi.json", openAPI.serve)
+
+	viewer := requireRole(roleViewer)
+	operator := requireRole(roleOperator)
+	admin := requireRole(roleAdmin)
+
+	api.Post("/auth/login", auth.login)
+	api.Post("/auth/logout", auth.logout)
+	api.Get("/auth/me", viewer, auth.me)
+
+	api.Get("/farms", viewer, handlers.listFarms)
+	registerFarmRoutes(api.Group("/farms/:farm"), farmScope, handlers)
+	registerFarmRoutes(api, defaultFarmScope, handlers) // Old single-farm routes
+
+	api.Get("/users", admin, auth.listUsers)
+	api.Post("/users", admin, auth.createUser)
+	api.Put("/users/:name", admin, auth.updateUser)
+	api.Delete("/users/:name", admin, auth.removeUser)
+	api.Put("/users/:name/password", admin, auth.setPassword)
+	api.Get("/users/:name/api-keys", admin, auth.listAPIKeys)
+	api.Post("/users/:name/api-keys", admin, auth.createAPIKey)
+	api.Delete("/users/:name/api-keys/:id", admin, auth.revokeAPIKey)
+	api.Get("/audit", admin, auth.listAudit)
+	api.Get("/ingest/status", admin, queue.status)
+	api.Get("/ingest/dead-letters", operator, queue.listDeadLetters)
+	api.Post("/ingest/dead-letters/replay", operator, queue.replayDeadLetters)
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
@@ -388,12 +851,37 @@ func main() {
 			"version": "1.0",
 			"status":  "running",
 			"endpoints": []string{
-				"/api/sensors",
-				"/api/sensors/:id/latest",
-				"/api/sensors/:id/history",
-				"/api/gates",
-				"/api/gates/:id/status",
-				"/api/stats",
+				"/api/farms",
+				"/api/farms/:farm/sensors",
+				"/api/farms/:farm/devices",
+				"/api/farms/:farm/sensors/:id/latest",
+				"/api/farms/:farm/sensors/:id/history",
+				"/api/farms/:farm/gates",
+				"/api/farms/:farm/gates/:id/status",
+				"/api/farms/:farm/gates/:id/history",
+				"/api/farms/:farm/gates/:id/duty-cycle",
+				"/api/farms/:farm/geo/layers/:name",
+				"/api/farms/:farm/geo/zones",
+				"/api/farms/:farm/geo/heatmap",
+				"/api/farms/:farm/geo/surface",
+				"/api/farms/:farm/geo/contours",
+				"/api/farms/:farm/decisions",
+				"/api/farms/:farm/irrigation/queue",
+				"/api/farms/:farm/stats",
+				"/api/farms/:farm/export/latest",
+				"/api/farms/:farm/export/history",
+				"/api/farms/:farm/export/gates",
+				"/api/farms/:farm/archive",
+				"/api/farms/:farm/archive/download",
+				"/api/auth/login",
+				"/api/users",
+				"/api/audit",
+				"/api/ingest/status",
+				"/api/ingest/dead-letters",
+				"/api/openapi.json",
+				"/healthz",
+				"/readyz",
+				"/metrics",
 			},
 		})
 	})
@@ -407,6 +895,5 @@ func main() {
 		})
 	})
 
-	log.Printf("🌐 Server listening on http://localhost%s", config.HTTPPort)
-	log.Fatal(app.Listen(config.HTTPPort))
+	return app
 }
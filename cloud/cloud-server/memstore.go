@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ============================================================================
+// IN-MEMORY STORE
+// ============================================================================
+
+// MemoryStore keeps everything in maps, for tests and demos without Redis.
+// It follows the Redis store: the same records, the last 1000 readings per
+// sensor and the last 100000 events per audit trail.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	farms       map[string]bool
+	latest      map[farmItem]map[string]string // Latest reading per sensor
+	history     map[farmItem][]string          // Newest first
+	gates       map[farmItem]map[string]string // Latest status per gate
+	gateHistory map[farmItem]*auditLog
+	gateStates  map[farmItem]*auditLog
+	queues      map[string][]byte
+	decisions   map[string]*auditLog
+	devices     map[farmItem][]byte // JSON, so callers never share a Device
+	users       map[string]User
+	apiKeys     map[string]APIKey // By hash of the secret
+	userAudit   *auditLog
+}
+
+// farmItem is a sensor, gate or device of a farm
+type farmItem struct {
+	farm string
+	id   int
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		farms:       make(map[string]bool),
+		latest:      make(map[farmItem]map[string]string),
+		history:     make(map[farmItem][]string),
+		gates:       make(map[farmItem]map[string]string),
+		gateHistory: make(map[farmItem]*auditLog),
+		gateStates:  make(map[farmItem]*auditLog),
+		queues:      make(map[string][]byte),
+		decisions:   make(map[string]*auditLog),
+		devices:     make(map[farmItem][]byte),
+		users:       make(map[string]User),
+		apiKeys:     make(map[string]APIKey),
+		userAudit:   newAuditLog(),
+	}
+}
+
+func (m *MemoryStore) ping(ctx context.Context) error    { return nil }
+func (m *MemoryStore) prepare(ctx context.Context) error { return nil }
+func (m *MemoryStore) close() error                      { return nil }
+
+// idsOf lists the IDs a farm has in one of the maps, as Redis set members
+func idsOf[V any](items map[farmItem]V, farm string) []string {
+	ids := []int{}
+	for item := range items {
+		if item.farm == farm {
+			ids = append(ids, item.id)
+		}
+	}
+	sort.Ints(ids)
+
+	members := make([]string, len(ids))
+	for i, id := range ids {
+		members[i] = strconv.Itoa(id)
+	}
+	return members
+}
+
+// ============================================================================
+// AUDIT LOG
+// ============================================================================
+
+// auditLog is the in-memory counterpart of a Redis sorted set scored by
+// timestamp: entries are ordered by time and each entry is kept once.
+type auditLog struct {
+	entries []auditEntry     // Oldest first
+	members map[string]int64 // Timestamp of each entry
+}
+
+type auditEntry struct {
+	timestamp int64
+	data      string
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{members: make(map[string]int64)}
+}
+
+// auditLogOf returns the log stored under key, creating it
+func auditLogOf[K comparable](logs map[K]*auditLog, key K) *auditLog {
+	if logs[key] == nil {
+		logs[key] = newAuditLog()
+	}
+	return logs[key]
+}
+
+// search returns the index of the first entry after timestamp, or at it
+// when inclusive is set
+func (l *auditLog) search(timestamp int64, inclusive bool) int {
+	return sort.Search(len(l.entries), func(i int) bool {
+		if inclusive {
+			return l.entries[i].timestamp >= timestamp
+		}
+		return l.entries[i].timestamp > timestamp
+	})
+}
+
+// add records an entry, moving it if it was recorded before, and drops the
+// oldest entries beyond maxAuditEvents
+func (l *auditLog) add(timestamp int64, data string) {
+	if previous, ok := l.members[data]; ok {
+		for i := l.search(previous, true); i < len(l.entries) && l.entries[i].timestamp == previous; i++ {
+			if l.entries[i].data == data {
+				l.entries = append(l.entries[:i], l.entries[i+1:]...)
+				break
+			}
+		}
+	}
+
+	i := l.search(timestamp, false)
+	l.entries = append(l.entries, auditEntry{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = auditEntry{timestamp: timestamp, data: data}
+	l.members[data] = timestamp
+
+	if excess := len(l.entries) - maxAuditEvents; excess > 0 {
+		for _, entry := range l.entries[:excess] {
+			delete(l.members, entry.data)
+		}
+		l.entries = append([]auditEntry(nil), l.entries[excess:]...)
+	}
+}
+
+// query returns the entries in a time range, newest first
+func (l *auditLog) query(span timeRange, offset, count int64) []string {
+	items := []string{}
+	if l == nil {
+		return items
+	}
+	first := l.search(span.From, true)
+	for i := l.search(span.To, false) - 1 - int(offset); i >= first && int64(len(items)) < count; i-- {
+		items = append(items, l.entries[i].data)
+	}
+	return items
+}
+
+// ============================================================================
+// SENSORS, GATES AND EDGE DATA
+// ============================================================================
+
+// Store the latest readings and their history
+func (m *MemoryStore) storeSensorReadings(ctx context.Context, farm string, msgs []SensorMessage) error {
+	entries := make([]string, len(msgs))
+	for i, msg := range msgs {
+		entry, err := sensorHistoryEntry(msg)
+		if err != nil {
+			return err
+		}
+		entries[i] = string(entry)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.farms[farm] = true
+	for i, msg := range msgs {
+		item := farmItem{farm, msg.SensorID}
+		latest := m.latest[item]
+		if latest == nil {
+			latest = make(map[string]string)
+			m.latest[item] = latest
+		}
+		fields, stale := latestReadingFields(farm, msg)
+		for _, field := range stale {
+			delete(latest, field)
+		}
+		maps.Copy(latest, fields)
+
+		history := append([]string{entries[i]}, m.history[item]...)
+		if len(history) > maxSensorHistory {
+			history = history[:maxSensorHistory]
+		}
+		m.history[item] = history
+	}
+	return nil
+}
+
+// Get latest reading
+func (m *MemoryStore) getLatestReading(ctx context.Context, farm string, sensorID int) (map[string]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	latest := maps.Clone(m.latest[farmItem{farm, sensorID}])
+	if latest == nil {
+		latest = map[string]string{}
+	}
+	return latest, nil
+}
+
+// Get the latest readings of many sensors
+func (m *MemoryStore) getLatestReadings(ctx context.Context, farm string, sensorIDs []int) (map[int]map[string]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	readings := make(map[int]map[string]string, len(sensorIDs))
+	for _, id := range sensorIDs {
+		if latest := m.latest[farmItem{farm, id}]; len(latest) > 0 {
+			readings[id] = maps.Clone(latest)
+		}
+	}
+	return readings, nil
+}
+
+// Get history (last N readings)
+func (m *MemoryStore) getSensorHistory(ctx context.Context, farm string, sensorID int, count int) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	history := m.history[farmItem{farm, sensorID}]
+	if count > 0 && count < len(history) {
+		history = history[:count]
+	}
+	return append([]string{}, history...), nil
+}
+
+// Get history entries in a time range (newest first)
+func (m *MemoryStore) querySensorHistory(ctx context.Context, farm string, sensorID int, span timeRange, offset, count int64) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return pageHistory(m.history[farmItem{farm, sensorID}], span, offset, count), nil
+}
+
+// Get all sensor IDs of a farm
+func (m *MemoryStore) getAllSensors(ctx context.Context, farm string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return idsOf(m.latest, farm), nil
+}
+
+// Store gate status
+func (m *MemoryStore) storeGateStatus(ctx context.Context, farm string, gateID int, isOpen bool, timestamp int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.farms[farm] = true
+	m.gates[farmItem{farm, gateID}] = gateStatusFields(farm, gateID, isOpen, timestamp)
+	return nil
+}
+
+// Get gate status
+func (m *MemoryStore) getGateStatus(ctx context.Context, farm string, gateID int) (map[string]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	status := maps.Clone(m.gates[farmItem{farm, gateID}])
+	if status == nil {
+		status = map[string]string{}
+	}
+	return status, nil
+}
+
+// Get the status of many gates
+func (m *MemoryStore) getGateStatuses(ctx context.Context, farm string, gateIDs []int) (map[int]map[string]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	statuses := make(map[int]map[string]string, len(gateIDs))
+	for _, id := range gateIDs {
+		if status := m.gates[farmItem{farm, id}]; len(status) > 0 {
+			statuses[id] = maps.Clone(status)
+		}
+	}
+	return statuses, nil
+}
+
+// Get all gate IDs of a farm
+func (m *MemoryStore) getAllGates(ctx context.Context, farm string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return idsOf(m.gates, farm), nil
+}
+
+// Store an event in a gate's history
+func (m *MemoryStore) storeGateEvent(ctx context.Context, farm string, event GateEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	item := farmItem{farm, event.GateID}
+	auditLogOf(m.gateHistory, item).add(event.Timestamp, string(data))
+	if event.Type == "state" {
+		auditLogOf(m.gateStates, item).add(event.Timestamp, string(data))
+	}
+	return nil
+}
+
+// Query a gate's history in a time range, newest first
+func (m *MemoryStore) queryGateHistory(ctx context.Context, farm string, gateID int, span timeRange, offset, count int64) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.gateHistory[farmItem{farm, gateID}].query(span, offset, count), nil
+}
+
+// Get a gate's state changes in a time range (oldest first), plus the last
+// state change before the range
+func (m *MemoryStore) getGateStates(ctx context.Context, farm string, gateID int, from, to int64) (*GateEvent, []GateEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	states := []GateEvent{}
+	changes := m.gateStates[farmItem{farm, gateID}]
+	if changes == nil {
+		return nil, states, nil
+	}
+
+	first := changes.search(from, true)
+	var initial *GateEvent
+	if first > 0 {
+		var event GateEvent
+		if json.Unmarshal([]byte(changes.entries[first-1].data), &event) == nil {
+			initial = &event
+		}
+	}
+	for _, entry := range changes.entries[first:changes.search(to, false)] {
+		var event GateEvent
+		if json.Unmarshal([]byte(entry.data), &event) == nil {
+			states = append(states, event)
+		}
+	}
+	return initial, states, nil
+}
+
+// Store the latest irrigation queue snapshot published by the edge
+func (m *MemoryStore) storeIrrigationQueue(ctx context.Context, farm string, snapshot []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queues[farm] = append([]byte(nil), snapshot...)
+	return nil
+}
+
+// Get the latest irrigation queue snapshot, nil if none was reported
+func (m *MemoryStore) getIrrigationQueue(ctx context.Context, farm string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.queues[farm], nil
+}
+
+// Store an edge decision event
+func (m *MemoryStore) storeDecision(ctx context.Context, farm string, event []byte, timestamp int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	auditLogOf(m.decisions, farm).add(timestamp, string(event))
+	return nil
+}
+
+// Query decisions in a time range, newest first
+func (m *MemoryStore) queryDecisions(ctx context.Context, farm string, span timeRange, offset, count int64) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.decisions[farm].query(span, offset, count), nil
+}
+
+// ============================================================================
+// REGISTRY AND FARMS
+// ============================================================================
+
+// Create or replace a device
+func (m *MemoryStore) storeDevice(ctx context.Context, farm string, device Device) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.farms[farm] = true
+	m.devices[farmItem{farm, device.SensorID}] = data
+	return nil
+}
+
+// Get a device, nil if it is not registered
+func (m *MemoryStore) getDevice(ctx context.Context, farm string, sensorID int) (*Device, error) {
+	m.mutex.RLock()
+	data, ok := m.devices[farmItem{farm, sensorID}]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	var device Device
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Get the registry entries of many devices, unknown devices are left out
+func (m *MemoryStore) getDevices(ctx context.Context, farm string, sensorIDs []int) (map[int]*Device, error) {
+	devices := make(map[int]*Device, len(sensorIDs))
+	for _, id := range sensorIDs {
+		device, err := m.getDevice(ctx, farm, id)
+		if err != nil {
+			return nil, err
+		}
+		if device != nil {
+			devices[id] = device
+		}
+	}
+	return devices, nil
+}
+
+// Get all registered devices of a farm, ordered by ID
+func (m *MemoryStore) getAllDevices(ctx context.Context, farm string) ([]Device, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	devices := []Device{}
+	for item, data := range m.devices {
+		var device Device
+		if item.farm == farm && json.Unmarshal(data, &device) == nil {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SensorID < devices[j].SensorID })
+	return devices, nil
+}
+
+// Remove a device from the registry (its readings are kept)
+func (m *MemoryStore) deleteDevice(ctx context.Context, farm string, sensorID int) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	item := farmItem{farm, sensorID}
+	_, found := m.devices[item]
+	delete(m.devices, item)
+	return found, nil
+}
+
+// Get all farms that have reported data
+func (m *MemoryStore) getAllFarms(ctx context.Context) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	farms := make([]string, 0, len(m.farms))
+	for farm := range m.farms {
+		farms = append(farms, farm)
+	}
+	return farms, nil
+}
+
+// ============================================================================
+// USERS AND API KEYS
+// ============================================================================
+
+// Create or replace a user
+func (m *MemoryStore) storeUser(ctx context.Context, user User) error {
+	user.Farms = append([]string{}, user.Farms...)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.users[user.Username] = user
+	return nil
+}
+
+// Get a user, nil if it does not exist
+func (m *MemoryStore) getUser(ctx context.Context, username string) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	user, ok := m.users[username]
+	if !ok {
+		return nil, nil
+	}
+	user.Farms = append([]string{}, user.Farms...)
+	return &user, nil
+}
+
+// Get all usernames
+func (m *MemoryStore) getAllUsers(ctx context.Context) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.users))
+	for name := range m.users {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Delete a user and its API keys
+func (m *MemoryStore) deleteUser(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for hash, key := range m.apiKeys {
+		if key.Username == username {
+			delete(m.apiKeys, hash)
+		}
+	}
+	delete(m.users, username)
+	return nil
+}
+
+// Store an API key under the hash of its secret
+func (m *MemoryStore) storeAPIKey(ctx context.Context, hash string, key APIKey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.apiKeys[hash] = key
+	return nil
+}
+
+// Look up an API key by the hash of its secret, nil if unknown
+func (m *MemoryStore) getAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	key, ok := m.apiKeys[hash]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+// List a user's API keys (metadata only)
+func (m *MemoryStore) getUserAPIKeys(ctx context.Context, username string) (map[string]APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	keys := make(map[string]APIKey)
+	for hash, key := range m.apiKeys {
+		if key.Username == username {
+			keys[hash] = key
+		}
+	}
+	return keys, nil
+}
+
+// Revoke an API key by id
+func (m *MemoryStore) deleteAPIKey(ctx context.Context, username, id string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for hash, key := range m.apiKeys {
+		if key.Username == username && key.ID == id {
+			delete(m.apiKeys, hash)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Record a user action
+func (m *MemoryStore) storeUserAudit(ctx context.Context, entry map[string]interface{}, timestamp int64) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.userAudit.add(timestamp, string(data))
+	return nil
+}
+
+// Query user actions in a time range, newest first
+func (m *MemoryStore) queryUserAudit(ctx context.Context, span timeRange, offset, count int64) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.userAudit.query(span, offset, count), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ============================================================================
+// PROMETHEUS METRICS
+// ============================================================================
+
+var (
+	mqttMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_mqtt_messages_received_total",
+		Help: "MQTT messages received, by topic pattern.",
+	}, []string{"topic"})
+
+	mqttParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_mqtt_parse_failures_total",
+		Help: "MQTT messages that could not be parsed, by message kind.",
+	}, []string{"kind"})
+
+	sensorPayloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_sensor_payload_bytes_total",
+		Help: "Sensor payload bytes received, by encoding (json, cbor).",
+	}, []string{"encoding"})
+
+	sensorIngestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloud_sensor_ingest_duration_seconds",
+		Help:    "Time from receiving a sensor message to its readings being stored, queueing included, by mode (single, batch).",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"mode"})
+
+	sensorReadingsIngested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_sensor_readings_ingested_total",
+		Help: "Sensor readings stored, by mode (single, batch).",
+	}, []string{"mode"})
+
+	ingestPipelineReadings = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloud_ingest_pipeline_readings",
+		Help:    "Sensor readings stored per Redis round trip by the ingestion workers.",
+		Buckets: []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000},
+	})
+
+	ingestRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cloud_ingest_retries_total",
+		Help: "Store attempts retried by the ingestion workers after a Redis error.",
+	})
+
+	ingestDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_ingest_dead_letters_total",
+		Help: "MQTT messages written to the dead-letter file, by reason.",
+	}, []string{"reason"})
+
+	uncalibratedReadings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_uncalibrated_readings_total",
+		Help: "Raw sensor readings stored without a value because the device has no calibration, by farm.",
+	}, []string{"farm"})
+
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloud_redis_command_duration_seconds",
+		Help:    "Redis command and pipeline latency.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_redis_errors_total",
+		Help: "Redis commands that returned an error (excluding nil replies).",
+	}, []string{"command"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloud_http_request_duration_seconds",
+		Help:    "HTTP API latency, by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	openAPIViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloud_openapi_violations_total",
+		Help: "Requests rejected and responses logged for not matching openapi.yaml, by kind (request, response) and route.",
+	}, []string{"kind", "route"})
+
+	sensorMetrics = newSensorCollector("cloud")
+)
+
+func init() {
+	prometheus.MustRegister(
+		mqttMessagesReceived,
+		mqttParseFailures,
+		sensorPayloadBytes,
+		sensorIngestDuration,
+		sensorReadingsIngested,
+		ingestPipelineReadings,
+		ingestRetries,
+		ingestDeadLetters,
+		uncalibratedReadings,
+		redisDuration,
+		redisErrors,
+		httpDuration,
+		openAPIViolations,
+		sensorMetrics,
+	)
+}
+
+// observeIngest records a stored sensor message of n readings
+func observeIngest(mode string, n int, start time.Time) {
+	sensorIngestDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+	sensorReadingsIngested.WithLabelValues(mode).Add(float64(n))
+}
+
+// topicLabel turns a topic into a low-cardinality label by dropping numeric
+// ids, e.g. farm/north/sensors/soil-moisture-sensors/9001 → farm/north/sensors/soil-moisture-sensors
+func topicLabel(topic string) string {
+	parts := strings.Split(topic, "/")
+	kept := parts[:0]
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "/")
+}
+
+// metricsMiddleware records API latency per route pattern
+func metricsMiddleware(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := c.Response().StatusCode()
+	if e, ok := err.(*fiber.Error); ok {
+		status = e.Code
+	}
+	httpDuration.WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(status)).
+		Observe(time.Since(start).Seconds())
+	return err
+}
+
+// ============================================================================
+// REDIS INSTRUMENTATION
+// ============================================================================
+
+type redisStartKey struct{}
+
+// redisMetricsHook measures every Redis command and pipeline
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+func observeRedis(ctx context.Context, command string, err error) {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	}
+	if err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ============================================================================
+// MQTT CONNECTION SETTINGS
+// ============================================================================
+
+// This file is the same in the edge, the simulator, the gate test tool and
+// the cloud server. edge/mqttconfig.go is the canonical copy: change it there
+// and copy it to simulator/, water-gate-test/ and cloud/cloud-server/
+// (TestMQTTConfigCopiesAreIdentical in the cloud server checks they match).
+// Each program defines defaultFarm and validateFarmID.
+
+// MQTTConfig holds broker connection settings, read from the environment:
+//
+//	MQTT_BROKER        tcp://, ssl://, ws:// or wss:// URL (default tcp://localhost:1883)
+//	MQTT_CLIENT_ID     Client ID (default <program>-<hostname>, unique per device)
+//	MQTT_USERNAME      Broker username
+//	MQTT_PASSWORD      Broker password
+//	MQTT_CA_FILE       PEM CA bundle used to verify the broker
+//	MQTT_CERT_FILE     PEM client certificate (mutual TLS)
+//	MQTT_KEY_FILE      PEM client key (mutual TLS)
+//	MQTT_TLS_INSECURE  "1" skips broker certificate verification (testing only)
+//	FARM_ID            Farm/site namespace for all topics (default "default",
+//	                   not used by the cloud, which serves every farm)
+//
+// Topic ACL per program for farm "north" (mosquitto acl_file syntax). Use
+// one user per program and farm. The edge is the only writer of gate
+// commands in automatic mode, sensors must not be able to write commands and
+// the gate test tool, which can drive any gate, is for technicians only:
+//
+//	user edge-north
+//	topic read  farm/north/sensors/#
+//	topic write farm/north/commands/water-gate-sensors/+
+//	topic write farm/north/gates/+/status
+//	topic write farm/north/edge/#
+//
+//	user simulator-north
+//	topic write farm/north/sensors/#
+//	topic read  farm/north/commands/water-gate-sensors/+
+//
+//	user gate-tester-north
+//	topic write farm/north/commands/water-gate-sensors/+
+//
+//	user cloud
+//	topic read farm/#
+//	topic read gates/+/status
+type MQTTConfig struct {
+	BrokerURL   string
+	ClientID    string
+	Username    string
+	Password    string
+	CAFile      string
+	CertFile    string
+	KeyFile     string
+	TLSInsecure bool
+	FarmID      string
+}
+
+func loadMQTTConfig(program string) MQTTConfig {
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = fmt.Sprintf("pid%d", os.Getpid())
+		}
+		clientID = program + "-" + host
+	}
+
+	farm := os.Getenv("FARM_ID")
+	if farm == "" {
+		farm = defaultFarm
+	}
+
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		broker = "tcp://localhost:1883"
+	}
+
+	return MQTTConfig{
+		BrokerURL:   broker,
+		ClientID:    clientID,
+		Username:    os.Getenv("MQTT_USERNAME"),
+		Password:    os.Getenv("MQTT_PASSWORD"),
+		CAFile:      os.Getenv("MQTT_CA_FILE"),
+		CertFile:    os.Getenv("MQTT_CERT_FILE"),
+		KeyFile:     os.Getenv("MQTT_KEY_FILE"),
+		TLSInsecure: os.Getenv("MQTT_TLS_INSECURE") == "1",
+		FarmID:      farm,
+	}
+}
+
+// usesTLS reports whether the broker URL needs a TLS connection
+func (c MQTTConfig) usesTLS() bool {
+	return strings.HasPrefix(c.BrokerURL, "ssl://") ||
+		strings.HasPrefix(c.BrokerURL, "tls://") ||
+		strings.HasPrefix(c.BrokerURL, "mqtts://") ||
+		strings.HasPrefix(c.BrokerURL, "wss://")
+}
+
+// tlsConfig builds the TLS settings from the CA and client certificate files
+func (c MQTTConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.TLSInsecure,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// apply sets broker, client ID, credentials and TLS on the client options
+func (c MQTTConfig) apply(opts *mqtt.ClientOptions) error {
+	if err := validateFarmID(c.FarmID); err != nil {
+		return fmt.Errorf("FARM_ID: %w", err)
+	}
+	opts.AddBroker(c.BrokerURL)
+	opts.SetClientID(c.ClientID)
+
+	if c.Username != "" {
+		opts.SetUsername(c.Username)
+		opts.SetPassword(c.Password)
+	}
+
+	if c.usesTLS() || c.CAFile != "" || c.CertFile != "" {
+		config, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(config)
+	}
+	return nil
+}
+
+// topic builds a topic in this farm's namespace: farm/<farm>/<suffix>
+func (c MQTTConfig) topic(format string, args ...interface{}) string {
+	return "farm/" + c.FarmID + "/" + fmt.Sprintf(format, args...)
+}
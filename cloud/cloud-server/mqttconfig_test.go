@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+func TestMQTTConfigCopiesAreIdentical(t *testing.T) {
+	canonical, err := os.ReadFile("../../edge/mqttconfig.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"mqttconfig.go", "../../simulator/mqttconfig.go", "../../water-gate-test/mqttconfig.go"} {
+		copied, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(copied, canonical) {
+			t.Errorf("%s differs from edge/mqttconfig.go, copy it over", path)
+		}
+	}
+}
+
+func TestMQTTConfigFromEnvironment(t *testing.T) {
+	for _, name := range []string{"MQTT_BROKER", "MQTT_CLIENT_ID", "MQTT_USERNAME", "MQTT_PASSWORD", "FARM_ID"} {
+		t.Setenv(name, "")
+	}
+	host, _ := os.Hostname()
+	config := loadMQTTConfig("cloud-server")
+	if config.BrokerURL != "tcp://localhost:1883" || config.ClientID != "cloud-server-"+host || config.FarmID != defaultFarm {
+		t.Errorf("default config is %+v", config)
+	}
+
+	// Every device sets its own client ID
+	t.Setenv("MQTT_CLIENT_ID", "edge-north-7")
+	t.Setenv("FARM_ID", "north")
+	config = loadMQTTConfig("edge")
+	if config.ClientID != "edge-north-7" || config.topic("sensors/%d", 1) != "farm/north/sensors/1" {
+		t.Errorf("config is %+v", config)
+	}
+
+	t.Setenv("FARM_ID", "sensors")
+	if err := loadMQTTConfig("edge").apply(paho.NewClientOptions()); err == nil {
+		t.Error("reserved FARM_ID accepted")
+	}
+}
+
+// TestMQTTConfigTLSBroker connects to an in-process broker that requires
+// TLS with client certificates and a username and password
+func TestMQTTConfigTLSBroker(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCertificate(t, dir, "ca", nil, nil)
+	testCertificate(t, dir, "broker", ca, caKey)
+	testCertificate(t, dir, "device", ca, caKey)
+	other, otherKey := testCertificate(t, dir, "other-ca", nil, nil)
+	testCertificate(t, dir, "stranger", other, otherKey)
+
+	brokerCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "broker.pem"), filepath.Join(dir, "broker-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	broker := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := broker.AddHook(new(auth.Hook), &auth.Options{Ledger: &auth.Ledger{
+		Auth: auth.AuthRules{{Username: "edge-north", Password: "s3cret", Allow: true}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "tls", Address: "127.0.0.1:0", TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{brokerCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}})
+	if err := broker.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() { broker.Close() })
+
+	valid := MQTTConfig{
+		BrokerURL: "ssl://" + listener.Address(),
+		ClientID:  "edge-north-7",
+		Username:  "edge-north",
+		Password:  "s3cret",
+		CAFile:    filepath.Join(dir, "ca.pem"),
+		CertFile:  filepath.Join(dir, "device.pem"),
+		KeyFile:   filepath.Join(dir, "device-key.pem"),
+		FarmID:    "north",
+	}
+	if err := testConnect(valid); err != nil {
+		t.Fatalf("connect with CA, client certificate and password: %v", err)
+	}
+	client, ok := broker.Clients.Get("edge-north-7")
+	if !ok {
+		t.Fatal("broker does not know client edge-north-7")
+	}
+	if string(client.Properties.Username) != "edge-north" {
+		t.Errorf("broker sees user %q", client.Properties.Username)
+	}
+
+	for name, change := range map[string]func(*MQTTConfig){
+		"wrong password":        func(c *MQTTConfig) { c.Password = "guess" },
+		"no password":           func(c *MQTTConfig) { c.Username, c.Password = "", "" },
+		"no client certificate": func(c *MQTTConfig) { c.CertFile, c.KeyFile = "", "" },
+		"foreign certificate": func(c *MQTTConfig) {
+			c.CertFile, c.KeyFile = filepath.Join(dir, "stranger.pem"), filepath.Join(dir, "stranger-key.pem")
+		},
+		"broker not trusted": func(c *MQTTConfig) { c.CAFile = filepath.Join(dir, "other-ca.pem") },
+		"plain TCP":          func(c *MQTTConfig) { c.BrokerURL = "tcp://" + listener.Address() },
+	} {
+		config := valid
+		config.ClientID = "edge-north-rejected"
+		change(&config)
+		if err := testConnect(config); err == nil {
+			t.Errorf("%s: connected", name)
+		}
+	}
+
+	// A missing or empty CA file is reported before connecting
+	config := valid
+	config.CAFile = filepath.Join(dir, "missing.pem")
+	if err := config.apply(paho.NewClientOptions()); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+// testConnect connects and disconnects with a config
+func testConnect(config MQTTConfig) error {
+	opts := paho.NewClientOptions()
+	if err := config.apply(opts); err != nil {
+		return err
+	}
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(5 * time.Second)
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(10 * time.Second) {
+		return os.ErrDeadlineExceeded
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	client.Disconnect(100)
+	return nil
+}
+
+// testCertificate writes <name>.pem and <name>-key.pem to dir, a CA if
+// parent is nil, otherwise a certificate for 127.0.0.1 signed by parent
+func testCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// ============================================================================
+// OPENAPI CONTRACT
+// ============================================================================
+
+// openapi.yaml documents every /api route. It is served at /api/openapi.json,
+// requests are validated against it, and the Go client in cloud/client is
+// generated from it.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Validation modes (CLOUD_OPENAPI_VALIDATE)
+const (
+	validateOff      = "off"
+	validateRequests = "requests" // Reject requests that do not match the spec
+	validateAll      = "all"      // Also log JSON responses that do not match the spec
+)
+
+type OpenAPI struct {
+	doc    *openapi3.T
+	router routers.Router
+	json   []byte // The spec as served
+	mode   string
+}
+
+func loadOpenAPI(mode string) (*OpenAPI, error) {
+	switch mode {
+	case validateOff, validateRequests, validateAll:
+	default:
+		return nil, fmt.Errorf("CLOUD_OPENAPI_VALIDATE must be off, requests or all, got %q", mode)
+	}
+
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("parse openapi.yaml: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid openapi.yaml: %w", err)
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Match paths only, whatever host the server is reached at
+	doc.Servers = nil
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep validation errors to one line, without the schema and value
+	openapi3.SchemaErrorDetailsDisabled = true
+	return &OpenAPI{doc: doc, router: router, json: body, mode: mode}, nil
+}
+
+// GET /api/openapi.json
+func (o *OpenAPI) serve(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(o.json)
+}
+
+// findRoute looks a request up in the spec. Old single-farm routes are
+// documented under /api/farms/{farm}.
+func (o *OpenAPI) findRoute(req *http.Request) (*openapi3filter.RequestValidationInput, error) {
+	route, params, err := o.router.FindRoute(req)
+	path := req.URL.Path
+	if err != nil && path != "/api/farms" && !strings.HasPrefix(path, "/api/farms/") {
+		req = req.Clone(req.Context())
+		req.URL.Path = "/api/farms/" + defaultFarm + strings.TrimPrefix(path, "/api")
+		route, params, err = o.router.FindRoute(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: params,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc, // Checked by requireRole
+			SkipSettingDefaults: true,
+		},
+	}, nil
+}
+
+// validate rejects requests that do not match the spec and, in mode "all",
+// logs JSON responses that do not match it. Streamed and binary responses
+// are not checked.
+func (o *OpenAPI) validate(c *fiber.Ctx) error {
+	if o.mode == validateOff {
+		return c.Next()
+	}
+
+	req, err := adaptor.ConvertRequest(c, false)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	input, err := o.findRoute(req)
+	if err != nil {
+		return c.Next() // Unknown path or method, Fiber answers 404/405
+	}
+
+	// Anonymous callers of protected routes get their 401 from requireRole
+	operation := input.Route.Operation
+	public := operation.Security != nil && len(*operation.Security) == 0
+	if public || currentIdentity(c) != nil {
+		if err := openapi3filter.ValidateRequest(c.UserContext(), input); err != nil {
+			openAPIViolations.WithLabelValues("request", input.Route.Path).Inc()
+			return c.Status(400).JSON(fiber.Map{"error": requestError(err)})
+		}
+	}
+
+	if err := c.Next(); err != nil || o.mode != validateAll {
+		return err
+	}
+
+	response := c.Response()
+	contentType := string(response.Header.ContentType())
+	if response.IsBodyStream() || !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON) {
+		return nil
+	}
+	header := http.Header{}
+	header.Set(fiber.HeaderContentType, contentType)
+	err = openapi3filter.ValidateResponse(c.UserContext(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 response.StatusCode(),
+		Header:                 header,
+		Body:                   io.NopCloser(bytes.NewReader(response.Body())),
+	})
+	if err != nil {
+		openAPIViolations.WithLabelValues("response", input.Route.Path).Inc()
+		log.Printf("❌ %s %s %d does not match openapi.yaml: %v",
+			c.Method(), input.Route.Path, response.StatusCode(), err)
+	}
+	return nil
+}
+
+// requestError is the message of a request validation error, without the
+// operation it happened in
+func requestError(err error) string {
+	if requestErr, ok := err.(*openapi3filter.RequestError); ok {
+		if requestErr.Parameter != nil {
+			return fmt.Sprintf("Invalid %s parameter %q: %v",
+				requestErr.Parameter.In, requestErr.Parameter.Name, requestErr.Err)
+		}
+		if requestErr.RequestBody != nil && requestErr.Err != nil {
+			return "Invalid request body: " + requestErr.Err.Error()
+		}
+		return requestErr.Error()
+	}
+	return err.Error()
+}
+
+// checkRoutes compares the registered /api routes with the spec, so that
+// handlers and spec cannot drift apart unnoticed
+func (o *OpenAPI) checkRoutes(app *fiber.App) error {
+	served := map[string]bool{}
+	var undocumented []string
+	for _, route := range app.GetRoutes(true) {
+		if !strings.HasPrefix(route.Path, "/api") || route.Method == fiber.MethodHead {
+			continue
+		}
+		path := specPath(route.Path)
+		if o.doc.Paths.Value(path) == nil && !strings.HasPrefix(path, "/api/farms") {
+			path = "/api/farms/{farm}" + strings.TrimPrefix(path, "/api") // Old single-farm route
+		}
+		item := o.doc.Paths.Value(path)
+		if item == nil || item.GetOperation(route.Method) == nil {
+			undocumented = append(undocumented, route.Method+" "+route.Path)
+			continue
+		}
+		served[route.Method+" "+path] = true
+	}
+
+	var unserved []string
+	for path, item := range o.doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !served[method+" "+path] {
+				unserved = append(unserved, method+" "+path)
+			}
+		}
+	}
+
+	if len(undocumented) == 0 && len(unserved) == 0 {
+		return nil
+	}
+	sort.Strings(undocumented)
+	sort.Strings(unserved)
+	return fmt.Errorf("routes missing from openapi.yaml: %v, documented operations without a route: %v",
+		undocumented, unserved)
+}
+
+// specPath turns a Fiber route into an OpenAPI path, e.g.
+// /api/farms/:farm/gates/:id/status → /api/farms/{farm}/gates/{id}/status
+func specPath(route string) string {
+	parts := strings.Split(route, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
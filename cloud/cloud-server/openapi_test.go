@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contractCase is one request of the contract test
+type contractCase struct {
+	method string
+	path   string
+	body   interface{}
+	status int
+}
+
+// TestContract calls every operation of openapi.yaml and checks each
+// response against it
+func TestContract(t *testing.T) {
+	sensor := server.moisture[0]
+	gate := server.gates[0]
+	now := time.Now().Unix()
+	day := fmt.Sprintf("from=%d&to=%d", now-86400, now)
+	farm := "/api/farms/default"
+
+	cases := []contractCase{
+		{"GET", "/api/", nil, 200},
+		{"GET", "/api/openapi.json", nil, 200},
+		{"GET", "/api/auth/me", nil, 200},
+		{"GET", "/api/farms", nil, 200},
+		{"GET", farm + "/stats", nil, 200},
+		{"GET", farm + "/sensors", nil, 200},
+		{"GET", farm + "/sensors?type=soil-moisture-sensor&sort=value&limit=5&fields=sensor_id,value", nil, 200},
+		{"GET", fmt.Sprintf("%s/sensors/%d/latest", farm, sensor), nil, 200},
+		{"GET", farm + "/sensors/99999/latest", nil, 404},
+		{"GET", fmt.Sprintf("%s/sensors/%d/history?limit=10", farm, sensor), nil, 200},
+		{"GET", farm + "/sensors/abc/history", nil, 400},
+
+		{"GET", farm + "/devices", nil, 200},
+		{"GET", fmt.Sprintf("%s/devices/%d", farm, sensor), nil, 200},
+		{"GET", farm + "/devices/99999", nil, 404},
+		{"POST", farm + "/devices", map[string]interface{}{
+			"sensor_id": 60001, "type": "soil-moisture-sensors", "lat": 32.7637, "lon": 52.6365,
+		}, 201},
+		{"POST", farm + "/devices", map[string]interface{}{
+			"sensor_id": 60001, "type": "soil-moisture-sensors", "lat": 32.7637, "lon": 52.6365,
+		}, 409},
+		{"POST", farm + "/devices", map[string]interface{}{"sensor_id": 60002}, 400},
+		{"PUT", farm + "/devices/60001", map[string]interface{}{
+			"type": "soil-moisture-sensors", "lat": 32.7637, "lon": 52.6365, "status": "maintenance",
+			"calibration": map[string]interface{}{"method": "linear", "coefficients": []float64{0, 1}},
+		}, 200},
+		{"GET", farm + "/devices/export", nil, 200},
+		{"GET", farm + "/devices/export?format=geojson", nil, 200},
+		{"POST", farm + "/devices/import", map[string]interface{}{
+			"devices": []map[string]interface{}{{"sensor_id": 60003, "type": "weather-sensor", "lat": 32.7637, "lon": 52.6365}},
+		}, 200},
+		{"GET", farm + "/devices/calibrations", nil, 200},
+		{"POST", farm + "/devices/calibrations", map[string]interface{}{
+			"calibrations": map[string]interface{}{"60001": nil, "99999": map[string]interface{}{"method": "linear", "coefficients": []float64{0, 1}}},
+		}, 200},
+		{"DELETE", farm + "/devices/60003", nil, 204},
+		{"DELETE", farm + "/devices/60003", nil, 404},
+
+		{"GET", farm + "/gates", nil, 200},
+		{"GET", fmt.Sprintf("%s/gates/%d/status", farm, gate), nil, 200},
+		{"GET", farm + "/gates/99999/status", nil, 404},
+		{"GET", fmt.Sprintf("%s/gates/%d/history", farm, gate), nil, 200},
+		{"GET", fmt.Sprintf("%s/gates/%d/duty-cycle?days=7", farm, gate), nil, 200},
+
+		{"GET", farm + "/geo/layers", nil, 200},
+		{"GET", farm + "/geo/layers/water-gates", nil, 200},
+		{"GET", farm + "/geo/layers/nope", nil, 404},
+		{"GET", farm + "/geo/zones", nil, 200},
+		{"GET", farm + "/geo/heatmap", nil, 200},
+		{"GET", farm + "/geo/surface", nil, 200},
+		{"GET", farm + "/geo/surface?format=asc&method=kriging", nil, 200},
+		{"GET", farm + "/geo/contours?interval=10", nil, 200},
+		{"GET", farm + "/geo/contours?interval=0", nil, 400},
+
+		{"GET", farm + "/decisions", nil, 200},
+		{"GET", fmt.Sprintf("%s/decisions?gate=%d&action=close", farm, gate), nil, 200},
+		{"GET", farm + "/irrigation/queue", nil, 200},
+
+		{"GET", farm + "/export/latest", nil, 200},
+		{"GET", farm + "/export/latest?format=ndjson", nil, 200},
+		{"GET", farm + "/export/history?" + day, nil, 200},
+		{"GET", farm + "/export/history?format=geojson&" + day, nil, 200},
+		{"GET", farm + "/export/gates?" + day, nil, 200},
+		{"GET", farm + "/archive", nil, 200},
+		{"GET", farm + "/archive/download?" + day, nil, 200},
+		{"GET", farm + "/archive/download?format=parquet&kind=gate-events&" + day, nil, 200},
+
+		{"GET", "/api/users", nil, 200},
+		{"POST", "/api/users", map[string]interface{}{
+			"username": "contract", "password": "contract-pass", "role": "operator",
+		}, 201},
+		{"POST", "/api/users", map[string]interface{}{
+			"username": "short", "password": "short", "role": "viewer",
+		}, 400},
+		{"PUT", "/api/users/contract", map[string]interface{}{"role": "viewer", "farms": []string{"default"}}, 200},
+		{"PUT", "/api/users/contract/password", map[string]interface{}{"password": "contract-pass-2"}, 204},
+		{"GET", "/api/users/contract/api-keys", nil, 200},
+		{"POST", "/api/users/contract/api-keys", map[string]interface{}{"name": "ci", "role": "viewer"}, 201},
+		{"POST", "/api/users/nobody/api-keys", map[string]interface{}{"name": "ci"}, 404},
+		{"DELETE", "/api/users/contract/api-keys/missing", nil, 404},
+		{"GET", "/api/audit?limit=10", nil, 200},
+
+		{"GET", "/api/ingest/status", nil, 200},
+		{"GET", "/api/ingest/dead-letters", nil, 200},
+		{"POST", "/api/ingest/dead-letters/replay", nil, 200},
+	}
+	for _, tc := range cases {
+		resp := server.do(t, tc.method, tc.path, tc.body)
+		if resp.status != tc.status {
+			t.Errorf("%s %s: status %d, want %d: %.300s", tc.method, tc.path, resp.status, tc.status, resp.body)
+		}
+	}
+
+	// Revoking a key needs its ID
+	resp := server.do(t, "POST", "/api/users/contract/api-keys", map[string]interface{}{"name": "revoked"})
+	expect(t, resp, 201)
+	var created struct {
+		Key struct {
+			ID string `json:"id"`
+		} `json:"key"`
+	}
+	resp.json(t, &created)
+	expect(t, server.do(t, "DELETE", "/api/users/contract/api-keys/"+url.PathEscape(created.Key.ID), nil), 204)
+	expect(t, server.do(t, "DELETE", "/api/users/contract", nil), 204)
+
+	// Sessions are tokens, logging out clears the cookie
+	resp = server.do(t, "POST", "/api/auth/logout", nil)
+	expect(t, resp, 200)
+	if !strings.Contains(resp.header.Get("Set-Cookie"), tokenCookie+"=;") {
+		t.Errorf("logout did not clear the cookie: %q", resp.header.Get("Set-Cookie"))
+	}
+	expect(t, server.doAs(t, "", "POST", "/api/auth/login", map[string]string{
+		"username": "admin", "password": "wrong-password",
+	}), 401)
+
+	// Every operation of the spec was called
+	var missing []string
+	for _, path := range server.openAPI.doc.Paths.InMatchingOrder() {
+		for method := range server.openAPI.doc.Paths.Find(path).Operations() {
+			if !server.covered[method+" "+path] {
+				missing = append(missing, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Errorf("operations without a checked response:\n%s", strings.Join(missing, "\n"))
+	}
+}
+
+// TestContractLegacyRoutes checks that the routes without a farm answer
+// like the default farm's
+func TestContractLegacyRoutes(t *testing.T) {
+	for _, path := range []string{"/api/stats", "/api/sensors", "/api/gates", "/api/geo/zones"} {
+		expect(t, server.do(t, "GET", path, nil), 200)
+	}
+}
+
+// TestContractRejectsInvalidRequests checks that requests the spec does
+// not allow never reach the handlers
+func TestContractRejectsInvalidRequests(t *testing.T) {
+	cases := []contractCase{
+		{"GET", "/api/farms/Not_A_Farm/stats", nil, 400},
+		{"GET", "/api/farms/default/sensors?limit=0", nil, 400},
+		{"GET", "/api/farms/default/export/latest?format=xml", nil, 400},
+		{"POST", "/api/users", map[string]interface{}{"username": "x", "password": "long-enough", "role": "root"}, 400},
+	}
+	for _, tc := range cases {
+		resp := server.do(t, tc.method, tc.path, tc.body)
+		if resp.status != tc.status {
+			t.Errorf("%s %s: status %d, want %d: %.300s", tc.method, tc.path, resp.status, tc.status, resp.body)
+		}
+	}
+	expect(t, server.doAs(t, "", "GET", "/api/farms/default/stats", nil), 401)
+
+	// Every farm operation declares the 400 of an invalid farm ID
+	ids := strings.NewReplacer("{farm}", "Not_A_Farm", "{id}", "1", "{name}", "main")
+	for _, path := range server.openAPI.doc.Paths.InMatchingOrder() {
+		if !strings.Contains(path, "{farm}") {
+			continue
+		}
+		for method := range server.openAPI.doc.Paths.Find(path).Operations() {
+			expect(t, server.do(t, method, ids.Replace(path), map[string]interface{}{}), 400)
+		}
+	}
+}
+
+// TestContractAuthErrors checks that every operation that needs a login
+// answers a declared 401 to anonymous callers, and every farm operation a
+// declared 403 to users of other farms
+func TestContractAuthErrors(t *testing.T) {
+	scoped := server.user(t, "contract-scoped", roleOperator, "contract-north")
+	ids := strings.NewReplacer("{farm}", "contract-south", "{id}", "1", "{name}", "main")
+	body := map[string]interface{}{"type": moistureLayer, "calibrations": map[string]interface{}{}} // Valid for every farm operation
+	for _, path := range server.openAPI.doc.Paths.InMatchingOrder() {
+		for method, op := range server.openAPI.doc.Paths.Find(path).Operations() {
+			if op.Security != nil && len(*op.Security) == 0 {
+				continue // Public
+			}
+			expect(t, server.doAs(t, "", method, ids.Replace(path), map[string]interface{}{}), 401)
+			if strings.Contains(path, "{farm}") {
+				expect(t, server.doAs(t, scoped, method, ids.Replace(path), body), 403)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ============================================================================
+// PARQUET WRITER
+// ============================================================================
+
+// The archive's Parquet files are written with parquet-go: flat schemas of
+// int64, double, UTF-8 string and boolean columns, required or optional,
+// gzip compressed and one row group per parquetRowGroupRows rows.
+
+// Archive column kinds and their Parquet physical types
+const (
+	columnTime   = "time"   // Unix seconds; TIMESTAMP_MILLIS in Parquet
+	columnInt    = "int"    // INT64
+	columnFloat  = "float"  // DOUBLE
+	columnString = "string" // BYTE_ARRAY (UTF8)
+	columnBool   = "bool"   // BOOLEAN
+)
+
+// Rows per row group, bounds the memory a row group needs
+const parquetRowGroupRows = 100000
+
+// archiveColumn is one column of an archive table
+type archiveColumn struct {
+	Name     string
+	Kind     string
+	Optional bool // Empty CSV cells are nulls
+}
+
+// physicalType is the Parquet type of a column kind
+func (c archiveColumn) physicalType() parquet.Type {
+	switch c.Kind {
+	case columnTime, columnInt:
+		return parquet.Type_INT64
+	case columnFloat:
+		return parquet.Type_DOUBLE
+	case columnBool:
+		return parquet.Type_BOOLEAN
+	}
+	return parquet.Type_BYTE_ARRAY
+}
+
+// metadata describes the column to parquet-go's CSV writer
+func (c archiveColumn) metadata() string {
+	repetition := parquet.FieldRepetitionType_REQUIRED
+	if c.Optional {
+		repetition = parquet.FieldRepetitionType_OPTIONAL
+	}
+	md := fmt.Sprintf("name=%s, type=%s, repetitiontype=%s", c.Name, c.physicalType(), repetition)
+	switch c.Kind {
+	case columnString:
+		md += ", convertedtype=UTF8"
+	case columnTime:
+		md += ", convertedtype=TIMESTAMP_MILLIS"
+	}
+	return md
+}
+
+// value converts a CSV cell to the column's Parquet value, nil for null
+func (c archiveColumn) value(cell string) (interface{}, error) {
+	if c.Optional && cell == "" {
+		return nil, nil
+	}
+	switch c.Kind {
+	case columnTime, columnInt:
+		number, err := parseIntCell(cell)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+		if c.Kind == columnTime {
+			number *= 1000
+		}
+		return number, nil
+	case columnFloat:
+		number, err := parseFloatCell(cell)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+		return number, nil
+	case columnBool:
+		return cell == "true", nil
+	}
+	return cell, nil
+}
+
+func parseIntCell(cell string) (int64, error) {
+	if cell == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(cell, 10, 64)
+}
+
+func parseFloatCell(cell string) (float64, error) {
+	if cell == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(cell, 64)
+}
+
+// parquetWriter writes row groups of CSV cells to w
+type parquetWriter struct {
+	columns []archiveColumn
+	pw      *writer.CSVWriter
+}
+
+func newParquetWriter(w io.Writer, columns []archiveColumn) (*parquetWriter, error) {
+	md := make([]string, len(columns))
+	for i, column := range columns {
+		md[i] = column.metadata()
+	}
+	pw, err := writer.NewCSVWriterFromWriter(md, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	createdBy := "cropmind cloud-server"
+	pw.Footer.CreatedBy = &createdBy
+	pw.CompressionType = parquet.CompressionCodec_GZIP
+	return &parquetWriter{columns: columns, pw: pw}, nil
+}
+
+// writeRows writes rows of CSV cells, one row group per parquetRowGroupRows
+func (p *parquetWriter) writeRows(rows [][]string) error {
+	for start := 0; start < len(rows); start += parquetRowGroupRows {
+		end := min(start+parquetRowGroupRows, len(rows))
+		for _, row := range rows[start:end] {
+			record := make([]interface{}, len(p.columns))
+			for i, column := range p.columns {
+				value, err := column.value(row[i])
+				if err != nil {
+					return err
+				}
+				record[i] = value
+			}
+			if err := p.pw.Write(record); err != nil {
+				return err
+			}
+		}
+		if err := p.pw.Flush(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close writes the footer
+func (p *parquetWriter) close() error {
+	return p.pw.WriteStop()
+}
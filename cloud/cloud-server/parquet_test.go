@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// The archive's Parquet files are read back with an independent reader
+
+// parquetTestColumns has every column kind, required and optional
+var parquetTestColumns = []archiveColumn{
+	{Name: "time", Kind: columnTime},
+	{Name: "int", Kind: columnInt},
+	{Name: "float", Kind: columnFloat},
+	{Name: "string", Kind: columnString},
+	{Name: "bool", Kind: columnBool},
+	{Name: "time_opt", Kind: columnTime, Optional: true},
+	{Name: "int_opt", Kind: columnInt, Optional: true},
+	{Name: "float_opt", Kind: columnFloat, Optional: true},
+	{Name: "string_opt", Kind: columnString, Optional: true},
+	{Name: "bool_opt", Kind: columnBool, Optional: true},
+}
+
+var parquetTestRows = [][]string{
+	{"1760000000", "0", "0", "", "false", "1760000000", "", "", "", ""},
+	{"1760000060", "-42", "-1.5", "soil-moisture-sensors", "true", "", "7", "41.25", "north", "true"},
+	{"0", "9223372036854775807", "1e-300", "°C", "true", "", "", "", "", ""},
+	{"1760000120", "-9223372036854775808", "NaN", "a,b\n\"c\"", "false", "1760000120", "-1", "NaN", "", "false"},
+	{"1760000180", "1", "+Inf", "x", "true", "1", "0", "0", "°C", "true"},
+	{"1760000240", "2", "-Inf", "y", "true", "", "", "-Inf", "", ""},
+	{"1760000300", "3", "3.25", "z", "false", "1760000300", "3", "", "z", "false"},
+	{"1760000360", "4", "4.5", "", "true", "", "4", "4.5", "", "true"},
+	{"1760000420", "5", "5.75", "last", "true", "1760000420", "5", "5.75", "last", "true"}, // Ninth value, second bit-packed byte
+}
+
+// writeTestParquet writes rows with the archive's Parquet writer
+func writeTestParquet(t *testing.T, columns []archiveColumn, rows [][]string) []byte {
+	t.Helper()
+	var file bytes.Buffer
+	w, err := newParquetWriter(&file, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeRows(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Bytes()
+}
+
+// readTestParquet returns the values and definition levels of every column
+func readTestParquet(t *testing.T, file []byte, columns int) (*reader.ParquetReader, [][]interface{}, [][]int32) {
+	t.Helper()
+	pr, err := reader.NewParquetColumnReader(buffer.NewBufferFileFromBytes(file), 1)
+	if err != nil {
+		t.Fatalf("read footer: %v", err)
+	}
+	values := make([][]interface{}, columns)
+	levels := make([][]int32, columns)
+	for i := range values {
+		if values[i], _, levels[i], err = pr.ReadColumnByIndex(int64(i), pr.GetNumRows()); err != nil {
+			t.Fatalf("read column %d: %v", i, err)
+		}
+	}
+	return pr, values, levels
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	file := writeTestParquet(t, parquetTestColumns, parquetTestRows)
+	pr, values, levels := readTestParquet(t, file, len(parquetTestColumns))
+	defer pr.ReadStop()
+
+	if rows := pr.GetNumRows(); rows != int64(len(parquetTestRows)) {
+		t.Fatalf("file has %d rows, want %d", rows, len(parquetTestRows))
+	}
+
+	// Schema: root, then one element per column (the reader renames the
+	// elements, the names in the file are its external names)
+	schema := pr.Footer.Schema
+	if len(schema) != len(parquetTestColumns)+1 || schema[0].GetNumChildren() != int32(len(parquetTestColumns)) {
+		t.Fatalf("schema has %d elements", len(schema))
+	}
+	for i, column := range parquetTestColumns {
+		element := schema[i+1]
+		repetition := parquet.FieldRepetitionType_REQUIRED
+		if column.Optional {
+			repetition = parquet.FieldRepetitionType_OPTIONAL
+		}
+		if pr.SchemaHandler.GetExName(i+1) != column.Name || element.GetType() != column.physicalType() ||
+			element.GetRepetitionType() != repetition {
+			t.Errorf("column %s has schema %s", column.Name, element)
+		}
+		switch column.Kind {
+		case columnTime:
+			if element.GetConvertedType() != parquet.ConvertedType_TIMESTAMP_MILLIS {
+				t.Errorf("column %s is %v, want TIMESTAMP_MILLIS", column.Name, element.ConvertedType)
+			}
+		case columnString:
+			if element.GetConvertedType() != parquet.ConvertedType_UTF8 {
+				t.Errorf("column %s is %v, want UTF8", column.Name, element.ConvertedType)
+			}
+		}
+	}
+
+	for i, column := range parquetTestColumns {
+		if len(values[i]) != len(parquetTestRows) {
+			t.Errorf("column %s has %d values", column.Name, len(values[i]))
+			continue
+		}
+		for r, row := range parquetTestRows {
+			cell, got := row[i], values[i][r]
+			if column.Optional && cell == "" {
+				if got != nil || levels[i][r] != 0 {
+					t.Errorf("%s row %d: got %v (level %d), want null", column.Name, r, got, levels[i][r])
+				}
+				continue
+			}
+			if column.Optional && levels[i][r] != 1 {
+				t.Errorf("%s row %d: definition level %d", column.Name, r, levels[i][r])
+			}
+			if want := parquetTestValue(t, column, cell); !sameParquetValue(got, want) {
+				t.Errorf("%s row %d: got %v (%T), want %v (%T)", column.Name, r, got, got, want, want)
+			}
+		}
+	}
+}
+
+// parquetTestValue is what the reader should return for a cell
+func parquetTestValue(t *testing.T, column archiveColumn, cell string) interface{} {
+	t.Helper()
+	switch column.Kind {
+	case columnTime, columnInt:
+		number, err := strconv.ParseInt(cell, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if column.Kind == columnTime {
+			number *= 1000
+		}
+		return number
+	case columnFloat:
+		number, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return number
+	case columnBool:
+		return cell == "true"
+	}
+	return cell
+}
+
+// sameParquetValue compares values, NaN equal to NaN
+func sameParquetValue(got, want interface{}) bool {
+	if w, ok := want.(float64); ok {
+		g, ok := got.(float64)
+		return ok && (g == w || math.IsNaN(g) && math.IsNaN(w))
+	}
+	return got == want
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	columns := []archiveColumn{{Name: "id", Kind: columnInt}, {Name: "note", Kind: columnString, Optional: true}}
+	rows := make([][]string, parquetRowGroupRows+3)
+	for i := range rows {
+		note := ""
+		if i%3 == 0 {
+			note = "n" + strconv.Itoa(i)
+		}
+		rows[i] = []string{strconv.Itoa(i), note}
+	}
+
+	file := writeTestParquet(t, columns, rows)
+	pr, values, _ := readTestParquet(t, file, len(columns))
+	defer pr.ReadStop()
+
+	if len(pr.Footer.RowGroups) != 2 || pr.Footer.RowGroups[1].GetNumRows() != 3 {
+		t.Fatalf("file has %d row groups", len(pr.Footer.RowGroups))
+	}
+	for i, row := range rows {
+		if values[0][i] != int64(i) {
+			t.Fatalf("row %d: id %v", i, values[0][i])
+		}
+		if (row[1] == "" && values[1][i] != nil) || (row[1] != "" && values[1][i] != row[1]) {
+			t.Fatalf("row %d: note %v, want %q", i, values[1][i], row[1])
+		}
+	}
+}
+
+func TestParquetRejectsBadCells(t *testing.T) {
+	for _, column := range []archiveColumn{{Name: "int", Kind: columnInt}, {Name: "float", Kind: columnFloat}} {
+		if _, err := column.value("12abc"); err == nil {
+			t.Errorf("%s column accepted 12abc", column.Kind)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// DEVICE REGISTRY
+// ============================================================================
+
+// Devices are stored as JSON at farm:<farm>:device:<id>, with the IDs in
+// farm:<farm>:devices. The default farm is seeded from the GeoJSON layers on
+// first start, other farms are filled through the API or an import.
+
+// Device lifecycle status, set by operators
+const (
+	deviceActive      = "active"
+	deviceMaintenance = "maintenance"
+	deviceRetired     = "retired"
+)
+
+// Reporting state shown by listSensors
+const (
+	stateOnline  = "online"  // Registered and reporting
+	stateSilent  = "silent"  // Registered, no reading within deviceSilentAfter
+	stateUnknown = "unknown" // Reporting without being registered
+)
+
+// A registered device with no reading for this long is reported as silent
+const deviceSilentAfter = 5 * time.Minute
+
+// Device is the registry entry of one sensor or actuator
+type Device struct {
+	SensorID    int          `json:"sensor_id"`
+	Type        string       `json:"type"`
+	Lat         float64      `json:"lat"`
+	Lon         float64      `json:"lon"`
+	InstalledAt string       `json:"installed_at,omitempty"` // YYYY-MM-DD
+	Calibration *Calibration `json:"calibration,omitempty"`
+	Zone        string       `json:"zone,omitempty"`
+	GateID      int          `json:"gate_id,omitempty"` // Gate irrigating this device's zone
+	Firmware    string       `json:"firmware,omitempty"`
+	Status      string       `json:"status"`
+	UpdatedAt   int64        `json:"updated_at"`
+}
+
+// validate checks a device before it is stored and fills defaults
+func (d *Device) validate() error {
+	if d.SensorID <= 0 {
+		return fmt.Errorf("sensor_id must be positive")
+	}
+	if d.Type == "" {
+		return fmt.Errorf("type is required")
+	}
+	if d.Lat < -90 || d.Lat > 90 || d.Lon < -180 || d.Lon > 180 {
+		return fmt.Errorf("lat/lon out of range")
+	}
+	if d.InstalledAt != "" {
+		if _, err := time.Parse("2006-01-02", d.InstalledAt); err != nil {
+			return fmt.Errorf("installed_at must be YYYY-MM-DD")
+		}
+	}
+	if d.Calibration != nil {
+		if err := d.Calibration.validate(); err != nil {
+			return err
+		}
+	}
+	if d.GateID < 0 {
+		return fmt.Errorf("gate_id must not be negative")
+	}
+
+	switch d.Status {
+	case "":
+		d.Status = deviceActive
+	case deviceActive, deviceMaintenance, deviceRetired:
+	default:
+		return fmt.Errorf("status must be active, maintenance or retired")
+	}
+	return nil
+}
+
+// devicesFromLayers builds registry entries from the point layers of the
+// farm layout. The layer name becomes the device type.
+func devicesFromLayers(layers map[string]FeatureCollection) ([]Device, error) {
+	now := time.Now().Unix()
+	devices := []Device{}
+	for name, layer := range layers {
+		for _, feature := range layer.Features {
+			if !isPointGeometry(feature.Geometry) {
+				continue // Gates and zones are not devices
+			}
+			device, err := deviceFromFeature(name, feature)
+			if err != nil {
+				return nil, fmt.Errorf("layer %s: %w", name, err)
+			}
+			if err := device.validate(); err != nil {
+				return nil, fmt.Errorf("layer %s, device %d: %w", name, device.SensorID, err)
+			}
+			device.UpdatedAt = now
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SensorID < devices[j].SensorID })
+	return devices, nil
+}
+
+// seedRegistry registers the devices of the GeoJSON layout in the default
+// farm when its registry is still empty
+func seedRegistry(ctx context.Context, store Store, layersDir string) {
+	existing, err := store.getAllDevices(ctx, defaultFarm)
+	if err != nil {
+		log.Printf("⚠️ Could not check device registry: %v", err)
+		return
+	}
+	if len(existing) > 0 {
+		return
+	}
+
+	layers, err := loadLayers(layersDir)
+	if err != nil {
+		log.Printf("⚠️ Device registry not seeded: %v", err)
+		return
+	}
+	devices, err := devicesFromLayers(layers)
+	if err != nil {
+		log.Printf("⚠️ Device registry not seeded: %v", err)
+		return
+	}
+
+	for _, device := range devices {
+		if err := store.storeDevice(ctx, defaultFarm, device); err != nil {
+			log.Printf("❌ Failed to register device %d: %v", device.SensorID, err)
+			return
+		}
+	}
+	log.Printf("✅ Registered %d devices from %s", len(devices), layersDir)
+}
+
+// ============================================================================
+// REGISTRY STORE (REDIS)
+// ============================================================================
+
+// Create or replace a device
+func (r *RedisClient) storeDevice(ctx context.Context, farm string, device Device) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.client.Pipeline()
+	pipe.Set(ctx, farmKey(farm, "device:%d", device.SensorID), data, 0)
+	pipe.SAdd(ctx, farmKey(farm, "devices"), device.SensorID)
+	pipe.SAdd(ctx, "farms", farm)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get a device, nil if it is not registered
+func (r *RedisClient) getDevice(ctx context.Context, farm string, sensorID int) (*Device, error) {
+	data, err := r.client.Get(ctx, farmKey(farm, "device:%d", sensorID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var device Device
+	if err := json.Unmarshal(data, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Get the registry entries of many devices in one round trip, unknown
+// devices are left out
+func (r *RedisClient) getDevices(ctx context.Context, farm string, sensorIDs []int) (map[int]*Device, error) {
+	devices := make(map[int]*Device, len(sensorIDs))
+	if len(sensorIDs) == 0 {
+		return devices, nil
+	}
+
+	keys := make([]string, len(sensorIDs))
+	for i, id := range sensorIDs {
+		keys[i] = farmKey(farm, "device:%d", id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var device Device
+		if json.Unmarshal([]byte(data), &device) == nil {
+			devices[device.SensorID] = &device
+		}
+	}
+	return devices, nil
+}
+
+// Get all registered devices of a farm, ordered by ID
+func (r *RedisClient) getAllDevices(ctx context.Context, farm string) ([]Device, error) {
+	ids, err := r.client.SMembers(ctx, farmKey(farm, "devices")).Result()
+	if err != nil || len(ids) == 0 {
+		return []Device{}, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = farmKey(farm, "device:%s", id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var device Device
+		if json.Unmarshal([]byte(data), &device) == nil {
+			devices = append(devices, device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SensorID < devices[j].SensorID })
+	return devices, nil
+}
+
+// Remove a device from the registry (its readings are kept)
+func (r *RedisClient) deleteDevice(ctx context.Context, farm string, sensorID int) (bool, error) {
+	pipe := r.client.Pipeline()
+	deleted := pipe.Del(ctx, farmKey(farm, "device:%d", sensorID))
+	pipe.SRem(ctx, farmKey(farm, "devices"), sensorID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return deleted.Val() > 0, nil
+}
+
+// ============================================================================
+// REGISTRY HTTP HANDLERS
+// ============================================================================
+
+// sensorState derives the reporting state from the latest reading
+func sensorState(latest map[string]string, registered bool, now time.Time) string {
+	if !registered {
+		return stateUnknown
+	}
+	timestamp, err := strconv.ParseInt(latest["timestamp"], 10, 64)
+	if err != nil || now.Sub(time.Unix(timestamp, 0)) > deviceSilentAfter {
+		return stateSilent
+	}
+	return stateOnline
+}
+
+// GET /api/farms/:farm/devices?type=&status=
+func (h *APIHandlers) listDevices(c *fiber.Ctx) error {
+	devices, err := h.store.getAllDevices(c.UserContext(), farmOf(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	typeFilter := c.Query("type")
+	statusFilter := c.Query("status")
+	filtered := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		if typeFilter != "" && device.Type != typeFilter {
+			continue
+		}
+		if statusFilter != "" && device.Status != statusFilter {
+			continue
+		}
+		filtered = append(filtered, device)
+	}
+
+	return c.JSON(fiber.Map{
+		"devices": filtered,
+		"count":   len(filtered),
+	})
+}
+
+// GET /api/farms/:farm/devices/:id
+func (h *APIHandlers) getDevice(c *fiber.Ctx) error {
+	sensorID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid device id"})
+	}
+	device, err := h.store.getDevice(c.UserContext(), farmOf(c), sensorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if device == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Device not registered"})
+	}
+	return c.JSON(device)
+}
+
+// POST /api/farms/:farm/devices
+func (h *APIHandlers) createDevice(c *fiber.Ctx) error {
+	var device Device
+	if err := c.BodyParser(&device); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if err := device.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	farm := farmOf(c)
+	existing, err := h.store.getDevice(c.UserContext(), farm, device.SensorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if existing != nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Device already registered"})
+	}
+
+	device.UpdatedAt = time.Now().Unix()
+	if err := h.store.storeDevice(c.UserContext(), farm, device); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(device)
+}
+
+// PUT /api/farms/:farm/devices/:id (replaces the entry, creates it if missing)
+func (h *APIHandlers) updateDevice(c *fiber.Ctx) error {
+	sensorID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid device id"})
+	}
+
+	var device Device
+	if err := c.BodyParser(&device); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if device.SensorID != 0 && device.SensorID != sensorID {
+		return c.Status(400).JSON(fiber.Map{"error": "sensor_id does not match the URL"})
+	}
+	device.SensorID = sensorID
+	if err := device.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	device.UpdatedAt = time.Now().Unix()
+	if err := h.store.storeDevice(c.UserContext(), farmOf(c), device); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(device)
+}
+
+// DELETE /api/farms/:farm/devices/:id
+func (h *APIHandlers) deleteDevice(c *fiber.Ctx) error {
+	sensorID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid device id"})
+	}
+	found, err := h.store.deleteDevice(c.UserContext(), farmOf(c), sensorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Device not registered"})
+	}
+	return c.SendStatus(204)
+}
+
+// GET /api/farms/:farm/devices/export?format=json|geojson
+func (h *APIHandlers) exportDevices(c *fiber.Ctx) error {
+	farm := farmOf(c)
+	devices, err := h.store.getAllDevices(c.UserContext(), farm)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	format := c.Query("format", "json")
+	var export interface{}
+	switch format {
+	case "json":
+		export = fiber.Map{
+			"farm_id":     farm,
+			"exported_at": time.Now().Unix(),
+			"devices":     devices,
+		}
+	case "geojson":
+		export = devicesToGeoJSON(farm, devices)
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "format must be json or geojson"})
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s-devices.%s"`, farm, format))
+	return c.JSON(export)
+}
+
+// devicesToGeoJSON exports devices as Point features with every registry
+// field as a property
+func devicesToGeoJSON(farm string, devices []Device) FeatureCollection {
+	features := make([]Feature, 0, len(devices))
+	for _, device := range devices {
+		var properties map[string]interface{}
+		data, _ := json.Marshal(device)
+		json.Unmarshal(data, &properties)
+		properties["id"] = device.SensorID
+
+		coordinates, _ := json.Marshal([]float64{device.Lon, device.Lat})
+		features = append(features, Feature{
+			Type:       "Feature",
+			Properties: properties,
+			Geometry:   Geometry{Type: "Point", Coordinates: coordinates},
+		})
+	}
+	return FeatureCollection{Type: "FeatureCollection", Name: farm + "-devices", Features: features}
+}
+
+// POST /api/farms/:farm/devices/import
+//
+// Accepts a registry export ({"devices": [...]}), a GeoJSON layer or a list
+// of layers. Devices are created or replaced, others are left alone. GeoJSON
+// properties other than "id" are read as registry fields, the layer name is
+// the default type.
+func (h *APIHandlers) importDevices(c *fiber.Ctx) error {
+	devices, err := parseDeviceImport(c.Body())
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	for i := range devices {
+		if err := devices[i].validate(); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("device %d: %v", devices[i].SensorID, err)})
+		}
+	}
+
+	farm := farmOf(c)
+	now := time.Now().Unix()
+	for _, device := range devices {
+		device.UpdatedAt = now
+		if err := h.store.storeDevice(c.UserContext(), farm, device); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	return c.JSON(fiber.Map{"imported": len(devices)})
+}
+
+func parseDeviceImport(body []byte) ([]Device, error) {
+	var probe struct {
+		Type    string   `json:"type"`
+		Devices []Device `json:"devices"`
+	}
+	var layers []FeatureCollection
+
+	if err := json.Unmarshal(body, &probe); err == nil {
+		if probe.Type != "FeatureCollection" {
+			if probe.Devices == nil {
+				return nil, fmt.Errorf("expected a registry export, a GeoJSON layer or a list of layers")
+			}
+			return probe.Devices, nil
+		}
+		var layer FeatureCollection
+		if err := json.Unmarshal(body, &layer); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	} else if err := json.Unmarshal(body, &layers); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	devices := []Device{}
+	for _, layer := range layers {
+		for _, feature := range layer.Features {
+			if !isPointGeometry(feature.Geometry) {
+				continue
+			}
+			device, err := deviceFromFeature(layer.Name, feature)
+			if err != nil {
+				return nil, fmt.Errorf("layer %s: %w", layer.Name, err)
+			}
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// deviceFromFeature reads a device from a Point feature. The registry fields
+// come from the properties, the location from the geometry.
+func deviceFromFeature(layerName string, feature Feature) (Device, error) {
+	id, ok := featureID(feature)
+	if !ok {
+		return Device{}, fmt.Errorf("feature without numeric id")
+	}
+
+	device := Device{Type: layerName}
+	data, _ := json.Marshal(feature.Properties)
+	if err := json.Unmarshal(data, &device); err != nil {
+		return Device{}, fmt.Errorf("feature %d: %w", id, err)
+	}
+	device.SensorID = id
+
+	lon, lat, err := firstPosition(feature.Geometry)
+	if err != nil {
+		return Device{}, fmt.Errorf("feature %d: %w", id, err)
+	}
+	device.Lat, device.Lon = lat, lon
+	return device, nil
+}
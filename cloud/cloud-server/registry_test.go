@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeviceLifecycle(t *testing.T) {
+	base := "/api/farms/registry/devices"
+	device := map[string]interface{}{
+		"sensor_id": 1, "type": moistureLayer, "lat": 32.7637, "lon": 52.6365,
+		"installed_at": "2026-03-01", "zone": "north", "gate_id": 4,
+	}
+
+	var created Device
+	resp := server.do(t, "POST", base, device)
+	expect(t, resp, 201)
+	resp.json(t, &created)
+	if created.Status != deviceActive || created.UpdatedAt == 0 {
+		t.Errorf("created device is %+v, want active with updated_at", created)
+	}
+	expect(t, server.do(t, "POST", base, device), 409)
+
+	var got Device
+	server.do(t, "GET", base+"/1", nil).json(t, &got)
+	if got.Zone != "north" || got.GateID != 4 || got.InstalledAt != "2026-03-01" {
+		t.Errorf("stored device is %+v", got)
+	}
+
+	// PUT replaces the whole entry
+	resp = server.do(t, "PUT", base+"/1", map[string]interface{}{
+		"type": moistureLayer, "lat": 32.7638, "lon": 52.6366, "status": deviceMaintenance,
+	})
+	expect(t, resp, 200)
+	var replaced Device
+	server.do(t, "GET", base+"/1", nil).json(t, &replaced)
+	if replaced.Status != deviceMaintenance || replaced.Zone != "" || replaced.Lat != 32.7638 {
+		t.Errorf("replaced device is %+v", replaced)
+	}
+	expect(t, server.do(t, "PUT", base+"/1", map[string]interface{}{"sensor_id": 2, "type": moistureLayer}), 400)
+
+	var list struct {
+		Devices []Device `json:"devices"`
+		Count   int      `json:"count"`
+	}
+	server.do(t, "GET", base+"?status="+deviceMaintenance, nil).json(t, &list)
+	if list.Count != 1 || list.Devices[0].SensorID != 1 {
+		t.Errorf("maintenance devices are %+v", list.Devices)
+	}
+
+	expect(t, server.do(t, "DELETE", base+"/1", nil), 204)
+	expect(t, server.do(t, "GET", base+"/1", nil), 404)
+	expect(t, server.do(t, "DELETE", base+"/1", nil), 404)
+}
+
+func TestDeviceValidation(t *testing.T) {
+	base := "/api/farms/registry-invalid/devices"
+	for _, device := range []map[string]interface{}{
+		{"sensor_id": 1, "type": moistureLayer, "installed_at": "March"},
+		{"sensor_id": 1, "type": moistureLayer, "status": "lost"},
+		{"sensor_id": 1, "type": moistureLayer, "lat": 91},
+		{"sensor_id": 1, "type": moistureLayer, "calibration": map[string]interface{}{"method": "linear", "coefficients": []float64{1}}},
+	} {
+		expect(t, server.do(t, "POST", base, device), 400)
+	}
+	expect(t, server.do(t, "POST", base+"/import", map[string]interface{}{
+		"devices": []map[string]interface{}{{"sensor_id": 1, "type": moistureLayer}, {"sensor_id": 2}},
+	}), 400)
+
+	var list struct {
+		Count int `json:"count"`
+	}
+	server.do(t, "GET", base, nil).json(t, &list)
+	if list.Count != 0 {
+		t.Errorf("%d invalid devices were stored", list.Count)
+	}
+}
+
+func TestDeviceExportImportRoundTrip(t *testing.T) {
+	// The seeded default farm exported as GeoJSON and imported elsewhere
+	resp := server.do(t, "GET", "/api/farms/default/devices/export?format=geojson", nil)
+	expect(t, resp, 200)
+	var layer FeatureCollection
+	resp.json(t, &layer)
+
+	var imported struct {
+		Imported int `json:"imported"`
+	}
+	server.do(t, "POST", "/api/farms/registry-copy/devices/import", layer).json(t, &imported)
+	if imported.Imported != len(layer.Features) || imported.Imported == 0 {
+		t.Fatalf("imported %d of %d devices", imported.Imported, len(layer.Features))
+	}
+
+	var original, copied struct {
+		Devices []Device `json:"devices"`
+	}
+	server.do(t, "GET", "/api/farms/default/devices/export", nil).json(t, &original)
+	server.do(t, "GET", "/api/farms/registry-copy/devices/export", nil).json(t, &copied)
+	if len(original.Devices) != len(copied.Devices) {
+		t.Fatalf("copied %d of %d devices", len(copied.Devices), len(original.Devices))
+	}
+	for i, device := range original.Devices {
+		got := copied.Devices[i]
+		if device.SensorID != got.SensorID || device.Type != got.Type || device.Lat != got.Lat ||
+			device.Lon != got.Lon || device.Zone != got.Zone || device.GateID != got.GateID {
+			t.Errorf("device %d copied as %+v, was %+v", device.SensorID, got, device)
+		}
+	}
+}
+
+func TestRawReadingsAreCalibrated(t *testing.T) {
+	farm := "registry-calibration"
+	expect(t, server.do(t, "POST", "/api/farms/"+farm+"/devices", map[string]interface{}{
+		"sensor_id": 1, "type": moistureLayer, "lat": 32.7637, "lon": 52.6365,
+		"calibration": map[string]interface{}{"method": "linear", "coefficients": []float64{1, 2}},
+	}), 201)
+
+	raw := 10.0
+	server.publish("farm/"+farm+"/sensors/soil-moisture-sensors/1", SensorMessage{
+		SensorID: 1, Type: moistureLayer, RawValue: &raw, Unit: "%", Timestamp: time.Now().Unix(),
+	})
+	var latest map[string]string
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors/1/latest", nil).json(t, &latest)
+	if latest["value"] != "21" || latest["raw_value"] != "10" || latest["calibrated"] != "1" {
+		t.Errorf("calibrated reading is %v, want value 21 from raw 10", latest)
+	}
+
+	// Readings of a device without a calibration keep only their raw value
+	server.publish("farm/"+farm+"/sensors/soil-moisture-sensors/2", SensorMessage{
+		SensorID: 2, Type: moistureLayer, RawValue: &raw, Unit: "%", Timestamp: time.Now().Unix(),
+	})
+	var uncalibrated map[string]string
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors/2/latest", nil).json(t, &uncalibrated)
+	if uncalibrated["calibrated"] != "0" || uncalibrated["raw_value"] != "10" {
+		t.Errorf("uncalibrated reading is %v", uncalibrated)
+	}
+}
+
+func TestSeededRegistry(t *testing.T) {
+	layers, err := loadLayers("../../edge/sensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := devicesFromLayers(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Devices []Device `json:"devices"`
+	}
+	server.do(t, "GET", "/api/farms/default/devices/export", nil).json(t, &got)
+	registered := map[int]bool{}
+	for _, device := range got.Devices {
+		registered[device.SensorID] = true
+	}
+	for _, device := range want {
+		if !registered[device.SensorID] {
+			t.Errorf("device %d of layer %s is not registered", device.SensorID, device.Type)
+		}
+	}
+}
+
+func TestFarmOutlivesTheRequest(t *testing.T) {
+	// Fiber reuses the route parameter's memory, the stored farm must not change
+	expect(t, server.do(t, "POST", "/api/farms/farm-one/devices", map[string]interface{}{
+		"sensor_id": 1, "type": moistureLayer,
+	}), 201)
+	expect(t, server.do(t, "GET", "/api/farms/farm-two/devices", nil), 200)
+
+	devices, err := server.store.getAllDevices(context.Background(), "farm-one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Errorf("farm-one has %d devices after a request for farm-two", len(devices))
+	}
+}
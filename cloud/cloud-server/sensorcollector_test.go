@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSensorCollectorCopiesAreIdentical(t *testing.T) {
+	canonical, err := os.ReadFile("../../edge/sensorcollector.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile("sensorcollector.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(copied, canonical) {
+		t.Error("sensorcollector.go differs from edge/sensorcollector.go, copy it over")
+	}
+}
+
+func TestSensorCollector(t *testing.T) {
+	collector := newSensorCollector("test")
+	collector.observe("north", 1, moistureLayer, 41)
+	collector.observe("south", 1, moistureLayer, 12) // Same ID, other farm
+	collector.observe("north", 1, moistureLayer, 42)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	want := `
+# HELP test_sensor_value Latest reported value per sensor.
+# TYPE test_sensor_value gauge
+test_sensor_value{farm="north",sensor_id="1",type="soil-moisture-sensors"} 42
+test_sensor_value{farm="south",sensor_id="1",type="soil-moisture-sensors"} 12
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want), "test_sensor_value"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(collector, "test_sensor_last_seen_age_seconds"); n != 2 {
+		t.Errorf("%d age gauges, want 2", n)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// SENSOR LISTING
+// ============================================================================
+
+// The sensor listing returns typed sensors, filtered, sorted and paged in
+// memory. The store is read in three round trips whatever the number of
+// sensors: the reporting IDs, the registry and one pipeline of latest
+// readings.
+
+// Page size of the sensor listing
+const (
+	defaultSensorPage = 100
+	maxSensorPage     = 1000
+)
+
+// SensorSummary is one sensor of the listing: its latest reading (location
+// from the registry if it never reported), reporting state, zone and
+// registry entry
+type SensorSummary struct {
+	SensorID    int      `json:"sensor_id"`
+	FarmID      string   `json:"farm_id"`
+	Type        string   `json:"type"`
+	Value       *float64 `json:"value,omitempty"` // Missing for uncalibrated raw readings
+	Unit        string   `json:"unit,omitempty"`
+	RawValue    *float64 `json:"raw_value,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Calibrated  *bool    `json:"calibrated,omitempty"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	Timestamp   int64    `json:"timestamp,omitempty"` // Missing if it never reported
+	State       string   `json:"state"`
+	Zone        string   `json:"zone,omitempty"`
+	GateID      int      `json:"gate_id,omitempty"`
+	Device      *Device  `json:"device,omitempty"`
+}
+
+// Fields that can be selected with ?fields= and sorted with ?sort=
+var (
+	sensorFields = map[string]bool{
+		"sensor_id": true, "farm_id": true, "type": true, "value": true, "unit": true,
+		"raw_value": true, "temperature": true, "calibrated": true, "lat": true, "lon": true,
+		"timestamp": true, "state": true, "zone": true, "gate_id": true, "device": true,
+	}
+	sensorSortFields = []string{"sensor_id", "type", "value", "timestamp", "state", "zone", "gate_id"}
+)
+
+// sensorQuery holds the filters, order and page of a listing
+type sensorQuery struct {
+	Type       string
+	Zone       string
+	GateID     int
+	State      string // Reporting state
+	Status     string // Registry status
+	BBox       []float64
+	Sort       string
+	Descending bool
+	Limit      int
+	Cursor     *sensorCursor
+	Fields     []string
+}
+
+// sensorCursor is the position after the last sensor of a page
+type sensorCursor struct {
+	Sort string    `json:"s"`
+	Key  sortValue `json:"k"`
+	ID   int       `json:"id"`
+}
+
+// sortValue is a sensor's value of the sort field
+type sortValue struct {
+	Missing bool    `json:"m,omitempty"`
+	Number  float64 `json:"n,omitempty"`
+	Text    string  `json:"t,omitempty"`
+}
+
+// parseSensorQuery reads ?type=&zone=&gate=&state=&status=
+// &bbox=minLon,minLat,maxLon,maxLat&sort=-timestamp&limit=&cursor=&fields=
+func parseSensorQuery(c *fiber.Ctx) (sensorQuery, error) {
+	q := sensorQuery{
+		Type:   c.Query("type"),
+		Zone:   c.Query("zone"),
+		State:  c.Query("state"),
+		Status: c.Query("status"),
+		Sort:   c.Query("sort", "sensor_id"),
+		Limit:  c.QueryInt("limit", defaultSensorPage),
+	}
+
+	if gate := c.Query("gate"); gate != "" {
+		gateID, err := strconv.Atoi(gate)
+		if err != nil {
+			return q, fmt.Errorf("invalid gate: %s", gate)
+		}
+		q.GateID = gateID
+	}
+	if bbox := c.Query("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		for _, part := range parts {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				break
+			}
+			q.BBox = append(q.BBox, value)
+		}
+		if len(q.BBox) != 4 || q.BBox[0] > q.BBox[2] || q.BBox[1] > q.BBox[3] {
+			return q, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+	}
+
+	if strings.HasPrefix(q.Sort, "-") {
+		q.Sort, q.Descending = q.Sort[1:], true
+	}
+	valid := false
+	for _, field := range sensorSortFields {
+		valid = valid || field == q.Sort
+	}
+	if !valid {
+		return q, fmt.Errorf("sort must be one of %s, - for descending", strings.Join(sensorSortFields, ", "))
+	}
+	if q.Limit <= 0 || q.Limit > maxSensorPage {
+		return q, fmt.Errorf("limit must be between 1 and %d", maxSensorPage)
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			q.Cursor = &sensorCursor{}
+			err = json.Unmarshal(data, q.Cursor)
+		}
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		if q.Cursor.Sort != c.Query("sort", "sensor_id") {
+			return q, fmt.Errorf("cursor belongs to another sort order")
+		}
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		q.Fields = []string{"sensor_id"} // Always included
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			if !sensorFields[field] {
+				return q, fmt.Errorf("unknown field: %s", field)
+			}
+			if field != "sensor_id" {
+				q.Fields = append(q.Fields, field)
+			}
+		}
+	}
+	return q, nil
+}
+
+// matches applies the filters
+func (q sensorQuery) matches(s SensorSummary) bool {
+	if q.Type != "" && s.Type != q.Type {
+		return false
+	}
+	if q.Zone != "" && s.Zone != q.Zone {
+		return false
+	}
+	if q.GateID != 0 && s.GateID != q.GateID {
+		return false
+	}
+	if q.State != "" && s.State != q.State {
+		return false
+	}
+	if q.Status != "" && (s.Device == nil || s.Device.Status != q.Status) {
+		return false
+	}
+	if q.BBox != nil && (s.Lon < q.BBox[0] || s.Lat < q.BBox[1] || s.Lon > q.BBox[2] || s.Lat > q.BBox[3]) {
+		return false
+	}
+	return true
+}
+
+// sortValue returns a sensor's value of the sort field
+func (s SensorSummary) sortValue(field string) sortValue {
+	switch field {
+	case "type":
+		return sortValue{Text: s.Type, Missing: s.Type == ""}
+	case "value":
+		if s.Value == nil {
+			return sortValue{Missing: true}
+		}
+		return sortValue{Number: *s.Value}
+	case "timestamp":
+		return sortValue{Number: float64(s.Timestamp), Missing: s.Timestamp == 0}
+	case "state":
+		return sortValue{Text: s.State}
+	case "zone":
+		return sortValue{Text: s.Zone, Missing: s.Zone == ""}
+	case "gate_id":
+		return sortValue{Number: float64(s.GateID), Missing: s.GateID == 0}
+	}
+	return sortValue{Number: float64(s.SensorID)}
+}
+
+// before reports whether (a, aID) comes before (b, bID) in the order.
+// Sensors without a value of the sort field come last in both directions,
+// ties are ordered by sensor ID.
+func (q sensorQuery) before(a sortValue, aID int, b sortValue, bID int) bool {
+	if a.Missing != b.Missing {
+		return b.Missing
+	}
+	if a.Text != b.Text {
+		return (a.Text < b.Text) != q.Descending
+	}
+	if a.Number != b.Number {
+		return (a.Number < b.Number) != q.Descending
+	}
+	return aID < bID
+}
+
+// selectFields keeps the requested fields of a sensor
+func selectFields(s SensorSummary, fields []string) interface{} {
+	if fields == nil {
+		return s
+	}
+	var all map[string]json.RawMessage
+	data, _ := json.Marshal(s)
+	json.Unmarshal(data, &all)
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+// sensorSummaries builds the typed listing of every registered and every
+// reporting sensor of a farm
+func (h *APIHandlers) sensorSummaries(ctx context.Context, farm string) ([]SensorSummary, error) {
+	sensorIDs, err := h.store.getAllSensors(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := h.devicesByID(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := h.layout.layers(farm)
+	if err != nil {
+		return nil, err
+	}
+	centroids := gateCentroids(layers)
+
+	ids := make([]int, 0, len(devices)+len(sensorIDs))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	for _, raw := range sensorIDs {
+		if id, err := strconv.Atoi(raw); err == nil {
+			if _, registered := devices[id]; !registered {
+				ids = append(ids, id)
+			}
+		}
+	}
+	readings, err := h.store.getLatestReadings(ctx, farm, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sensors := make([]SensorSummary, 0, len(ids))
+	for _, id := range ids {
+		latest := readings[id]
+		device, registered := devices[id]
+
+		sensor := SensorSummary{
+			SensorID: id,
+			FarmID:   farm,
+			Type:     latest["type"],
+			Unit:     latest["unit"],
+			State:    sensorState(latest, registered, now),
+		}
+		if len(latest) > 0 {
+			sensor.Lat, _ = strconv.ParseFloat(latest["lat"], 64)
+			sensor.Lon, _ = strconv.ParseFloat(latest["lon"], 64)
+			sensor.Timestamp, _ = strconv.ParseInt(latest["timestamp"], 10, 64)
+			sensor.Value = parseFloatPointer(latest["value"])
+			sensor.RawValue = parseFloatPointer(latest["raw_value"])
+			sensor.Temperature = parseFloatPointer(latest["temperature"])
+			if latest["calibrated"] != "" {
+				calibrated := latest["calibrated"] == "1"
+				sensor.Calibrated = &calibrated
+			}
+		}
+		if registered {
+			if len(latest) == 0 {
+				sensor.Type, sensor.Lat, sensor.Lon = device.Type, device.Lat, device.Lon
+			}
+			sensor.Zone, sensor.GateID, _ = deviceZone(device, centroids)
+			sensor.Device = &device
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors, nil
+}
+
+// parseFloatPointer reads an optional hash field
+func parseFloatPointer(value string) *float64 {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return &f
+	}
+	return nil
+}
+
+// GET /api/farms/:farm/sensors?type=&zone=&gate=&state=online|silent|unknown
+// &status=active|maintenance|retired&bbox=minLon,minLat,maxLon,maxLat
+// &sort=sensor_id|type|value|timestamp|state|zone|gate_id (- for descending)
+// &limit=100&cursor=&fields=value,timestamp
+//
+// Lists every registered device and every device that reported, with its
+// latest data, state, zone and registry entry. Registered devices that never
+// reported only carry their registry type and location. next_cursor fetches
+// the next page with the same filters and sort.
+func (h *APIHandlers) listSensors(c *fiber.Ctx) error {
+	q, err := parseSensorQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	all, err := h.sensorSummaries(c.UserContext(), farmOf(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	matching := all[:0]
+	for _, sensor := range all {
+		if q.matches(sensor) {
+			matching = append(matching, sensor)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return q.before(matching[i].sortValue(q.Sort), matching[i].SensorID, matching[j].sortValue(q.Sort), matching[j].SensorID)
+	})
+
+	start := 0
+	if q.Cursor != nil {
+		start = sort.Search(len(matching), func(i int) bool {
+			return q.before(q.Cursor.Key, q.Cursor.ID, matching[i].sortValue(q.Sort), matching[i].SensorID)
+		})
+	}
+	end := min(start+q.Limit, len(matching))
+	page := matching[start:end]
+
+	sensors := make([]interface{}, 0, len(page))
+	for _, sensor := range page {
+		sensors = append(sensors, selectFields(sensor, q.Fields))
+	}
+	response := fiber.Map{
+		"sensors": sensors,
+		"count":   len(sensors),
+		"total":   len(matching),
+		"limit":   q.Limit,
+	}
+	if end < len(matching) {
+		last := page[len(page)-1]
+		data, _ := json.Marshal(sensorCursor{Sort: c.Query("sort", "sensor_id"), Key: last.sortValue(q.Sort), ID: last.SensorID})
+		response["next_cursor"] = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return c.JSON(response)
+}
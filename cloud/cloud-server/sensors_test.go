@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// publishReadings stores a reading of value 10*id for sensors 1-5 and a
+// weather reading for sensor 6 in farm
+func publishReadings(farm string, timestamp int64) {
+	for id := 1; id <= 5; id++ {
+		server.publish(fmt.Sprintf("farm/%s/sensors/soil-moisture-sensors/%d", farm, id), SensorMessage{
+			SensorID: id, Type: moistureLayer, Value: float64(10 * id), Unit: "%", Timestamp: timestamp,
+		})
+	}
+	server.publish(fmt.Sprintf("farm/%s/sensors/weather-sensor/6", farm), SensorMessage{
+		SensorID: 6, Type: "weather-sensor", Value: 21.5, Unit: "°C", Timestamp: timestamp,
+	})
+}
+
+type sensorPage struct {
+	Sensors    []map[string]interface{} `json:"sensors"`
+	Count      int                      `json:"count"`
+	Total      int                      `json:"total"`
+	NextCursor string                   `json:"next_cursor"`
+}
+
+func TestListSensorsFiltersSortsAndPages(t *testing.T) {
+	farm := "sensors-list"
+	publishReadings(farm, time.Now().Unix())
+	for _, id := range []int{1, 7} { // 7 never reports
+		expect(t, server.do(t, "POST", "/api/farms/"+farm+"/devices", map[string]interface{}{
+			"sensor_id": id, "type": moistureLayer, "lat": 32.7637, "lon": 52.6365,
+		}), 201)
+	}
+
+	var all sensorPage
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors", nil).json(t, &all)
+	if all.Total != 7 || all.Count != 7 {
+		t.Fatalf("listed %d of %d sensors, want 7", all.Count, all.Total)
+	}
+	states := map[float64]string{1: stateOnline, 7: stateSilent}
+	for _, sensor := range all.Sensors {
+		want, registered := states[sensor["sensor_id"].(float64)]
+		if !registered {
+			want = stateUnknown
+		}
+		if sensor["state"] != want {
+			t.Errorf("sensor %v is %v, want %s", sensor["sensor_id"], sensor["state"], want)
+		}
+	}
+
+	// Descending by value, two per page, following next_cursor
+	var ids []float64
+	path := "/api/farms/" + farm + "/sensors?type=" + moistureLayer + "&sort=-value&limit=2"
+	for page := 0; page < 4; page++ {
+		var got sensorPage
+		server.do(t, "GET", path, nil).json(t, &got)
+		if got.Total != 6 {
+			t.Fatalf("type filter matched %d sensors, want 6", got.Total)
+		}
+		for _, sensor := range got.Sensors {
+			ids = append(ids, sensor["sensor_id"].(float64))
+		}
+		if got.NextCursor == "" {
+			break
+		}
+		path = "/api/farms/" + farm + "/sensors?type=" + moistureLayer + "&sort=-value&limit=2&cursor=" + url.QueryEscape(got.NextCursor)
+	}
+	if fmt.Sprint(ids) != "[5 4 3 2 1 7]" { // No value comes last
+		t.Errorf("pages returned sensors %v, want [5 4 3 2 1 7]", ids)
+	}
+
+	// Only the requested fields and the ID
+	var selected sensorPage
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors?fields=value&limit=1", nil).json(t, &selected)
+	if len(selected.Sensors) != 1 || len(selected.Sensors[0]) != 2 || selected.Sensors[0]["value"] != 10.0 {
+		t.Errorf("fields=value returned %v", selected.Sensors)
+	}
+
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/sensors?sort=color", nil), 400)
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/sensors?bbox=1,2,3", nil), 400)
+}
+
+func TestListSensorsIncludesRegisteredDevices(t *testing.T) {
+	var got sensorPage
+	server.do(t, "GET", "/api/farms/default/sensors?limit=1000&fields=sensor_id,state,device", nil).json(t, &got)
+	devices, err := server.store.getAllDevices(context.Background(), defaultFarm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Total < len(devices) {
+		t.Errorf("listed %d sensors, %d devices are registered", got.Total, len(devices))
+	}
+	for _, sensor := range got.Sensors {
+		if sensor["device"] == nil {
+			t.Errorf("sensor %v has no registry entry", sensor["sensor_id"])
+		}
+	}
+}
+
+func TestLatestReading(t *testing.T) {
+	farm := "sensors-latest"
+	now := time.Now().Unix()
+	publishReadings(farm, now-60)
+	server.publish("farm/"+farm+"/sensors/soil-moisture-sensors/3", SensorMessage{
+		SensorID: 3, Type: moistureLayer, Value: 42.5, Unit: "%", Timestamp: now,
+	})
+
+	var latest map[string]string
+	resp := server.do(t, "GET", "/api/farms/"+farm+"/sensors/3/latest", nil)
+	expect(t, resp, 200)
+	resp.json(t, &latest)
+	if latest["value"] != "42.5" || latest["timestamp"] != fmt.Sprint(now) || latest["type"] != moistureLayer {
+		t.Errorf("latest reading is %v", latest)
+	}
+	expect(t, server.do(t, "GET", "/api/farms/"+farm+"/sensors/99/latest", nil), 404)
+}
+
+func TestSensorHistoryNewestFirst(t *testing.T) {
+	farm := "sensors-history"
+	now := time.Now().Unix()
+	for i := int64(0); i < 5; i++ {
+		server.publish("farm/"+farm+"/sensors/soil-moisture-sensors/1", SensorMessage{
+			SensorID: 1, Type: moistureLayer, Value: float64(i), Unit: "%", Timestamp: now - 300 + i*60,
+		})
+	}
+
+	var history struct {
+		History []string `json:"history"`
+		Count   int      `json:"count"`
+	}
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors/1/history?limit=3", nil).json(t, &history)
+	if history.Count != 3 {
+		t.Fatalf("history has %d entries, want 3", history.Count)
+	}
+	var first SensorMessage
+	if err := json.Unmarshal([]byte(history.History[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Value != 4 || first.Timestamp != now-60 {
+		t.Errorf("newest entry is %+v, want value 4 at %d", first, now-60)
+	}
+
+	server.do(t, "GET", "/api/farms/"+farm+"/sensors/1/history", nil).json(t, &history)
+	if history.Count != 5 {
+		t.Errorf("history has %d entries, want 5", history.Count)
+	}
+}
+
+func TestReadingOfAnotherFarmIsDropped(t *testing.T) {
+	server.publish("farm/sensors-mismatch/sensors/soil-moisture-sensors/1", SensorMessage{
+		FarmID: "elsewhere", SensorID: 1, Type: moistureLayer, Value: 50, Timestamp: time.Now().Unix(),
+	})
+	expect(t, server.do(t, "GET", "/api/farms/sensors-mismatch/sensors/1/latest", nil), 404)
+	expect(t, server.do(t, "GET", "/api/farms/elsewhere/sensors/1/latest", nil), 404)
+}
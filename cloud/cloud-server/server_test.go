@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// TEST SERVER
+// ============================================================================
+
+// The handler tests run the real app (middleware, routes, spec validation)
+// on the memory store, seeded with the repository's farm layout and a few
+// minutes of messages fed through the ingestion pipeline. Every response is
+// checked against openapi.yaml.
+
+const testPassword = "secret123"
+
+type testServer struct {
+	app      *fiber.App
+	openAPI  *OpenAPI
+	store    Store
+	mqtt     *MQTTHandler
+	token    string // Admin session
+	moisture []int  // Registered soil moisture sensors of the default farm
+	gates    []int  // Gates that reported a status
+
+	mu      sync.Mutex
+	covered map[string]bool // "GET /api/farms/{farm}/stats" → a response was checked
+}
+
+var server *testServer
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	dir, err := os.MkdirTemp("", "cropmind-test-")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server, err = newTestServer(dir)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestServer(dir string) (*testServer, error) {
+	ctx := context.Background()
+	config := &Config{
+		Store:         StoreConfig{Backend: storeMemory},
+		MQTT:          MQTTConfig{BrokerURL: "tcp://localhost:1", ClientID: "cloud-test", FarmID: defaultFarm},
+		CORSOrigins:   "http://localhost:8080",
+		LayersDir:     "../../edge/sensors",
+		AdminPassword: testPassword,
+		Ingest:        IngestConfig{Workers: 1, QueueSize: 100, DeadLetterFile: dir + "/deadletter.jsonl"},
+		Archive:       ArchiveConfig{Dir: dir + "/archive", RetentionDays: 30},
+		Validate:      validateRequests,
+	}
+	openAPI, err := loadOpenAPI(config.Validate)
+	if err != nil {
+		return nil, err
+	}
+	store := newMemoryStore()
+	archive, err := newArchiver(config.Archive)
+	if err != nil {
+		return nil, err
+	}
+	layout := newLayoutStore(config.LayersDir)
+	stats := newStats(store, layout)
+	mqttHandler := newMQTTHandler(config.MQTT, store, archive, stats, config.Ingest)
+	seedRegistry(ctx, store, config.LayersDir)
+	bootstrapAdmin(ctx, store, config.AdminPassword)
+
+	s := &testServer{
+		openAPI: openAPI,
+		store:   store,
+		mqtt:    mqttHandler,
+		covered: map[string]bool{},
+	}
+	s.app = newApp(config, ctx, openAPI, newAuth(store, "test-secret"),
+		newHealth(store, storeMemory, mqttHandler), newAPIHandlers(store, layout, archive, stats), mqttHandler.queue)
+	if err := openAPI.checkRoutes(s.app); err != nil {
+		return nil, err
+	}
+	if err := s.ingest(ctx, layout); err != nil {
+		return nil, err
+	}
+	archive.flush()
+
+	token, err := s.login("admin", testPassword)
+	if err != nil {
+		return nil, err
+	}
+	s.token = token
+	return s, nil
+}
+
+// ingest feeds readings of every registered device, gate states, commands,
+// decisions and a queue snapshot through the ingestion pipeline
+func (s *testServer) ingest(ctx context.Context, layout *LayoutStore) error {
+	devices, err := s.store.getAllDevices(ctx, defaultFarm)
+	if err != nil {
+		return err
+	}
+	layers, err := layout.layers(defaultFarm)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	var items []ingestItem
+	add := func(topic string, payload interface{}) {
+		data, _ := json.Marshal(payload)
+		items = append(items, ingestItem{Topic: topic, Payload: data, Received: time.Now()})
+	}
+
+	for i, device := range devices {
+		value := 20 + float64(i%7)*10 // 20-80, some zones dry
+		if device.Type == moistureLayer {
+			s.moisture = append(s.moisture, device.SensorID)
+		}
+		for minute := int64(3); minute >= 0; minute-- {
+			add(fmt.Sprintf("farm/sensors/%s/%d", device.Type, device.SensorID), SensorMessage{
+				SensorID: device.SensorID, Type: device.Type, Lat: device.Lat, Lon: device.Lon, Value: value + float64(minute),
+				Unit: "%", Timestamp: now - minute*60,
+			})
+		}
+	}
+	for gateID := range gateCentroids(layers) {
+		s.gates = append(s.gates, gateID)
+		add(fmt.Sprintf("farm/gates/%d/status", gateID), GateStatusMessage{
+			GateID: gateID, Status: "open", IsOpen: true, Timestamp: now - 600,
+		})
+		add(fmt.Sprintf("farm/commands/water-gate-sensors/%d", gateID), GateCommandMessage{
+			GateID: gateID, Command: "close", Reason: "test", Source: "edge", Timestamp: now - 300,
+		})
+		add(fmt.Sprintf("farm/gates/%d/status", gateID), GateStatusMessage{
+			GateID: gateID, Status: "closed", IsOpen: false, Timestamp: now - 299,
+		})
+		add("farm/edge/decisions", DecisionMessage{
+			GateID: gateID, Action: "close", Reason: "moisture above 70%", Source: "edge", Timestamp: now - 300,
+		})
+	}
+	add("farm/edge/irrigation-queue", map[string]interface{}{"timestamp": now, "queue": []interface{}{}})
+	if len(s.moisture) == 0 || len(s.gates) == 0 {
+		return fmt.Errorf("no moisture sensors or gates in the test layout")
+	}
+
+	s.mqtt.queue.process(items)
+	return nil
+}
+
+// publish feeds one message through the ingestion pipeline as if it had
+// arrived on topic, and returns once it is stored
+func (s *testServer) publish(topic string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	s.mqtt.queue.process([]ingestItem{{Topic: topic, Payload: data, Received: time.Now()}})
+}
+
+// user creates a user and returns its session token
+func (s *testServer) user(t *testing.T, name, role string, farms ...string) string {
+	t.Helper()
+	user := map[string]interface{}{"username": name, "password": testPassword, "role": role}
+	if len(farms) > 0 {
+		user["farms"] = farms
+	}
+	expect(t, s.do(t, "POST", "/api/users", user), 201)
+	token, err := s.login(name, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// login returns a session token
+func (s *testServer) login(username, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req := httptest.NewRequest("POST", "/api/auth/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil || session.Token == "" {
+		return "", fmt.Errorf("login as %s: status %d", username, resp.StatusCode)
+	}
+	return session.Token, nil
+}
+
+// testResponse is a response with its body read
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// json decodes the body
+func (r testResponse) json(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.body, v); err != nil {
+		t.Fatalf("decode %s: %v", r.body, err)
+	}
+}
+
+// do sends a request as the admin and checks the response against the spec
+func (s *testServer) do(t *testing.T, method, path string, body interface{}) testResponse {
+	t.Helper()
+	return s.doAs(t, s.token, method, path, body)
+}
+
+// doAs sends a request with a token (none if empty) or, if it starts with
+// "cm_", an API key, and checks the response against the spec
+func (s *testServer) doAs(t *testing.T, token, method, path string, body interface{}) testResponse {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case strings.HasPrefix(token, "cm_"):
+		req.Header.Set("X-API-Key", token)
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	got := testResponse{status: resp.StatusCode, header: resp.Header}
+	if got.body, err = io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	s.checkResponse(t, method, path, data, got)
+	return got
+}
+
+// checkResponse validates a response against openapi.yaml. Bodies are
+// checked for JSON responses; other content types only need to be declared.
+func (s *testServer) checkResponse(t *testing.T, method, path string, body []byte, resp testResponse) {
+	t.Helper()
+	if !strings.HasPrefix(path, "/api") {
+		return
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	input, err := s.openAPI.findRoute(req)
+	if err != nil {
+		t.Errorf("%s %s is not in openapi.yaml: %v", method, path, err)
+		return
+	}
+	contentType := resp.header.Get("Content-Type")
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 resp.status,
+		Header:                 resp.header,
+		Body:                   io.NopCloser(bytes.NewReader(resp.body)),
+		Options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+			ExcludeResponseBody:   !strings.HasPrefix(contentType, fiber.MIMEApplicationJSON),
+		},
+	})
+	if err != nil {
+		t.Errorf("%s %s %d does not match openapi.yaml: %v\n%.500s", method, path, resp.status, err, resp.body)
+	}
+
+	s.mu.Lock()
+	s.covered[method+" "+input.Route.Path] = true
+	s.mu.Unlock()
+}
+
+// expect fails the test unless the response has the wanted status
+func expect(t *testing.T, resp testResponse, status int) {
+	t.Helper()
+	if resp.status != status {
+		t.Fatalf("status %d, want %d: %.300s", resp.status, status, resp.body)
+	}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ============================================================================
+// SQL STORE (SQLITE, POSTGRESQL)
+// ============================================================================
+
+// SQLStore keeps the same records as the Redis store in SQL tables, but
+// never trims them, so sensor history, gate events, decisions and the user
+// audit trail are kept for good. Latest readings, gate states and registry
+// entries are stored as the JSON of their Redis hash or value. Queries are
+// written with ? placeholders and rewritten for PostgreSQL.
+type SQLStore struct {
+	db      *sql.DB
+	backend string
+	serial  string // Auto-increment key of the backend
+}
+
+// Tables, created on start. {serial} is the auto-increment key of the
+// backend; it keeps rows in insertion order.
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS farms (
+	farm TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS sensor_latest (
+	farm      TEXT NOT NULL,
+	sensor_id BIGINT NOT NULL,
+	fields    TEXT NOT NULL,
+	PRIMARY KEY (farm, sensor_id)
+);
+CREATE TABLE IF NOT EXISTS sensor_history (
+	id        {serial},
+	farm      TEXT NOT NULL,
+	sensor_id BIGINT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	entry     TEXT NOT NULL
+);
+DROP INDEX IF EXISTS sensor_history_sensor;
+CREATE INDEX IF NOT EXISTS sensor_history_time ON sensor_history (farm, sensor_id, timestamp);
+CREATE TABLE IF NOT EXISTS gate_latest (
+	farm    TEXT NOT NULL,
+	gate_id BIGINT NOT NULL,
+	fields  TEXT NOT NULL,
+	PRIMARY KEY (farm, gate_id)
+);
+CREATE TABLE IF NOT EXISTS gate_events (
+	id        {serial},
+	farm      TEXT NOT NULL,
+	gate_id   BIGINT NOT NULL,
+	type      TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	event     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS gate_events_gate ON gate_events (farm, gate_id, timestamp);
+CREATE TABLE IF NOT EXISTS irrigation_queues (
+	farm     TEXT PRIMARY KEY,
+	snapshot TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS decisions (
+	id        {serial},
+	farm      TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+	event     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS decisions_farm ON decisions (farm, timestamp);
+CREATE TABLE IF NOT EXISTS devices (
+	farm      TEXT NOT NULL,
+	sensor_id BIGINT NOT NULL,
+	device    TEXT NOT NULL,
+	PRIMARY KEY (farm, sensor_id)
+);
+CREATE TABLE IF NOT EXISTS users (
+	username      TEXT PRIMARY KEY,
+	role          TEXT NOT NULL,
+	farms         TEXT NOT NULL,
+	password_hash TEXT NOT NULL,
+	created_at    BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	hash     TEXT PRIMARY KEY,
+	username TEXT NOT NULL,
+	key_id   TEXT NOT NULL,
+	api_key  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS api_keys_user ON api_keys (username);
+CREATE TABLE IF NOT EXISTS user_audit (
+	id        {serial},
+	timestamp BIGINT NOT NULL,
+	entry     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_audit_time ON user_audit (timestamp);
+`
+
+// Default SQLite database, and the settings that let the ingestion workers
+// and the API share it
+const (
+	defaultSQLiteFile    = "cropmind.db"
+	defaultSQLiteOptions = "_busy_timeout=5000&_journal_mode=WAL"
+)
+
+func newSQLStore(backend, dsn string) (*SQLStore, error) {
+	driver, serial := "sqlite3", "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if backend == storePostgres {
+		driver, serial = "pgx", "BIGSERIAL PRIMARY KEY"
+		if dsn == "" {
+			return nil, fmt.Errorf("set CLOUD_STORE_DSN to the PostgreSQL connection string")
+		}
+	} else {
+		if !cgoEnabled() {
+			return nil, fmt.Errorf("the SQLite store needs a cgo build (CGO_ENABLED=1 and a C compiler), use postgres or rebuild")
+		}
+		if dsn == "" {
+			dsn = defaultSQLiteFile
+		}
+		if !strings.Contains(dsn, "?") {
+			dsn += "?" + defaultSQLiteOptions
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if backend == storeSQLite {
+		db.SetMaxOpenConns(1) // SQLite has one writer, queue for it here
+	}
+	return &SQLStore{db: db, backend: backend, serial: serial}, nil
+}
+
+// cgoEnabled reports whether the binary was built with cgo. Without it the
+// SQLite driver is a stub that fails every connection.
+func cgoEnabled() bool {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return true
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "CGO_ENABLED" {
+			return setting.Value == "1"
+		}
+	}
+	return true
+}
+
+func (s *SQLStore) ping(ctx context.Context) error {
+	timeout, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := s.db.PingContext(timeout); err != nil {
+		return fmt.Errorf("connect to %s: %w", s.backend, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) close() error {
+	return s.db.Close()
+}
+
+// prepare creates the tables that do not exist yet
+func (s *SQLStore) prepare(ctx context.Context) error {
+	for _, statement := range strings.Split(strings.ReplaceAll(sqlSchema, "{serial}", s.serial), ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("create %s tables: %w", s.backend, err)
+		}
+	}
+	return nil
+}
+
+// bind rewrites ? placeholders as $1, $2, ... for PostgreSQL
+func (s *SQLStore) bind(query string) string {
+	if s.backend != storePostgres {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, char := range query {
+		if char == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(char)
+	}
+	return out.String()
+}
+
+// exec runs a statement outside a transaction
+func (s *SQLStore) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.db.ExecContext(ctx, s.bind(query), args...)
+	return err
+}
+
+// queryStrings returns the first column of every row
+func (s *SQLStore) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// queryFields returns the string maps stored as JSON in (id, fields) rows
+func (s *SQLStore) queryFields(ctx context.Context, query string, args ...interface{}) (map[int]map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make(map[int]map[string]string)
+	for rows.Next() {
+		var id int
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var fields map[string]string
+		if json.Unmarshal([]byte(data), &fields) == nil {
+			items[id] = fields
+		}
+	}
+	return items, rows.Err()
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Upserts, in the syntax SQLite and PostgreSQL share
+const (
+	sqlAddFarm      = `INSERT INTO farms (farm) VALUES (?) ON CONFLICT (farm) DO NOTHING`
+	sqlUpsertSensor = `INSERT INTO sensor_latest (farm, sensor_id, fields) VALUES (?, ?, ?)
+		ON CONFLICT (farm, sensor_id) DO UPDATE SET fields = excluded.fields`
+	sqlUpsertGate = `INSERT INTO gate_latest (farm, gate_id, fields) VALUES (?, ?, ?)
+		ON CONFLICT (farm, gate_id) DO UPDATE SET fields = excluded.fields`
+	sqlUpsertDevice = `INSERT INTO devices (farm, sensor_id, device) VALUES (?, ?, ?)
+		ON CONFLICT (farm, sensor_id) DO UPDATE SET device = excluded.device`
+)
+
+// ============================================================================
+// SENSORS, GATES AND EDGE DATA
+// ============================================================================
+
+// Store the latest readings and their history in one transaction. A reading
+// sets every field of the latest hash or clears it, so replacing the stored
+// fields gives the same hash as Redis.
+func (s *SQLStore) storeSensorReadings(ctx context.Context, farm string, msgs []SensorMessage) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.bind(sqlAddFarm), farm); err != nil {
+			return err
+		}
+		latest, err := tx.PrepareContext(ctx, s.bind(sqlUpsertSensor))
+		if err != nil {
+			return err
+		}
+		defer latest.Close()
+		history, err := tx.PrepareContext(ctx, s.bind(`INSERT INTO sensor_history (farm, sensor_id, timestamp, entry) VALUES (?, ?, ?, ?)`))
+		if err != nil {
+			return err
+		}
+		defer history.Close()
+
+		for _, msg := range msgs {
+			fields, _ := latestReadingFields(farm, msg)
+			data, _ := json.Marshal(fields)
+			if _, err := latest.ExecContext(ctx, farm, msg.SensorID, string(data)); err != nil {
+				return err
+			}
+			entry, err := sensorHistoryEntry(msg)
+			if err != nil {
+				return err
+			}
+			if _, err := history.ExecContext(ctx, farm, msg.SensorID, msg.Timestamp, string(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get latest reading
+func (s *SQLStore) getLatestReading(ctx context.Context, farm string, sensorID int) (map[string]string, error) {
+	readings, err := s.queryFields(ctx, `SELECT sensor_id, fields FROM sensor_latest WHERE farm = ? AND sensor_id = ?`, farm, sensorID)
+	if err != nil {
+		return nil, err
+	}
+	if latest, ok := readings[sensorID]; ok {
+		return latest, nil
+	}
+	return map[string]string{}, nil
+}
+
+// Get the latest readings of many sensors
+func (s *SQLStore) getLatestReadings(ctx context.Context, farm string, sensorIDs []int) (map[int]map[string]string, error) {
+	all, err := s.queryFields(ctx, `SELECT sensor_id, fields FROM sensor_latest WHERE farm = ?`, farm)
+	if err != nil {
+		return nil, err
+	}
+	readings := make(map[int]map[string]string, len(sensorIDs))
+	for _, id := range sensorIDs {
+		if latest, ok := all[id]; ok {
+			readings[id] = latest
+		}
+	}
+	return readings, nil
+}
+
+// Get history (last N readings)
+func (s *SQLStore) getSensorHistory(ctx context.Context, farm string, sensorID int, count int) ([]string, error) {
+	if count <= 0 {
+		return s.queryStrings(ctx, `SELECT entry FROM sensor_history WHERE farm = ? AND sensor_id = ? ORDER BY timestamp DESC, id DESC`,
+			farm, sensorID)
+	}
+	return s.queryStrings(ctx, `SELECT entry FROM sensor_history WHERE farm = ? AND sensor_id = ? ORDER BY timestamp DESC, id DESC LIMIT ?`,
+		farm, sensorID, count)
+}
+
+// Get history entries in a time range (newest first)
+func (s *SQLStore) querySensorHistory(ctx context.Context, farm string, sensorID int, span timeRange, offset, count int64) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT entry FROM sensor_history
+		WHERE farm = ? AND sensor_id = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`,
+		farm, sensorID, span.From, span.To, count, offset)
+}
+
+// Get all sensor IDs of a farm
+func (s *SQLStore) getAllSensors(ctx context.Context, farm string) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT CAST(sensor_id AS TEXT) FROM sensor_latest WHERE farm = ? ORDER BY sensor_id`, farm)
+}
+
+// Store gate status
+func (s *SQLStore) storeGateStatus(ctx context.Context, farm string, gateID int, isOpen bool, timestamp int64) error {
+	data, _ := json.Marshal(gateStatusFields(farm, gateID, isOpen, timestamp))
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.bind(sqlAddFarm), farm); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.bind(sqlUpsertGate), farm, gateID, string(data))
+		return err
+	})
+}
+
+// Get gate status
+func (s *SQLStore) getGateStatus(ctx context.Context, farm string, gateID int) (map[string]string, error) {
+	gates, err := s.queryFields(ctx, `SELECT gate_id, fields FROM gate_latest WHERE farm = ? AND gate_id = ?`, farm, gateID)
+	if err != nil {
+		return nil, err
+	}
+	if status, ok := gates[gateID]; ok {
+		return status, nil
+	}
+	return map[string]string{}, nil
+}
+
+// Get the status of many gates
+func (s *SQLStore) getGateStatuses(ctx context.Context, farm string, gateIDs []int) (map[int]map[string]string, error) {
+	all, err := s.queryFields(ctx, `SELECT gate_id, fields FROM gate_latest WHERE farm = ?`, farm)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[int]map[string]string, len(gateIDs))
+	for _, id := range gateIDs {
+		if status, ok := all[id]; ok {
+			statuses[id] = status
+		}
+	}
+	return statuses, nil
+}
+
+// Get all gate IDs of a farm
+func (s *SQLStore) getAllGates(ctx context.Context, farm string) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT CAST(gate_id AS TEXT) FROM gate_latest WHERE farm = ? ORDER BY gate_id`, farm)
+}
+
+// Store an event in a gate's history
+func (s *SQLStore) storeGateEvent(ctx context.Context, farm string, event GateEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.exec(ctx, `INSERT INTO gate_events (farm, gate_id, type, timestamp, event) VALUES (?, ?, ?, ?, ?)`,
+		farm, event.GateID, event.Type, event.Timestamp, string(data))
+}
+
+// Query a gate's history in a time range, newest first
+func (s *SQLStore) queryGateHistory(ctx context.Context, farm string, gateID int, span timeRange, offset, count int64) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT event FROM gate_events
+		WHERE farm = ? AND gate_id = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`,
+		farm, gateID, span.From, span.To, count, offset)
+}
+
+// Get a gate's state changes in a time range (oldest first), plus the last
+// state change before the range
+func (s *SQLStore) getGateStates(ctx context.Context, farm string, gateID int, from, to int64) (*GateEvent, []GateEvent, error) {
+	before, err := s.queryStrings(ctx, `SELECT event FROM gate_events
+		WHERE farm = ? AND gate_id = ? AND type = 'state' AND timestamp < ?
+		ORDER BY timestamp DESC, id DESC LIMIT 1`,
+		farm, gateID, from)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var initial *GateEvent
+	if len(before) > 0 {
+		var event GateEvent
+		if json.Unmarshal([]byte(before[0]), &event) == nil {
+			initial = &event
+		}
+	}
+
+	raw, err := s.queryStrings(ctx, `SELECT event FROM gate_events
+		WHERE farm = ? AND gate_id = ? AND type = 'state' AND timestamp BETWEEN ? AND ?
+		ORDER BY timestamp, id`,
+		farm, gateID, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	states := make([]GateEvent, 0, len(raw))
+	for _, item := range raw {
+		var event GateEvent
+		if json.Unmarshal([]byte(item), &event) == nil {
+			states = append(states, event)
+		}
+	}
+	return initial, states, nil
+}
+
+// Store the latest irrigation queue snapshot published by the edge
+func (s *SQLStore) storeIrrigationQueue(ctx context.Context, farm string, snapshot []byte) error {
+	return s.exec(ctx, `INSERT INTO irrigation_queues (farm, snapshot) VALUES (?, ?)
+		ON CONFLICT (farm) DO UPDATE SET snapshot = excluded.snapshot`, farm, string(snapshot))
+}
+
+// Get the latest irrigation queue snapshot, nil if none was reported
+func (s *SQLStore) getIrrigationQueue(ctx context.Context, farm string) ([]byte, error) {
+	snapshots, err := s.queryStrings(ctx, `SELECT snapshot FROM irrigation_queues WHERE farm = ?`, farm)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	return []byte(snapshots[0]), nil
+}
+
+// Store an edge decision event
+func (s *SQLStore) storeDecision(ctx context.Context, farm string, event []byte, timestamp int64) error {
+	return s.exec(ctx, `INSERT INTO decisions (farm, timestamp, event) VALUES (?, ?, ?)`, farm, timestamp, string(event))
+}
+
+// Query decisions in a time range, newest first
+func (s *SQLStore) queryDecisions(ctx context.Context, farm string, span timeRange, offset, count int64) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT event FROM decisions
+		WHERE farm = ? AND timestamp BETWEEN ? AND ?
+		ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`,
+		farm, span.From, span.To, count, offset)
+}
+
+// ============================================================================
+// REGISTRY AND FARMS
+// ============================================================================
+
+// Create or replace a device
+func (s *SQLStore) storeDevice(ctx context.Context, farm string, device Device) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.bind(sqlAddFarm), farm); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.bind(sqlUpsertDevice), farm, device.SensorID, string(data))
+		return err
+	})
+}
+
+// Get a device, nil if it is not registered
+func (s *SQLStore) getDevice(ctx context.Context, farm string, sensorID int) (*Device, error) {
+	rows, err := s.queryStrings(ctx, `SELECT device FROM devices WHERE farm = ? AND sensor_id = ?`, farm, sensorID)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	var device Device
+	if err := json.Unmarshal([]byte(rows[0]), &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Get the registry entries of many devices, unknown devices are left out
+func (s *SQLStore) getDevices(ctx context.Context, farm string, sensorIDs []int) (map[int]*Device, error) {
+	devices := make(map[int]*Device, len(sensorIDs))
+	if len(sensorIDs) == 0 {
+		return devices, nil
+	}
+
+	wanted := make(map[int]bool, len(sensorIDs))
+	for _, id := range sensorIDs {
+		wanted[id] = true
+	}
+	all, err := s.getAllDevices(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		if wanted[all[i].SensorID] {
+			devices[all[i].SensorID] = &all[i]
+		}
+	}
+	return devices, nil
+}
+
+// Get all registered devices of a farm, ordered by ID
+func (s *SQLStore) getAllDevices(ctx context.Context, farm string) ([]Device, error) {
+	rows, err := s.queryStrings(ctx, `SELECT device FROM devices WHERE farm = ? ORDER BY sensor_id`, farm)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(rows))
+	for _, data := range rows {
+		var device Device
+		if json.Unmarshal([]byte(data), &device) == nil {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// Remove a device from the registry (its readings are kept)
+func (s *SQLStore) deleteDevice(ctx context.Context, farm string, sensorID int) (bool, error) {
+	result, err := s.db.ExecContext(ctx, s.bind(`DELETE FROM devices WHERE farm = ? AND sensor_id = ?`), farm, sensorID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Get all farms that have reported data
+func (s *SQLStore) getAllFarms(ctx context.Context) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT farm FROM farms`)
+}
+
+// ============================================================================
+// USERS AND API KEYS
+// ============================================================================
+
+// Create or replace a user
+func (s *SQLStore) storeUser(ctx context.Context, user User) error {
+	return s.exec(ctx, `INSERT INTO users (username, role, farms, password_hash, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET role = excluded.role, farms = excluded.farms,
+			password_hash = excluded.password_hash, created_at = excluded.created_at`,
+		user.Username, user.Role, strings.Join(user.Farms, ","), user.PasswordHash, user.CreatedAt)
+}
+
+// Get a user, nil if it does not exist
+func (s *SQLStore) getUser(ctx context.Context, username string) (*User, error) {
+	user := &User{Farms: []string{}}
+	var farms string
+	err := s.db.QueryRowContext(ctx, s.bind(`SELECT username, role, farms, password_hash, created_at FROM users WHERE username = ?`),
+		username).Scan(&user.Username, &user.Role, &farms, &user.PasswordHash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if farms != "" {
+		user.Farms = strings.Split(farms, ",")
+	}
+	return user, nil
+}
+
+// Get all usernames
+func (s *SQLStore) getAllUsers(ctx context.Context) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT username FROM users`)
+}
+
+// Delete a user and its API keys
+func (s *SQLStore) deleteUser(ctx context.Context, username string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.bind(`DELETE FROM api_keys WHERE username = ?`), username); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.bind(`DELETE FROM users WHERE username = ?`), username)
+		return err
+	})
+}
+
+// Store an API key under the hash of its secret
+func (s *SQLStore) storeAPIKey(ctx context.Context, hash string, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.exec(ctx, `INSERT INTO api_keys (hash, username, key_id, api_key) VALUES (?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET username = excluded.username, key_id = excluded.key_id, api_key = excluded.api_key`,
+		hash, key.Username, key.ID, string(data))
+}
+
+// Look up an API key by the hash of its secret, nil if unknown
+func (s *SQLStore) getAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	rows, err := s.queryStrings(ctx, `SELECT api_key FROM api_keys WHERE hash = ?`, hash)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	var key APIKey
+	if err := json.Unmarshal([]byte(rows[0]), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// List a user's API keys (metadata only)
+func (s *SQLStore) getUserAPIKeys(ctx context.Context, username string) (map[string]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, s.bind(`SELECT hash, api_key FROM api_keys WHERE username = ?`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]APIKey)
+	for rows.Next() {
+		var hash, data string
+		if err := rows.Scan(&hash, &data); err != nil {
+			return nil, err
+		}
+		var key APIKey
+		if json.Unmarshal([]byte(data), &key) == nil {
+			keys[hash] = key
+		}
+	}
+	return keys, rows.Err()
+}
+
+// Revoke an API key by id
+func (s *SQLStore) deleteAPIKey(ctx context.Context, username, id string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, s.bind(`DELETE FROM api_keys WHERE username = ? AND key_id = ?`), username, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Record a user action
+func (s *SQLStore) storeUserAudit(ctx context.Context, entry map[string]interface{}, timestamp int64) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return s.exec(ctx, `INSERT INTO user_audit (timestamp, entry) VALUES (?, ?)`, timestamp, string(data))
+}
+
+// Query user actions in a time range, newest first
+func (s *SQLStore) queryUserAudit(ctx context.Context, span timeRange, offset, count int64) ([]string, error) {
+	return s.queryStrings(ctx, `SELECT entry FROM user_audit
+		WHERE timestamp BETWEEN ? AND ?
+		ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`,
+		span.From, span.To, count, offset)
+}
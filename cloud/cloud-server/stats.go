@@ -0,0 +1,695 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// FARM STATISTICS
+// ============================================================================
+
+// Statistics are kept in memory and updated as messages are stored, so
+// GET /stats does not read the store. They are seeded from the store once
+// it is reachable on start, and the device registry (zones, retired devices) is reloaded every
+// minute. Aggregates only count the latest plausible value of each sensor:
+// raw readings without a calibration, readings outside the range of their
+// type and retired devices are left out.
+
+const (
+	statsRefreshInterval = time.Minute
+	messageRateWindow    = 60                   // Seconds of the messages_per_minute window
+	dryZoneMoisture      = 40.0                 // Mean soil moisture (%) the edge opens a gate at
+	waterFlowType        = "water-flow-sensors" // Readings in L/min
+	maxDayReadings       = 20000                // History read per flow sensor when seeding water_delivered_today
+)
+
+// Plausible range of each sensor type, readings outside it are faulty
+var sensorRanges = map[string][2]float64{
+	"soil-moisture-sensors":    {0, 100},
+	"soil-temperature-sensors": {-30, 70},
+	"water-flow-sensors":       {0, 10000},
+	"water-level-sensor":       {0, 100},
+	"weather-sensor":           {-50, 60},
+}
+
+// Stats tracks the statistics of every farm
+type Stats struct {
+	store  Store
+	layout *LayoutStore
+	mu     sync.Mutex
+	farms  map[string]*farmStats
+	ctx    context.Context // Cancelled by close
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type farmStats struct {
+	sensors     map[int]*sensorStat
+	groups      map[groupKey]*aggregate
+	gates       map[int]bool // Open
+	devices     map[int]Device
+	centroids   map[int][]float64
+	zoneGates   map[string]int
+	rate        [messageRateWindow]rateBucket
+	lastMessage time.Time
+	waterDate   string // UTC day waterLiters was delivered on
+	waterLiters float64
+}
+
+type sensorStat struct {
+	sensorType string
+	unit       string
+	value      float64
+	hasValue   bool // Calibrated value, raw-only readings have none
+	faulty     bool // Value outside the range of its type
+	timestamp  int64
+	zone       string
+	counted    bool // Value is in the aggregates
+}
+
+// groupKey names an aggregate: a sensor type across the farm (zone "") or
+// within a zone
+type groupKey struct {
+	zone       string
+	sensorType string
+}
+
+// aggregate keeps the count and sum of a group's values. Min and max are
+// recomputed from the sensors when a value that was one of them leaves.
+type aggregate struct {
+	count    int
+	sum      float64
+	min, max float64
+	unit     string
+	stale    bool
+}
+
+type rateBucket struct {
+	second int64
+	count  int
+}
+
+// Aggregate is the mean, min and max of the latest values of a group
+type Aggregate struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// SensorCounts counts a farm's sensors by state
+type SensorCounts struct {
+	Online        int `json:"online"`         // Reported within deviceSilentAfter
+	Silent        int `json:"silent"`         // Stale, last reading older than that
+	NeverReported int `json:"never_reported"` // Registered, no reading yet
+	Faulty        int `json:"faulty"`         // Latest value outside the range of its type
+	Uncalibrated  int `json:"uncalibrated"`   // Latest reading raw only
+	Unregistered  int `json:"unregistered"`
+	Retired       int `json:"retired"`
+}
+
+// Alert is a condition that needs attention
+type Alert struct {
+	Type       string   `json:"type"` // "sensor_silent", "sensor_faulty" or "zone_dry"
+	SensorID   int      `json:"sensor_id,omitempty"`
+	SensorType string   `json:"sensor_type,omitempty"`
+	Zone       string   `json:"zone,omitempty"`
+	GateID     int      `json:"gate_id,omitempty"`
+	Value      *float64 `json:"value,omitempty"`
+	Timestamp  int64    `json:"timestamp,omitempty"` // Of the reading that raised it
+	Message    string   `json:"message"`
+}
+
+// FarmStatistics is the response of GET /stats
+type FarmStatistics struct {
+	FarmID              string                           `json:"farm_id"`
+	TotalSensors        int                              `json:"total_sensors"`
+	RegisteredDevices   int                              `json:"registered_devices"`
+	TotalGates          int                              `json:"total_gates"`
+	OpenGates           int                              `json:"open_gates"`
+	Status              string                           `json:"status"` // online, silent or unknown, by the last message
+	LastMessage         int64                            `json:"last_message,omitempty"`
+	MessagesPerMinute   int                              `json:"messages_per_minute"`
+	Sensors             SensorCounts                     `json:"sensors"`
+	ByType              map[string]*Aggregate            `json:"by_type"`
+	ByZone              map[string]map[string]*Aggregate `json:"by_zone"`
+	WaterDeliveredToday float64                          `json:"water_delivered_today_liters"`
+	Alerts              []Alert                          `json:"alerts"`
+	Timestamp           int64                            `json:"timestamp"`
+}
+
+func newStats(store Store, layout *LayoutStore) *Stats {
+	s := &Stats{
+		store:  store,
+		layout: layout,
+		farms:  make(map[string]*farmStats),
+		done:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	return s
+}
+
+func (s *Stats) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(statsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(s.ctx, statsRefreshInterval)
+			s.refreshAll(ctx)
+			cancel()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Stats) close() {
+	s.cancel()
+	<-s.done
+}
+
+// farm returns a farm's statistics, creating them. Callers hold s.mu.
+func (s *Stats) farm(farm string) *farmStats {
+	f, ok := s.farms[farm]
+	if !ok {
+		f = &farmStats{
+			sensors:   make(map[int]*sensorStat),
+			groups:    make(map[groupKey]*aggregate),
+			gates:     make(map[int]bool),
+			devices:   make(map[int]Device),
+			zoneGates: make(map[string]int),
+		}
+		s.farms[farm] = f
+	}
+	return f
+}
+
+// ============================================================================
+// INGEST
+// ============================================================================
+
+// addReadings records stored sensor readings
+func (s *Stats) addReadings(farm string, readings []SensorMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.farm(farm)
+	for _, reading := range readings {
+		f.setReading(reading.SensorID, reading.Type, reading.Unit, reading.Value, reading.hasValue(), reading.Timestamp)
+	}
+}
+
+// setGate records a stored gate status
+func (s *Stats) setGate(farm string, gateID int, open bool) {
+	s.mu.Lock()
+	s.farm(farm).gates[gateID] = open
+	s.mu.Unlock()
+}
+
+// countMessage records an MQTT message of a farm
+func (s *Stats) countMessage(farm string, received time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.farm(farm)
+	second := received.Unix()
+	bucket := &f.rate[second%messageRateWindow]
+	if bucket.second != second {
+		*bucket = rateBucket{second: second}
+	}
+	bucket.count++
+	if received.After(f.lastMessage) {
+		f.lastMessage = received
+	}
+}
+
+// setReading replaces a sensor's latest value in the aggregates. Readings
+// older than the latest are ignored. Timestamps ahead of the server clock
+// count as now, so a sensor with a wrong clock cannot move the water day
+// forward or hide its later readings.
+func (f *farmStats) setReading(sensorID int, sensorType, unit string, value float64, hasValue bool, timestamp int64) {
+	timestamp = min(timestamp, time.Now().Unix())
+	sensor, ok := f.sensors[sensorID]
+	if !ok {
+		sensor = &sensorStat{zone: f.zoneOf(sensorID)}
+		f.sensors[sensorID] = sensor
+	} else if timestamp < sensor.timestamp {
+		return
+	}
+
+	if sensorType == waterFlowType && hasValue {
+		f.addWater(sensor, timestamp)
+	}
+
+	f.exclude(sensor)
+	sensor.sensorType, sensor.unit, sensor.timestamp = sensorType, unit, timestamp
+	sensor.value, sensor.hasValue = value, hasValue
+	sensor.faulty = hasValue && !plausible(sensorType, value)
+	f.include(sensorID, sensor)
+}
+
+// addWater adds the water a flow sensor measured since its previous
+// reading, at the previous rate. Gaps longer than deviceSilentAfter and
+// time before midnight (UTC) do not count.
+func (f *farmStats) addWater(sensor *sensorStat, timestamp int64) {
+	now := time.Unix(timestamp, 0).UTC()
+	date := now.Format("2006-01-02")
+	if date != f.waterDate {
+		if date < f.waterDate {
+			return
+		}
+		f.waterDate, f.waterLiters = date, 0
+	}
+	if !sensor.hasValue || sensor.faulty || sensor.timestamp == 0 {
+		return
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	from := sensor.timestamp
+	if from < midnight {
+		from = midnight
+	}
+	elapsed := time.Duration(timestamp-from) * time.Second
+	if elapsed <= 0 || elapsed > deviceSilentAfter {
+		return
+	}
+	f.waterLiters += sensor.value * elapsed.Minutes()
+}
+
+// plausible reports whether a value is within the range of its type
+func plausible(sensorType string, value float64) bool {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return false
+	}
+	limits, ok := sensorRanges[sensorType]
+	return !ok || (value >= limits[0] && value <= limits[1])
+}
+
+// include adds a sensor's value to its groups, if it counts
+func (f *farmStats) include(sensorID int, sensor *sensorStat) {
+	sensor.counted = sensor.hasValue && !sensor.faulty && f.devices[sensorID].Status != deviceRetired
+	if !sensor.counted {
+		return
+	}
+	for _, key := range sensor.groups() {
+		group, ok := f.groups[key]
+		if !ok {
+			group = &aggregate{}
+			f.groups[key] = group
+		}
+		group.add(sensor.value)
+		group.unit = sensor.unit
+	}
+}
+
+// exclude removes a sensor's value from its groups
+func (f *farmStats) exclude(sensor *sensorStat) {
+	if !sensor.counted {
+		return
+	}
+	for _, key := range sensor.groups() {
+		if group, ok := f.groups[key]; ok {
+			group.remove(sensor.value)
+		}
+	}
+	sensor.counted = false
+}
+
+func (sensor *sensorStat) groups() []groupKey {
+	keys := []groupKey{{sensorType: sensor.sensorType}}
+	if sensor.zone != "" {
+		keys = append(keys, groupKey{zone: sensor.zone, sensorType: sensor.sensorType})
+	}
+	return keys
+}
+
+func (a *aggregate) add(value float64) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count++
+	a.sum += value
+}
+
+func (a *aggregate) remove(value float64) {
+	a.count--
+	a.sum -= value
+	if a.count == 0 {
+		a.sum, a.stale = 0, false
+		return
+	}
+	if value <= a.min || value >= a.max {
+		a.stale = true
+	}
+}
+
+// zoneOf returns the zone of a registered device, "" for other sensors
+func (f *farmStats) zoneOf(sensorID int) string {
+	device, ok := f.devices[sensorID]
+	if !ok {
+		return ""
+	}
+	name, _, _ := deviceZone(device, f.centroids)
+	return name
+}
+
+// ============================================================================
+// SEEDING AND REGISTRY REFRESH
+// ============================================================================
+
+// seed loads the latest readings, gate states and today's water of every
+// farm from the store. A store error leaves the farm to fill from ingest.
+func (s *Stats) seed(ctx context.Context) {
+	farms, err := s.store.getAllFarms(ctx)
+	if err != nil {
+		log.Printf("⚠️ Statistics start empty, cannot list farms: %v", err)
+		return
+	}
+	for _, farm := range farms {
+		if err := s.seedFarm(ctx, farm); err != nil {
+			log.Printf("⚠️ Statistics of farm %s start empty: %v", farm, err)
+		}
+	}
+	log.Printf("✅ Statistics seeded for %d farm(s)", len(farms))
+}
+
+func (s *Stats) seedFarm(ctx context.Context, farm string) error {
+	s.refresh(ctx, farm)
+
+	sensorIDs, err := s.store.getAllSensors(ctx, farm)
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(sensorIDs))
+	for _, raw := range sensorIDs {
+		if id, err := strconv.Atoi(raw); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	latest, err := s.store.getLatestReadings(ctx, farm, ids)
+	if err != nil {
+		return err
+	}
+
+	// Replay today's flow readings first so the water delivered adds up
+	now := time.Now().UTC()
+	today := timeRange{
+		From: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Unix(),
+		To:   now.Unix(),
+	}
+	flows := make(map[int][]historyEntry)
+	for id, fields := range latest {
+		if fields["type"] != waterFlowType {
+			continue
+		}
+		entries, err := s.store.querySensorHistory(ctx, farm, id, today, 0, maxDayReadings)
+		if err != nil {
+			return err
+		}
+		for i := len(entries) - 1; i >= 0; i-- { // Oldest first
+			var entry historyEntry
+			if json.Unmarshal([]byte(entries[i]), &entry) == nil {
+				flows[id] = append(flows[id], entry)
+			}
+		}
+	}
+
+	gateIDs, err := s.store.getAllGates(ctx, farm)
+	if err != nil {
+		return err
+	}
+	gates := make([]int, 0, len(gateIDs))
+	for _, raw := range gateIDs {
+		if id, err := strconv.Atoi(raw); err == nil {
+			gates = append(gates, id)
+		}
+	}
+	statuses, err := s.store.getGateStatuses(ctx, farm, gates)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.farm(farm)
+	for id, entries := range flows {
+		for _, entry := range entries {
+			if entry.Value != nil {
+				f.setReading(id, waterFlowType, latest[id]["unit"], *entry.Value, true, entry.Timestamp)
+			}
+		}
+	}
+	for id, fields := range latest {
+		timestamp, err := strconv.ParseInt(fields["timestamp"], 10, 64)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields["value"], 64)
+		f.setReading(id, fields["type"], fields["unit"], value, err == nil, timestamp)
+	}
+	for id, status := range statuses {
+		if len(status) > 0 {
+			f.gates[id] = status["is_open"] == "1"
+		}
+	}
+	return nil
+}
+
+// refreshAll reloads the registry of every farm
+func (s *Stats) refreshAll(ctx context.Context) {
+	farms, err := s.store.getAllFarms(ctx)
+	if err != nil {
+		log.Printf("⚠️ Statistics registry refresh: %v", err)
+		return
+	}
+	for _, farm := range farms {
+		s.refresh(ctx, farm)
+	}
+}
+
+// refresh reloads a farm's registry and moves sensors whose zone or status
+// changed to their new groups
+func (s *Stats) refresh(ctx context.Context, farm string) {
+	devices, err := s.store.getAllDevices(ctx, farm)
+	if err != nil {
+		log.Printf("⚠️ Statistics registry refresh of farm %s: %v", farm, err)
+		return
+	}
+	layers, err := s.layout.layers(farm)
+	if err != nil {
+		log.Printf("⚠️ Statistics layout of farm %s: %v", farm, err)
+	}
+	centroids := gateCentroids(layers)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.farm(farm)
+	f.devices = make(map[int]Device, len(devices))
+	f.zoneGates = make(map[string]int)
+	f.centroids = centroids
+	for _, device := range devices {
+		f.devices[device.SensorID] = device
+		if name, gateID, _ := deviceZone(device, centroids); name != "" && gateID != 0 {
+			f.zoneGates[name] = gateID
+		}
+	}
+	for id, sensor := range f.sensors {
+		f.exclude(sensor)
+		sensor.zone = f.zoneOf(id)
+		f.include(id, sensor)
+	}
+}
+
+// ============================================================================
+// SNAPSHOT
+// ============================================================================
+
+// snapshot returns a farm's statistics at a point in time
+func (s *Stats) snapshot(farm string, now time.Time) FarmStatistics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.farms[farm]
+	if !ok {
+		f = &farmStats{} // Nothing received yet
+	}
+
+	stats := FarmStatistics{
+		FarmID:            farm,
+		TotalSensors:      len(f.sensors),
+		RegisteredDevices: len(f.devices),
+		TotalGates:        len(f.gates),
+		Status:            stateUnknown,
+		ByType:            make(map[string]*Aggregate),
+		ByZone:            make(map[string]map[string]*Aggregate),
+		Alerts:            []Alert{},
+		Timestamp:         now.Unix(),
+	}
+	for _, open := range f.gates {
+		if open {
+			stats.OpenGates++
+		}
+	}
+	if !f.lastMessage.IsZero() {
+		stats.LastMessage = f.lastMessage.Unix()
+		stats.Status = stateSilent
+		if now.Sub(f.lastMessage) <= deviceSilentAfter {
+			stats.Status = stateOnline
+		}
+	}
+	for _, bucket := range f.rate {
+		if now.Unix()-bucket.second < messageRateWindow {
+			stats.MessagesPerMinute += bucket.count
+		}
+	}
+	if f.waterDate == now.UTC().Format("2006-01-02") {
+		stats.WaterDeliveredToday = math.Round(f.waterLiters*10) / 10
+	}
+
+	for key, group := range f.groups {
+		if group.count == 0 {
+			continue
+		}
+		if group.stale {
+			f.recompute(key, group)
+		}
+		aggregate := &Aggregate{
+			Count: group.count,
+			Mean:  round2(group.sum / float64(group.count)),
+			Min:   round2(group.min),
+			Max:   round2(group.max),
+			Unit:  group.unit,
+		}
+		if key.zone == "" {
+			stats.ByType[key.sensorType] = aggregate
+			continue
+		}
+		if stats.ByZone[key.zone] == nil {
+			stats.ByZone[key.zone] = make(map[string]*Aggregate)
+		}
+		stats.ByZone[key.zone][key.sensorType] = aggregate
+	}
+
+	stats.Sensors, stats.Alerts = f.sensorStates(now)
+	for zone, types := range stats.ByZone {
+		moisture, ok := types[moistureLayer]
+		gateID := f.zoneGates[zone]
+		if !ok || moisture.Mean >= dryZoneMoisture || gateID == 0 || f.gates[gateID] {
+			continue
+		}
+		mean := moisture.Mean
+		stats.Alerts = append(stats.Alerts, Alert{
+			Type:    "zone_dry",
+			Zone:    zone,
+			GateID:  gateID,
+			Value:   &mean,
+			Message: fmt.Sprintf("Mean soil moisture %.1f%% below %.0f%% with gate %d closed", mean, dryZoneMoisture, gateID),
+		})
+	}
+	sort.Slice(stats.Alerts, func(i, j int) bool {
+		a, b := stats.Alerts[i], stats.Alerts[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		return a.SensorID < b.SensorID
+	})
+	return stats
+}
+
+// sensorStates counts sensors by state and raises the alerts of silent and
+// faulty sensors. Devices in maintenance raise no alerts.
+func (f *farmStats) sensorStates(now time.Time) (SensorCounts, []Alert) {
+	var counts SensorCounts
+	alerts := []Alert{}
+	for id, device := range f.devices {
+		if device.Status == deviceRetired {
+			counts.Retired++
+		} else if _, reported := f.sensors[id]; !reported {
+			counts.NeverReported++
+		}
+	}
+	for id, sensor := range f.sensors {
+		device, registered := f.devices[id]
+		if !registered {
+			counts.Unregistered++
+		}
+		if device.Status == deviceRetired {
+			continue
+		}
+		alerting := device.Status != deviceMaintenance
+
+		if now.Sub(time.Unix(sensor.timestamp, 0)) > deviceSilentAfter {
+			counts.Silent++
+			if alerting {
+				alerts = append(alerts, Alert{
+					Type:       "sensor_silent",
+					SensorID:   id,
+					SensorType: sensor.sensorType,
+					Timestamp:  sensor.timestamp,
+					Message:    fmt.Sprintf("No reading since %s", time.Unix(sensor.timestamp, 0).UTC().Format(time.RFC3339)),
+				})
+			}
+		} else {
+			counts.Online++
+		}
+
+		switch {
+		case !sensor.hasValue:
+			counts.Uncalibrated++
+		case sensor.faulty:
+			counts.Faulty++
+			if alerting {
+				value := sensor.value
+				alerts = append(alerts, Alert{
+					Type:       "sensor_faulty",
+					SensorID:   id,
+					SensorType: sensor.sensorType,
+					Value:      &value,
+					Timestamp:  sensor.timestamp,
+					Message:    fmt.Sprintf("Value %g %s outside the range of %s", value, sensor.unit, sensor.sensorType),
+				})
+			}
+		}
+	}
+	return counts, alerts
+}
+
+// recompute rebuilds a group's min and max from its sensors
+func (f *farmStats) recompute(key groupKey, group *aggregate) {
+	first := true
+	for _, sensor := range f.sensors {
+		if !sensor.counted || sensor.sensorType != key.sensorType || (key.zone != "" && sensor.zone != key.zone) {
+			continue
+		}
+		if first || sensor.value < group.min {
+			group.min = sensor.value
+		}
+		if first || sensor.value > group.max {
+			group.max = sensor.value
+		}
+		first = false
+	}
+	group.stale = false
+}
+
+// GET /api/farms/:farm/stats (farm statistics, kept up to date at ingest)
+func (h *APIHandlers) getStats(c *fiber.Ctx) error {
+	return c.JSON(h.stats.snapshot(farmOf(c), time.Now()))
+}
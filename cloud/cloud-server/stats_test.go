@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestStats keeps the statistics of a memory store
+func newTestStats(t *testing.T) (*Stats, Store) {
+	store := newMemoryStore()
+	stats := newStats(store, newLayoutStore("../../edge/sensors"))
+	t.Cleanup(stats.close)
+	return stats, store
+}
+
+// moisture is a calibrated soil moisture reading
+func moisture(sensorID int, value float64, timestamp int64) SensorMessage {
+	return SensorMessage{SensorID: sensorID, Type: moistureLayer, Value: value, Unit: "%", Timestamp: timestamp}
+}
+
+// flow is a water flow reading in L/min
+func flow(sensorID int, value float64, timestamp int64) SensorMessage {
+	return SensorMessage{SensorID: sensorID, Type: waterFlowType, Value: value, Unit: "L/min", Timestamp: timestamp}
+}
+
+// checkAggregate compares an aggregate of a snapshot
+func checkAggregate(t *testing.T, what string, got *Aggregate, count int, mean, min, max float64) {
+	t.Helper()
+	if count == 0 {
+		if got != nil {
+			t.Errorf("%s is %+v, want none", what, got)
+		}
+		return
+	}
+	if got == nil || got.Count != count || got.Mean != mean || got.Min != min || got.Max != max {
+		t.Errorf("%s is %+v, want count %d, mean %v, min %v, max %v", what, got, count, mean, min, max)
+	}
+}
+
+func TestStatsAggregates(t *testing.T) {
+	farm := "stats-aggregates"
+	stats, _ := newTestStats(t)
+	now := time.Now()
+	ts := now.Unix() - 60
+
+	stats.addReadings(farm, []SensorMessage{moisture(1, 20, ts), moisture(2, 30, ts), moisture(3, 40, ts)})
+	checkAggregate(t, "3 readings", stats.snapshot(farm, now).ByType[moistureLayer], 3, 30, 20, 40)
+
+	// A new value replaces the sensor's old one
+	stats.addReadings(farm, []SensorMessage{moisture(2, 35, ts+1)})
+	checkAggregate(t, "replaced value", stats.snapshot(farm, now).ByType[moistureLayer], 3, 31.67, 20, 40)
+
+	// Older readings are ignored
+	stats.addReadings(farm, []SensorMessage{moisture(2, 90, ts-10)})
+	checkAggregate(t, "older reading", stats.snapshot(farm, now).ByType[moistureLayer], 3, 31.67, 20, 40)
+
+	// The min and max leave: both are recomputed from the other sensors
+	stats.addReadings(farm, []SensorMessage{moisture(1, 33, ts+2), moisture(3, 34, ts+2)})
+	checkAggregate(t, "stale min and max", stats.snapshot(farm, now).ByType[moistureLayer], 3, 34, 33, 35)
+
+	// Raw-only and faulty readings leave the aggregates
+	raw := 2400.0
+	stats.addReadings(farm, []SensorMessage{
+		{SensorID: 1, Type: moistureLayer, RawValue: &raw, Unit: "%", Timestamp: ts + 3},
+		moisture(3, 140, ts+3),
+	})
+	snapshot := stats.snapshot(farm, now)
+	checkAggregate(t, "raw and faulty", snapshot.ByType[moistureLayer], 1, 35, 35, 35)
+	if snapshot.Sensors.Uncalibrated != 1 || snapshot.Sensors.Faulty != 1 {
+		t.Errorf("sensor counts are %+v, want 1 uncalibrated and 1 faulty", snapshot.Sensors)
+	}
+
+	// Back in range, a sensor counts again
+	stats.addReadings(farm, []SensorMessage{moisture(3, 45, ts+4)})
+	checkAggregate(t, "recovered", stats.snapshot(farm, now).ByType[moistureLayer], 2, 40, 35, 45)
+
+	// The last value of a group leaves
+	stats.addReadings(farm, []SensorMessage{{SensorID: 2, Type: moistureLayer, RawValue: &raw, Unit: "%", Timestamp: ts + 5},
+		{SensorID: 3, Type: moistureLayer, RawValue: &raw, Unit: "%", Timestamp: ts + 5}})
+	checkAggregate(t, "no values", stats.snapshot(farm, now).ByType[moistureLayer], 0, 0, 0, 0)
+}
+
+func TestStatsRegistry(t *testing.T) {
+	farm := "stats-registry"
+	ctx := context.Background()
+	stats, store := newTestStats(t)
+	now := time.Now()
+	ts := now.Unix() - 60
+
+	for _, device := range []Device{
+		{SensorID: 1, Type: moistureLayer, Zone: "north", Status: deviceActive},
+		{SensorID: 2, Type: moistureLayer, Zone: "north", Status: deviceActive},
+		{SensorID: 3, Type: moistureLayer, Zone: "south", Status: deviceActive},
+	} {
+		store.storeDevice(ctx, farm, device)
+	}
+	stats.refresh(ctx, farm)
+	stats.addReadings(farm, []SensorMessage{moisture(1, 20, ts), moisture(2, 30, ts), moisture(3, 50, ts)})
+	snapshot := stats.snapshot(farm, now)
+	checkAggregate(t, "north", snapshot.ByZone["north"][moistureLayer], 2, 25, 20, 30)
+	checkAggregate(t, "south", snapshot.ByZone["south"][moistureLayer], 1, 50, 50, 50)
+
+	// A device moved to another zone takes its value along
+	store.storeDevice(ctx, farm, Device{SensorID: 1, Type: moistureLayer, Zone: "south", Status: deviceActive})
+	stats.refresh(ctx, farm)
+	snapshot = stats.snapshot(farm, now)
+	checkAggregate(t, "north after the move", snapshot.ByZone["north"][moistureLayer], 1, 30, 30, 30)
+	checkAggregate(t, "south after the move", snapshot.ByZone["south"][moistureLayer], 2, 35, 20, 50)
+	checkAggregate(t, "farm after the move", snapshot.ByType[moistureLayer], 3, 33.33, 20, 50)
+
+	// Retired devices leave every aggregate, readings included
+	store.storeDevice(ctx, farm, Device{SensorID: 3, Type: moistureLayer, Zone: "south", Status: deviceRetired})
+	stats.refresh(ctx, farm)
+	stats.addReadings(farm, []SensorMessage{moisture(3, 60, ts+1)})
+	snapshot = stats.snapshot(farm, now)
+	checkAggregate(t, "south without the retired device", snapshot.ByZone["south"][moistureLayer], 1, 20, 20, 20)
+	checkAggregate(t, "farm without the retired device", snapshot.ByType[moistureLayer], 2, 25, 20, 30)
+	if snapshot.Sensors.Retired != 1 {
+		t.Errorf("sensor counts are %+v, want 1 retired", snapshot.Sensors)
+	}
+
+	// Back in service, it counts with its latest value
+	store.storeDevice(ctx, farm, Device{SensorID: 3, Type: moistureLayer, Zone: "south", Status: deviceActive})
+	stats.refresh(ctx, farm)
+	checkAggregate(t, "south with the device back", stats.snapshot(farm, now).ByZone["south"][moistureLayer], 2, 40, 20, 60)
+
+	// Deleted from the registry, the sensor counts for the farm only
+	store.deleteDevice(ctx, farm, 3)
+	stats.refresh(ctx, farm)
+	snapshot = stats.snapshot(farm, now)
+	checkAggregate(t, "south without the deleted device", snapshot.ByZone["south"][moistureLayer], 1, 20, 20, 20)
+	checkAggregate(t, "farm with the unregistered sensor", snapshot.ByType[moistureLayer], 3, 36.67, 20, 60)
+}
+
+func TestStatsWaterDelivered(t *testing.T) {
+	farm := "stats-water"
+	stats, _ := newTestStats(t)
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if now.Sub(midnight) < 10*time.Minute {
+		t.Skip("too close to midnight (UTC)")
+	}
+	ts := now.Unix() - 300
+
+	// 10 L/min for 2 minutes, then 20 L/min for 1 minute
+	stats.addReadings(farm, []SensorMessage{flow(1, 10, ts), flow(1, 20, ts+120), flow(1, 0, ts+180)})
+	if water := stats.snapshot(farm, now).WaterDeliveredToday; water != 40 {
+		t.Fatalf("water delivered is %v L, want 40", water)
+	}
+
+	// A sensor clock a day ahead neither starts a new day nor hides the
+	// readings that follow
+	stats.addReadings(farm, []SensorMessage{flow(1, 30, now.Add(24*time.Hour).Unix())})
+	if water := stats.snapshot(farm, now).WaterDeliveredToday; water != 40 {
+		t.Errorf("water delivered after a future reading is %v L, want 40", water)
+	}
+	stats.addReadings(farm, []SensorMessage{flow(1, 0, now.Unix()+1)})
+	stats.mu.Lock()
+	waterDate, waterLiters := stats.farms[farm].waterDate, stats.farms[farm].waterLiters
+	stats.mu.Unlock()
+	if waterDate != midnight.Format("2006-01-02") || waterLiters < 40 || waterLiters > 40.5 {
+		t.Errorf("water of %s is %v L, want today's 40 L and at most a second at 30 L/min", waterDate, waterLiters)
+	}
+
+	// Faulty flow values add nothing
+	stats.addReadings(farm, []SensorMessage{flow(2, 20000, ts), flow(2, 10, ts+60)})
+	if water := stats.snapshot(farm, now).WaterDeliveredToday; water > 40.5 {
+		t.Errorf("water delivered after a faulty reading is %v L", water)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+)
+
+// ============================================================================
+// STORAGE BACKENDS
+// ============================================================================
+
+// Handlers persist through the Store interface, so the server can run on
+// another backend than Redis:
+//
+//	CLOUD_STORE=redis     Redis at CLOUD_REDIS_ADDR (default, localhost:6379)
+//	CLOUD_STORE=memory    In-process maps, lost on restart (tests and demos)
+//	CLOUD_STORE=sqlite    SQLite file CLOUD_STORE_DSN (default cropmind.db), never pruned
+//	CLOUD_STORE=postgres  PostgreSQL at CLOUD_STORE_DSN (a URL or key=value DSN), never pruned
+//
+// Redis and memory keep the last 1000 readings per sensor and 100000 audit
+// events per set; the SQL stores keep the full history and leave deleting old
+// rows to the operator.
+//
+// Alerts are not persisted: the statistics derive them from the latest
+// readings and the registry, so there is nothing to store or keep in sync.
+
+// Storage backends
+const (
+	storeRedis    = "redis"
+	storeMemory   = "memory"
+	storeSQLite   = "sqlite"
+	storePostgres = "postgres"
+)
+
+// Sensor history kept by the Redis and memory stores
+const maxSensorHistory = 1000
+
+// StoreConfig selects and locates the backend
+type StoreConfig struct {
+	Backend   string
+	RedisAddr string
+	DSN       string
+}
+
+// Store is everything the server persists. Latest readings and gate states
+// are returned as the flat string maps of their Redis hashes; history and
+// audit entries as the JSON they were stored as. Every call takes the
+// context of the request or job it is made for and gives up once that is
+// cancelled or past its deadline.
+type Store interface {
+	// Connection, checked with a short timeout, data preparation once
+	// connected (tables, migrations) and closing at shutdown
+	ping(ctx context.Context) error
+	prepare(ctx context.Context) error
+	close() error
+
+	// Sensor readings
+	storeSensorReadings(ctx context.Context, farm string, msgs []SensorMessage) error
+	getLatestReading(ctx context.Context, farm string, sensorID int) (map[string]string, error)
+	getLatestReadings(ctx context.Context, farm string, sensorIDs []int) (map[int]map[string]string, error)
+	getSensorHistory(ctx context.Context, farm string, sensorID int, count int) ([]string, error)
+	querySensorHistory(ctx context.Context, farm string, sensorID int, span timeRange, offset, count int64) ([]string, error)
+	getAllSensors(ctx context.Context, farm string) ([]string, error)
+
+	// Gates and their audit trail
+	storeGateStatus(ctx context.Context, farm string, gateID int, isOpen bool, timestamp int64) error
+	getGateStatus(ctx context.Context, farm string, gateID int) (map[string]string, error)
+	getGateStatuses(ctx context.Context, farm string, gateIDs []int) (map[int]map[string]string, error)
+	getAllGates(ctx context.Context, farm string) ([]string, error)
+	storeGateEvent(ctx context.Context, farm string, event GateEvent) error
+	queryGateHistory(ctx context.Context, farm string, gateID int, span timeRange, offset, count int64) ([]string, error)
+	getGateStates(ctx context.Context, farm string, gateID int, from, to int64) (*GateEvent, []GateEvent, error)
+
+	// Edge scheduler and decisions
+	storeIrrigationQueue(ctx context.Context, farm string, snapshot []byte) error
+	getIrrigationQueue(ctx context.Context, farm string) ([]byte, error) // nil if none was reported
+	storeDecision(ctx context.Context, farm string, event []byte, timestamp int64) error
+	queryDecisions(ctx context.Context, farm string, span timeRange, offset, count int64) ([]string, error)
+
+	// Device registry
+	storeDevice(ctx context.Context, farm string, device Device) error
+	getDevice(ctx context.Context, farm string, sensorID int) (*Device, error)
+	getDevices(ctx context.Context, farm string, sensorIDs []int) (map[int]*Device, error)
+	getAllDevices(ctx context.Context, farm string) ([]Device, error)
+	deleteDevice(ctx context.Context, farm string, sensorID int) (bool, error)
+
+	getAllFarms(ctx context.Context) ([]string, error)
+
+	// Users, API keys and the user audit trail
+	storeUser(ctx context.Context, user User) error
+	getUser(ctx context.Context, username string) (*User, error)
+	getAllUsers(ctx context.Context) ([]string, error)
+	deleteUser(ctx context.Context, username string) error
+	storeAPIKey(ctx context.Context, hash string, key APIKey) error
+	getAPIKey(ctx context.Context, hash string) (*APIKey, error)
+	getUserAPIKeys(ctx context.Context, username string) (map[string]APIKey, error)
+	deleteAPIKey(ctx context.Context, username, id string) (bool, error)
+	storeUserAudit(ctx context.Context, entry map[string]interface{}, timestamp int64) error
+	queryUserAudit(ctx context.Context, span timeRange, offset, count int64) ([]string, error)
+}
+
+// openStore connects to the configured backend
+func openStore(config StoreConfig) (Store, error) {
+	switch config.Backend {
+	case storeRedis:
+		return newRedisClient(config.RedisAddr), nil
+	case storeMemory:
+		log.Println("⚠️ Using the in-memory store, all data is lost on restart")
+		return newMemoryStore(), nil
+	case storeSQLite, storePostgres:
+		return newSQLStore(config.Backend, config.DSN)
+	default:
+		return nil, fmt.Errorf("CLOUD_STORE must be %s, %s, %s or %s", storeRedis, storeMemory, storeSQLite, storePostgres)
+	}
+}
+
+// timeRange selects audit events by unix timestamp, both ends included
+type timeRange struct {
+	From int64
+	To   int64
+}
+
+// allTime is the range of an audit query without from and to
+var allTime = timeRange{From: math.MinInt64, To: math.MaxInt64}
+
+// contains reports whether a timestamp is in the range
+func (t timeRange) contains(timestamp int64) bool {
+	return timestamp >= t.From && timestamp <= t.To
+}
+
+// ============================================================================
+// STORED RECORDS
+// ============================================================================
+
+// The backends store the same records, built here so the API returns the
+// same fields whichever one is used. Values are formatted the way go-redis
+// writes them into a hash (booleans as "1" and "0").
+
+// formatBool writes a boolean as Redis stores it
+func formatBool(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// formatFloat writes a float as Redis stores it
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// latestReadingFields is the latest-reading hash of a message, plus the
+// fields an earlier reading may have left that this one does not have. Raw
+// readings also keep raw_value, the probe temperature and whether they were
+// calibrated; an uncalibrated raw reading has no value.
+func latestReadingFields(farm string, msg SensorMessage) (map[string]string, []string) {
+	fields := map[string]string{
+		"farm_id":   farm,
+		"sensor_id": strconv.Itoa(msg.SensorID),
+		"type":      msg.Type,
+		"unit":      msg.Unit,
+		"lat":       formatFloat(msg.Lat),
+		"lon":       formatFloat(msg.Lon),
+		"timestamp": strconv.FormatInt(msg.Timestamp, 10),
+	}
+	var stale []string
+	if msg.hasValue() {
+		fields["value"] = formatFloat(msg.Value)
+	} else {
+		stale = append(stale, "value")
+	}
+	if msg.RawValue != nil {
+		fields["raw_value"] = formatFloat(*msg.RawValue)
+		fields["calibrated"] = formatBool(msg.Calibrated)
+		if msg.Temperature != nil {
+			fields["temperature"] = formatFloat(*msg.Temperature)
+		} else {
+			stale = append(stale, "temperature")
+		}
+	} else {
+		stale = append(stale, "raw_value", "calibrated", "temperature")
+	}
+	return fields, stale
+}
+
+// historyEntry is one element of a sensor's history
+type historyEntry struct {
+	Value     *float64 `json:"value,omitempty"`
+	RawValue  *float64 `json:"raw_value,omitempty"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// sensorHistoryEntry is the stored history entry of a message. It fails
+// for values JSON cannot hold, e.g. a calibration that overflowed.
+func sensorHistoryEntry(msg SensorMessage) ([]byte, error) {
+	entry := historyEntry{RawValue: msg.RawValue, Timestamp: msg.Timestamp}
+	if msg.hasValue() {
+		value := math.Round(msg.Value*100) / 100
+		entry.Value = &value
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("sensor %d: %w", msg.SensorID, err)
+	}
+	return data, nil
+}
+
+// pageHistory pages through the history entries (newest first) of a time
+// range, for the stores that keep them in a list
+func pageHistory(entries []string, span timeRange, offset, count int64) []string {
+	page := []string{}
+	for _, entry := range entries {
+		var decoded historyEntry
+		if json.Unmarshal([]byte(entry), &decoded) != nil || !span.contains(decoded.Timestamp) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if int64(len(page)) == count {
+			break
+		}
+		page = append(page, entry)
+	}
+	return page
+}
+
+// gateStatusFields is the latest-status hash of a gate
+func gateStatusFields(farm string, gateID int, isOpen bool, timestamp int64) map[string]string {
+	status := "closed"
+	if isOpen {
+		status = "open"
+	}
+	return map[string]string{
+		"farm_id":   farm,
+		"gate_id":   strconv.Itoa(gateID),
+		"status":    status,
+		"is_open":   formatBool(isOpen),
+		"timestamp": strconv.FormatInt(timestamp, 10),
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// The conformance tests run the same checks against every backend: memory,
+// SQLite, Redis (on miniredis) and, if CLOUD_TEST_POSTGRES_DSN is set, a
+// PostgreSQL database (its tables are dropped first).
+
+// testStores opens a fresh store of every backend
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{storeMemory: newMemoryStore()}
+
+	sqlite, err := newSQLStore(storeSQLite, filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores[storeSQLite] = sqlite
+
+	stores[storeRedis] = newRedisClient(miniredis.RunT(t).Addr())
+
+	if dsn := os.Getenv("CLOUD_TEST_POSTGRES_DSN"); dsn != "" {
+		postgres, err := newSQLStore(storePostgres, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"farms", "sensor_latest", "sensor_history", "gate_latest", "gate_events",
+			"irrigation_queues", "decisions", "devices", "users", "api_keys", "user_audit"} {
+			postgres.db.Exec("DROP TABLE IF EXISTS " + table)
+		}
+		stores[storePostgres] = postgres
+	}
+
+	for name, store := range stores {
+		if err := store.prepare(context.Background()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { store.close() })
+	}
+	return stores
+}
+
+// forEachStore runs a conformance check as a subtest per backend
+func forEachStore(t *testing.T, check func(t *testing.T, ctx context.Context, store Store)) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			check(t, context.Background(), store)
+		})
+	}
+}
+
+// timestamps decodes the timestamps of stored JSON entries
+func timestamps(t *testing.T, entries []string) []int64 {
+	t.Helper()
+	list := []int64{}
+	for _, entry := range entries {
+		var decoded struct {
+			Timestamp int64 `json:"timestamp"`
+		}
+		if err := json.Unmarshal([]byte(entry), &decoded); err != nil {
+			t.Fatalf("entry %s: %v", entry, err)
+		}
+		list = append(list, decoded.Timestamp)
+	}
+	return list
+}
+
+func sorted(list []string) []string {
+	list = slices.Clone(list)
+	sort.Strings(list)
+	return list
+}
+
+func TestStoreSensorReadings(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		farm := "conformance"
+		raw, temperature := 2400.0, 18.5
+		err := store.storeSensorReadings(ctx, farm, []SensorMessage{
+			{SensorID: 1, Type: moistureLayer, Lat: 32.5, Lon: 52.5, Value: 41.234, Unit: "%", Timestamp: 100},
+			{SensorID: 1, Type: moistureLayer, Lat: 32.5, Lon: 52.5, Value: 42, Unit: "%", Timestamp: 200},
+			{SensorID: 2, Type: "soil-temperature-sensors", Value: 18, Unit: "°C", Timestamp: 200},
+			{SensorID: 1, Type: moistureLayer, Lat: 32.5, Lon: 52.5, Value: 43, Unit: "%", Timestamp: 300},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		latest, err := store.getLatestReading(ctx, farm, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"farm_id": farm, "sensor_id": "1", "type": moistureLayer, "unit": "%",
+			"lat": "32.5", "lon": "52.5", "value": "43", "timestamp": "300",
+		}
+		if fmt.Sprint(latest) != fmt.Sprint(want) {
+			t.Errorf("latest reading is %v, want %v", latest, want)
+		}
+		if latest, _ := store.getLatestReading(ctx, farm, 99); len(latest) != 0 {
+			t.Errorf("unknown sensor has latest reading %v", latest)
+		}
+
+		// A raw reading replaces the value, a calibrated one the raw fields
+		store.storeSensorReadings(ctx, farm, []SensorMessage{
+			{SensorID: 1, Type: moistureLayer, RawValue: &raw, Temperature: &temperature, Unit: "%", Timestamp: 400},
+		})
+		latest, _ = store.getLatestReading(ctx, farm, 1)
+		if _, ok := latest["value"]; ok || latest["raw_value"] != "2400" || latest["temperature"] != "18.5" || latest["calibrated"] != "0" {
+			t.Errorf("raw reading left %v", latest)
+		}
+		store.storeSensorReadings(ctx, farm, []SensorMessage{
+			{SensorID: 1, Type: moistureLayer, Value: 44, Unit: "%", Timestamp: 500},
+		})
+		latest, _ = store.getLatestReading(ctx, farm, 1)
+		if _, ok := latest["raw_value"]; ok || latest["value"] != "44" {
+			t.Errorf("calibrated reading left %v", latest)
+		}
+
+		// A value JSON cannot hold fails the whole call and stores nothing
+		err = store.storeSensorReadings(ctx, farm, []SensorMessage{
+			{SensorID: 1, Type: moistureLayer, Value: 45, Unit: "%", Timestamp: 600},
+			{SensorID: 1, Type: moistureLayer, Value: math.Inf(1), Unit: "%", Timestamp: 700},
+		})
+		if err == nil {
+			t.Error("stored an infinite value")
+		}
+		if latest, _ = store.getLatestReading(ctx, farm, 1); latest["value"] != "44" {
+			t.Errorf("failed call left %v", latest)
+		}
+
+		readings, err := store.getLatestReadings(ctx, farm, []int{1, 2, 99})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(readings) != 2 || readings[2]["value"] != "18" {
+			t.Errorf("latest readings are %v", readings)
+		}
+
+		history, err := store.getSensorHistory(ctx, farm, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, history)); got != "[500 400]" {
+			t.Errorf("last 2 history entries are at %s, want [500 400]", got)
+		}
+		if all, _ := store.getSensorHistory(ctx, farm, 1, 0); len(all) != 5 {
+			t.Errorf("history has %d entries, want 5", len(all))
+		}
+		if first, _ := store.getSensorHistory(ctx, farm, 1, 10); len(first) != 5 || first[4] != `{"value":41.23,"timestamp":100}` {
+			t.Errorf("oldest history entry is %v", first)
+		}
+
+		history, err = store.querySensorHistory(ctx, farm, 1, timeRange{From: 200, To: 400}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, history)); got != "[300 200]" {
+			t.Errorf("history 200-400 after 1 is at %s, want [300 200]", got)
+		}
+
+		sensors, err := store.getAllSensors(ctx, farm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(sorted(sensors)) != "[1 2]" {
+			t.Errorf("sensors are %v", sensors)
+		}
+		if sensors, _ := store.getAllSensors(ctx, "conformance-other"); len(sensors) != 0 {
+			t.Errorf("other farm has sensors %v", sensors)
+		}
+	})
+}
+
+func TestStoreSensorHistoryCap(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		farm := "conformance-cap"
+		readings := make([]SensorMessage, maxSensorHistory+10)
+		for i := range readings {
+			readings[i] = SensorMessage{SensorID: 1, Type: moistureLayer, Value: 1, Unit: "%", Timestamp: int64(i + 1)}
+		}
+		if err := store.storeSensorReadings(ctx, farm, readings); err != nil {
+			t.Fatal(err)
+		}
+		history, err := store.getSensorHistory(ctx, farm, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Redis and memory keep the last readings, the SQL stores all
+		want := maxSensorHistory
+		if _, sql := store.(*SQLStore); sql {
+			want = len(readings)
+		}
+		if len(history) != want {
+			t.Errorf("history has %d entries, want %d", len(history), want)
+		}
+	})
+}
+
+func TestRedisBatchRetry(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := newRedisClient(mr.Addr())
+	defer store.close()
+
+	// Sensor 2's latest hash is in the way, so EXEC applies the rest of
+	// the batch and fails
+	farm := "retry"
+	mr.Set(farmKey(farm, "sensor:%d:latest", 2), "not a hash")
+	batch := []SensorMessage{
+		{SensorID: 1, Type: moistureLayer, Value: 41, Unit: "%", Timestamp: 100},
+		{SensorID: 1, Type: moistureLayer, Value: 42, Unit: "%", Timestamp: 200},
+		{SensorID: 2, Type: moistureLayer, Value: 43, Unit: "%", Timestamp: 200},
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := store.storeSensorReadings(ctx, farm, batch); err == nil {
+			t.Fatal("stored a batch over a string key")
+		}
+	}
+	mr.Del(farmKey(farm, "sensor:%d:latest", 2))
+	if err := store.storeSensorReadings(ctx, farm, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for sensorID, want := range map[int]string{1: "[200 100]", 2: "[200]"} {
+		history, err := store.getSensorHistory(ctx, farm, sensorID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, history)); got != want {
+			t.Errorf("sensor %d history is at %s after the retries, want %s", sensorID, got, want)
+		}
+	}
+}
+
+func TestRedisHistoryListsConverted(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := newRedisClient(mr.Addr())
+	defer store.close()
+
+	key := farmKey(defaultFarm, "sensor:%d:history", 1)
+	mr.Lpush(key, `{"value":41,"timestamp":100}`)
+	mr.Lpush(key, `{"value":42,"timestamp":200}`)
+	if err := store.prepare(ctx); err != nil {
+		t.Fatal(err)
+	}
+	history, err := store.getSensorHistory(ctx, defaultFarm, 1, 0)
+	if err != nil || fmt.Sprint(history) != `[{"value":42,"timestamp":200} {"value":41,"timestamp":100}]` {
+		t.Errorf("converted history is %v, %v", history, err)
+	}
+	if err := store.prepare(ctx); err != nil {
+		t.Errorf("preparing again: %v", err)
+	}
+}
+
+func TestStoreGates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		farm := "conformance-gates"
+		for _, err := range []error{
+			store.storeGateStatus(ctx, farm, 1, true, 100),
+			store.storeGateStatus(ctx, farm, 2, false, 110),
+			store.storeGateStatus(ctx, farm, 1, false, 200),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status, err := store.getGateStatus(ctx, farm, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"farm_id": farm, "gate_id": "1", "status": "closed", "is_open": "0", "timestamp": "200"}
+		if fmt.Sprint(status) != fmt.Sprint(want) {
+			t.Errorf("gate 1 status is %v, want %v", status, want)
+		}
+		if status, _ := store.getGateStatus(ctx, farm, 9); len(status) != 0 {
+			t.Errorf("unknown gate has status %v", status)
+		}
+		statuses, err := store.getGateStatuses(ctx, farm, []int{1, 2, 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 2 || statuses[2]["status"] != "closed" {
+			t.Errorf("gate statuses are %v", statuses)
+		}
+		if gates, _ := store.getAllGates(ctx, farm); fmt.Sprint(sorted(gates)) != "[1 2]" {
+			t.Errorf("gates are %v", gates)
+		}
+
+		events := []GateEvent{
+			{Type: "state", GateID: 1, Timestamp: 100, Status: "open"},
+			{Type: "command", GateID: 1, Timestamp: 150, Command: "close", Source: "edge"},
+			{Type: "decision", GateID: 1, Timestamp: 150, Action: "close", Reason: "wet"},
+			{Type: "state", GateID: 1, Timestamp: 200, Status: "closed"},
+			{Type: "state", GateID: 1, Timestamp: 300, Status: "open"},
+			{Type: "state", GateID: 2, Timestamp: 300, Status: "open"},
+		}
+		for _, event := range events {
+			if err := store.storeGateEvent(ctx, farm, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		history, err := store.queryGateHistory(ctx, farm, 1, allTime, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, history)); got != "[300 200 150 150 100]" {
+			t.Errorf("gate 1 history is at %s", got)
+		}
+		history, _ = store.queryGateHistory(ctx, farm, 1, timeRange{From: 150, To: 250}, 1, 2)
+		if got := fmt.Sprint(timestamps(t, history)); got != "[150 150]" {
+			t.Errorf("gate 1 history 150-250 after 1 is at %s, want [150 150]", got)
+		}
+
+		initial, states, err := store.getGateStates(ctx, farm, 1, 150, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if initial == nil || initial.Status != "open" || initial.Timestamp != 100 {
+			t.Errorf("state before 150 is %+v, want open at 100", initial)
+		}
+		if len(states) != 2 || states[0].Status != "closed" || states[1].Status != "open" {
+			t.Errorf("states 150-300 are %+v", states)
+		}
+		if initial, states, _ := store.getGateStates(ctx, farm, 9, 0, 1000); initial != nil || len(states) != 0 {
+			t.Errorf("unknown gate has states %+v, %+v", initial, states)
+		}
+	})
+}
+
+func TestStoreEdgeData(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		farm := "conformance-edge"
+		if snapshot, err := store.getIrrigationQueue(ctx, farm); err != nil || snapshot != nil {
+			t.Errorf("queue before any snapshot is %s, %v", snapshot, err)
+		}
+		store.storeIrrigationQueue(ctx, farm, []byte(`{"queue":[1]}`))
+		store.storeIrrigationQueue(ctx, farm, []byte(`{"queue":[2]}`))
+		if snapshot, _ := store.getIrrigationQueue(ctx, farm); string(snapshot) != `{"queue":[2]}` {
+			t.Errorf("queue snapshot is %s", snapshot)
+		}
+
+		for i := int64(1); i <= 5; i++ {
+			event := fmt.Sprintf(`{"gate_id":1,"action":"open","timestamp":%d}`, i*100)
+			if err := store.storeDecision(ctx, farm, []byte(event), i*100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		decisions, err := store.queryDecisions(ctx, farm, timeRange{From: 200, To: 500}, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, decisions)); got != "[400 300]" {
+			t.Errorf("decisions 200-500 after 1 are at %s, want [400 300]", got)
+		}
+		if decisions, _ := store.queryDecisions(ctx, "conformance-none", allTime, 0, 10); len(decisions) != 0 {
+			t.Errorf("other farm has decisions %v", decisions)
+		}
+	})
+}
+
+func TestStoreDevices(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		farm := "conformance-devices"
+		devices := []Device{
+			{SensorID: 2, Type: moistureLayer, Lat: 32.5, Lon: 52.5, Zone: "north", GateID: 1, Status: "active", UpdatedAt: 100,
+				Calibration: &Calibration{Method: calibrationLinear, Coefficients: []float64{-5, 0.1}}},
+			{SensorID: 1, Type: "water-flow-sensors", Status: "maintenance", UpdatedAt: 100},
+		}
+		for _, device := range devices {
+			if err := store.storeDevice(ctx, farm, device); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		device, err := store.getDevice(ctx, farm, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device == nil || device.Zone != "north" || device.Calibration == nil || fmt.Sprint(device.Calibration.Coefficients) != "[-5 0.1]" {
+			t.Errorf("device 2 is %+v", device)
+		}
+		if device, err := store.getDevice(ctx, farm, 9); device != nil || err != nil {
+			t.Errorf("unknown device is %+v, %v", device, err)
+		}
+		found, err := store.getDevices(ctx, farm, []int{1, 2, 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 || found[1].Status != "maintenance" {
+			t.Errorf("devices 1, 2, 9 are %v", found)
+		}
+		all, err := store.getAllDevices(ctx, farm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 || all[0].SensorID != 1 || all[1].SensorID != 2 {
+			t.Errorf("all devices are %+v, want ordered by ID", all)
+		}
+
+		if deleted, err := store.deleteDevice(ctx, farm, 1); !deleted || err != nil {
+			t.Errorf("deleting device 1: %v, %v", deleted, err)
+		}
+		if deleted, _ := store.deleteDevice(ctx, farm, 1); deleted {
+			t.Error("deleted device 1 twice")
+		}
+		if all, _ := store.getAllDevices(ctx, farm); len(all) != 1 {
+			t.Errorf("%d devices after a delete, want 1", len(all))
+		}
+
+		farms, err := store.getAllFarms(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(farms, farm) {
+			t.Errorf("farms %v miss %s", farms, farm)
+		}
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, ctx context.Context, store Store) {
+		users := []User{
+			{Username: "alice", Role: roleAdmin, PasswordHash: "hash-a", CreatedAt: 100},
+			{Username: "bob", Role: roleViewer, Farms: []string{"north", "south"}, PasswordHash: "hash-b", CreatedAt: 200},
+		}
+		for _, user := range users {
+			if err := store.storeUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}
+		user, err := store.getUser(ctx, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user == nil || user.Role != roleViewer || user.PasswordHash != "hash-b" || fmt.Sprint(user.Farms) != "[north south]" {
+			t.Errorf("bob is %+v", user)
+		}
+		if user, err := store.getUser(ctx, "nobody"); user != nil || err != nil {
+			t.Errorf("unknown user is %+v, %v", user, err)
+		}
+		if names, _ := store.getAllUsers(ctx); fmt.Sprint(sorted(names)) != "[alice bob]" {
+			t.Errorf("users are %v", names)
+		}
+
+		keys := map[string]APIKey{
+			"hash-1": {ID: "k1", Name: "ci", Username: "bob", Role: roleViewer, CreatedAt: 300},
+			"hash-2": {ID: "k2", Name: "prometheus", Username: "bob", Role: roleViewer, CreatedAt: 300},
+			"hash-3": {ID: "k3", Name: "ops", Username: "alice", Role: roleAdmin, CreatedAt: 300},
+		}
+		for hash, key := range keys {
+			if err := store.storeAPIKey(ctx, hash, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if key, err := store.getAPIKey(ctx, "hash-2"); err != nil || key == nil || key.Name != "prometheus" {
+			t.Errorf("key hash-2 is %+v, %v", key, err)
+		}
+		if key, err := store.getAPIKey(ctx, "hash-9"); key != nil || err != nil {
+			t.Errorf("unknown key is %+v, %v", key, err)
+		}
+		if bobs, _ := store.getUserAPIKeys(ctx, "bob"); len(bobs) != 2 || bobs["hash-1"].ID != "k1" {
+			t.Errorf("bob's keys are %v", bobs)
+		}
+		if deleted, err := store.deleteAPIKey(ctx, "bob", "k1"); !deleted || err != nil {
+			t.Errorf("revoking k1: %v, %v", deleted, err)
+		}
+		if deleted, _ := store.deleteAPIKey(ctx, "bob", "k3"); deleted {
+			t.Error("revoked alice's key as bob")
+		}
+
+		if err := store.deleteUser(ctx, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if user, _ := store.getUser(ctx, "bob"); user != nil {
+			t.Errorf("deleted user is %+v", user)
+		}
+		if key, _ := store.getAPIKey(ctx, "hash-2"); key != nil {
+			t.Errorf("deleted user's key is %+v", key)
+		}
+		if key, _ := store.getAPIKey(ctx, "hash-3"); key == nil {
+			t.Error("other user's key was deleted")
+		}
+
+		for i := int64(1); i <= 3; i++ {
+			entry := map[string]interface{}{"username": "alice", "action": "POST /api/users", "timestamp": i * 100}
+			if err := store.storeUserAudit(ctx, entry, i*100); err != nil {
+				t.Fatal(err)
+			}
+		}
+		audit, err := store.queryUserAudit(ctx, timeRange{From: 150, To: 300}, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(timestamps(t, audit)); got != "[300 200]" {
+			t.Errorf("audit 150-300 is at %s, want [300 200]", got)
+		}
+	})
+}
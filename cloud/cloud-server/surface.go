@@ -0,0 +1,841 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ============================================================================
+// MOISTURE SURFACE (SPATIAL INTERPOLATION)
+// ============================================================================
+
+// The fresh soil moisture readings are interpolated onto a regular lon/lat
+// grid, either by inverse distance weighting or by ordinary kriging with an
+// exponential variogram fitted to the readings. The surface is served as
+// JSON for the dashboard, as an ESRI ASCII grid or GeoTIFF raster and as
+// GeoJSON contours for QGIS, and zone estimates are averaged from it.
+
+const (
+	methodIDW     = "idw"
+	methodKriging = "kriging"
+)
+
+// Surface defaults and limits
+const (
+	defaultSurfaceCell    = 5.0   // meters
+	minSurfaceCell        = 0.5   // meters
+	defaultIDWPower       = 2.0   // IDW distance exponent
+	maxIDWPower           = 10.0  // Larger powers underflow the weights
+	defaultContourStep    = 5.0   // % moisture between contour lines
+	maxSurfaceCells       = 40000 // cols * rows
+	maxContourLevels      = 100
+	metersPerDegreeLat    = 111320.0
+	asciiGridNoData       = -9999
+	minKrigingSamples     = 3
+	variogramBins         = 10
+	variogramRangeSteps   = 20
+	variogramNuggetShares = 5 // nugget candidates 0, 0.1, ... of the variance
+)
+
+// interpolator estimates moisture at any location from the samples
+type interpolator interface {
+	estimate(lon, lat float64) float64
+}
+
+// Grid is a regular lon/lat raster. Values[0] is the northern row, each row
+// runs west to east; every value is the estimate at the cell centre.
+type Grid struct {
+	Method    string      `json:"method"`
+	MinLon    float64     `json:"min_lon"`
+	MinLat    float64     `json:"min_lat"`
+	MaxLon    float64     `json:"max_lon"`
+	MaxLat    float64     `json:"max_lat"`
+	Cols      int         `json:"cols"`
+	Rows      int         `json:"rows"`
+	CellSize  float64     `json:"cell_size_m"`
+	CellLon   float64     `json:"cell_lon"`
+	CellLat   float64     `json:"cell_lat"`
+	Power     float64     `json:"power,omitempty"`
+	Variogram *Variogram  `json:"variogram,omitempty"`
+	Values    [][]float64 `json:"values"`
+	Min       float64     `json:"min"`
+	Max       float64     `json:"max"`
+	Samples   int         `json:"samples"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+// surfaceOptions are the query parameters shared by the surface endpoints
+type surfaceOptions struct {
+	Method   string
+	CellSize float64
+	Power    float64
+}
+
+// parseSurfaceOptions reads ?method=idw|kriging&cell=5&power=2
+func parseSurfaceOptions(c *fiber.Ctx) (surfaceOptions, error) {
+	options := surfaceOptions{Method: c.Query("method", methodIDW)}
+	if options.Method != methodIDW && options.Method != methodKriging {
+		return options, fmt.Errorf("method must be idw or kriging")
+	}
+
+	var err error
+	options.CellSize, err = strconv.ParseFloat(c.Query("cell", fmt.Sprint(defaultSurfaceCell)), 64)
+	if err != nil || !finite(options.CellSize) || options.CellSize < minSurfaceCell {
+		return options, fmt.Errorf("cell must be a number of meters, at least %g", minSurfaceCell)
+	}
+	options.Power, err = strconv.ParseFloat(c.Query("power", fmt.Sprint(defaultIDWPower)), 64)
+	if err != nil || !finite(options.Power) || options.Power <= 0 || options.Power > maxIDWPower {
+		return options, fmt.Errorf("power must be positive and at most %g", maxIDWPower)
+	}
+	return options, nil
+}
+
+// finite reports whether value is neither NaN nor infinite
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// buildSurface interpolates the samples onto a grid covering them plus one
+// cell of margin
+func buildSurface(samples []moistureSample, options surfaceOptions) (*Grid, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no fresh soil moisture readings")
+	}
+
+	grid := &Grid{Method: options.Method, CellSize: options.CellSize, Samples: len(samples)}
+	var interp interpolator
+	switch options.Method {
+	case methodKriging:
+		kriging, err := newKriging(samples)
+		if err != nil {
+			return nil, err
+		}
+		interp, grid.Variogram = kriging, &kriging.variogram
+	default:
+		interp, grid.Power = &idwInterpolator{samples: samples, power: options.Power}, options.Power
+	}
+
+	points := make([][]float64, len(samples))
+	for i, sample := range samples {
+		points[i] = []float64{sample.Lon, sample.Lat}
+	}
+	minLon, minLat, maxLon, maxLat := bounds(points)
+
+	cellLat := options.CellSize / metersPerDegreeLat
+	cellLon := options.CellSize / (metersPerDegreeLat * math.Cos((minLat+maxLat)/2*math.Pi/180))
+	minLon, minLat = minLon-cellLon, minLat-cellLat
+	maxLon, maxLat = maxLon+cellLon, maxLat+cellLat
+
+	// Sized as floats first, a tiny cell would overflow int
+	width := math.Ceil((maxLon - minLon) / cellLon)
+	height := math.Ceil((maxLat - minLat) / cellLat)
+	if !finite(width) || !finite(height) || width*height > maxSurfaceCells {
+		smallest := math.Ceil(options.CellSize*math.Sqrt(width*height/maxSurfaceCells)*10) / 10
+		return nil, fmt.Errorf("grid of %.0fx%.0f cells is too large, use a cell size of at least %.1f m", width, height, smallest)
+	}
+	cols, rows := int(width), int(height)
+
+	grid.MinLon, grid.MinLat = minLon, minLat
+	grid.MaxLon, grid.MaxLat = minLon+float64(cols)*cellLon, minLat+float64(rows)*cellLat
+	grid.Cols, grid.Rows = cols, rows
+	grid.CellLon, grid.CellLat = cellLon, cellLat
+	grid.Values = make([][]float64, rows)
+	grid.Min, grid.Max = math.Inf(1), math.Inf(-1)
+	grid.Timestamp = time.Now().Unix()
+
+	for row := 0; row < rows; row++ {
+		grid.Values[row] = make([]float64, cols)
+		for col := 0; col < cols; col++ {
+			lon, lat := grid.cellCentre(row, col)
+			value := interp.estimate(lon, lat)
+			grid.Values[row][col] = value
+			grid.Min = math.Min(grid.Min, value)
+			grid.Max = math.Max(grid.Max, value)
+		}
+	}
+	return grid, nil
+}
+
+// cellCentre returns the [lon, lat] centre of a grid cell
+func (g *Grid) cellCentre(row, col int) (float64, float64) {
+	return g.MinLon + (float64(col)+0.5)*g.CellLon, g.MaxLat - (float64(row)+0.5)*g.CellLat
+}
+
+// ============================================================================
+// INVERSE DISTANCE WEIGHTING
+// ============================================================================
+
+type idwInterpolator struct {
+	samples []moistureSample
+	power   float64
+}
+
+// estimate returns the inverse distance weighted mean of all samples
+func (i *idwInterpolator) estimate(lon, lat float64) float64 {
+	var weighted, weights float64
+	for _, sample := range i.samples {
+		distance := distanceMeters(lon, lat, sample.Lon, sample.Lat)
+		if distance < 1e-6 {
+			return sample.Value
+		}
+		weight := 1 / math.Pow(distance, i.power)
+		weighted += weight * sample.Value
+		weights += weight
+	}
+	return weighted / weights
+}
+
+// ============================================================================
+// ORDINARY KRIGING
+// ============================================================================
+
+// Variogram is an exponential semivariogram model:
+// γ(h) = nugget + (sill - nugget) * (1 - exp(-3h / range))
+type Variogram struct {
+	Model  string  `json:"model"`
+	Nugget float64 `json:"nugget"`
+	Sill   float64 `json:"sill"`
+	Range  float64 `json:"range_m"`
+}
+
+func (v Variogram) gamma(h float64) float64 {
+	if h == 0 {
+		return 0
+	}
+	return v.Nugget + (v.Sill-v.Nugget)*(1-math.Exp(-3*h/v.Range))
+}
+
+type krigingInterpolator struct {
+	samples   []moistureSample
+	variogram Variogram
+	lu        [][]float64 // LU decomposition of the kriging matrix
+	pivot     []int
+}
+
+// newKriging fits the variogram and factorizes the kriging system once, so
+// each estimate only solves for a new right-hand side
+func newKriging(samples []moistureSample) (*krigingInterpolator, error) {
+	n := len(samples)
+	if n < minKrigingSamples {
+		return nil, fmt.Errorf("kriging needs at least %d fresh readings, have %d", minKrigingSamples, n)
+	}
+
+	k := &krigingInterpolator{samples: samples, variogram: fitVariogram(samples)}
+
+	// [Γ 1; 1ᵀ 0] [w; μ] = [γ; 1]
+	matrix := make([][]float64, n+1)
+	for i := range matrix {
+		matrix[i] = make([]float64, n+1)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			h := distanceMeters(samples[i].Lon, samples[i].Lat, samples[j].Lon, samples[j].Lat)
+			matrix[i][j] = k.variogram.gamma(h)
+		}
+		matrix[i][n], matrix[n][i] = 1, 1
+	}
+
+	var err error
+	k.lu, k.pivot, err = luDecompose(matrix)
+	if err != nil {
+		return nil, fmt.Errorf("kriging system is singular (sensors at the same location?), use idw")
+	}
+	return k, nil
+}
+
+// estimate returns the kriging weighted sum of the samples
+func (k *krigingInterpolator) estimate(lon, lat float64) float64 {
+	n := len(k.samples)
+	rhs := make([]float64, n+1)
+	for i, sample := range k.samples {
+		rhs[i] = k.variogram.gamma(distanceMeters(lon, lat, sample.Lon, sample.Lat))
+	}
+	rhs[n] = 1
+
+	weights := luSolve(k.lu, k.pivot, rhs)
+	var value float64
+	for i, sample := range k.samples {
+		value += weights[i] * sample.Value
+	}
+	return value
+}
+
+// fitVariogram fits nugget and range of an exponential model to the
+// empirical semivariogram, with the sill at the sample variance
+func fitVariogram(samples []moistureSample) Variogram {
+	var mean float64
+	for _, sample := range samples {
+		mean += sample.Value
+	}
+	mean /= float64(len(samples))
+	var variance float64
+	for _, sample := range samples {
+		variance += (sample.Value - mean) * (sample.Value - mean)
+	}
+	variance /= float64(len(samples))
+	if variance == 0 {
+		variance = 1 // Flat field, any model gives the same estimate
+	}
+
+	type pair struct{ h, gamma float64 }
+	var pairs []pair
+	var maxDistance float64
+	for i := range samples {
+		for j := i + 1; j < len(samples); j++ {
+			h := distanceMeters(samples[i].Lon, samples[i].Lat, samples[j].Lon, samples[j].Lat)
+			diff := samples[i].Value - samples[j].Value
+			pairs = append(pairs, pair{h, diff * diff / 2})
+			maxDistance = math.Max(maxDistance, h)
+		}
+	}
+	if maxDistance == 0 {
+		return Variogram{Model: "exponential", Sill: variance, Range: 1}
+	}
+
+	// Empirical semivariogram up to half the largest distance
+	binWidth := maxDistance / 2 / variogramBins
+	var binH, binGamma [variogramBins]float64
+	var binCount [variogramBins]int
+	for _, p := range pairs {
+		bin := int(p.h / binWidth)
+		if bin >= variogramBins {
+			continue
+		}
+		binH[bin] += p.h
+		binGamma[bin] += p.gamma
+		binCount[bin]++
+	}
+
+	best := Variogram{Model: "exponential", Sill: variance, Range: maxDistance / 3}
+	bestError := math.Inf(1)
+	for step := 1; step <= variogramRangeSteps; step++ {
+		for share := 0; share < variogramNuggetShares; share++ {
+			candidate := Variogram{
+				Model:  "exponential",
+				Nugget: variance * float64(share) / 10,
+				Sill:   variance,
+				Range:  maxDistance * float64(step) / variogramRangeSteps,
+			}
+			var sse float64
+			for bin := 0; bin < variogramBins; bin++ {
+				if binCount[bin] == 0 {
+					continue
+				}
+				h := binH[bin] / float64(binCount[bin])
+				diff := candidate.gamma(h) - binGamma[bin]/float64(binCount[bin])
+				sse += float64(binCount[bin]) * diff * diff
+			}
+			if sse < bestError {
+				best, bestError = candidate, sse
+			}
+		}
+	}
+	return best
+}
+
+// luDecompose factorizes a square matrix in place with partial pivoting
+func luDecompose(matrix [][]float64) ([][]float64, []int, error) {
+	n := len(matrix)
+	pivot := make([]int, n)
+	for i := range pivot {
+		pivot[i] = i
+	}
+
+	for col := 0; col < n; col++ {
+		best := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(matrix[row][col]) > math.Abs(matrix[best][col]) {
+				best = row
+			}
+		}
+		if math.Abs(matrix[best][col]) < 1e-12 {
+			return nil, nil, fmt.Errorf("singular matrix")
+		}
+		matrix[col], matrix[best] = matrix[best], matrix[col]
+		pivot[col], pivot[best] = pivot[best], pivot[col]
+
+		for row := col + 1; row < n; row++ {
+			matrix[row][col] /= matrix[col][col]
+			for k := col + 1; k < n; k++ {
+				matrix[row][k] -= matrix[row][col] * matrix[col][k]
+			}
+		}
+	}
+	return matrix, pivot, nil
+}
+
+// luSolve solves LU x = P b
+func luSolve(lu [][]float64, pivot []int, b []float64) []float64 {
+	n := len(lu)
+	x := make([]float64, n)
+	for i := 0; i < n; i++ {
+		x[i] = b[pivot[i]]
+		for k := 0; k < i; k++ {
+			x[i] -= lu[i][k] * x[k]
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		for k := i + 1; k < n; k++ {
+			x[i] -= lu[i][k] * x[k]
+		}
+		x[i] /= lu[i][i]
+	}
+	return x
+}
+
+// ============================================================================
+// RASTER EXPORT (ESRI ASCII GRID, GEOTIFF)
+// ============================================================================
+
+// asciiGrid renders the surface as an ESRI ASCII grid. Cells are not square
+// in degrees, so the header uses dx/dy, which GDAL and QGIS read.
+func asciiGrid(grid *Grid) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ncols %d\nnrows %d\n", grid.Cols, grid.Rows)
+	fmt.Fprintf(&buf, "xllcorner %.10f\nyllcorner %.10f\n", grid.MinLon, grid.MinLat)
+	fmt.Fprintf(&buf, "dx %.12f\ndy %.12f\n", grid.CellLon, grid.CellLat)
+	fmt.Fprintf(&buf, "NODATA_value %d\n", asciiGridNoData)
+	for _, row := range grid.Values {
+		for col, value := range row {
+			if col > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(strconv.FormatFloat(value, 'f', 2, 64))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// TIFF tag types
+const (
+	tiffShort  = 3
+	tiffLong   = 4
+	tiffDouble = 12
+)
+
+type tiffEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     uint32 // Inline value or offset of the data
+	data      []byte // Data stored after the IFD
+}
+
+// geoTIFF renders the surface as a single-band float32 GeoTIFF in WGS 84
+// (EPSG:4326), uncompressed, one strip
+func geoTIFF(grid *Grid) []byte {
+	le := binary.LittleEndian
+	doubles := func(values ...float64) []byte {
+		data := make([]byte, 8*len(values))
+		for i, value := range values {
+			le.PutUint64(data[8*i:], math.Float64bits(value))
+		}
+		return data
+	}
+	shorts := func(values ...uint16) []byte {
+		data := make([]byte, 2*len(values))
+		for i, value := range values {
+			le.PutUint16(data[2*i:], value)
+		}
+		return data
+	}
+
+	pixels := make([]byte, 4*grid.Cols*grid.Rows)
+	for row, values := range grid.Values {
+		for col, value := range values {
+			le.PutUint32(pixels[4*(row*grid.Cols+col):], math.Float32bits(float32(value)))
+		}
+	}
+
+	geoKeys := shorts(
+		1, 1, 0, 3, // Directory version, revision, key count
+		1024, 0, 1, 2, // GTModelTypeGeoKey: geographic
+		1025, 0, 1, 1, // GTRasterTypeGeoKey: pixel is area
+		2048, 0, 1, 4326, // GeographicTypeGeoKey: WGS 84
+	)
+
+	scale := doubles(grid.CellLon, grid.CellLat, 0)
+	tiepoint := doubles(0, 0, 0, grid.MinLon, grid.MaxLat, 0) // Raster (0,0) at the north-west corner
+
+	entries := []tiffEntry{
+		{tag: 256, kind: tiffLong, count: 1, value: uint32(grid.Cols)},                // ImageWidth
+		{tag: 257, kind: tiffLong, count: 1, value: uint32(grid.Rows)},                // ImageLength
+		{tag: 258, kind: tiffShort, count: 1, value: 32},                              // BitsPerSample
+		{tag: 259, kind: tiffShort, count: 1, value: 1},                               // Compression: none
+		{tag: 262, kind: tiffShort, count: 1, value: 1},                               // Photometric: black is zero
+		{tag: 273, kind: tiffLong, count: 1, data: pixels},                            // StripOffsets
+		{tag: 277, kind: tiffShort, count: 1, value: 1},                               // SamplesPerPixel
+		{tag: 278, kind: tiffLong, count: 1, value: uint32(grid.Rows)},                // RowsPerStrip
+		{tag: 279, kind: tiffLong, count: 1, value: uint32(len(pixels))},              // StripByteCounts
+		{tag: 284, kind: tiffShort, count: 1, value: 1},                               // PlanarConfiguration
+		{tag: 339, kind: tiffShort, count: 1, value: 3},                               // SampleFormat: IEEE float
+		{tag: 33550, kind: tiffDouble, count: 3, data: scale},                         // ModelPixelScale
+		{tag: 33922, kind: tiffDouble, count: 6, data: tiepoint},                      // ModelTiepoint
+		{tag: 34735, kind: tiffShort, count: uint32(len(geoKeys) / 2), data: geoKeys}, // GeoKeyDirectory
+	}
+
+	// Header, IFD, then the out-of-line data in entry order
+	offset := uint32(8 + 2 + 12*len(entries) + 4)
+	for i := range entries {
+		if entries[i].data != nil {
+			entries[i].value = offset
+			offset += uint32(len(entries[i].data))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, le, uint16(42))
+	binary.Write(&buf, le, uint32(8))
+	binary.Write(&buf, le, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&buf, le, entry.tag)
+		binary.Write(&buf, le, entry.kind)
+		binary.Write(&buf, le, entry.count)
+		if entry.kind == tiffShort && entry.data == nil {
+			binary.Write(&buf, le, uint16(entry.value)) // Left-justified in the value field
+			binary.Write(&buf, le, uint16(0))
+		} else {
+			binary.Write(&buf, le, entry.value)
+		}
+	}
+	binary.Write(&buf, le, uint32(0)) // No next IFD
+	for _, entry := range entries {
+		buf.Write(entry.data)
+	}
+	return buf.Bytes()
+}
+
+// ============================================================================
+// CONTOURS (MARCHING SQUARES)
+// ============================================================================
+
+// contourLevels returns the multiples of step within the surface range
+func contourLevels(grid *Grid, step float64) ([]float64, error) {
+	first := math.Ceil(grid.Min/step) * step
+	if (grid.Max-first)/step+1 > maxContourLevels {
+		return nil, fmt.Errorf("more than %d contour levels, use a larger interval", maxContourLevels)
+	}
+	levels := []float64{}
+	for i := 0; first+float64(i)*step <= grid.Max; i++ {
+		levels = append(levels, round2(first+float64(i)*step))
+	}
+	return levels, nil
+}
+
+// contourLines traces the isolines of one level through the cell centres.
+// Crossings are identified by the grid edge they lie on, so the segments
+// of neighbouring squares join exactly into lines.
+func contourLines(grid *Grid, level float64) [][][]float64 {
+	type edge struct {
+		row, col   int
+		horizontal bool // Between (row, col) and (row, col+1), else (row+1, col)
+	}
+	position := func(e edge) []float64 {
+		r2, c2 := e.row+1, e.col
+		if e.horizontal {
+			r2, c2 = e.row, e.col+1
+		}
+		v1, v2 := grid.Values[e.row][e.col], grid.Values[r2][c2]
+		t := (level - v1) / (v2 - v1)
+		lon1, lat1 := grid.cellCentre(e.row, e.col)
+		lon2, lat2 := grid.cellCentre(r2, c2)
+		return []float64{lon1 + t*(lon2-lon1), lat1 + t*(lat2-lat1)}
+	}
+
+	// Segments of each square, by the edges they connect
+	var segments [][2]edge
+	for row := 0; row+1 < grid.Rows; row++ {
+		for col := 0; col+1 < grid.Cols; col++ {
+			tl, tr := grid.Values[row][col], grid.Values[row][col+1]
+			bl, br := grid.Values[row+1][col], grid.Values[row+1][col+1]
+			top := edge{row, col, true}
+			bottom := edge{row + 1, col, true}
+			left := edge{row, col, false}
+			right := edge{row, col + 1, false}
+
+			index := 0
+			for i, value := range []float64{tl, tr, br, bl} {
+				if value >= level {
+					index |= 1 << i
+				}
+			}
+			switch index {
+			case 1, 14:
+				segments = append(segments, [2]edge{left, top})
+			case 2, 13:
+				segments = append(segments, [2]edge{top, right})
+			case 3, 12:
+				segments = append(segments, [2]edge{left, right})
+			case 4, 11:
+				segments = append(segments, [2]edge{right, bottom})
+			case 6, 9:
+				segments = append(segments, [2]edge{top, bottom})
+			case 7, 8:
+				segments = append(segments, [2]edge{left, bottom})
+			case 5, 10: // Saddle, resolved by the centre value
+				centreAbove := (tl+tr+bl+br)/4 >= level
+				if (index == 5) == centreAbove {
+					segments = append(segments, [2]edge{left, bottom}, [2]edge{top, right})
+				} else {
+					segments = append(segments, [2]edge{left, top}, [2]edge{right, bottom})
+				}
+			}
+		}
+	}
+
+	// Chain the segments, open lines first (they start at an edge used once)
+	byEdge := make(map[edge][]int)
+	for i, segment := range segments {
+		byEdge[segment[0]] = append(byEdge[segment[0]], i)
+		byEdge[segment[1]] = append(byEdge[segment[1]], i)
+	}
+	used := make([]bool, len(segments))
+	trace := func(start int, from edge) [][]float64 {
+		line := [][]float64{position(from)}
+		current, at := start, from
+		for current >= 0 && !used[current] {
+			used[current] = true
+			next := segments[current][0]
+			if next == at {
+				next = segments[current][1]
+			}
+			line = append(line, position(next))
+			at, current = next, -1
+			for _, candidate := range byEdge[at] {
+				if !used[candidate] {
+					current = candidate
+				}
+			}
+		}
+		return line
+	}
+
+	var lines [][][]float64
+	for e, indexes := range byEdge {
+		if len(indexes) == 1 && !used[indexes[0]] {
+			lines = append(lines, trace(indexes[0], e))
+		}
+	}
+	for i := range segments {
+		if !used[i] {
+			lines = append(lines, trace(i, segments[i][0])) // Closed ring
+		}
+	}
+	return lines
+}
+
+// contourFeatures returns one MultiLineString feature per level
+func contourFeatures(grid *Grid, levels []float64) []fiber.Map {
+	features := []fiber.Map{}
+	for _, level := range levels {
+		lines := contourLines(grid, level)
+		if len(lines) == 0 {
+			continue
+		}
+		sort.Slice(lines, func(i, j int) bool { return len(lines[i]) > len(lines[j]) })
+		features = append(features, fiber.Map{
+			"type":       "Feature",
+			"properties": fiber.Map{"moisture": level},
+			"geometry":   fiber.Map{"type": "MultiLineString", "coordinates": lines},
+		})
+	}
+	return features
+}
+
+// ============================================================================
+// ZONE ESTIMATES
+// ============================================================================
+
+// zoneEstimates averages the surface over each zone. Every cell belongs to
+// the zone of its nearest soil moisture sensor, so a zone estimate covers
+// the area between its sensors, not only the sensor locations. Cells
+// farther from every sensor than twice the median sensor spacing are not
+// part of any zone.
+func zoneEstimates(grid *Grid, zones []*zone) map[string]fiber.Map {
+	type member struct {
+		zone     string
+		lon, lat float64
+	}
+	var members []member
+	for _, z := range zones {
+		for _, point := range z.Points {
+			members = append(members, member{z.Name, point[0], point[1]})
+		}
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	spacing := make([]float64, 0, len(members))
+	for i, a := range members {
+		nearest := math.Inf(1)
+		for j, b := range members {
+			if i != j {
+				nearest = math.Min(nearest, distanceMeters(a.lon, a.lat, b.lon, b.lat))
+			}
+		}
+		if !math.IsInf(nearest, 1) {
+			spacing = append(spacing, nearest)
+		}
+	}
+	reach := grid.CellSize
+	if len(spacing) > 0 {
+		sort.Float64s(spacing)
+		reach = math.Max(reach, 2*spacing[len(spacing)/2])
+	}
+
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Cols; col++ {
+			lon, lat := grid.cellCentre(row, col)
+			nearest, nearestDistance := "", math.Inf(1)
+			for _, m := range members {
+				if distance := distanceMeters(lon, lat, m.lon, m.lat); distance < nearestDistance {
+					nearest, nearestDistance = m.zone, distance
+				}
+			}
+			if nearestDistance > reach {
+				continue
+			}
+			sums[nearest] += grid.Values[row][col]
+			counts[nearest]++
+		}
+	}
+
+	estimates := make(map[string]fiber.Map, len(counts))
+	for name, count := range counts {
+		estimates[name] = fiber.Map{
+			"estimated_moisture": round2(sums[name] / float64(count)),
+			"estimate_cells":     count,
+			"estimate_method":    grid.Method,
+		}
+	}
+	return estimates
+}
+
+// ============================================================================
+// GEOMETRY HELPERS
+// ============================================================================
+
+// distanceMeters approximates the distance between two nearby positions
+// (equirectangular projection, fine at field scale)
+func distanceMeters(lon1, lat1, lon2, lat2 float64) float64 {
+	x := (lon2 - lon1) * math.Cos((lat1+lat2)/2*math.Pi/180)
+	y := lat2 - lat1
+	return math.Sqrt(x*x+y*y) * metersPerDegreeLat
+}
+
+// bounds returns the bounding box of [lon, lat] points
+func bounds(points [][]float64) (minLon, minLat, maxLon, maxLat float64) {
+	minLon, minLat = math.Inf(1), math.Inf(1)
+	maxLon, maxLat = math.Inf(-1), math.Inf(-1)
+	for _, p := range points {
+		minLon, maxLon = math.Min(minLon, p[0]), math.Max(maxLon, p[0])
+		minLat, maxLat = math.Min(minLat, p[1]), math.Max(maxLat, p[1])
+	}
+	return
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// ============================================================================
+// SURFACE HTTP HANDLERS
+// ============================================================================
+
+// farmSurface interpolates a farm's fresh moisture readings
+func (h *APIHandlers) farmSurface(ctx context.Context, farm string, options surfaceOptions) (*Grid, error) {
+	devices, err := h.devicesByID(ctx, farm)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := h.moistureSamples(ctx, farm, devices)
+	if err != nil {
+		return nil, err
+	}
+	return buildSurface(samples, options)
+}
+
+// GET /api/farms/:farm/geo/heatmap?method=idw|kriging&cell=5&power=2
+func (h *APIHandlers) getHeatmap(c *fiber.Ctx) error {
+	options, err := parseSurfaceOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	grid, err := h.farmSurface(c.UserContext(), farmOf(c), options)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(grid)
+}
+
+// GET /api/farms/:farm/geo/surface?format=asc|tif (raster download for QGIS)
+func (h *APIHandlers) getSurface(c *fiber.Ctx) error {
+	options, err := parseSurfaceOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	format := strings.ToLower(c.Query("format", "tif"))
+	if format != "asc" && format != "tif" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be asc or tif"})
+	}
+
+	farm := farmOf(c)
+	grid, err := h.farmSurface(c.UserContext(), farm, options)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	filename := fmt.Sprintf("%s-moisture-%s-%d.%s", farm, grid.Method, grid.Timestamp, format)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	if format == "asc" {
+		c.Set(fiber.HeaderContentType, "text/plain; charset=utf-8")
+		return c.Send(asciiGrid(grid))
+	}
+	c.Set(fiber.HeaderContentType, "image/tiff")
+	return c.Send(geoTIFF(grid))
+}
+
+// GET /api/farms/:farm/geo/contours?interval=5 (GeoJSON isolines)
+func (h *APIHandlers) getContours(c *fiber.Ctx) error {
+	options, err := parseSurfaceOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	interval, err := strconv.ParseFloat(c.Query("interval", fmt.Sprint(defaultContourStep)), 64)
+	if err != nil || !finite(interval) || interval <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "interval must be positive"})
+	}
+
+	farm := farmOf(c)
+	grid, err := h.farmSurface(c.UserContext(), farm, options)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.Error()})
+	}
+	levels, err := contourLevels(grid, interval)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/geo+json")
+	return c.JSON(fiber.Map{
+		"type":     "FeatureCollection",
+		"name":     farm + "-moisture-contours",
+		"method":   grid.Method,
+		"interval": interval,
+		"features": contourFeatures(grid, levels),
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"testing"
+)
+
+// squareSamples places four samples on the corners of a square of side
+// meters near the simulator's farm
+func squareSamples(side float64, values ...float64) []moistureSample {
+	const lon, lat = 51.4, 35.7
+	dLat := side / metersPerDegreeLat
+	dLon := side / (metersPerDegreeLat * math.Cos(lat*math.Pi/180))
+	corners := [][2]float64{{lon, lat}, {lon + dLon, lat}, {lon, lat + dLat}, {lon + dLon, lat + dLat}}
+	samples := make([]moistureSample, len(values))
+	for i, value := range values {
+		samples[i] = moistureSample{SensorID: i + 1, Lon: corners[i][0], Lat: corners[i][1], Value: value}
+	}
+	return samples
+}
+
+func TestBuildSurface(t *testing.T) {
+	samples := squareSamples(40, 20, 30, 40, 50)
+	for _, method := range []string{methodIDW, methodKriging} {
+		grid, err := buildSurface(samples, surfaceOptions{Method: method, CellSize: 5, Power: 2})
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		// 40 m plus a 5 m margin on each side
+		if grid.Cols < 10 || grid.Cols > 11 || grid.Rows < 10 || grid.Rows > 11 {
+			t.Errorf("%s: grid is %dx%d cells, want about 10x10", method, grid.Cols, grid.Rows)
+		}
+		if len(grid.Values) != grid.Rows || len(grid.Values[0]) != grid.Cols {
+			t.Errorf("%s: values are %dx%d, header says %dx%d", method, len(grid.Values[0]), len(grid.Values), grid.Cols, grid.Rows)
+		}
+		if grid.MinLon >= samples[0].Lon || grid.MaxLat <= samples[3].Lat {
+			t.Errorf("%s: grid %v..%v does not cover the samples", method, grid.MinLon, grid.MaxLat)
+		}
+		if grid.Min >= grid.Max || grid.Min < 10 || grid.Max > 60 {
+			t.Errorf("%s: surface ranges %v..%v, want within the samples", method, grid.Min, grid.Max)
+		}
+		if grid.Samples != 4 || grid.Method != method {
+			t.Errorf("%s: grid is %+v", method, grid)
+		}
+	}
+
+	if _, err := buildSurface(nil, surfaceOptions{Method: methodIDW, CellSize: 5, Power: 2}); err == nil {
+		t.Error("built a surface without samples")
+	}
+}
+
+func TestBuildSurfaceTooLarge(t *testing.T) {
+	samples := squareSamples(1000, 20, 30, 40, 50)
+	for _, cell := range []float64{1, 1e-300, math.SmallestNonzeroFloat64} {
+		if grid, err := buildSurface(samples, surfaceOptions{Method: methodIDW, CellSize: cell, Power: 2}); err == nil {
+			t.Errorf("cell %g built a %dx%d grid", cell, grid.Cols, grid.Rows)
+		}
+	}
+}
+
+func TestIDW(t *testing.T) {
+	samples := squareSamples(40, 20, 40)
+	idw := &idwInterpolator{samples: samples, power: 2}
+
+	if value := idw.estimate(samples[0].Lon, samples[0].Lat); value != 20 {
+		t.Errorf("estimate at a sample is %v, want 20", value)
+	}
+	midLon, midLat := (samples[0].Lon+samples[1].Lon)/2, samples[0].Lat
+	if value := idw.estimate(midLon, midLat); math.Abs(value-30) > 1e-9 {
+		t.Errorf("estimate halfway between is %v, want 30", value)
+	}
+	near := idw.estimate(samples[0].Lon+(samples[1].Lon-samples[0].Lon)/10, midLat)
+	if near <= 20 || near >= 30 {
+		t.Errorf("estimate near the dry sample is %v, want between 20 and 30", near)
+	}
+}
+
+func TestKriging(t *testing.T) {
+	samples := squareSamples(40, 20, 30, 40, 50)
+	kriging, err := newKriging(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kriging.variogram.Sill <= 0 || kriging.variogram.Range <= 0 {
+		t.Errorf("fitted variogram %+v", kriging.variogram)
+	}
+	for _, sample := range samples {
+		if value := kriging.estimate(sample.Lon, sample.Lat); math.Abs(value-sample.Value) > 1e-6 {
+			t.Errorf("estimate at sensor %d is %v, want %v", sample.SensorID, value, sample.Value)
+		}
+	}
+	centreLon, centreLat := (samples[0].Lon+samples[3].Lon)/2, (samples[0].Lat+samples[3].Lat)/2
+	if value := kriging.estimate(centreLon, centreLat); math.Abs(value-35) > 1e-6 {
+		t.Errorf("estimate at the centre is %v, want the mean 35", value)
+	}
+
+	flat, err := newKriging(squareSamples(40, 25, 25, 25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := flat.estimate(centreLon, centreLat); math.Abs(value-25) > 1e-6 {
+		t.Errorf("flat field estimate is %v, want 25", value)
+	}
+
+	if _, err := newKriging(squareSamples(40, 20, 30)); err == nil {
+		t.Error("kriged two samples")
+	}
+	stacked := squareSamples(40, 20, 30, 40)
+	stacked[1].Lon, stacked[1].Lat = stacked[0].Lon, stacked[0].Lat
+	if _, err := newKriging(stacked); err == nil {
+		t.Error("kriged two sensors at the same location")
+	}
+}
+
+func TestContourLevels(t *testing.T) {
+	levels, err := contourLevels(&Grid{Min: 12.3, Max: 37}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(levels) != "[15 20 25 30 35]" {
+		t.Errorf("levels are %v", levels)
+	}
+	if levels, _ := contourLevels(&Grid{Min: 21, Max: 24}, 5); len(levels) != 0 {
+		t.Errorf("levels within one step are %v", levels)
+	}
+	if _, err := contourLevels(&Grid{Min: 0, Max: 100}, 0.5); err == nil {
+		t.Error("allowed 201 levels")
+	}
+}
+
+// testGrid builds a grid of one degree cells with the given values
+func testGrid(values [][]float64) *Grid {
+	return &Grid{Rows: len(values), Cols: len(values[0]), CellLon: 1, CellLat: 1, MaxLat: float64(len(values)), Values: values}
+}
+
+func TestContourLines(t *testing.T) {
+	// West to east gradient: one open line between the second and third column
+	gradient := testGrid([][]float64{
+		{10, 20, 30, 40},
+		{10, 20, 30, 40},
+		{10, 20, 30, 40},
+	})
+	lines := contourLines(gradient, 25)
+	if len(lines) != 1 || len(lines[0]) != 3 {
+		t.Fatalf("gradient lines are %v, want one line of 3 points", lines)
+	}
+	for _, point := range lines[0] {
+		if point[0] != 2 {
+			t.Errorf("gradient line passes %v, want lon 2", point)
+		}
+	}
+
+	// A peak in the middle: one closed ring around it
+	peak := testGrid([][]float64{
+		{10, 10, 10},
+		{10, 50, 10},
+		{10, 10, 10},
+	})
+	lines = contourLines(peak, 30)
+	if len(lines) != 1 || len(lines[0]) != 5 {
+		t.Fatalf("peak lines are %v, want one ring of 5 points", lines)
+	}
+	if first, last := lines[0][0], lines[0][len(lines[0])-1]; first[0] != last[0] || first[1] != last[1] {
+		t.Errorf("peak ring is not closed: %v", lines[0])
+	}
+
+	if lines := contourLines(peak, 60); len(lines) != 0 {
+		t.Errorf("level above the surface has lines %v", lines)
+	}
+}
+
+func TestSurfaceParameters(t *testing.T) {
+	for _, query := range []string{"cell=1e-300", "cell=0.1", "cell=NaN", "cell=Inf", "power=Inf", "power=NaN", "power=0", "interval=NaN", "interval=Inf"} {
+		values, _ := url.ParseQuery(query)
+		expect(t, server.do(t, "GET", "/api/farms/default/geo/contours?"+values.Encode(), nil), 400)
+	}
+}
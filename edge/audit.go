@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// ============================================
+// DECISION AUDIT LOG
+// ============================================
+
+// Every evaluation is recorded as a structured event in a JSON log file.
+// Decisions that change something (a gate opening or closing, a zone
+// entering or leaving the queue, a cooldown or override starting) are also
+// published to the cloud, so "why did gate 2 open at 03:14" has an answer
+// without repeating every reading. Console DEBUG output is off unless
+// EDGE_DEBUG=1.
+const (
+	decisionLogFile = "decisions.log"
+	decisionTopic   = "edge/decisions" // Under farm/<farm>/
+)
+
+// Decision actions
+const (
+	actionNone     = "none"     // Thresholds not crossed
+	actionQueue    = "queue"    // Dry zone queued for irrigation
+	actionDequeue  = "dequeue"  // Zone left the queue (wet again)
+	actionOpen     = "open"     // Gate opened
+	actionClose    = "close"    // Gate closed
+	actionCooldown = "cooldown" // Action needed but gate in cooldown
+	actionOverride = "override" // Manual override set, gate already in requested state
+	actionRelease  = "release"  // Manual override released
+	actionUnmapped = "unmapped" // Sensor not mapped to any gate
+)
+
+// DecisionEvent is one structured audit record
+type DecisionEvent struct {
+	FarmID            string   `json:"farm_id"`
+	Timestamp         int64    `json:"timestamp"`
+	Level             string   `json:"level"`
+	Source            string   `json:"source"` // "auto", "scheduler" or "manual"
+	SensorID          int      `json:"sensor_id,omitempty"`
+	Moisture          *float64 `json:"moisture,omitempty"` // nil without a reading, 0% is a reading
+	GateID            int      `json:"gate_id,omitempty"`
+	ZoneMoisture      float64  `json:"zone_moisture"`
+	ZoneSensors       int      `json:"zone_sensors"`
+	DryThreshold      float64  `json:"dry_threshold"`
+	WetThreshold      float64  `json:"wet_threshold"`
+	CooldownRemaining float64  `json:"cooldown_remaining_seconds"`
+	GateOpenBefore    bool     `json:"gate_open_before"`
+	GateOpenAfter     bool     `json:"gate_open_after"`
+	Action            string   `json:"action"`
+	Reason            string   `json:"reason"`
+}
+
+var (
+	debugConsole   = os.Getenv("EDGE_DEBUG") == "1"
+	decisionLogger *slog.Logger
+)
+
+// initDecisionLog opens the JSON decision log. The minimum level comes from
+// EDGE_LOG_LEVEL (debug, info, warn, error) and defaults to debug so that
+// every evaluation is kept.
+func initDecisionLog() {
+	level := slog.LevelDebug
+	if env := os.Getenv("EDGE_LOG_LEVEL"); env != "" {
+		if err := level.UnmarshalText([]byte(strings.ToUpper(env))); err != nil {
+			log.Printf("⚠️ Invalid EDGE_LOG_LEVEL %q, using debug", env)
+			level = slog.LevelDebug
+		}
+	}
+
+	file, err := os.OpenFile(decisionLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("⚠️ Cannot open %s, decision log goes to stderr: %v", decisionLogFile, err)
+		file = os.Stderr
+	}
+
+	decisionLogger = slog.New(slog.NewJSONHandler(file, &slog.HandlerOptions{Level: level}))
+}
+
+// debugf prints console debug output when EDGE_DEBUG=1
+func debugf(format string, args ...interface{}) {
+	if debugConsole {
+		fmt.Printf(format, args...)
+	}
+}
+
+// newGateEvent pre-fills an event with the gate and zone context before an
+// action is taken. Caller must hold stateMutex.
+func newGateEvent(gate *GateState, source string) DecisionEvent {
+	event := DecisionEvent{
+		Source:         source,
+		GateID:         gate.GateID,
+		DryThreshold:   dryThreshold,
+		WetThreshold:   wetThreshold,
+		GateOpenBefore: gate.IsOpen,
+		Action:         actionNone,
+	}
+	event.ZoneMoisture, event.ZoneSensors = zoneAggregate(gate.GateID)
+
+	if remaining := commandCooldown - time.Since(gate.LastCommand); remaining > 0 {
+		event.CooldownRemaining = remaining.Seconds()
+	}
+	return event
+}
+
+// zoneAggregate returns the mean moisture and reporting sensor count of a
+// gate zone. Caller must hold stateMutex.
+func zoneAggregate(gateID int) (float64, int) {
+	sum := 0.0
+	count := 0
+	for sensorID, mappedGate := range sensorToGateMap {
+		if mappedGate != gateID {
+			continue
+		}
+		if value, ok := soilMoistureStates[sensorID]; ok {
+			sum += value
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return sum / float64(count), count
+}
+
+// levelFor maps actions to log levels
+func levelFor(action string) slog.Level {
+	switch action {
+	case actionNone:
+		return slog.LevelDebug
+	case actionUnmapped:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// changesState reports whether a decision changed something worth keeping
+// beyond the local log
+func changesState(action string) bool {
+	return action != actionNone && action != actionUnmapped
+}
+
+// emitDecision writes the event to the JSON log and, if it changed
+// something, publishes it to the cloud and keeps it for the local API.
+func emitDecision(event DecisionEvent) {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+	event.FarmID = mqttConfig.FarmID
+	level := levelFor(event.Action)
+	event.Level = strings.ToLower(level.String())
+
+	if decisionLogger != nil {
+		decisionLogger.LogAttrs(context.Background(), level, "decision",
+			slog.String("farm_id", event.FarmID),
+			slog.String("source", event.Source),
+			slog.Int("sensor_id", event.SensorID),
+			slog.Any("moisture", event.Moisture),
+			slog.Int("gate_id", event.GateID),
+			slog.Float64("zone_moisture", event.ZoneMoisture),
+			slog.Int("zone_sensors", event.ZoneSensors),
+			slog.Float64("dry_threshold", event.DryThreshold),
+			slog.Float64("wet_threshold", event.WetThreshold),
+			slog.Float64("cooldown_remaining_seconds", event.CooldownRemaining),
+			slog.Bool("gate_open_before", event.GateOpenBefore),
+			slog.Bool("gate_open_after", event.GateOpenAfter),
+			slog.String("action", event.Action),
+			slog.String("reason", event.Reason),
+		)
+	}
+
+	if !changesState(event.Action) {
+		return
+	}
+	if client != nil {
+		if payload, err := json.Marshal(event); err == nil {
+			client.Publish(mqttConfig.topic(decisionTopic), 0, false, payload)
+		}
+	}
+	recordDecision(event)
+}
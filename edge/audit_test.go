@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// actions lists the actions of decision events
+func actions(events []DecisionEvent) []string {
+	var list []string
+	for _, event := range events {
+		list = append(list, event.Action)
+	}
+	return list
+}
+
+func TestDecisionsPublishedOnChange(t *testing.T) {
+	recorder := resetEdge(t)
+
+	// Gate 1 in cooldown: the dry zone is queued and waits for the cooldown
+	// once, however many readings
+	stateMutex.Lock()
+	gateStates[1].LastCommand = time.Now()
+	stateMutex.Unlock()
+	for i := 0; i < 3; i++ {
+		handleSoilMoisture(SensorData{SensorID: 9001, Type: "soil-moisture-sensors", Value: 30})
+	}
+	published := recorder.publishedDecisions(t)
+	if fmt.Sprint(actions(published)) != "[queue cooldown]" || published[0].GateID != 1 {
+		t.Fatalf("dry readings published %v, want [queue cooldown]", actions(published))
+	}
+
+	// Readings within the thresholds and unmapped sensors stay in the local log
+	handleSoilMoisture(SensorData{SensorID: 9020, Type: "soil-moisture-sensors", Value: 55})
+	handleSoilMoisture(SensorData{SensorID: 1, Type: "soil-moisture-sensors", Value: 55})
+	if published := recorder.publishedDecisions(t); len(published) != 2 {
+		t.Errorf("no-op readings published %v", actions(published[2:]))
+	}
+
+	// An open gate in cooldown reports the cooldown once per command
+	recorder = resetEdge(t)
+	stateMutex.Lock()
+	gateStates[2].IsOpen, gateStates[2].LastCommand = true, time.Now()
+	stateMutex.Unlock()
+	for i := 0; i < 3; i++ {
+		handleSoilMoisture(SensorData{SensorID: 9020, Type: "soil-moisture-sensors", Value: 80})
+	}
+	published = recorder.publishedDecisions(t)
+	if len(published) != 1 || published[0].Action != actionCooldown {
+		t.Errorf("wet readings in cooldown published %v, want one cooldown decision", actions(published))
+	}
+
+	stateMutex.Lock()
+	gateStates[2].LastCommand = time.Now().Add(-commandCooldown)
+	stateMutex.Unlock()
+	handleSoilMoisture(SensorData{SensorID: 9020, Type: "soil-moisture-sensors", Value: 80})
+	published = recorder.publishedDecisions(t)
+	if len(published) != 2 || published[1].Action != actionClose {
+		t.Errorf("wet reading after the cooldown published %v, want a close", actions(published))
+	}
+	if recent := len(decisions); recent != 2 {
+		t.Errorf("local API keeps %d decisions, want 2", recent)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+)
+
+// ============================================
+// BATCHED READINGS
+// ============================================
+
+// Gateways can send many readings in one JSON message:
+//
+//	farm/<farm>/sensors/<type>/batch      readings of one sensor type
+//	farm/<farm>/sensors/batch/<gateway>   everything a gateway collected
+//
+// Each reading is handled as if it had arrived on its own topic. Readings
+// of types the edge does not subscribe to are skipped.
+
+// batchSegment marks batch topics
+const batchSegment = "batch"
+
+// Sensor types the edge acts on
+var sensorTypes = []string{"soil-moisture-sensors", "water-flow-sensors", "soil-temperature-sensors"}
+
+// SensorBatch is the payload of a batch topic
+type SensorBatch struct {
+	FarmID   string       `json:"farm_id"`
+	Gateway  string       `json:"gateway,omitempty"`
+	Readings []SensorData `json:"readings"`
+}
+
+// isBatchTopic reports whether a sensor topic carries a batch
+func isBatchTopic(topic string) bool {
+	parts := strings.Split(strings.TrimPrefix(topic, mqttConfig.topic("sensors/")), "/")
+	return len(parts) == 2 && (parts[0] == batchSegment || parts[1] == batchSegment)
+}
+
+// handleBatch processes the readings of a batch message
+func handleBatch(topic string, payload []byte) {
+	var batch SensorBatch
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		log.Printf("❌ Error parsing batch on %s: %v", topic, err)
+		return
+	}
+	if batch.FarmID != "" && batch.FarmID != mqttConfig.FarmID {
+		log.Printf("❌ Batch on %s is for farm %q", topic, batch.FarmID)
+		return
+	}
+
+	// Per-type batches may leave the type out of the readings
+	topicType := strings.Split(strings.TrimPrefix(topic, mqttConfig.topic("sensors/")), "/")[0]
+	if topicType == batchSegment {
+		topicType = ""
+	}
+
+	wanted := make(map[string]bool, len(sensorTypes))
+	for _, sensorType := range sensorTypes {
+		wanted[sensorType] = true
+	}
+
+	processed := 0
+	for _, data := range batch.Readings {
+		if data.Type == "" {
+			data.Type = topicType
+		}
+		if topicType != "" && data.Type != topicType {
+			log.Printf("⚠️ Skipping sensor %d in batch on %s: type %s", data.SensorID, topic, data.Type)
+			continue
+		}
+		if !wanted[data.Type] || data.SensorID <= 0 {
+			continue
+		}
+		if data.FarmID != "" && data.FarmID != mqttConfig.FarmID {
+			log.Printf("⚠️ Skipping sensor %d in batch on %s: farm %q", data.SensorID, topic, data.FarmID)
+			continue
+		}
+		data.FarmID = mqttConfig.FarmID
+		processReading(data)
+		processed++
+	}
+	debugf("📦 Batch on %s: %d of %d readings processed\n", topic, processed, len(batch.Readings))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ============================================
+// SENSOR CALIBRATION
+// ============================================
+
+// Probes in raw mode publish "raw_value" (e.g. ADC counts) and the probe
+// "temperature" instead of a final "value". EDGE_CALIBRATION_FILE holds the
+// per-sensor curves, in the format served by the cloud at
+// /api/farms/<farm>/devices/calibrations:
+//
+//	{
+//	  "farm_id": "north",
+//	  "calibrations": {
+//	    "9001": {"method": "linear", "coefficients": [177.8, -0.0556], "temp_coefficient": -4},
+//	    "9002": {"method": "table", "table": [[1400, 100], [2300, 40], [3200, 0]]}
+//	  }
+//	}
+//
+// Raw readings of sensors without a calibration are not used for decisions.
+// The curves themselves are in calibrationcurve.go.
+
+var (
+	calibrations     = make(map[int]*Calibration)
+	uncalibratedSeen = make(map[int]bool) // Sensors already warned about
+	calibrationMutex sync.Mutex
+)
+
+// loadCalibrations reads EDGE_CALIBRATION_FILE, if set
+func loadCalibrations() error {
+	path := os.Getenv("EDGE_CALIBRATION_FILE")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var set CalibrationSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if set.FarmID != "" && set.FarmID != mqttConfig.FarmID {
+		return fmt.Errorf("%s is for farm %q, this edge runs farm %q", path, set.FarmID, mqttConfig.FarmID)
+	}
+
+	loaded := make(map[int]*Calibration, len(set.Calibrations))
+	for key, calibration := range set.Calibrations {
+		sensorID, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid sensor id %q", key)
+		}
+		if calibration == nil {
+			continue
+		}
+		if err := calibration.validate(); err != nil {
+			return fmt.Errorf("sensor %d: %w", sensorID, err)
+		}
+		loaded[sensorID] = calibration
+	}
+
+	calibrationMutex.Lock()
+	calibrations = loaded
+	calibrationMutex.Unlock()
+
+	fmt.Printf("✅ Loaded %d sensor calibrations from %s\n", len(loaded), path)
+	return nil
+}
+
+// calibrateReading turns a raw reading into an engineering value. Readings
+// without raw_value are already calibrated. It reports false when the
+// sensor has no calibration; the first such reading of a sensor is logged.
+func calibrateReading(data *SensorData) bool {
+	if data.RawValue == nil {
+		return true
+	}
+
+	calibrationMutex.Lock()
+	calibration := calibrations[data.SensorID]
+	warned := uncalibratedSeen[data.SensorID]
+	if calibration == nil {
+		uncalibratedSeen[data.SensorID] = true
+	}
+	calibrationMutex.Unlock()
+
+	if calibration == nil {
+		if !warned {
+			fmt.Printf("⚠️ Sensor %d reports raw values but has no calibration, ignoring its readings\n", data.SensorID)
+		}
+		uncalibratedReadings.Inc()
+		return false
+	}
+
+	data.Value = calibration.apply(*data.RawValue, data.Temperature)
+	return true
+}
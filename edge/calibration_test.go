@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withCalibrationFile loads calibrations for one test as farm "north"
+func withCalibrationFile(t *testing.T, path string) error {
+	t.Helper()
+	savedFarm := mqttConfig.FarmID
+	calibrationMutex.Lock()
+	saved := calibrations
+	calibrationMutex.Unlock()
+	t.Cleanup(func() {
+		mqttConfig.FarmID = savedFarm
+		calibrationMutex.Lock()
+		calibrations = saved
+		calibrationMutex.Unlock()
+	})
+	mqttConfig.FarmID = "north"
+	t.Setenv("EDGE_CALIBRATION_FILE", path)
+	return loadCalibrations()
+}
+
+// rawReading is a soil moisture reading of a probe in raw mode
+func rawReading(sensorID int, raw float64, temperature *float64) SensorData {
+	return SensorData{SensorID: sensorID, Type: "soil-moisture-sensors", RawValue: &raw, Temperature: temperature}
+}
+
+func TestLoadExportedCalibrations(t *testing.T) {
+	// Written by the cloud, see TestExportCalibrationsForEdge
+	if err := withCalibrationFile(t, "testdata/calibrations.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	reference, warm := 20.0, 30.0
+	tests := []struct {
+		name    string
+		reading SensorData
+		want    float64
+	}{
+		{"linear", rawReading(9001, 2000, nil), 177.8 - 0.0556*2000},
+		{"linear at the reference temperature", rawReading(9001, 2000, &reference), 177.8 - 0.0556*2000},
+		{"linear compensated", rawReading(9001, 2000, &warm), 177.8 - 0.0556*(2000+4*10)},
+		{"table point", rawReading(9002, 2300, nil), 40},
+		{"table between points", rawReading(9002, 2750, nil), 20},
+		{"table below", rawReading(9002, 1000, nil), 100},
+		{"table above", rawReading(9002, 4000, nil), 0},
+		{"calibrated value", SensorData{SensorID: 9003, Value: 31}, 31},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reading := test.reading
+			if !calibrateReading(&reading) {
+				t.Fatal("reading was not calibrated")
+			}
+			if math.Abs(reading.Value-test.want) > 1e-9 {
+				t.Errorf("value is %v, want %v", reading.Value, test.want)
+			}
+		})
+	}
+
+	reading := rawReading(9003, 2000, nil)
+	if calibrateReading(&reading) {
+		t.Error("raw reading of a sensor without a calibration was used")
+	}
+}
+
+func TestLoadCalibrationsRejects(t *testing.T) {
+	tests := map[string]string{
+		"other farm":        `{"farm_id": "south", "calibrations": {}}`,
+		"invalid sensor id": `{"calibrations": {"x": {"method": "linear", "coefficients": [0, 1]}}}`,
+		"invalid curve":     `{"calibrations": {"9001": {"method": "linear", "coefficients": [1]}}}`,
+		"not json":          `calibrations`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "calibrations.json")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := withCalibrationFile(t, path); err == nil {
+				t.Error("loaded")
+			}
+		})
+	}
+}
+
+func TestCalibrationValidate(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	tests := []struct {
+		name  string
+		curve Calibration
+		valid bool
+	}{
+		{"linear", Calibration{Method: calibrationLinear, Coefficients: []float64{0, 1}}, true},
+		{"polynomial by default", Calibration{Coefficients: []float64{1, 2, 3}}, true},
+		{"table by default", Calibration{Table: [][2]float64{{0, 0}, {1, 1}}}, true},
+		{"linear with one coefficient", Calibration{Method: calibrationLinear, Coefficients: []float64{1}}, false},
+		{"no coefficients", Calibration{Method: calibrationPolynomial}, false},
+		{"one table point", Calibration{Table: [][2]float64{{0, 0}}}, false},
+		{"descending table", Calibration{Table: [][2]float64{{1, 0}, {0, 1}}}, false},
+		{"unknown method", Calibration{Method: "spline", Coefficients: []float64{0, 1}}, false},
+		{"NaN coefficient", Calibration{Coefficients: []float64{0, nan}}, false},
+		{"infinite coefficient", Calibration{Coefficients: []float64{inf}}, false},
+		{"NaN temperature coefficient", Calibration{Coefficients: []float64{0, 1}, TempCoefficient: nan}, false},
+		{"NaN table raw value", Calibration{Table: [][2]float64{{0, 0}, {nan, 1}, {2, 2}}}, false},
+		{"infinite table value", Calibration{Table: [][2]float64{{0, 0}, {1, inf}}}, false},
+		{"infinite reference temperature", Calibration{Coefficients: []float64{0, 1}, ReferenceTemp: &inf}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			curve := test.curve
+			if err := curve.validate(); (err == nil) != test.valid {
+				t.Errorf("validate = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ============================================
+// COMPACT PAYLOADS (CBOR)
+// ============================================
+
+// Low-bandwidth sensors publish CBOR on farm/<farm>/sensors/<type>/<id>/cbor
+// (MQTT 3.1.1 has no content-type property, so the topic suffix tells the
+// encodings apart). The payload only carries what changes, keyed by small
+// integers; farm, type and sensor ID come from the topic (the unit stays
+// empty, the console prints it per sensor type):
+//
+//	1: value        float
+//	2: timestamp    unix seconds
+//	3: raw_value    float (raw mode)
+//	4: temperature  float (raw mode)
+//
+// Floats may come in any CBOR width (half, single or double precision) and
+// are decoded as float64.
+
+// compactSuffix is the topic suffix that marks a CBOR payload
+const compactSuffix = "cbor"
+
+// CompactReading is the CBOR payload of one reading
+type CompactReading struct {
+	Value       *float64 `cbor:"1,keyasint,omitempty"`
+	Timestamp   int64    `cbor:"2,keyasint"`
+	RawValue    *float64 `cbor:"3,keyasint,omitempty"`
+	Temperature *float64 `cbor:"4,keyasint,omitempty"`
+}
+
+// isCompactTopic reports whether a sensor topic carries a CBOR payload
+func isCompactTopic(topic string) bool {
+	return strings.HasSuffix(topic, "/"+compactSuffix)
+}
+
+// decodeCompact turns a CBOR reading from farm/<farm>/sensors/<type>/<id>/cbor
+// into the same SensorData a JSON payload gives
+func decodeCompact(topic string, payload []byte) (SensorData, error) {
+	parts := strings.Split(strings.TrimPrefix(topic, mqttConfig.topic("sensors/")), "/")
+	if len(parts) != 3 {
+		return SensorData{}, fmt.Errorf("unexpected topic %s", topic)
+	}
+	sensorID, err := strconv.Atoi(parts[1])
+	if err != nil || sensorID <= 0 {
+		return SensorData{}, fmt.Errorf("invalid sensor id in topic %s", topic)
+	}
+
+	var reading CompactReading
+	if err := cbor.Unmarshal(payload, &reading); err != nil {
+		return SensorData{}, err
+	}
+	if reading.Value == nil && reading.RawValue == nil {
+		return SensorData{}, fmt.Errorf("sensor %d sent neither value nor raw_value", sensorID)
+	}
+	// CBOR, unlike JSON, can carry NaN and infinities
+	for _, value := range []*float64{reading.Value, reading.RawValue, reading.Temperature} {
+		if value != nil && (math.IsNaN(*value) || math.IsInf(*value, 0)) {
+			return SensorData{}, fmt.Errorf("sensor %d sent a value that is not finite", sensorID)
+		}
+	}
+
+	data := SensorData{
+		FarmID:      mqttConfig.FarmID,
+		SensorID:    sensorID,
+		Type:        parts[0],
+		RawValue:    reading.RawValue,
+		Temperature: reading.Temperature,
+		Timestamp:   reading.Timestamp,
+	}
+	if reading.Value != nil {
+		data.Value = *reading.Value
+	}
+	return data, nil
+}
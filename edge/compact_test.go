@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestDecodeCompact(t *testing.T) {
+	topic := mqttConfig.topic("sensors/soil-moisture-sensors/9001/cbor")
+	now := time.Now().Unix()
+
+	payload, _ := cbor.Marshal(map[int]interface{}{1: float32(45.25), 2: now})
+	data, err := decodeCompact(topic, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.SensorID != 9001 || data.Type != "soil-moisture-sensors" || data.Value != 45.25 ||
+		data.Timestamp != now || data.FarmID != mqttConfig.FarmID {
+		t.Errorf("decoded %+v", data)
+	}
+
+	payload, _ = cbor.Marshal(map[int]interface{}{3: 2400.0, 4: 18.5, 2: now})
+	data, err = decodeCompact(topic, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.RawValue == nil || *data.RawValue != 2400 || data.Temperature == nil || *data.Temperature != 18.5 {
+		t.Errorf("raw reading decoded as %+v", data)
+	}
+
+	// A reading without a value must not pass for 0% moisture
+	payload, _ = cbor.Marshal(map[int]interface{}{2: now})
+	if data, err := decodeCompact(topic, payload); err == nil {
+		t.Errorf("reading without value or raw_value decoded as %+v", data)
+	}
+
+	// CBOR can carry values JSON cannot, they are not readings
+	for _, reading := range []map[int]interface{}{
+		{1: math.NaN(), 2: now}, {1: math.Inf(1), 2: now}, {3: math.Inf(-1), 2: now}, {3: 2400.0, 4: math.NaN(), 2: now},
+	} {
+		payload, _ := cbor.Marshal(reading)
+		if data, err := decodeCompact(topic, payload); err == nil {
+			t.Errorf("non-finite reading %v decoded as %+v", reading, data)
+		}
+	}
+
+	for _, bad := range []string{
+		mqttConfig.topic("sensors/soil-moisture-sensors/x/cbor"),
+		mqttConfig.topic("sensors/soil-moisture-sensors/cbor"),
+	} {
+		if _, err := decodeCompact(bad, payload); err == nil {
+			t.Errorf("decoded topic %s", bad)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// ============================================
+// FARM CONFIGURATION
+// ============================================
+
+// One edge processor runs per farm. FARM_ID selects the topic namespace,
+// and EDGE_FARM_CONFIG can point to a JSON file describing that farm:
+//
+//	{
+//	  "farm_id": "north",
+//	  "gate_count": 4,
+//	  "sensor_to_gate": {"101": 1, "102": 1, "201": 2},
+//	  "gate_flow_lpm": {"1": 30, "2": 20},
+//	  "gate_crop_value": {"1": 1.0, "2": 0.6}
+//	}
+//
+// Sections left out keep the built-in demo farm layout.
+type FarmConfig struct {
+	FarmID         string          `json:"farm_id"`
+	GateCount      int             `json:"gate_count"`
+	SensorToGate   map[int]int     `json:"sensor_to_gate"`
+	GateFlowRates  map[int]float64 `json:"gate_flow_lpm"`
+	GateCropValues map[int]float64 `json:"gate_crop_value"`
+}
+
+// Number of gates on this farm
+var gateCount = 22
+
+// loadFarmConfig applies EDGE_FARM_CONFIG, if set, before any state is
+// initialized
+func loadFarmConfig() error {
+	path := os.Getenv("EDGE_FARM_CONFIG")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config FarmConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if config.FarmID != "" {
+		if env := os.Getenv("FARM_ID"); env != "" && env != config.FarmID {
+			return fmt.Errorf("FARM_ID %q does not match farm_id %q in %s", env, config.FarmID, path)
+		}
+		mqttConfig.FarmID = config.FarmID
+	}
+
+	if config.GateCount < 0 {
+		return fmt.Errorf("gate_count must not be negative")
+	}
+	if config.GateCount > 0 {
+		gateCount = config.GateCount
+	}
+
+	if len(config.SensorToGate) > 0 {
+		for sensorID, gateID := range config.SensorToGate {
+			if gateID < 1 || gateID > gateCount {
+				return fmt.Errorf("sensor %d mapped to gate %d, farm has gates 1-%d", sensorID, gateID, gateCount)
+			}
+		}
+		sensorToGateMap = config.SensorToGate
+	}
+	if config.GateFlowRates != nil {
+		gateFlowRates = config.GateFlowRates
+	}
+	if config.GateCropValues != nil {
+		gateCropValues = config.GateCropValues
+	}
+
+	fmt.Printf("✅ Loaded farm configuration from %s\n", path)
+	return nil
+}
+
+// ============================================
+// FARM NAMESPACE
+// ============================================
+
+// Every topic is namespaced by farm, farm/<farm>/sensors/..., so sensor and
+// gate IDs only need to be unique within one farm
+const defaultFarm = "default"
+
+var farmIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validateFarmID checks that a farm ID is a single topic level and can not
+// be mistaken for the old un-namespaced topics (farm/sensors/...)
+func validateFarmID(farm string) error {
+	if !farmIDPattern.MatchString(farm) {
+		return fmt.Errorf("invalid farm id %q, use 1-32 characters a-z, 0-9 and -", farm)
+	}
+	switch farm {
+	case "sensors", "gates", "commands", "edge":
+		return fmt.Errorf("farm id %q is reserved", farm)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================
+// LOCAL HTTP API
+// ============================================
+
+// Local status and control API for on-site technicians. It keeps working
+// when the cloud is unreachable, as long as the edge is on the LAN.
+//
+//	EDGE_HTTP_ADDR   Listen address (default 127.0.0.1:8081, set :8081 for the LAN)
+//	EDGE_API_TOKEN   Token for the POST routes, sent as "Authorization: Bearer
+//	                 <token>" or "X-API-Key: <token>". Without it gate
+//	                 overrides are disabled; the GET routes need no token.
+const (
+	defaultHTTPAddr   = "127.0.0.1:8081"
+	minAPITokenLength = 16
+	recentDecisions   = 100 // Decisions kept in memory for /api/decisions
+)
+
+var (
+	httpAddr       = defaultHTTPAddr
+	apiToken       string
+	decisions      []DecisionEvent
+	decisionsMutex sync.Mutex
+	startTime      = time.Now()
+	lastReading    time.Time
+)
+
+// recordDecision appends a decision to the in-memory ring buffer
+func recordDecision(d DecisionEvent) {
+	decisionsMutex.Lock()
+	defer decisionsMutex.Unlock()
+
+	decisions = append(decisions, d)
+	if len(decisions) > recentDecisions {
+		decisions = decisions[len(decisions)-recentDecisions:]
+	}
+}
+
+// loadHTTPConfig reads the listen addresses and API token
+func loadHTTPConfig() error {
+	if addr := os.Getenv("EDGE_HTTP_ADDR"); addr != "" {
+		httpAddr = addr
+	}
+	if addr := os.Getenv("EDGE_METRICS_ADDR"); addr != "" {
+		metricsAddr = addr
+	}
+	apiToken = os.Getenv("EDGE_API_TOKEN")
+	if apiToken != "" && len(apiToken) < minAPITokenLength {
+		return fmt.Errorf("EDGE_API_TOKEN must be at least %d characters", minAPITokenLength)
+	}
+	return nil
+}
+
+// startHTTPServer serves the local API in the background
+func startHTTPServer() {
+	handler := newHTTPHandler()
+	go func() {
+		log.Printf("🌐 Local API listening on http://%s", httpAddr)
+		if err := http.ListenAndServe(httpAddr, handler); err != nil {
+			log.Printf("❌ Local API stopped: %v", err)
+		}
+	}()
+}
+
+// newHTTPHandler routes the local API
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health", handleHealth)
+	mux.HandleFunc("GET /api/gates", handleGates)
+	mux.HandleFunc("GET /api/moisture", handleMoisture)
+	mux.HandleFunc("GET /api/policy", handlePolicy)
+	mux.HandleFunc("GET /api/queue", handleQueue)
+	mux.HandleFunc("GET /api/decisions", handleDecisions)
+	mux.HandleFunc("POST /api/gates/{id}/{action}", requireToken(handleGateOverride))
+	return mux
+}
+
+// requireToken only lets requests with the API token through
+func requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiToken == "" {
+			writeError(w, http.StatusForbidden, "Gate overrides are disabled, set EDGE_API_TOKEN")
+			return
+		}
+		token := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = bearer
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "Missing or invalid API token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// GET /api/health
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	stateMutex.RLock()
+	last := lastReading
+	stateMutex.RUnlock()
+
+	connected := client != nil && client.IsConnectionOpen()
+	status := "ok"
+	if !connected {
+		status = "degraded"
+	}
+
+	lastReadingUnix := int64(0)
+	if !last.IsZero() {
+		lastReadingUnix = last.Unix()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         status,
+		"farm_id":        mqttConfig.FarmID,
+		"mqtt_connected": connected,
+		"mqtt_broker":    mqttConfig.BrokerURL,
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"last_reading":   lastReadingUnix,
+		"timestamp":      time.Now().Unix(),
+	})
+}
+
+// GET /api/gates
+func handleGates(w http.ResponseWriter, r *http.Request) {
+	stateMutex.RLock()
+	gates := make([]GateState, 0, len(gateStates))
+	for _, gate := range gateStates {
+		gates = append(gates, *gate)
+	}
+	stateMutex.RUnlock()
+
+	sort.Slice(gates, func(i, j int) bool { return gates[i].GateID < gates[j].GateID })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"gates": gates, "count": len(gates)})
+}
+
+// GET /api/moisture
+func handleMoisture(w http.ResponseWriter, r *http.Request) {
+	stateMutex.RLock()
+	readings := make(map[string]float64, len(soilMoistureStates))
+	for sensorID, value := range soilMoistureStates {
+		readings[strconv.Itoa(sensorID)] = value
+	}
+	stateMutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sensors": readings, "count": len(readings)})
+}
+
+// GET /api/policy
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"dry_threshold":       dryThreshold,
+		"wet_threshold":       wetThreshold,
+		"command_cooldown":    commandCooldown.String(),
+		"max_open_gates":      maxOpenGates,
+		"supply_capacity_lpm": supplyCapacityLPM,
+		"irrigation_slot":     irrigationSlot.String(),
+		"sensor_to_gate":      len(sensorToGateMap),
+	})
+}
+
+// GET /api/queue
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	stateMutex.RLock()
+	snapshot := queueSnapshot()
+	stateMutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// GET /api/decisions?limit=20
+func handleDecisions(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+
+	decisionsMutex.Lock()
+	start := len(decisions) - limit
+	if start < 0 {
+		start = 0
+	}
+	recent := make([]DecisionEvent, 0, len(decisions)-start)
+	for i := len(decisions) - 1; i >= start; i-- {
+		recent = append(recent, decisions[i])
+	}
+	decisionsMutex.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"decisions": recent, "count": len(recent)})
+}
+
+// POST /api/gates/:id/open|close|auto
+//
+// open and close put the gate under manual override, the automatic
+// scheduler leaves it alone until it is released with auto. An open that
+// would exceed the water supply limits is refused with 409.
+func handleGateOverride(w http.ResponseWriter, r *http.Request) {
+	gateID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid gate id")
+		return
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	gate, exists := gateStates[gateID]
+	if !exists {
+		writeError(w, http.StatusNotFound, "Gate not found")
+		return
+	}
+
+	event := newGateEvent(gate, "manual")
+	event.Reason = "Manual override from local API"
+
+	switch r.PathValue("action") {
+	case "open":
+		if !gate.IsOpen && !hasCapacityFor(gateID) {
+			open, flow := supplyInUse()
+			writeError(w, http.StatusConflict, fmt.Sprintf(
+				"No supply for gate %d: %d gate(s) open using %.0f of %.0f L/min, close one first",
+				gateID, open, flow, supplyCapacityLPM))
+			return
+		}
+		gate.ManualOverride = true
+		dequeueIrrigation(gateID)
+		event.Action = actionOverride
+		if !gate.IsOpen {
+			event.Action = actionOpen
+			openGate(gate, event.Reason, "manual")
+		}
+	case "close":
+		gate.ManualOverride = true
+		dequeueIrrigation(gateID)
+		event.Action = actionOverride
+		if gate.IsOpen {
+			event.Action = actionClose
+			closeGate(gate, event.Reason, "manual")
+		}
+	case "auto":
+		gate.ManualOverride = false
+		queueChanged = true
+		event.Action = actionRelease
+		event.Reason = "Manual override released from local API"
+		fmt.Printf("🔓 Gate %d returned to automatic control\n", gateID)
+	default:
+		writeError(w, http.StatusBadRequest, "Action must be open, close or auto")
+		return
+	}
+
+	event.GateOpenAfter = gate.IsOpen
+	emitDecision(event)
+
+	dispatchIrrigationQueue()
+	writeJSON(w, http.StatusOK, *gate)
+}
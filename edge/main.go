@@ -15,20 +15,28 @@ import (
 
 // SensorData represents incoming sensor data
 type SensorData struct {
-	SensorID  int     `json:"sensor_id"`
-	Type      string  `json:"type"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Value     float64 `json:"value"`
-	Unit      string  `json:"unit"`
-	Timestamp int64   `json:"timestamp"`
+	FarmID      string   `json:"farm_id"`
+	SensorID    int      `json:"sensor_id"`
+	Type        string   `json:"type"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	Value       float64  `json:"value"`
+	RawValue    *float64 `json:"raw_value,omitempty"`   // Uncalibrated reading (raw mode)
+	Temperature *float64 `json:"temperature,omitempty"` // Probe temperature in °C (raw mode)
+	Unit        string   `json:"unit"`
+	Timestamp   int64    `json:"timestamp"`
 }
 
 // GateState tracks the current state of each water gate
 type GateState struct {
-	GateID      int
-	IsOpen      bool
-	LastCommand time.Time
+	GateID         int       `json:"gate_id"`
+	IsOpen         bool      `json:"is_open"`
+	LastCommand    time.Time `json:"last_command"`
+	OpenedAt       time.Time `json:"opened_at"`       // When the current irrigation started
+	LastIrrigated  time.Time `json:"last_irrigated"`  // When the gate last closed after irrigating
+	ManualOverride bool      `json:"manual_override"` // Set from the local API, disables automation
+
+	cooldownReported time.Time // LastCommand of the cooldown already reported
 }
 
 // Global state
@@ -40,13 +48,13 @@ var (
 
 // Configuration
 const (
-	mqttBroker      = "tcp://localhost:1883"
 	dryThreshold    = 40.0 // Below this → open gate
 	wetThreshold    = 70.0 // Above this → close gate
 	commandCooldown = 30 * time.Second
 )
 
-// Sensor ID to Gate ID mapping
+// Sensor ID to Gate ID mapping of the demo farm, replaced by the
+// sensor_to_gate section of EDGE_FARM_CONFIG
 var sensorToGateMap = map[int]int{
 	// Gate 1 controls sensors 9001-9019
 	9001: 1, 9002: 1, 9003: 1, 9004: 1, 9005: 1,
@@ -61,22 +69,25 @@ var sensorToGateMap = map[int]int{
 	9035: 2, 9036: 2, 9037: 2, 9038: 2,
 }
 
-// MQTT client
-var client mqtt.Client
+// MQTT client and connection settings
+var (
+	client     mqtt.Client
+	mqttConfig = loadMQTTConfig("edge-processor")
+)
 
 // ============================================
 // INITIALIZATION
 // ============================================
 
 func initializeGateStates() {
-	for gateID := 1; gateID <= 22; gateID++ {
+	for gateID := 1; gateID <= gateCount; gateID++ {
 		gateStates[gateID] = &GateState{
 			GateID:      gateID,
 			IsOpen:      false,
 			LastCommand: time.Time{}, // Zero time (very old)
 		}
 	}
-	fmt.Println("✅ Initialized 22 gates (all CLOSED)")
+	fmt.Printf("✅ Initialized %d gates (all CLOSED)\n", gateCount)
 }
 
 // ============================================
@@ -84,23 +95,57 @@ func initializeGateStates() {
 // ============================================
 
 var messageHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	// Log received message
+	if isCompactTopic(msg.Topic()) {
+		debugf("📥 Received: Topic=%s | Payload=%x (%d bytes CBOR)\n", msg.Topic(), msg.Payload(), len(msg.Payload()))
+	} else {
+		debugf("📥 Received: Topic=%s | Payload=%s\n", msg.Topic(), string(msg.Payload()))
+	}
+
+	// Many readings in one message
+	if isBatchTopic(msg.Topic()) {
+		handleBatch(msg.Topic(), msg.Payload())
+		return
+	}
+
 	var data SensorData
-	if err := json.Unmarshal(msg.Payload(), &data); err != nil {
+	var err error
+	if isCompactTopic(msg.Topic()) {
+		data, err = decodeCompact(msg.Topic(), msg.Payload())
+	} else {
+		err = json.Unmarshal(msg.Payload(), &data)
+	}
+	if err != nil {
 		log.Printf("❌ Error parsing message: %v", err)
 		return
 	}
+	processReading(data)
+}
 
+// processReading calibrates, records and acts on one reading
+func processReading(data SensorData) {
 	// Format timestamp
 	timestamp := time.Unix(data.Timestamp, 0).Format("15:04:05")
 
-	// Log received message
-	fmt.Printf("📥 Received: Topic=%s | Payload=%s\n", msg.Topic(), string(msg.Payload()))
+	stateMutex.Lock()
+	lastReading = time.Now()
+	stateMutex.Unlock()
+
+	readingsProcessed.WithLabelValues(data.Type).Inc()
+	if !calibrateReading(&data) {
+		return
+	}
+	sensorMetrics.observe(mqttConfig.FarmID, data.SensorID, data.Type, data.Value)
 
 	// Handle different sensor types
 	switch data.Type {
 	case "soil-moisture-sensors":
-		fmt.Printf("%s 📊 Soil Moisture [%d]: %.2f%% at %s\n",
-			timestamp, data.SensorID, data.Value, timestamp)
+		raw := ""
+		if data.RawValue != nil {
+			raw = fmt.Sprintf(" (raw %.0f)", *data.RawValue)
+		}
+		fmt.Printf("%s 📊 Soil Moisture [%d]: %.2f%%%s at %s\n",
+			timestamp, data.SensorID, data.Value, raw, timestamp)
 		handleSoilMoisture(data)
 
 	case "water-flow-sensors":
@@ -108,12 +153,12 @@ var messageHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Messa
 		if data.Value > 10.0 {
 			icon = "🚰"
 		}
-		fmt.Printf("%s 💧 Water Flow [%d]: %.2f %s %s\n",
-			timestamp, data.SensorID, data.Value, data.Unit, icon)
+		fmt.Printf("%s 💧 Water Flow [%d]: %.2f L/min %s\n",
+			timestamp, data.SensorID, data.Value, icon)
 
 	case "soil-temperature-sensors":
-		fmt.Printf("%s 🌡️ Soil Temp [%d]: %.2f%s\n",
-			timestamp, data.SensorID, data.Value, data.Unit)
+		fmt.Printf("%s 🌡️ Soil Temp [%d]: %.2f°C\n",
+			timestamp, data.SensorID, data.Value)
 	}
 }
 
@@ -131,95 +176,162 @@ func handleSoilMoisture(data SensorData) {
 // ============================================
 
 func evaluateIrrigationNeeds(sensorID int, moistureLevel float64) {
-	fmt.Printf("🔍 DEBUG: Evaluating sensor %d with moisture %.2f%%\n", sensorID, moistureLevel)
+	debugf("🔍 DEBUG: Evaluating sensor %d with moisture %.2f%%\n", sensorID, moistureLevel)
 
 	// Find which gate controls this sensor
 	gateID, exists := sensorToGateMap[sensorID]
 	if !exists {
-		fmt.Printf("⚠️ DEBUG: Sensor %d not mapped to any gate\n", sensorID)
+		debugf("⚠️ DEBUG: Sensor %d not mapped to any gate\n", sensorID)
+		emitDecision(DecisionEvent{
+			Source:       "auto",
+			SensorID:     sensorID,
+			Moisture:     &moistureLevel,
+			DryThreshold: dryThreshold,
+			WetThreshold: wetThreshold,
+			Action:       actionUnmapped,
+			Reason:       fmt.Sprintf("Sensor %d not mapped to any gate", sensorID),
+		})
 		return // Unknown sensor
 	}
-	fmt.Printf("✅ DEBUG: Sensor %d mapped to Gate %d\n", sensorID, gateID)
+	debugf("✅ DEBUG: Sensor %d mapped to Gate %d\n", sensorID, gateID)
 
 	stateMutex.Lock()
 	defer stateMutex.Unlock()
 
 	gate := gateStates[gateID]
-	fmt.Printf("🚪 DEBUG: Gate %d current state: IsOpen=%v, LastCommand=%v\n",
+	debugf("🚪 DEBUG: Gate %d current state: IsOpen=%v, LastCommand=%v\n",
 		gateID, gate.IsOpen, gate.LastCommand)
 
+	event := newGateEvent(gate, "auto")
+	event.SensorID = sensorID
+	event.Moisture = &moistureLevel
+
 	// Check cooldown
 	timeSinceLastCommand := time.Since(gate.LastCommand)
-	fmt.Printf("⏱️ DEBUG: Time since last command: %v (cooldown: %v)\n",
+	debugf("⏱️ DEBUG: Time since last command: %v (cooldown: %v)\n",
 		timeSinceLastCommand, commandCooldown)
 
-	if timeSinceLastCommand < commandCooldown {
-		fmt.Printf("❌ DEBUG: Still in cooldown period, skipping\n")
-		return
-	}
+	inCooldown := timeSinceLastCommand < commandCooldown
 
 	// Decision logic
-	fmt.Printf("📊 DEBUG: Checking thresholds - Moisture: %.2f%% | Dry: %.2f%% | Wet: %.2f%%\n",
+	debugf("📊 DEBUG: Checking thresholds - Moisture: %.2f%% | Dry: %.2f%% | Wet: %.2f%%\n",
 		moistureLevel, dryThreshold, wetThreshold)
 
-	if moistureLevel < dryThreshold && !gate.IsOpen {
-		// Too dry - open gate
-		fmt.Printf("✅ DEBUG: Condition met! Moisture %.2f%% < %.2f%% AND gate is closed\n",
+	if gate.ManualOverride {
+		debugf("🔒 DEBUG: Gate %d is under manual override, skipping\n", gateID)
+		event.Reason = "Gate under manual override, automation skipped"
+	} else if moistureLevel < dryThreshold && !gate.IsOpen {
+		// Too dry - queue the zone, the scheduler opens it when supply allows
+		debugf("✅ DEBUG: Condition met! Moisture %.2f%% < %.2f%% AND gate is closed\n",
 			moistureLevel, dryThreshold)
-		sendGateCommand(gateID, "OPEN", fmt.Sprintf("Soil moisture %.2f%% below threshold %.2f%%", moistureLevel, dryThreshold))
-		gate.IsOpen = true
-		gate.LastCommand = time.Now()
+		if enqueueIrrigation(gate) {
+			event.Action = actionQueue
+			event.Reason = fmt.Sprintf("Soil moisture %.2f%% below threshold %.2f%%", moistureLevel, dryThreshold)
+		} else {
+			event.Reason = "Zone already queued for irrigation"
+		}
 	} else if moistureLevel > wetThreshold && gate.IsOpen {
-		// Too wet - close gate
-		fmt.Printf("✅ DEBUG: Condition met! Moisture %.2f%% > %.2f%% AND gate is open\n",
-			moistureLevel, wetThreshold)
-		sendGateCommand(gateID, "CLOSE", fmt.Sprintf("Soil moisture %.2f%% above threshold %.2f%%", moistureLevel, wetThreshold))
-		gate.IsOpen = false
-		gate.LastCommand = time.Now()
+		dequeueIrrigation(gateID)
+		if inCooldown {
+			debugf("❌ DEBUG: Still in cooldown period, skipping\n")
+			event.Reason = fmt.Sprintf("Soil moisture %.2f%% above threshold %.2f%%, gate in cooldown", moistureLevel, wetThreshold)
+			if gate.cooldownReported != gate.LastCommand {
+				// Reported once per command, later readings wait quietly
+				gate.cooldownReported = gate.LastCommand
+				cooldownSkips.Inc()
+				event.Action = actionCooldown
+			}
+		} else {
+			// Too wet - close gate
+			debugf("✅ DEBUG: Condition met! Moisture %.2f%% > %.2f%% AND gate is open\n",
+				moistureLevel, wetThreshold)
+			event.Action = actionClose
+			event.Reason = fmt.Sprintf("Soil moisture %.2f%% above threshold %.2f%%", moistureLevel, wetThreshold)
+			closeGate(gate, event.Reason, "auto")
+		}
+	} else if moistureLevel > wetThreshold && dequeueIrrigation(gateID) {
+		event.Action = actionDequeue
+		event.Reason = fmt.Sprintf("Soil moisture %.2f%% above threshold %.2f%%", moistureLevel, wetThreshold)
 	} else {
-		fmt.Printf("❌ DEBUG: No action needed - Moisture: %.2f%%, Gate Open: %v\n",
+		debugf("❌ DEBUG: No action needed - Moisture: %.2f%%, Gate Open: %v\n",
 			moistureLevel, gate.IsOpen)
+		event.Reason = "Moisture within thresholds or gate already in desired state"
 	}
-	fmt.Println()
+
+	event.GateOpenAfter = gate.IsOpen
+	emitDecision(event)
+
+	dispatchIrrigationQueue()
+	debugf("\n")
 }
 
 // ============================================
 // COMMAND EXECUTION
 // ============================================
 
-func sendGateCommand(gateID int, command string, reason string) {
-	topic := fmt.Sprintf("farm/commands/water-gate-sensors/%d", gateID)
-	payload := map[string]interface{}{
-		"gate_id":   gateID,
-		"command":   command,
-		"reason":    reason,
-		"timestamp": time.Now().Unix(),
+func sendGateCommand(gateID int, command string, reason string, source string) {
+	topic := mqttConfig.topic("commands/water-gate-sensors/%d", gateID)
+	payload := GateCommand{
+		FarmID:    mqttConfig.FarmID,
+		GateID:    gateID,
+		Command:   command,
+		Reason:    reason,
+		Source:    source,
+		Timestamp: time.Now().Unix(),
 	}
+	signCommand(&payload)
 
 	payloadBytes, _ := json.Marshal(payload)
 	token := client.Publish(topic, 0, false, payloadBytes)
 	token.Wait()
+	commandsSent.WithLabelValues(command, source).Inc()
 
 	timestamp := time.Now().Format("15:04:05")
 	fmt.Printf("%s 🚰 COMMAND: Gate #%d → %s | Reason: %s\n",
 		timestamp, gateID, command, reason)
 }
 
+// publishGateStatus reports the gate state the edge believes in, so the cloud
+// can track state changes (retained, one topic per gate)
+func publishGateStatus(gate *GateState) {
+	topic := mqttConfig.topic("gates/%d/status", gate.GateID)
+	status := "closed"
+	if gate.IsOpen {
+		status = "open"
+	}
+	payload := map[string]interface{}{
+		"farm_id":   mqttConfig.FarmID,
+		"gate_id":   gate.GateID,
+		"status":    status,
+		"is_open":   gate.IsOpen,
+		"timestamp": time.Now().Unix(),
+	}
+
+	payloadBytes, _ := json.Marshal(payload)
+	client.Publish(topic, 1, true, payloadBytes)
+}
+
 // ============================================
 // MQTT CONNECTION
 // ============================================
 
 func connectMQTT() mqtt.Client {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(mqttBroker)
-	opts.SetClientID("edge-processor")
+	if err := mqttConfig.apply(opts); err != nil {
+		log.Fatalf("❌ Invalid MQTT configuration: %v", err)
+	}
 	opts.SetDefaultPublishHandler(messageHandler)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		log.Printf("⚠️ Connection lost: %v", err)
 	})
+	connected := false
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Println("✅ Connected to MQTT broker")
+		if connected {
+			mqttReconnects.Inc()
+		}
+		connected = true
 	})
 
 	client := mqtt.NewClient(opts)
@@ -237,10 +349,22 @@ func connectMQTT() mqtt.Client {
 func main() {
 	fmt.Println("🌾 EDGE PROCESSOR - Smart Farm 🌾")
 	fmt.Println("Automated Irrigation Controller")
-	fmt.Println("======================================\n")
+	fmt.Println("======================================")
+	fmt.Println()
 
 	// Initialize state
+	if err := loadFarmConfig(); err != nil {
+		log.Fatalf("❌ Invalid farm configuration: %v", err)
+	}
+	if err := loadCalibrations(); err != nil {
+		log.Fatalf("❌ Invalid calibration file: %v", err)
+	}
 	initializeGateStates()
+	initDecisionLog()
+	initCommandSigning()
+	if err := loadHTTPConfig(); err != nil {
+		log.Fatalf("❌ Invalid local API configuration: %v", err)
+	}
 
 	// Connect to MQTT
 	client = connectMQTT()
@@ -248,17 +372,32 @@ func main() {
 
 	// Display configuration
 	fmt.Printf("🔧 Configuration:\n")
+	fmt.Printf("   • Farm: %s\n", mqttConfig.FarmID)
+	fmt.Printf("   • MQTT broker: %s (client %s)\n", mqttConfig.BrokerURL, mqttConfig.ClientID)
+	fmt.Printf("   • Command signing keys: %d\n", len(commandKeys))
 	fmt.Printf("   • Dry threshold: %.2f%%\n", dryThreshold)
 	fmt.Printf("   • Wet threshold: %.2f%%\n", wetThreshold)
 	fmt.Printf("   • Min command interval: %v\n", commandCooldown)
-	fmt.Printf("   • Sensor-to-Gate mapping: %d sensors configured\n\n", len(sensorToGateMap))
-
-	// Subscribe to sensor topics
-	topics := []string{
-		"farm/sensors/soil-moisture-sensors/+",
-		"farm/sensors/water-flow-sensors/+",
-		"farm/sensors/soil-temperature-sensors/+",
+	fmt.Printf("   • Sensor-to-Gate mapping: %d sensors configured\n", len(sensorToGateMap))
+	fmt.Printf("   • Supply capacity: %d gates / %.1f L/min\n", maxOpenGates, supplyCapacityLPM)
+	fmt.Printf("   • Irrigation slot: %v\n", irrigationSlot)
+	overrides := "gate overrides disabled, no EDGE_API_TOKEN"
+	if apiToken != "" {
+		overrides = "gate overrides need the API token"
+	}
+	fmt.Printf("   • Local API: http://%s/api (%s)\n", httpAddr, overrides)
+	fmt.Printf("   • Metrics: %s\n", metricsAddr)
+	fmt.Printf("   • Decision log: %s (topic %s)\n\n", decisionLogFile, mqttConfig.topic(decisionTopic))
+
+	// Subscribe to sensor topics: JSON (and per-type batches), compact (CBOR)
+	// and gateway batches
+	var topics []string
+	for _, sensorType := range sensorTypes {
+		topics = append(topics,
+			mqttConfig.topic("sensors/%s/+", sensorType),
+			mqttConfig.topic("sensors/%s/+/%s", sensorType, compactSuffix))
 	}
+	topics = append(topics, mqttConfig.topic("sensors/%s/+", batchSegment))
 
 	for _, topic := range topics {
 		if token := client.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
@@ -267,8 +406,14 @@ func main() {
 		fmt.Printf("✅ Subscribed to: %s\n", topic)
 	}
 
+	// Start the irrigation scheduler, local API and metrics
+	go runScheduler()
+	startHTTPServer()
+	startMetricsServer()
+
 	fmt.Println("\n🚀 Edge Processor is running... (Press Ctrl+C to stop)")
-	fmt.Println("\n⏳ Waiting for sensor data...\n")
+	fmt.Println("\n⏳ Waiting for sensor data...")
+	fmt.Println()
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// recordingClient stands in for the broker connection and keeps what the
+// edge publishes
+type recordingClient struct {
+	mqtt.Client
+	mu       sync.Mutex
+	messages []publishedMessage
+}
+
+type publishedMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, publishedMessage{Topic: topic, Payload: payload.([]byte)})
+	return &mqtt.DummyToken{}
+}
+
+func (c *recordingClient) IsConnectionOpen() bool { return true }
+
+// published returns the payloads sent to a topic below the farm
+func (c *recordingClient) published(topic string) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var payloads [][]byte
+	for _, msg := range c.messages {
+		if msg.Topic == mqttConfig.topic("%s", topic) {
+			payloads = append(payloads, msg.Payload)
+		}
+	}
+	return payloads
+}
+
+// publishedDecisions decodes the decisions sent to the cloud
+func (c *recordingClient) publishedDecisions(t *testing.T) []DecisionEvent {
+	t.Helper()
+	var events []DecisionEvent
+	for _, payload := range c.published(decisionTopic) {
+		var event DecisionEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// resetEdge starts a test from closed gates, no readings and an empty queue
+func resetEdge(t *testing.T) *recordingClient {
+	t.Helper()
+	recorder := &recordingClient{}
+	client = recorder
+	stateMutex.Lock()
+	gateStates = make(map[int]*GateState)
+	initializeGateStates()
+	soilMoistureStates = make(map[int]float64)
+	irrigationQueue = make(map[int]*QueueEntry)
+	queueChanged = false
+	stateMutex.Unlock()
+	decisionsMutex.Lock()
+	decisions = nil
+	decisionsMutex.Unlock()
+	return recorder
+}
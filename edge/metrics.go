@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ============================================
+// PROMETHEUS METRICS
+// ============================================
+
+// Served at /metrics on their own listener, so Prometheus can scrape them
+// while the local API stays on localhost. Set with EDGE_METRICS_ADDR
+// (default :9101, "off" disables it).
+const defaultMetricsAddr = ":9101"
+
+var metricsAddr = defaultMetricsAddr
+
+var (
+	readingsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edge_readings_processed_total",
+		Help: "Sensor readings processed, by sensor type.",
+	}, []string{"type"})
+
+	uncalibratedReadings = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "edge_uncalibrated_readings_total",
+		Help: "Raw sensor readings ignored because the sensor has no calibration.",
+	})
+
+	commandsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edge_gate_commands_sent_total",
+		Help: "Gate commands sent, by command and source.",
+	}, []string{"command", "source"})
+
+	cooldownSkips = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "edge_cooldown_skips_total",
+		Help: "Gate actions postponed by the cooldown, once per queued gate or command.",
+	})
+
+	mqttReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "edge_mqtt_reconnects_total",
+		Help: "Successful MQTT reconnections after a lost connection.",
+	})
+
+	openGatesGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "edge_open_gates",
+		Help: "Gates currently open.",
+	}, func() float64 {
+		stateMutex.RLock()
+		defer stateMutex.RUnlock()
+		open, _ := supplyInUse()
+		return float64(open)
+	})
+
+	queueLengthGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "edge_irrigation_queue_length",
+		Help: "Dry zones waiting for supply capacity.",
+	}, func() float64 {
+		stateMutex.RLock()
+		defer stateMutex.RUnlock()
+		return float64(len(irrigationQueue))
+	})
+
+	mqttConnectedGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "edge_mqtt_connected",
+		Help: "1 if the MQTT client is connected.",
+	}, func() float64 {
+		if client != nil && client.IsConnectionOpen() {
+			return 1
+		}
+		return 0
+	})
+
+	sensorMetrics = newSensorCollector("edge")
+)
+
+func init() {
+	prometheus.MustRegister(
+		readingsProcessed,
+		uncalibratedReadings,
+		commandsSent,
+		cooldownSkips,
+		mqttReconnects,
+		openGatesGauge,
+		queueLengthGauge,
+		mqttConnectedGauge,
+		sensorMetrics,
+	)
+}
+
+// startMetricsServer serves /metrics on metricsAddr
+func startMetricsServer() {
+	if metricsAddr == "off" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	go func() {
+		log.Printf("📈 Metrics listening on http://%s/metrics", metricsAddr)
+		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+			log.Printf("❌ Metrics listener stopped: %v", err)
+		}
+	}()
+}
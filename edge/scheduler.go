@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// ============================================
+// SUPPLY CAPACITY & SCHEDULING
+// ============================================
+
+// Supply capacity model. A zero value disables the corresponding limit.
+const (
+	maxOpenGates      = 2                // Max gates open at the same time
+	supplyCapacityLPM = 60.0             // Total water supply available (L/min)
+	defaultGateFlow   = 25.0             // Flow drawn by a gate without an explicit rate (L/min)
+	irrigationSlot    = 10 * time.Minute // Max continuous open time while other zones wait
+	schedulerInterval = 5 * time.Second
+	queueTopic        = "edge/irrigation-queue" // Under farm/<farm>/
+)
+
+// Priority score weights (dryness + crop value + time since last irrigation)
+const (
+	dryWeight  = 0.5
+	cropWeight = 0.2
+	waitWeight = 0.3
+	maxWaitAge = 24 * time.Hour // Wait bonus saturates after this long
+)
+
+// Flow drawn by each gate when open (L/min)
+var gateFlowRates = map[int]float64{
+	1: 25.0,
+	2: 25.0,
+}
+
+// Relative crop value per gate zone (0.0 - 1.0)
+var gateCropValues = map[int]float64{
+	1: 1.0,
+	2: 1.0,
+}
+
+// QueueEntry is a dry zone waiting for its gate to open
+type QueueEntry struct {
+	GateID     int       `json:"gate_id"`
+	Moisture   float64   `json:"moisture"`
+	Priority   float64   `json:"priority"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+
+	cooldownReported bool // The wait for the cooldown was counted and logged
+}
+
+// QueueSnapshot is the scheduler state published over MQTT
+type QueueSnapshot struct {
+	FarmID         string       `json:"farm_id"`
+	Timestamp      int64        `json:"timestamp"`
+	MaxOpenGates   int          `json:"max_open_gates"`
+	SupplyCapacity float64      `json:"supply_capacity_lpm"`
+	SupplyUsed     float64      `json:"supply_used_lpm"`
+	OpenGates      []int        `json:"open_gates"`
+	Queue          []QueueEntry `json:"queue"`
+}
+
+var (
+	irrigationQueue = make(map[int]*QueueEntry)
+	queueChanged    bool
+)
+
+func gateFlow(gateID int) float64 {
+	if flow, ok := gateFlowRates[gateID]; ok {
+		return flow
+	}
+	return defaultGateFlow
+}
+
+func gateCropValue(gateID int) float64 {
+	if value, ok := gateCropValues[gateID]; ok {
+		return value
+	}
+	return 1.0
+}
+
+// priorityScore ranks a dry zone. Drier zones, more valuable crops and zones
+// that have waited longer since their last irrigation come first.
+func priorityScore(gate *GateState, moisture float64, now time.Time) float64 {
+	dryness := (dryThreshold - moisture) / dryThreshold
+	dryness = clamp(dryness, 0, 1)
+
+	wait := 1.0 // Never irrigated → maximum wait bonus
+	if !gate.LastIrrigated.IsZero() {
+		wait = clamp(float64(now.Sub(gate.LastIrrigated))/float64(maxWaitAge), 0, 1)
+	}
+
+	return dryWeight*dryness + cropWeight*gateCropValue(gate.GateID) + waitWeight*wait
+}
+
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// enqueueIrrigation adds (or refreshes) a dry zone in the queue and reports
+// whether it was newly queued. The priority follows the zone's mean
+// moisture, not the one reading that triggered it. Caller must hold
+// stateMutex.
+func enqueueIrrigation(gate *GateState) bool {
+	now := time.Now()
+	moisture, _ := zoneAggregate(gate.GateID)
+	entry, exists := irrigationQueue[gate.GateID]
+	if !exists {
+		entry = &QueueEntry{GateID: gate.GateID, EnqueuedAt: now}
+		irrigationQueue[gate.GateID] = entry
+		fmt.Printf("📋 Gate %d queued for irrigation (zone moisture %.2f%%)\n", gate.GateID, moisture)
+		queueChanged = true
+	}
+	entry.Moisture = moisture
+	entry.Priority = priorityScore(gate, moisture, now)
+	return !exists
+}
+
+// dequeueIrrigation removes a zone from the queue and reports whether it
+// was queued. Caller must hold stateMutex.
+func dequeueIrrigation(gateID int) bool {
+	if _, exists := irrigationQueue[gateID]; !exists {
+		return false
+	}
+	delete(irrigationQueue, gateID)
+	fmt.Printf("📋 Gate %d removed from irrigation queue\n", gateID)
+	queueChanged = true
+	return true
+}
+
+// sortedQueue returns queue entries ordered by priority (highest first),
+// falling back to arrival order. Caller must hold stateMutex.
+func sortedQueue() []QueueEntry {
+	entries := make([]QueueEntry, 0, len(irrigationQueue))
+	for _, entry := range irrigationQueue {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].EnqueuedAt.Before(entries[j].EnqueuedAt)
+	})
+	return entries
+}
+
+// supplyInUse returns the number of open gates and their total flow.
+// Caller must hold stateMutex.
+func supplyInUse() (int, float64) {
+	open := 0
+	flow := 0.0
+	for _, gate := range gateStates {
+		if gate.IsOpen {
+			open++
+			flow += gateFlow(gate.GateID)
+		}
+	}
+	return open, flow
+}
+
+// hasCapacityFor reports whether opening gateID stays within the supply limits.
+// Caller must hold stateMutex.
+func hasCapacityFor(gateID int) bool {
+	open, flow := supplyInUse()
+	if maxOpenGates > 0 && open >= maxOpenGates {
+		return false
+	}
+	if supplyCapacityLPM > 0 && flow+gateFlow(gateID) > supplyCapacityLPM {
+		return false
+	}
+	return true
+}
+
+// openGate and closeGate update local state and send the command.
+// source is "auto" for scheduler decisions and "manual" for overrides.
+// Caller must hold stateMutex.
+func openGate(gate *GateState, reason string, source string) {
+	sendGateCommand(gate.GateID, "OPEN", reason, source)
+	now := time.Now()
+	gate.IsOpen = true
+	gate.LastCommand = now
+	gate.OpenedAt = now
+	queueChanged = true
+	publishGateStatus(gate)
+}
+
+func closeGate(gate *GateState, reason string, source string) {
+	sendGateCommand(gate.GateID, "CLOSE", reason, source)
+	now := time.Now()
+	gate.IsOpen = false
+	gate.LastCommand = now
+	gate.LastIrrigated = now
+	queueChanged = true
+	publishGateStatus(gate)
+}
+
+// waitingHead returns the highest priority queued gate that could open now
+// but for supply capacity. Caller must hold stateMutex.
+func waitingHead() (int, bool) {
+	for _, entry := range sortedQueue() {
+		gate := gateStates[entry.GateID]
+		if gate.IsOpen || gate.ManualOverride || time.Since(gate.LastCommand) < commandCooldown {
+			continue
+		}
+		return entry.GateID, true
+	}
+	return 0, false
+}
+
+// rotateGates closes gates that used up their irrigation slot while the
+// head of the queue is waiting for supply, longest open first, until the
+// head fits, so upstream zones cannot starve downstream ones. Rotated
+// zones that are still dry go back into the queue.
+// Caller must hold stateMutex.
+func rotateGates() {
+	head, waiting := waitingHead()
+	if !waiting || hasCapacityFor(head) {
+		return
+	}
+
+	var expired []*GateState
+	for _, gate := range gateStates {
+		if !gate.IsOpen || gate.ManualOverride || time.Since(gate.OpenedAt) < irrigationSlot {
+			continue
+		}
+		if time.Since(gate.LastCommand) < commandCooldown {
+			continue
+		}
+		expired = append(expired, gate)
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].OpenedAt.Before(expired[j].OpenedAt) })
+
+	for _, gate := range expired {
+		if hasCapacityFor(head) {
+			return
+		}
+		event := newGateEvent(gate, "scheduler")
+		event.Action = actionClose
+		event.Reason = fmt.Sprintf("Irrigation slot of %v used, rotating to waiting zones", irrigationSlot)
+		closeGate(gate, event.Reason, "auto")
+		event.GateOpenAfter = gate.IsOpen
+		emitDecision(event)
+
+		if moisture, count := zoneAggregate(gate.GateID); count > 0 && moisture < wetThreshold {
+			enqueueIrrigation(gate)
+		}
+	}
+}
+
+// dispatchIrrigationQueue opens queued gates in priority order while supply
+// capacity allows. Caller must hold stateMutex.
+func dispatchIrrigationQueue() {
+	rotateGates()
+
+	for _, entry := range sortedQueue() {
+		gate := gateStates[entry.GateID]
+		if gate.IsOpen || gate.ManualOverride {
+			delete(irrigationQueue, entry.GateID)
+			continue
+		}
+		if time.Since(gate.LastCommand) < commandCooldown {
+			reportQueuedCooldown(gate)
+			continue
+		}
+		if !hasCapacityFor(entry.GateID) {
+			break // Keep strict priority order when supply is exhausted
+		}
+
+		delete(irrigationQueue, entry.GateID)
+		event := newGateEvent(gate, "scheduler")
+		moisture := entry.Moisture
+		event.Moisture = &moisture
+		event.Action = actionOpen
+		event.Reason = fmt.Sprintf("Zone moisture %.2f%% (dry threshold %.2f%%), priority %.2f",
+			entry.Moisture, dryThreshold, entry.Priority)
+		openGate(gate, event.Reason, "auto")
+		event.GateOpenAfter = gate.IsOpen
+		emitDecision(event)
+	}
+
+	if queueChanged {
+		publishQueue()
+		queueChanged = false
+	}
+}
+
+// reportQueuedCooldown counts and logs a queued gate waiting for its
+// cooldown, once per queue entry. Caller must hold stateMutex.
+func reportQueuedCooldown(gate *GateState) {
+	entry := irrigationQueue[gate.GateID]
+	if entry.cooldownReported {
+		return
+	}
+	entry.cooldownReported = true
+	cooldownSkips.Inc()
+
+	event := newGateEvent(gate, "scheduler")
+	event.Action = actionCooldown
+	event.Reason = fmt.Sprintf("Zone queued at %.2f%% moisture, gate in cooldown", entry.Moisture)
+	event.GateOpenAfter = gate.IsOpen
+	emitDecision(event)
+}
+
+// queueSnapshot captures the scheduler state. Caller must hold stateMutex.
+func queueSnapshot() QueueSnapshot {
+	openGates := []int{}
+	for gateID, gate := range gateStates {
+		if gate.IsOpen {
+			openGates = append(openGates, gateID)
+		}
+	}
+	sort.Ints(openGates)
+	_, used := supplyInUse()
+
+	return QueueSnapshot{
+		FarmID:         mqttConfig.FarmID,
+		Timestamp:      time.Now().Unix(),
+		MaxOpenGates:   maxOpenGates,
+		SupplyCapacity: supplyCapacityLPM,
+		SupplyUsed:     used,
+		OpenGates:      openGates,
+		Queue:          sortedQueue(),
+	}
+}
+
+// publishQueue publishes the current queue as a retained message.
+// Caller must hold stateMutex.
+func publishQueue() {
+	payload, err := json.Marshal(queueSnapshot())
+	if err != nil {
+		log.Printf("❌ Failed to encode irrigation queue: %v", err)
+		return
+	}
+	client.Publish(mqttConfig.topic(queueTopic), 1, true, payload)
+}
+
+// runScheduler periodically re-evaluates the queue so cooldowns expiring and
+// irrigation slots running out take effect without waiting for new readings.
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stateMutex.Lock()
+		dispatchIrrigationQueue()
+		stateMutex.Unlock()
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withGateFlows overrides the gate flow rates for one test
+func withGateFlows(t *testing.T, flows map[int]float64) {
+	saved := gateFlowRates
+	gateFlowRates = flows
+	t.Cleanup(func() { gateFlowRates = saved })
+}
+
+// openGateIDs lists the open gates in ID order. Caller must hold stateMutex.
+func openGateIDs() []int {
+	return queueSnapshot().OpenGates
+}
+
+func TestHasCapacityFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		flows map[int]float64
+		open  []int
+		gate  int
+		want  bool
+	}{
+		{"nothing open", map[int]float64{1: 25, 2: 25, 3: 25}, nil, 1, true},
+		{"one of two gates open", map[int]float64{1: 25, 2: 25, 3: 25}, []int{1}, 2, true},
+		{"max open gates reached", map[int]float64{1: 10, 2: 10, 3: 10}, []int{1, 2}, 3, false},
+		{"flow over supply", map[int]float64{1: 25, 2: 40}, []int{1}, 2, false},
+		{"flow exactly at supply", map[int]float64{1: 25, 2: 35}, []int{1}, 2, true},
+		{"default flow", map[int]float64{}, []int{1}, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetEdge(t)
+			withGateFlows(t, test.flows)
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			gateStates[3] = &GateState{GateID: 3}
+			for _, gateID := range test.open {
+				gateStates[gateID].IsOpen = true
+			}
+			if got := hasCapacityFor(test.gate); got != test.want {
+				t.Errorf("hasCapacityFor(%d) = %v, want %v", test.gate, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	long := time.Now().Add(-2 * irrigationSlot)
+	short := time.Now().Add(-irrigationSlot / 2)
+	tests := []struct {
+		name     string
+		flows    map[int]float64
+		openedAt time.Time // Gate 1, open; gate 2 is queued
+		override bool
+		want     []int // Open gates after dispatch
+	}{
+		{"room for both", map[int]float64{1: 25, 2: 25}, long, false, []int{1, 2}},
+		{"slot used, no room", map[int]float64{1: 25, 2: 40}, long, false, []int{2}},
+		{"slot left, no room", map[int]float64{1: 25, 2: 40}, short, false, []int{1}},
+		{"manual override, no room", map[int]float64{1: 25, 2: 40}, long, true, []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetEdge(t)
+			withGateFlows(t, test.flows)
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			gate := gateStates[1]
+			gate.IsOpen, gate.OpenedAt, gate.LastCommand, gate.ManualOverride = true, test.openedAt, test.openedAt, test.override
+			soilMoistureStates[9001], soilMoistureStates[9020] = 35, 20
+			enqueueIrrigation(gateStates[2])
+
+			dispatchIrrigationQueue()
+			if got := openGateIDs(); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("open gates are %v, want %v", got, test.want)
+			}
+			if closed := !gate.IsOpen; closed {
+				if _, requeued := irrigationQueue[1]; !requeued {
+					t.Error("rotated zone, still dry, is not queued again")
+				}
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	recorder := resetEdge(t)
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	gate := gateStates[1]
+	gate.LastCommand = time.Now()
+	soilMoistureStates[9001] = 20
+	enqueueIrrigation(gate)
+
+	skips := testutil.ToFloat64(cooldownSkips)
+	for i := 0; i < 3; i++ {
+		dispatchIrrigationQueue()
+	}
+	if counted := testutil.ToFloat64(cooldownSkips) - skips; counted != 1 {
+		t.Errorf("three passes counted %v cooldown skips, want 1", counted)
+	}
+	if gate.IsOpen {
+		t.Fatal("gate opened in cooldown")
+	}
+	if _, queued := irrigationQueue[1]; !queued {
+		t.Fatal("gate in cooldown left the queue")
+	}
+
+	gate.LastCommand = time.Now().Add(-commandCooldown)
+	dispatchIrrigationQueue()
+	if !gate.IsOpen || len(irrigationQueue) != 0 {
+		t.Errorf("gate open %v, queue %v after the cooldown", gate.IsOpen, sortedQueue())
+	}
+	if commands := recorder.published("commands/water-gate-sensors/1"); len(commands) != 1 {
+		t.Errorf("sent %d commands, want one open", len(commands))
+	}
+}
+
+func TestPriority(t *testing.T) {
+	irrigated := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		moisture   [2]float64 // Zone 1, zone 2
+		irrigated  [2]time.Time
+		cropValues map[int]float64
+		want       int // Gate opened first
+	}{
+		{"drier zone first", [2]float64{30, 10}, [2]time.Time{}, nil, 2},
+		{"longer wait first", [2]float64{20, 20}, [2]time.Time{irrigated, {}}, nil, 2},
+		{"valuable crop first", [2]float64{20, 20}, [2]time.Time{}, map[int]float64{1: 1, 2: 0.5}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetEdge(t)
+			withGateFlows(t, map[int]float64{1: 40, 2: 40}) // One gate at a time
+			if test.cropValues != nil {
+				saved := gateCropValues
+				gateCropValues = test.cropValues
+				t.Cleanup(func() { gateCropValues = saved })
+			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			soilMoistureStates[9001], soilMoistureStates[9020] = test.moisture[0], test.moisture[1]
+			for i, gateID := range []int{1, 2} {
+				gateStates[gateID].LastIrrigated = test.irrigated[i]
+				enqueueIrrigation(gateStates[gateID])
+			}
+
+			dispatchIrrigationQueue()
+			if got := openGateIDs(); fmt.Sprint(got) != fmt.Sprint([]int{test.want}) {
+				t.Errorf("open gates are %v, want [%d]", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueuePriorityUsesZoneMoisture(t *testing.T) {
+	resetEdge(t)
+	stateMutex.Lock()
+	gateStates[1].LastCommand = time.Now() // Stay queued
+	stateMutex.Unlock()
+
+	handleSoilMoisture(SensorData{SensorID: 9002, Type: "soil-moisture-sensors", Value: 50})
+	handleSoilMoisture(SensorData{SensorID: 9001, Type: "soil-moisture-sensors", Value: 30})
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	entry := irrigationQueue[1]
+	if entry == nil || entry.Moisture != 40 {
+		t.Fatalf("queue entry is %+v, want the zone mean 40%%", entry)
+	}
+	if want := priorityScore(gateStates[1], 40, time.Now()); entry.Priority != want {
+		t.Errorf("priority %v, want %v", entry.Priority, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ============================================================================
+// PER-SENSOR GAUGES
+// ============================================================================
+
+// This file is the same in the edge and the cloud server.
+// edge/sensorcollector.go is the canonical copy: change it there and copy it
+// to cloud/cloud-server/ (TestSensorCollectorCopiesAreIdentical in the cloud
+// server checks they match).
+
+// sensorRef identifies a sensor, IDs are only unique within a farm
+type sensorRef struct {
+	farm     string
+	sensorID int
+}
+
+type sensorSample struct {
+	sensorType string
+	value      float64
+	lastSeen   time.Time
+}
+
+// sensorCollector exports the latest value and last-seen age of every
+// sensor. Age is computed at scrape time so it keeps growing for silent sensors.
+type sensorCollector struct {
+	mu      sync.RWMutex
+	samples map[sensorRef]sensorSample
+	value   *prometheus.Desc
+	age     *prometheus.Desc
+}
+
+func newSensorCollector(prefix string) *sensorCollector {
+	labels := []string{"farm", "sensor_id", "type"}
+	return &sensorCollector{
+		samples: make(map[sensorRef]sensorSample),
+		value: prometheus.NewDesc(prefix+"_sensor_value",
+			"Latest reported value per sensor.", labels, nil),
+		age: prometheus.NewDesc(prefix+"_sensor_last_seen_age_seconds",
+			"Seconds since the sensor last reported.", labels, nil),
+	}
+}
+
+func (s *sensorCollector) observe(farm string, sensorID int, sensorType string, value float64) {
+	s.mu.Lock()
+	s.samples[sensorRef{farm, sensorID}] = sensorSample{sensorType: sensorType, value: value, lastSeen: time.Now()}
+	s.mu.Unlock()
+}
+
+func (s *sensorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.value
+	ch <- s.age
+}
+
+func (s *sensorCollector) Collect(ch chan<- prometheus.Metric) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for ref, sample := range s.samples {
+		id := strconv.Itoa(ref.sensorID)
+		ch <- prometheus.MustNewConstMetric(s.value, prometheus.GaugeValue, sample.value, ref.farm, id, sample.sensorType)
+		ch <- prometheus.MustNewConstMetric(s.age, prometheus.GaugeValue,
+			time.Since(sample.lastSeen).Seconds(), ref.farm, id, sample.sensorType)
+	}
+}
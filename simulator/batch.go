@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ============================================================================
+// BATCHED PUBLISHING
+// ============================================================================
+
+// SIM_BATCH sends many readings per MQTT message instead of one per sensor:
+//
+//	SIM_BATCH=type     one message per sensor type on farm/<farm>/sensors/<type>/batch
+//	SIM_BATCH=gateway  one message per tick on farm/<farm>/sensors/batch/<gateway>
+//
+// The gateway name is SIM_GATEWAY_ID, or the MQTT client ID. Batches are
+// JSON: {"farm_id", "gateway", "readings": [<sensor reading>, ...]}.
+
+// batchSegment marks batch topics
+const batchSegment = "batch"
+
+// Batch modes
+const (
+	batchByType    = "type"
+	batchByGateway = "gateway"
+)
+
+// SensorBatch is the payload of a batch topic
+type SensorBatch struct {
+	FarmID   string       `json:"farm_id"`
+	Gateway  string       `json:"gateway,omitempty"`
+	Readings []SensorData `json:"readings"`
+}
+
+// configureBatching reads SIM_BATCH and SIM_GATEWAY_ID
+func (s *Simulator) configureBatching(mode, gateway string) error {
+	switch mode {
+	case "":
+		return nil
+	case batchByType, batchByGateway:
+	default:
+		return fmt.Errorf("SIM_BATCH must be %s or %s", batchByType, batchByGateway)
+	}
+	if s.compact {
+		return fmt.Errorf("SIM_BATCH only works with JSON payloads, unset SIM_ENCODING")
+	}
+
+	if gateway == "" {
+		gateway = s.config.ClientID
+	}
+	if gateway == "" || strings.ContainsAny(gateway, "/+#") {
+		return fmt.Errorf("gateway %q is not usable in a topic, set SIM_GATEWAY_ID", gateway)
+	}
+	s.batch, s.gateway = mode, gateway
+	return nil
+}
+
+// publishBatch sends readings as one message
+func (s *Simulator) publishBatch(topic string, readings []SensorData) {
+	if len(readings) == 0 {
+		return
+	}
+	batch := SensorBatch{FarmID: s.config.FarmID, Readings: readings}
+	if s.batch == batchByGateway {
+		batch.Gateway = s.gateway
+	}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		fmt.Printf("❌ Failed to encode batch: %v\n", err)
+		return
+	}
+
+	s.client.Publish(topic, 0, false, payload)
+	fmt.Printf("📦 Batch %s: %d readings, %d bytes\n", topic, len(readings), len(payload))
+}
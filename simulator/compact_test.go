@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// testReadings returns soil moisture readings as the simulator publishes
+// them, with raw probe values if raw is set
+func testReadings(n int, raw bool) []SensorData {
+	rng := rand.New(rand.NewSource(1))
+	readings := make([]SensorData, n)
+	for i := range readings {
+		value := 20 + rng.Float64()*60
+		readings[i] = SensorData{
+			FarmID: "default", SensorID: 9001 + i, Type: "soil-moisture-sensors",
+			Lat: 32.7637 + rng.Float64()/100, Lon: 52.6365 + rng.Float64()/100,
+			Unit: "%", Timestamp: time.Now().Unix(),
+		}
+		if raw {
+			counts, temperature := math.Round(2000+rng.Float64()*1000), 15+rng.Float64()*10
+			readings[i].RawValue, readings[i].Temperature = &counts, &temperature
+		} else {
+			readings[i].Value = &value
+		}
+	}
+	return readings
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		for _, data := range testReadings(100, raw) {
+			payload, err := encodeCompact(data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got CompactReading
+			if err := cbor.Unmarshal(payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Timestamp != data.Timestamp || !sameValue(got.Value, data.Value, 0) ||
+				!sameValue(got.RawValue, data.RawValue, 0) || !sameValue(got.Temperature, data.Temperature, 0) {
+				t.Fatalf("%+v decoded as %+v", data, got)
+			}
+
+			// float32 keeps about 7 significant digits
+			payload, err = encodeCompact(data, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = CompactReading{}
+			if err := cbor.Unmarshal(payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !sameValue(got.Value, data.Value, 1e-7) || !sameValue(got.RawValue, data.RawValue, 1e-7) ||
+				!sameValue(got.Temperature, data.Temperature, 1e-7) {
+				t.Fatalf("%+v decoded as %+v with float32 values", data, got)
+			}
+		}
+	}
+}
+
+// sameValue reports whether two optional values are both unset or equal
+// within a relative tolerance
+func sameValue(got, want *float64, tolerance float64) bool {
+	if got == nil || want == nil {
+		return got == want
+	}
+	return math.Abs(*got-*want) <= tolerance*math.Abs(*want)
+}
+
+// BenchmarkPayloadSize reports the bytes per reading of each encoding
+//
+//	go test -run '^$' -bench PayloadSize
+func BenchmarkPayloadSize(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		raw  bool
+	}{{"value", false}, {"raw", true}} {
+		readings := testReadings(1000, mode.raw)
+		b.Run(mode.name, func(b *testing.B) {
+			var jsonBytes, cborBytes, cbor32Bytes int
+			for n := 0; n < b.N; n++ {
+				jsonBytes, cborBytes, cbor32Bytes = 0, 0, 0
+				for _, data := range readings {
+					payload, _ := json.Marshal(data)
+					compact, err := encodeCompact(data, false)
+					if err != nil {
+						b.Fatal(err)
+					}
+					compact32, err := encodeCompact(data, true)
+					if err != nil {
+						b.Fatal(err)
+					}
+					jsonBytes, cborBytes, cbor32Bytes = jsonBytes+len(payload), cborBytes+len(compact), cbor32Bytes+len(compact32)
+				}
+			}
+			count := float64(len(readings))
+			b.ReportMetric(float64(jsonBytes)/count, "json-B/reading")
+			b.ReportMetric(float64(cborBytes)/count, "cbor-B/reading")
+			b.ReportMetric(float64(cbor32Bytes)/count, "cbor32-B/reading")
+		})
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// ============================================================================
+// DATA STRUCTURES FOR GEOJSON
+// ============================================================================
+
+// GeoJSON represents the root structure of each sensor layer
+type GeoJSON struct {
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	CRS      *CRS      `json:"crs,omitempty"`
+	Features []Feature `json:"features"`
+}
+
+// CRS is the named coordinate reference system QGIS writes into each layer
+type CRS struct {
+	Type       string `json:"type"`
+	Properties struct {
+		Name string `json:"name"`
+	} `json:"properties"`
+}
+
+// Feature represents individual sensor in the GeoJSON
+type Feature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *Geometry              `json:"geometry"`
+}
+
+// Geometry keeps the raw coordinates, they are decoded by type in Centroid
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometries  []Geometry      `json:"geometries"` // GeometryCollection
+}
+
+// Position is a [lon, lat] coordinate pair in CRS84
+type Position struct {
+	Lon float64
+	Lat float64
+}
+
+// Sensor is one simulated device with its resolved location
+type Sensor struct {
+	ID  int
+	Lat float64
+	Lon float64
+}
+
+// SensorLayer is a validated layer, one sensor type
+type SensorLayer struct {
+	Name    string
+	Sensors []Sensor
+}
+
+// Names QGIS and other tools use for CRS84 (WGS 84, lon/lat order)
+var crs84Names = map[string]bool{
+	"urn:ogc:def:crs:OGC:1.3:CRS84":                true,
+	"urn:ogc:def:crs:OGC::CRS84":                   true,
+	"OGC:CRS84":                                    true,
+	"http://www.opengis.net/def/crs/OGC/1.3/CRS84": true,
+}
+
+// ============================================================================
+// LAYER LOADING
+// ============================================================================
+
+// LoadSensors reads the layers of main.json and resolves every feature to a
+// sensor location. A layer in another CRS, or a feature with a missing id
+// or bad geometry, is skipped and reported in problems instead of being
+// published at (0,0). The error is only set when the file itself is
+// unusable.
+func LoadSensors(filepath string) ([]SensorLayer, []error, error) {
+	// Read file contents
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse JSON into GeoJSON structures
+	var geoJSONs []GeoJSON
+	if err := json.Unmarshal(data, &geoJSONs); err != nil {
+		return nil, nil, fmt.Errorf("%s: expected a list of GeoJSON layers: %w", filepath, err)
+	}
+
+	var layers []SensorLayer
+	var problems []error
+	for i, geoJSON := range geoJSONs {
+		layer, layerProblems := resolveLayer(i, geoJSON)
+		problems = append(problems, layerProblems...)
+		if layer != nil {
+			layers = append(layers, *layer)
+		}
+	}
+
+	if len(layers) == 0 {
+		return nil, problems, fmt.Errorf("%s: no usable sensor layers", filepath)
+	}
+	return layers, problems, nil
+}
+
+// resolveLayer validates one layer and resolves its features. A nil layer
+// means the whole layer was rejected.
+func resolveLayer(index int, geoJSON GeoJSON) (*SensorLayer, []error) {
+	name := geoJSON.Name
+	if name == "" {
+		return nil, []error{fmt.Errorf("layer #%d: missing name (the sensor type)", index)}
+	}
+	if geoJSON.Type != "FeatureCollection" {
+		return nil, []error{fmt.Errorf("layer %s: expected a FeatureCollection, got %q", name, geoJSON.Type)}
+	}
+	if err := checkCRS(geoJSON.CRS); err != nil {
+		return nil, []error{fmt.Errorf("layer %s: %w", name, err)}
+	}
+
+	layer := &SensorLayer{Name: name}
+	var problems []error
+	seen := make(map[int]bool)
+	for i, feature := range geoJSON.Features {
+		sensor, err := resolveFeature(feature)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("layer %s, %s: %w", name, describeFeature(i, feature), err))
+			continue
+		}
+		if seen[sensor.ID] {
+			problems = append(problems, fmt.Errorf("layer %s, %s: duplicate id", name, describeFeature(i, feature)))
+			continue
+		}
+		seen[sensor.ID] = true
+		layer.Sensors = append(layer.Sensors, sensor)
+	}
+	return layer, problems
+}
+
+// checkCRS accepts layers without a crs member (GeoJSON defaults to CRS84)
+// and layers explicitly in CRS84
+func checkCRS(crs *CRS) error {
+	if crs == nil {
+		return nil
+	}
+	if crs.Type != "name" || !crs84Names[crs.Properties.Name] {
+		return fmt.Errorf("unsupported CRS %q, export the layer as EPSG:4326 / CRS84", crs.Properties.Name)
+	}
+	return nil
+}
+
+// resolveFeature reads the sensor id and location of one feature
+func resolveFeature(feature Feature) (Sensor, error) {
+	id, ok := feature.Properties["id"].(float64)
+	if !ok {
+		return Sensor{}, errors.New("missing numeric id property")
+	}
+	if id != math.Trunc(id) || id <= 0 {
+		return Sensor{}, fmt.Errorf("id %v is not a positive integer", id)
+	}
+	if feature.Geometry == nil {
+		return Sensor{}, errors.New("feature has no geometry")
+	}
+
+	centroid, err := feature.Geometry.Centroid()
+	if err != nil {
+		return Sensor{}, err
+	}
+	return Sensor{ID: int(id), Lat: centroid.Lat, Lon: centroid.Lon}, nil
+}
+
+// describeFeature names a feature in error messages by index and id
+func describeFeature(index int, feature Feature) string {
+	if id, ok := feature.Properties["id"]; ok {
+		return fmt.Sprintf("feature #%d (id %v)", index, id)
+	}
+	return fmt.Sprintf("feature #%d", index)
+}
+
+// ============================================================================
+// GEOMETRY PARSING AND CENTROIDS
+// ============================================================================
+
+// Centroid returns the location of a geometry: the point itself, the mean
+// of a MultiPoint, the length-weighted centre of lines and the area-weighted
+// centre of polygons. Lines and polygons without length or area fall back
+// to the mean of their vertices.
+func (g *Geometry) Centroid() (Position, error) {
+	switch g.Type {
+	case "Point":
+		var raw []float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		return toPosition(raw)
+
+	case "MultiPoint":
+		var raw [][]float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		points, err := toPositions(raw)
+		if err != nil {
+			return Position{}, err
+		}
+		return meanPosition(points), nil
+
+	case "LineString":
+		var raw [][]float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		line, err := toPositions(raw)
+		if err != nil {
+			return Position{}, err
+		}
+		return linesCentroid([][]Position{line}), nil
+
+	case "MultiLineString":
+		var raw [][][]float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		lines, err := toPositionLists(raw)
+		if err != nil {
+			return Position{}, err
+		}
+		return linesCentroid(lines), nil
+
+	case "Polygon":
+		var raw [][][]float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		rings, err := toPositionLists(raw)
+		if err != nil {
+			return Position{}, err
+		}
+		return polygonsCentroid([][][]Position{rings}), nil
+
+	case "MultiPolygon":
+		var raw [][][][]float64
+		if err := g.decode(&raw); err != nil {
+			return Position{}, err
+		}
+		if len(raw) == 0 {
+			return Position{}, errors.New("MultiPolygon has no polygons")
+		}
+		polygons := make([][][]Position, len(raw))
+		for i, polygon := range raw {
+			rings, err := toPositionLists(polygon)
+			if err != nil {
+				return Position{}, fmt.Errorf("polygon %d: %w", i, err)
+			}
+			polygons[i] = rings
+		}
+		return polygonsCentroid(polygons), nil
+
+	case "GeometryCollection":
+		if len(g.Geometries) == 0 {
+			return Position{}, errors.New("GeometryCollection has no geometries")
+		}
+		centroids := make([]Position, len(g.Geometries))
+		for i := range g.Geometries {
+			centroid, err := g.Geometries[i].Centroid()
+			if err != nil {
+				return Position{}, fmt.Errorf("geometry %d: %w", i, err)
+			}
+			centroids[i] = centroid
+		}
+		return meanPosition(centroids), nil
+
+	case "":
+		return Position{}, errors.New("geometry without type")
+	default:
+		return Position{}, fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+}
+
+// decode unmarshals the coordinates into the shape of the geometry type
+func (g *Geometry) decode(target interface{}) error {
+	if len(g.Coordinates) == 0 || string(g.Coordinates) == "null" {
+		return fmt.Errorf("%s without coordinates", g.Type)
+	}
+	if err := json.Unmarshal(g.Coordinates, target); err != nil {
+		return fmt.Errorf("%s coordinates have the wrong nesting: %w", g.Type, err)
+	}
+	return nil
+}
+
+// toPosition validates a [lon, lat] pair
+func toPosition(raw []float64) (Position, error) {
+	if len(raw) < 2 {
+		return Position{}, fmt.Errorf("position %v needs lon and lat", raw)
+	}
+	lon, lat := raw[0], raw[1]
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return Position{}, fmt.Errorf("position [%v, %v] is outside lon/lat range (is the layer projected?)", lon, lat)
+	}
+	if lon == 0 && lat == 0 {
+		return Position{}, errors.New("position [0, 0] is a placeholder, not a field location")
+	}
+	return Position{Lon: lon, Lat: lat}, nil
+}
+
+func toPositions(raw [][]float64) ([]Position, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty coordinates")
+	}
+	positions := make([]Position, len(raw))
+	for i, pair := range raw {
+		position, err := toPosition(pair)
+		if err != nil {
+			return nil, fmt.Errorf("position %d: %w", i, err)
+		}
+		positions[i] = position
+	}
+	return positions, nil
+}
+
+func toPositionLists(raw [][][]float64) ([][]Position, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty coordinates")
+	}
+	lists := make([][]Position, len(raw))
+	for i, part := range raw {
+		positions, err := toPositions(part)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %w", i, err)
+		}
+		lists[i] = positions
+	}
+	return lists, nil
+}
+
+// meanPosition returns the average of positions
+func meanPosition(positions []Position) Position {
+	var sum Position
+	for _, p := range positions {
+		sum.Lon += p.Lon
+		sum.Lat += p.Lat
+	}
+	n := float64(len(positions))
+	return Position{Lon: sum.Lon / n, Lat: sum.Lat / n}
+}
+
+// linesCentroid weights each segment midpoint by the segment length.
+// Longitude is scaled by cos(lat) so east-west segments are not overweighted.
+func linesCentroid(lines [][]Position) Position {
+	var sum Position
+	var total float64
+	var vertices []Position
+	for _, line := range lines {
+		vertices = append(vertices, line...)
+		for i := 1; i < len(line); i++ {
+			a, b := line[i-1], line[i]
+			scale := math.Cos((a.Lat + b.Lat) / 2 * math.Pi / 180)
+			length := math.Hypot((b.Lon-a.Lon)*scale, b.Lat-a.Lat)
+			sum.Lon += length * (a.Lon + b.Lon) / 2
+			sum.Lat += length * (a.Lat + b.Lat) / 2
+			total += length
+		}
+	}
+	if total == 0 {
+		return meanPosition(vertices)
+	}
+	return Position{Lon: sum.Lon / total, Lat: sum.Lat / total}
+}
+
+// polygonsCentroid returns the area-weighted centroid of polygons, holes
+// (rings after the first) subtract their area
+func polygonsCentroid(polygons [][][]Position) Position {
+	var sum Position
+	var total float64
+	var vertices []Position
+	for _, rings := range polygons {
+		for i, ring := range rings {
+			vertices = append(vertices, ring...)
+			area, centroid := ringAreaCentroid(ring)
+			if i > 0 {
+				area = -area // Hole
+			}
+			sum.Lon += area * centroid.Lon
+			sum.Lat += area * centroid.Lat
+			total += area
+		}
+	}
+	if math.Abs(total) < 1e-18 {
+		return meanPosition(vertices)
+	}
+	return Position{Lon: sum.Lon / total, Lat: sum.Lat / total}
+}
+
+// ringAreaCentroid returns the unsigned area and centroid of a ring
+// (shoelace formula); the ring may or may not repeat its first position.
+// Coordinates are taken relative to the first vertex to keep precision.
+func ringAreaCentroid(ring []Position) (float64, Position) {
+	origin := ring[0]
+	var area, cx, cy float64
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		ax, ay := a.Lon-origin.Lon, a.Lat-origin.Lat
+		bx, by := b.Lon-origin.Lon, b.Lat-origin.Lat
+		cross := ax*by - bx*ay
+		area += cross
+		cx += (ax + bx) * cross
+		cy += (ay + by) * cross
+	}
+	if area == 0 {
+		return 0, Position{}
+	}
+	return math.Abs(area / 2), Position{Lon: origin.Lon + cx/(3*area), Lat: origin.Lat + cy/(3*area)}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// geometry parses a GeoJSON geometry
+func geometry(t *testing.T, raw string) *Geometry {
+	t.Helper()
+	var g Geometry
+	if err := json.Unmarshal([]byte(raw), &g); err != nil {
+		t.Fatalf("geometry %s: %v", raw, err)
+	}
+	return &g
+}
+
+func TestCentroid(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry string
+		want     Position
+		err      string // Part of the error, "" for none
+	}{
+		{"point", `{"type": "Point", "coordinates": [51.4, 35.7]}`, Position{51.4, 35.7}, ""},
+		{"point with altitude", `{"type": "Point", "coordinates": [51.4, 35.7, 1200]}`, Position{51.4, 35.7}, ""},
+		{"multipoint", `{"type": "MultiPoint", "coordinates": [[10, 10], [12, 14]]}`, Position{11, 12}, ""},
+		{"line, weighted by length", `{"type": "LineString", "coordinates": [[10, 1], [12, 1], [13, 1]]}`, Position{11.5, 1}, ""},
+		{"line of one point", `{"type": "LineString", "coordinates": [[10, 10], [10, 10]]}`, Position{10, 10}, ""},
+		{"multiline", `{"type": "MultiLineString", "coordinates": [[[10, 1], [12, 1]], [[20, 1], [21, 1]]]}`, Position{14.1667, 1}, ""},
+		{"square", `{"type": "Polygon", "coordinates": [[[10, 10], [12, 10], [12, 12], [10, 12], [10, 10]]]}`, Position{11, 11}, ""},
+		{"open ring", `{"type": "Polygon", "coordinates": [[[10, 10], [12, 10], [12, 12], [10, 12]]]}`, Position{11, 11}, ""},
+		{"clockwise ring", `{"type": "Polygon", "coordinates": [[[10, 10], [10, 12], [12, 12], [12, 10], [10, 10]]]}`, Position{11, 11}, ""},
+		{"polygon with a hole", `{"type": "Polygon", "coordinates": [
+			[[10, 10], [14, 10], [14, 14], [10, 14], [10, 10]],
+			[[10, 10], [12, 10], [12, 12], [10, 12], [10, 10]]]}`, Position{12.3333, 12.3333}, ""},
+		{"degenerate ring", `{"type": "Polygon", "coordinates": [[[10, 10], [11, 10], [12, 10], [10, 10]]]}`, Position{10.75, 10}, ""},
+		{"multipolygon, weighted by area", `{"type": "MultiPolygon", "coordinates": [
+			[[[10, 10], [12, 10], [12, 12], [10, 12], [10, 10]]],
+			[[[20, 20], [21, 20], [21, 21], [20, 21], [20, 20]]]]}`, Position{12.9, 12.9}, ""},
+		{"collection", `{"type": "GeometryCollection", "geometries": [
+			{"type": "Point", "coordinates": [10, 10]},
+			{"type": "Polygon", "coordinates": [[[11, 13], [13, 13], [13, 15], [11, 15], [11, 13]]]}]}`, Position{11, 12}, ""},
+
+		{"no type", `{"coordinates": [51.4, 35.7]}`, Position{}, "without type"},
+		{"unknown type", `{"type": "Circle", "coordinates": [51.4, 35.7]}`, Position{}, "unknown geometry type"},
+		{"no coordinates", `{"type": "Point"}`, Position{}, "without coordinates"},
+		{"null coordinates", `{"type": "Point", "coordinates": null}`, Position{}, "without coordinates"},
+		{"wrong nesting", `{"type": "Point", "coordinates": [[51.4, 35.7]]}`, Position{}, "wrong nesting"},
+		{"latitude only", `{"type": "Point", "coordinates": [51.4]}`, Position{}, "needs lon and lat"},
+		{"projected", `{"type": "Point", "coordinates": [538000, 3950000]}`, Position{}, "outside lon/lat range"},
+		{"placeholder", `{"type": "Point", "coordinates": [0, 0]}`, Position{}, "placeholder"},
+		{"empty multipoint", `{"type": "MultiPoint", "coordinates": []}`, Position{}, "empty coordinates"},
+		{"empty line", `{"type": "LineString", "coordinates": []}`, Position{}, "empty coordinates"},
+		{"polygon without rings", `{"type": "Polygon", "coordinates": []}`, Position{}, "empty coordinates"},
+		{"empty ring", `{"type": "Polygon", "coordinates": [[]]}`, Position{}, "part 0: empty coordinates"},
+		{"bad vertex", `{"type": "Polygon", "coordinates": [[[10, 10], [12, 100], [12, 12]]]}`, Position{}, "part 0: position 1"},
+		{"multipolygon without polygons", `{"type": "MultiPolygon", "coordinates": []}`, Position{}, "no polygons"},
+		{"bad polygon", `{"type": "MultiPolygon", "coordinates": [[[[10, 10], [12, 10], [12, 12]]], []]}`, Position{}, "polygon 1"},
+		{"empty collection", `{"type": "GeometryCollection", "geometries": []}`, Position{}, "no geometries"},
+		{"bad member", `{"type": "GeometryCollection", "geometries": [{"type": "Point", "coordinates": [0, 0]}]}`, Position{}, "geometry 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := geometry(t, test.geometry).Centroid()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Centroid = %v, %v, want an error with %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got.Lon-test.want.Lon) > 1e-3 || math.Abs(got.Lat-test.want.Lat) > 1e-3 {
+				t.Errorf("Centroid = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckCRS(t *testing.T) {
+	named := func(name string) *CRS {
+		crs := &CRS{Type: "name"}
+		crs.Properties.Name = name
+		return crs
+	}
+	if err := checkCRS(nil); err != nil {
+		t.Errorf("layer without crs: %v", err)
+	}
+	for name := range crs84Names {
+		if err := checkCRS(named(name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	linked := named("urn:ogc:def:crs:OGC:1.3:CRS84")
+	linked.Type = "link"
+	for _, crs := range []*CRS{named("urn:ogc:def:crs:EPSG::3857"), named("EPSG:4326"), named(""), linked} {
+		if err := checkCRS(crs); err == nil {
+			t.Errorf("accepted crs %+v", crs)
+		}
+	}
+}
+
+// layer builds a FeatureCollection of features given as JSON
+func layer(t *testing.T, name string, crs *CRS, features ...string) GeoJSON {
+	t.Helper()
+	g := GeoJSON{Type: "FeatureCollection", Name: name, CRS: crs}
+	for _, raw := range features {
+		var feature Feature
+		if err := json.Unmarshal([]byte(raw), &feature); err != nil {
+			t.Fatalf("feature %s: %v", raw, err)
+		}
+		g.Features = append(g.Features, feature)
+	}
+	return g
+}
+
+const testPoint = `{"type": "Point", "coordinates": [51.4, 35.7]}`
+
+func TestResolveLayer(t *testing.T) {
+	projected := &CRS{Type: "name"}
+	projected.Properties.Name = "urn:ogc:def:crs:EPSG::32639"
+
+	tests := []struct {
+		name     string
+		layer    GeoJSON
+		sensors  []int    // IDs resolved, nil for a rejected layer
+		problems []string // Part of each problem, in order
+	}{
+		{"valid", layer(t, "soil-moisture-sensors", nil,
+			`{"type": "Feature", "properties": {"id": 1}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": 2, "name": "north"}, "geometry": `+testPoint+`}`),
+			[]int{1, 2}, nil},
+		{"no name", layer(t, "", nil), nil, []string{"layer #0: missing name"}},
+		{"not a collection", GeoJSON{Type: "Feature", Name: "weather-sensor"}, nil, []string{"expected a FeatureCollection"}},
+		{"projected", layer(t, "weather-sensor", projected,
+			`{"type": "Feature", "properties": {"id": 1}, "geometry": `+testPoint+`}`),
+			nil, []string{"layer weather-sensor: unsupported CRS \"urn:ogc:def:crs:EPSG::32639\""}},
+		{"bad features", layer(t, "water-flow-sensors", nil,
+			`{"type": "Feature", "properties": {"id": 1}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": null, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": "3"}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": 4.5}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": -5}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": 6}, "geometry": null}`,
+			`{"type": "Feature", "properties": {"id": 7}, "geometry": {"type": "Point", "coordinates": [0, 0]}}`,
+			`{"type": "Feature", "properties": {"id": 1}, "geometry": `+testPoint+`}`,
+			`{"type": "Feature", "properties": {"id": 8}, "geometry": `+testPoint+`}`),
+			[]int{1, 8}, []string{
+				"layer water-flow-sensors, feature #1: missing numeric id",
+				"feature #2: missing numeric id",
+				"feature #3 (id 3): missing numeric id",
+				"feature #4 (id 4.5): id 4.5 is not a positive integer",
+				"feature #5 (id -5): id -5 is not a positive integer",
+				"feature #6 (id 6): feature has no geometry",
+				"feature #7 (id 7): position [0, 0] is a placeholder",
+				"feature #8 (id 1): duplicate id",
+			}},
+		{"no features", layer(t, "water-level-sensor", nil), []int{}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, problems := resolveLayer(0, test.layer)
+			if test.sensors == nil {
+				if resolved != nil {
+					t.Errorf("layer accepted with %v", resolved.Sensors)
+				}
+			} else if resolved == nil {
+				t.Fatalf("layer rejected: %v", problems)
+			} else {
+				ids := []int{}
+				for _, sensor := range resolved.Sensors {
+					ids = append(ids, sensor.ID)
+				}
+				if fmt.Sprint(ids) != fmt.Sprint(test.sensors) {
+					t.Errorf("sensors %v, want %v", ids, test.sensors)
+				}
+			}
+
+			if len(problems) != len(test.problems) {
+				t.Fatalf("problems are %v, want %d", problems, len(test.problems))
+			}
+			for i, problem := range problems {
+				if !strings.Contains(problem.Error(), test.problems[i]) {
+					t.Errorf("problem %d is %q, want %q", i, problem, test.problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSensors(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "main.json")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := `{"type": "FeatureCollection", "name": "soil-moisture-sensors", "features": [
+		{"type": "Feature", "properties": {"id": 9001}, "geometry": {"type": "Point", "coordinates": [51.4, 35.7]}}]}`
+	projected := `{"type": "FeatureCollection", "name": "weather-sensor",
+		"crs": {"type": "name", "properties": {"name": "urn:ogc:def:crs:EPSG::3857"}}, "features": []}`
+
+	layers, problems, err := LoadSensors(write("[" + good + "," + projected + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || layers[0].Name != "soil-moisture-sensors" || layers[0].Sensors[0] != (Sensor{ID: 9001, Lat: 35.7, Lon: 51.4}) {
+		t.Errorf("layers are %+v", layers)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "weather-sensor") {
+		t.Errorf("problems are %v", problems)
+	}
+
+	for name, content := range map[string]string{
+		"not a list":     good,
+		"not JSON":       "{",
+		"no good layers": "[" + projected + "]",
+		"no layers":      "[]",
+	} {
+		if _, _, err := LoadSensors(write(content)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, _, err := LoadSensors(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a missing file")
+	}
+
+	// The shipped layers load without problems
+	layers, problems, err = LoadSensors("main.json")
+	if err != nil || len(problems) != 0 || len(layers) == 0 {
+		t.Errorf("main.json: %d layers, problems %v, %v", len(layers), problems, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
@@ -15,46 +16,34 @@ import (
 )
 
 // ============================================================================
-// DATA STRUCTURES FOR GEOJSON
+// DATA STRUCTURES
 // ============================================================================
 
-// GeoJSON represents the root structure of each sensor layer
-type GeoJSON struct {
-	Type     string    `json:"type"`
-	Name     string    `json:"name"`
-	Features []Feature `json:"features"`
-}
-
-// Feature represents individual sensor in the GeoJSON
-type Feature struct {
-	Type       string                 `json:"type"`
-	Properties map[string]interface{} `json:"properties"`
-	Geometry   Geometry               `json:"geometry"`
-}
-
-// Geometry holds the coordinate data
-type Geometry struct {
-	Type        string      `json:"type"`
-	Coordinates interface{} `json:"coordinates"`
-}
-
 // SensorData is what we publish to MQTT
 type SensorData struct {
-	SensorID  int     `json:"sensor_id"`
-	Type      string  `json:"type"`
-	Lat       float64 `json:"lat"`
-	Lon       float64 `json:"lon"`
-	Value     float64 `json:"value"`
-	Unit      string  `json:"unit"`
-	Timestamp int64   `json:"timestamp"`
+	FarmID      string   `json:"farm_id"`
+	SensorID    int      `json:"sensor_id"`
+	Type        string   `json:"type"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	Value       *float64 `json:"value,omitempty"`       // Not set in raw mode
+	RawValue    *float64 `json:"raw_value,omitempty"`   // Probe counts (raw mode)
+	Temperature *float64 `json:"temperature,omitempty"` // Probe temperature in °C (raw mode)
+	Unit        string   `json:"unit"`
+	Timestamp   int64    `json:"timestamp"`
 }
 
 // GateCommand represents commands sent to water gates
 type GateCommand struct {
+	FarmID    string `json:"farm_id"`
 	GateID    int    `json:"gate_id"`
 	Command   string `json:"command"` // ✅ FIXED: Was "Action", should be "Command"
 	Reason    string `json:"reason"`
+	Source    string `json:"source"`
 	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"`
 }
 
 // ============================================================================
@@ -170,23 +159,44 @@ var Scenarios = map[int]Scenario{
 // Simulator manages MQTT connection and sensor data generation
 type Simulator struct {
 	client        mqtt.Client
-	sensors       []GeoJSON
+	config        MQTTConfig // Broker settings and farm namespace
+	verifier      *CommandVerifier
+	sensors       []SensorLayer
+	probes        map[int]Probe // Soil moisture probes in raw mode, nil otherwise
+	compact       bool          // Publish CBOR instead of JSON (SIM_ENCODING=cbor)
+	float32Values bool          // Round CBOR values to float32 (SIM_CBOR_FLOAT32=1)
+	sentReadings  int           // Readings, bytes sent and their JSON size this tick (CBOR only)
+	sentBytes     int
+	jsonBytes     int
+	batch         string // Batch mode (SIM_BATCH), "" publishes one message per reading
+	gateway       string // Gateway name for SIM_BATCH=gateway
 	scenario      Scenario
 	anyGateOpen   bool       // ← Tracks if ANY gate is open
 	gateStatusMux sync.Mutex // ← Thread-safe gate status updates
 }
 
 // NewSimulator creates and connects to MQTT broker
-func NewSimulator(broker string, sensors []GeoJSON) (*Simulator, error) {
+func NewSimulator(config MQTTConfig, sensors []SensorLayer) (*Simulator, error) {
+	verifier, err := NewCommandVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("invalid GATE_COMMAND_KEYS: %w", err)
+	}
+	if verifier.KeyCount() == 0 {
+		fmt.Println("⚠️ GATE_COMMAND_KEYS not set, all gate commands will be rejected")
+	}
+
 	sim := &Simulator{
+		config:      config,
+		verifier:    verifier,
 		sensors:     sensors,
 		anyGateOpen: false, // All gates start closed
 	}
 
 	// Configure MQTT client
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID("sensor-simulator")
+	if err := config.apply(opts); err != nil {
+		return nil, err
+	}
 
 	// ✅ CRITICAL: Set message handler BEFORE connecting
 	opts.SetDefaultPublishHandler(sim.handleMessage)
@@ -201,7 +211,7 @@ func NewSimulator(broker string, sensors []GeoJSON) (*Simulator, error) {
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		fmt.Println("✓ Connected to MQTT broker")
 
-		topic := "farm/commands/water-gate-sensors/+"
+		topic := config.topic("commands/water-gate-sensors/+")
 		if token := client.Subscribe(topic, 0, nil); token.Wait() && token.Error() != nil {
 			fmt.Printf("❌ Failed to subscribe to %s: %v\n", topic, token.Error())
 		} else {
@@ -225,7 +235,7 @@ func (s *Simulator) handleMessage(client mqtt.Client, msg mqtt.Message) {
 	fmt.Printf("📨 DEBUG: Payload: %s\n", string(msg.Payload()))
 
 	// Only process gate commands
-	if !strings.Contains(msg.Topic(), "farm/commands/water-gate-sensors/") {
+	if !strings.HasPrefix(msg.Topic(), s.config.topic("commands/water-gate-sensors/")) {
 		fmt.Printf("⚠️ DEBUG: Ignoring non-gate topic: %s\n\n", msg.Topic())
 		return
 	}
@@ -238,6 +248,16 @@ func (s *Simulator) handleMessage(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
+	// Reject unsigned, forged, stale or replayed commands
+	if err := s.verifier.Verify(cmd); err != nil {
+		fmt.Printf("🛑 Rejected gate command for Gate #%d: %v\n\n", cmd.GateID, err)
+		return
+	}
+	if cmd.FarmID != s.config.FarmID {
+		fmt.Printf("🛑 Rejected gate command for Gate #%d: signed for farm %q\n\n", cmd.GateID, cmd.FarmID)
+		return
+	}
+
 	// Update gate status
 	s.gateStatusMux.Lock()
 	defer s.gateStatusMux.Unlock()
@@ -274,9 +294,11 @@ func (s *Simulator) Start(interval time.Duration) {
 
 // publishAll generates and publishes data for all sensors
 func (s *Simulator) publishAll() {
+	var gatewayReadings []SensorData
+
 	// Loop through each sensor type (soil moisture, temperature, etc.)
-	for _, geoJSON := range s.sensors {
-		sensorType := geoJSON.Name
+	for _, layer := range s.sensors {
+		sensorType := layer.Name
 
 		// ⚠️ SKIP WATER GATES - They are actuators, not sensors!
 		if sensorType == "water-gate-sensors" {
@@ -284,31 +306,53 @@ func (s *Simulator) publishAll() {
 		}
 
 		// Loop through each individual sensor in this type
-		for _, feature := range geoJSON.Features {
-			// Extract sensor ID from properties
-			id := int(feature.Properties["id"].(float64))
-
-			// Extract coordinates
-			lat, lon := ExtractCoordinates(feature.Geometry.Coordinates)
-
+		var readings []SensorData
+		for _, sensor := range layer.Sensors {
 			// Generate value based on current scenario AND gate status
 			value := s.generateValue(sensorType)
 
 			// Create sensor data packet
 			data := SensorData{
-				SensorID:  id,
+				FarmID:    s.config.FarmID,
+				SensorID:  sensor.ID,
 				Type:      sensorType,
-				Lat:       lat,
-				Lon:       lon,
-				Value:     value,
+				Lat:       sensor.Lat,
+				Lon:       sensor.Lon,
 				Unit:      s.getUnit(sensorType),
 				Timestamp: time.Now().Unix(),
 			}
 
-			// Publish to MQTT
-			s.publish(data)
+			// Raw probes report counts and their temperature, not moisture
+			if probe, ok := s.probes[sensor.ID]; ok && sensorType == "soil-moisture-sensors" {
+				temperature := math.Round(s.generateValue("soil-temperature-sensors")*10) / 10
+				raw := probe.counts(value, temperature)
+				data.RawValue, data.Temperature = &raw, &temperature
+			} else {
+				data.Value = &value
+			}
+
+			// Publish to MQTT, or collect for a batch
+			if s.batch == "" {
+				s.publish(data)
+			} else {
+				readings = append(readings, data)
+			}
+		}
+
+		switch s.batch {
+		case batchByType:
+			s.publishBatch(s.config.topic("sensors/%s/%s", sensorType, batchSegment), readings)
+		case batchByGateway:
+			gatewayReadings = append(gatewayReadings, readings...)
 		}
 	}
+
+	if s.batch == batchByGateway {
+		s.publishBatch(s.config.topic("sensors/%s/%s", batchSegment, s.gateway), gatewayReadings)
+	}
+	if s.compact {
+		s.reportPayloadSizes()
+	}
 }
 
 // generateValue creates a random value within scenario range
@@ -357,11 +401,25 @@ func (s *Simulator) getUnit(sensorType string) string {
 // publish sends sensor data to MQTT topic
 func (s *Simulator) publish(data SensorData) {
 	// ✅ Match Edge Processor's expected topic structure
-	topic := fmt.Sprintf("farm/sensors/%s/%d", data.Type, data.SensorID)
+	topic := s.config.topic("sensors/%s/%d", data.Type, data.SensorID)
 
 	// Convert data to JSON
 	payload, _ := json.Marshal(data)
 
+	// Or to CBOR, without the metadata the topic and registry already have
+	if s.compact {
+		compact, err := encodeCompact(data, s.float32Values)
+		if err != nil {
+			fmt.Printf("❌ Failed to encode sensor %d: %v\n", data.SensorID, err)
+			return
+		}
+		topic += "/" + compactSuffix
+		s.sentReadings++
+		s.sentBytes += len(compact)
+		s.jsonBytes += len(payload)
+		payload = compact
+	}
+
 	// Publish to MQTT (QoS 0, not retained)
 	s.client.Publish(topic, 0, false, payload)
 
@@ -373,9 +431,11 @@ func (s *Simulator) publish(data SensorData) {
 			gateStatus = "🚰"
 		}
 		s.gateStatusMux.Unlock()
-		fmt.Printf("📡 %s [%d]: %.2f %s %s\n", data.Type, data.SensorID, data.Value, data.Unit, gateStatus)
+		fmt.Printf("📡 %s [%d]: %.2f %s %s\n", data.Type, data.SensorID, *data.Value, data.Unit, gateStatus)
+	} else if data.RawValue != nil {
+		fmt.Printf("📡 %s [%d]: raw %.0f at %.1f°C\n", data.Type, data.SensorID, *data.RawValue, *data.Temperature)
 	} else {
-		fmt.Printf("📡 %s [%d]: %.2f %s\n", data.Type, data.SensorID, data.Value, data.Unit)
+		fmt.Printf("📡 %s [%d]: %.2f %s\n", data.Type, data.SensorID, *data.Value, data.Unit)
 	}
 }
 
@@ -384,47 +444,6 @@ func (s *Simulator) Close() {
 	s.client.Disconnect(250)
 }
 
-// ============================================================================
-// HELPER FUNCTIONS
-// ============================================================================
-
-// LoadSensors reads and parses the main.json file
-func LoadSensors(filepath string) ([]GeoJSON, error) {
-	// Read file contents
-	data, err := os.ReadFile(filepath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Parse JSON into GeoJSON structures
-	var geoJSONs []GeoJSON
-	err = json.Unmarshal(data, &geoJSONs)
-	if err != nil {
-		return nil, err
-	}
-
-	return geoJSONs, nil
-}
-
-// ExtractCoordinates handles different GeoJSON coordinate formats
-func ExtractCoordinates(coords interface{}) (float64, float64) {
-	switch v := coords.(type) {
-	case []interface{}: // Point coordinates [lon, lat]
-		if len(v) >= 2 {
-			lon := v[0].(float64)
-			lat := v[1].(float64)
-			return lat, lon
-		}
-	case [][][]interface{}: // Polygon coordinates
-		if len(v) > 0 && len(v[0]) > 0 && len(v[0][0]) >= 2 {
-			lon := v[0][0][0].(float64)
-			lat := v[0][0][1].(float64)
-			return lat, lon
-		}
-	}
-	return 0, 0
-}
-
 // ============================================================================
 // MAIN FUNCTION
 // ============================================================================
@@ -434,10 +453,14 @@ func main() {
 	fmt.Println("╔═══════════════════════════════════════╗")
 	fmt.Println("║   Smart Farm Sensor Simulator         ║")
 	fmt.Println("║   (Gate-Responsive Flow Sensors)      ║")
-	fmt.Println("╚═══════════════════════════════════════╝\n")
+	fmt.Println("╚═══════════════════════════════════════╝")
+	fmt.Println()
 
 	// Load sensors from JSON file
-	geoJSONs, err := LoadSensors("main.json")
+	layers, problems, err := LoadSensors("main.json")
+	for _, problem := range problems {
+		fmt.Printf("⚠️ Skipped %v\n", problem)
+	}
 	if err != nil {
 		fmt.Printf("❌ Error loading sensors: %v\n", err)
 		return
@@ -445,22 +468,23 @@ func main() {
 
 	// Count and display loaded sensors (excluding actuators)
 	totalSensors := 0
-	for _, gj := range geoJSONs {
-		count := len(gj.Features)
+	for _, layer := range layers {
+		count := len(layer.Sensors)
 
 		// Mark actuators differently
-		if gj.Name == "water-gate-sensors" {
-			fmt.Printf("⚙️  Found %d %s (actuators - controlled by Edge)\n", count, gj.Name)
+		if layer.Name == "water-gate-sensors" {
+			fmt.Printf("⚙️  Found %d %s (actuators - controlled by Edge)\n", count, layer.Name)
 		} else {
-			fmt.Printf("✓ Loaded %d %s\n", count, gj.Name)
+			fmt.Printf("✓ Loaded %d %s\n", count, layer.Name)
 			totalSensors += count
 		}
 	}
 	fmt.Printf("\n📊 Total active sensors: %d\n\n", totalSensors)
 
 	// Create simulator and connect to MQTT broker
-	broker := "tcp://localhost:1883"
-	sim, err := NewSimulator(broker, geoJSONs)
+	mqttConfig := loadMQTTConfig("sensor-simulator")
+	fmt.Printf("🔌 MQTT broker: %s (client %s, farm %s)\n", mqttConfig.BrokerURL, mqttConfig.ClientID, mqttConfig.FarmID)
+	sim, err := NewSimulator(mqttConfig, layers)
 	if err != nil {
 		fmt.Printf("❌ MQTT connection failed: %v\n", err)
 		fmt.Println("💡 Make sure mosquitto is running")
@@ -469,6 +493,43 @@ func main() {
 	}
 	defer sim.Close() // Disconnect when program exits
 
+	// Raw probe mode (calibration happens in the edge and cloud)
+	if os.Getenv("SIM_RAW_MOISTURE") == "1" {
+		sim.UseRawProbes()
+		fmt.Printf("🔬 Raw mode: %d soil moisture probes publish ADC counts\n", len(sim.probes))
+		if path := os.Getenv("SIM_CALIBRATION_FILE"); path != "" {
+			if err := sim.WriteCalibrations(path); err != nil {
+				fmt.Printf("❌ Failed to write calibrations: %v\n", err)
+				return
+			}
+			fmt.Printf("✓ Wrote probe calibrations to %s\n", path)
+		}
+	}
+
+	// Compact payloads for low-bandwidth uplinks
+	switch encoding := os.Getenv("SIM_ENCODING"); encoding {
+	case "", "json":
+	case compactSuffix:
+		sim.compact = true
+		sim.float32Values = os.Getenv("SIM_CBOR_FLOAT32") == "1"
+		fmt.Println("📦 Publishing CBOR payloads on sensors/<type>/<id>/cbor")
+		if sim.float32Values {
+			fmt.Println("📦 Rounding CBOR values to float32")
+		}
+	default:
+		fmt.Printf("❌ Unknown SIM_ENCODING %q (json or cbor)\n", encoding)
+		return
+	}
+
+	// Many readings per message
+	if err := sim.configureBatching(os.Getenv("SIM_BATCH"), os.Getenv("SIM_GATEWAY_ID")); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if sim.batch != "" {
+		fmt.Printf("📦 Publishing batches per %s\n", sim.batch)
+	}
+
 	// Display available scenarios
 	fmt.Println("\n🎯 Available Scenarios:")
 	fmt.Println("════════════════════════════════════════")
@@ -505,9 +566,11 @@ func main() {
 	// Start simulation
 	fmt.Printf("\n🚀 Starting simulation...\n")
 	fmt.Printf("📤 Publishing every %d seconds\n", interval)
-	fmt.Println("🎧 Listening for gate commands on: farm/commands/water-gate-sensors/+")
-	fmt.Println("⚙️  Water flow sensors will react to gate status\n")
-	fmt.Println("Press Ctrl+C to stop\n")
+	fmt.Printf("🎧 Listening for gate commands on: %s\n", sim.config.topic("commands/water-gate-sensors/+"))
+	fmt.Println("⚙️  Water flow sensors will react to gate status")
+	fmt.Println()
+	fmt.Println("Press Ctrl+C to stop")
+	fmt.Println()
 
 	// Begin continuous publishing loop
 	sim.Start(time.Duration(interval) * time.Second)
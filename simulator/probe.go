@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// ============================================================================
+// RAW PROBE MODE
+// ============================================================================
+
+// With SIM_RAW_MOISTURE=1 the soil moisture sensors behave like capacitive
+// probes: they publish ADC counts as "raw_value" and the probe temperature
+// instead of a moisture "value". Each probe gets its own dry/wet counts and
+// temperature drift, so one shared curve is not enough. SIM_CALIBRATION_FILE
+// names a file the matching calibrations are written to, ready for
+// POST /api/farms/<farm>/devices/calibrations and EDGE_CALIBRATION_FILE.
+
+// Nominal probe: fewer counts in wetter soil, drift away from 25 °C
+const (
+	probeDryCounts       = 3200.0 // ADC counts in dry soil (0 %)
+	probeWetCounts       = 1400.0 // ADC counts in saturated soil (100 %)
+	probeSpread          = 150.0  // Per-probe variation of the dry and wet counts
+	probeTempCoefficient = -4.0   // Counts per °C
+	probeReferenceTemp   = 25.0   // °C
+)
+
+// Probe is the response curve of one simulated moisture probe
+type Probe struct {
+	Dry             float64
+	Wet             float64
+	TempCoefficient float64
+}
+
+// Calibration is the linear curve that inverts a probe, in the format of
+// the cloud device registry
+type Calibration struct {
+	Method          string    `json:"method"`
+	Coefficients    []float64 `json:"coefficients"`
+	TempCoefficient float64   `json:"temp_coefficient"`
+}
+
+// CalibrationSet is the file written to SIM_CALIBRATION_FILE
+type CalibrationSet struct {
+	FarmID       string                 `json:"farm_id"`
+	Calibrations map[string]Calibration `json:"calibrations"`
+}
+
+// probeFor returns the probe of a sensor, the same on every run
+func probeFor(sensorID int) Probe {
+	r := rand.New(rand.NewSource(int64(sensorID)))
+	return Probe{
+		Dry:             probeDryCounts + (2*r.Float64()-1)*probeSpread,
+		Wet:             probeWetCounts + (2*r.Float64()-1)*probeSpread,
+		TempCoefficient: probeTempCoefficient * (0.8 + 0.4*r.Float64()),
+	}
+}
+
+// counts returns the raw reading for a moisture (%) at a temperature (°C)
+func (p Probe) counts(moisture, temperature float64) float64 {
+	return math.Round(p.Dry + (p.Wet-p.Dry)*moisture/100 + p.TempCoefficient*(temperature-probeReferenceTemp))
+}
+
+// calibration returns moisture = c0 + c1 * compensated counts
+func (p Probe) calibration() Calibration {
+	slope := 100 / (p.Wet - p.Dry)
+	return Calibration{
+		Method:          "linear",
+		Coefficients:    []float64{-p.Dry * slope, slope},
+		TempCoefficient: p.TempCoefficient,
+	}
+}
+
+// UseRawProbes switches the soil moisture sensors to raw mode
+func (s *Simulator) UseRawProbes() {
+	s.probes = make(map[int]Probe)
+	for _, layer := range s.sensors {
+		if layer.Name != "soil-moisture-sensors" {
+			continue
+		}
+		for _, sensor := range layer.Sensors {
+			s.probes[sensor.ID] = probeFor(sensor.ID)
+		}
+	}
+}
+
+// WriteCalibrations saves the calibrations of all raw probes
+func (s *Simulator) WriteCalibrations(path string) error {
+	set := CalibrationSet{FarmID: s.config.FarmID, Calibrations: make(map[string]Calibration)}
+	for id, probe := range s.probes {
+		set.Calibrations[strconv.Itoa(id)] = probe.calibration()
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
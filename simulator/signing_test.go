@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKey1 = "k1:00112233445566778899aabbccddeeff"
+	testKey2 = "k2:ffeeddccbbaa99887766554433221100"
+)
+
+// newTestVerifier loads a verifier from GATE_COMMAND_KEYS
+func newTestVerifier(t *testing.T, keys string) *CommandVerifier {
+	t.Helper()
+	t.Setenv("GATE_COMMAND_KEYS", keys)
+	v, err := NewCommandVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// signedCommand is an OPEN for gate 1 signed like the edge does
+func signedCommand(t *testing.T, key, nonce string, timestamp time.Time) GateCommand {
+	t.Helper()
+	t.Setenv("GATE_COMMAND_KEYS", key)
+	keys, err := loadCommandKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := GateCommand{
+		FarmID: "default", GateID: 1, Command: "OPEN", Reason: "test", Source: "auto",
+		Timestamp: timestamp.Unix(), Nonce: nonce, KeyID: keys[0].ID,
+	}
+	cmd.Signature = commandSignature(keys[0].Secret, cmd)
+	return cmd
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	tampered := signedCommand(t, testKey1, "n-tampered", now)
+	tampered.GateID = 2
+	unsigned := signedCommand(t, testKey1, "n-unsigned", now)
+	unsigned.Signature = ""
+
+	tests := []struct {
+		name string
+		cmd  GateCommand
+		want error
+	}{
+		{"signed", signedCommand(t, testKey1, "n-signed", now), nil},
+		{"unsigned", unsigned, errUnsigned},
+		{"no nonce", signedCommand(t, testKey1, "", now), errUnsigned},
+		{"unknown key", signedCommand(t, "k9:00112233445566778899aabbccddeeff", "n-unknown", now), errUnknownKey},
+		{"wrong secret", signedCommand(t, "k1:ffeeddccbbaa99887766554433221100", "n-secret", now), errBadSignature},
+		{"tampered gate", tampered, errBadSignature},
+		{"stale", signedCommand(t, testKey1, "n-stale", now.Add(-maxCommandAge-2*time.Second)), errStaleCommand},
+		{"from the future", signedCommand(t, testKey1, "n-future", now.Add(maxCommandAge+2*time.Second)), errStaleCommand},
+		{"within the window", signedCommand(t, testKey1, "n-window", now.Add(-maxCommandAge/2)), nil},
+	}
+	v := newTestVerifier(t, testKey1)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := v.Verify(test.cmd); !errors.Is(err, test.want) {
+				t.Errorf("Verify = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyReplayedNonce(t *testing.T) {
+	v := newTestVerifier(t, testKey1)
+	cmd := signedCommand(t, testKey1, "n-replay", time.Now())
+	if err := v.Verify(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(cmd); !errors.Is(err, errReplayedNonce) {
+		t.Errorf("replayed command: %v, want %v", err, errReplayedNonce)
+	}
+
+	// A rejected command does not use up its nonce
+	forged := signedCommand(t, testKey1, "n-forged", time.Now())
+	forged.Signature = strings.Repeat("0", len(forged.Signature))
+	v.Verify(forged)
+	if err := v.Verify(signedCommand(t, testKey1, "n-forged", time.Now())); err != nil {
+		t.Errorf("nonce of a forged command: %v", err)
+	}
+
+	// Nonces are forgotten once their commands are stale anyway
+	v.mu.Lock()
+	v.seen["n-replay"] = time.Now().Add(-2*maxCommandAge - time.Second)
+	v.mu.Unlock()
+	v.Verify(signedCommand(t, testKey1, "n-other", time.Now()))
+	v.mu.Lock()
+	_, kept := v.seen["n-replay"]
+	v.mu.Unlock()
+	if kept {
+		t.Error("expired nonce is still remembered")
+	}
+}
+
+func TestVerifyRotatedKey(t *testing.T) {
+	// While rotating, actuators accept the new key next to the old one
+	v := newTestVerifier(t, testKey1+","+testKey2)
+	if v.KeyCount() != 2 {
+		t.Fatalf("%d keys, want 2", v.KeyCount())
+	}
+	for _, key := range []string{testKey1, testKey2} {
+		if err := v.Verify(signedCommand(t, key, "n-both-"+key[:2], time.Now())); err != nil {
+			t.Errorf("command signed with %s: %v", key[:2], err)
+		}
+	}
+
+	// Once the rotation is done the old key is refused
+	v = newTestVerifier(t, testKey2)
+	if err := v.Verify(signedCommand(t, testKey1, "n-old", time.Now())); !errors.Is(err, errUnknownKey) {
+		t.Errorf("command signed with the dropped key: %v, want %v", err, errUnknownKey)
+	}
+	if err := v.Verify(signedCommand(t, testKey2, "n-new", time.Now())); err != nil {
+		t.Errorf("command signed with the new key: %v", err)
+	}
+}
+
+func TestVerifyWithoutKeys(t *testing.T) {
+	v := newTestVerifier(t, "")
+	if v.KeyCount() != 0 {
+		t.Fatalf("%d keys, want none", v.KeyCount())
+	}
+	if err := v.Verify(signedCommand(t, testKey1, "n-nokeys", time.Now())); err == nil {
+		t.Error("accepted a command without keys configured")
+	}
+}
+
+func TestLoadCommandKeys(t *testing.T) {
+	for _, bad := range []string{"k1", ":00112233445566778899aabbccddeeff", "k1:0011", "k1:not-hex-not-hex-not-hex-not-hex", testKey1 + ",k2"} {
+		t.Setenv("GATE_COMMAND_KEYS", bad)
+		if keys, err := loadCommandKeys(); err == nil {
+			t.Errorf("GATE_COMMAND_KEYS=%q loaded as %v", bad, keys)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ============================================================================
+// FARM NAMESPACE
+// ============================================================================
+
+// Every topic is namespaced by farm, farm/<farm>/sensors/..., so sensor and
+// gate IDs only need to be unique within one farm
+const defaultFarm = "default"
+
+var farmIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// validateFarmID checks that a farm ID is a single topic level and can not
+// be mistaken for the old un-namespaced topics (farm/sensors/...)
+func validateFarmID(farm string) error {
+	if !farmIDPattern.MatchString(farm) {
+		return fmt.Errorf("invalid farm id %q, use 1-32 characters a-z, 0-9 and -", farm)
+	}
+	switch farm {
+	case "sensors", "gates", "commands", "edge":
+		return fmt.Errorf("farm id %q is reserved", farm)
+	}
+	return nil
+}
@@ -8,17 +8,14 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-type GateCommand struct {
-	GateID    int    `json:"gate_id"`
-	Action    string `json:"action"`
-	Timestamp int64  `json:"timestamp"`
-}
-
 func main() {
 	// Connect to MQTT
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://localhost:1883")
-	opts.SetClientID("gate-tester")
+	mqttConfig := loadMQTTConfig("gate-tester")
+	if err := mqttConfig.apply(opts); err != nil {
+		fmt.Printf("❌ Invalid MQTT configuration: %v\n", err)
+		return
+	}
 
 	client := mqtt.NewClient(opts)
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
@@ -27,7 +24,11 @@ func main() {
 	}
 	defer client.Disconnect(250)
 
-	fmt.Println("🚰 Testing Gate Commands...\n")
+	initCommandSigning()
+	fmt.Printf("🏡 Farm: %s\n", mqttConfig.FarmID)
+
+	fmt.Println("🚰 Testing Gate Commands...")
+	fmt.Println()
 
 	// Test sequence
 	tests := []struct {
@@ -42,7 +43,7 @@ func main() {
 	}
 
 	for _, test := range tests {
-		sendCommand(client, test.gateID, test.action)
+		sendCommand(client, mqttConfig, test.gateID, test.action)
 		if test.wait > 0 {
 			time.Sleep(time.Duration(test.wait) * time.Second)
 		}
@@ -51,15 +52,19 @@ func main() {
 	fmt.Println("\n✓ Test complete!")
 }
 
-func sendCommand(client mqtt.Client, gateID int, action string) {
+func sendCommand(client mqtt.Client, config MQTTConfig, gateID int, action string) {
 	cmd := GateCommand{
+		FarmID:    config.FarmID,
 		GateID:    gateID,
-		Action:    action,
+		Command:   action,
+		Reason:    "Manual gate test",
+		Source:    "gate-tester",
 		Timestamp: time.Now().Unix(),
 	}
+	signCommand(&cmd)
 
 	payload, _ := json.Marshal(cmd)
-	topic := fmt.Sprintf("farm/commands/water-gate-sensors/%d", gateID)
+	topic := config.topic("commands/water-gate-sensors/%d", gateID)
 
 	client.Publish(topic, 0, false, payload)
 	fmt.Printf("📤 Gate #%d → %s\n", gateID, action)